@@ -0,0 +1,573 @@
+// Package config loads the settings of the PubSub server from a YAML or JSON file and the environment
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cpheps/coder-pub-sub/server"
+	"github.com/cpheps/coder-pub-sub/storage"
+	"github.com/cpheps/coder-pub-sub/websocket"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix prefixes the environment variable of every setting.
+// The rest of the name is the setting's key in upper case with dots replaced by underscores,
+// so storage.data_dir is set by PUBSUB_STORAGE_DATA_DIR.
+const EnvPrefix = "PUBSUB_"
+
+// Duration is a time.Duration written as a string such as 500ms, 30s or 1m30s
+type Duration time.Duration
+
+// MarshalText writes the duration as a string
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText parses a duration string
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, use a number with a unit such as 30s", text)
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+// List is a list of strings. Files may write it as a list, the environment as a comma separated string.
+type List []string
+
+// MarshalText writes the list comma separated
+func (l List) MarshalText() ([]byte, error) {
+	return []byte(strings.Join(l, ",")), nil
+}
+
+// UnmarshalText parses a comma separated list, empty items are skipped
+func (l *List) UnmarshalText(text []byte) error {
+	*l = nil
+	for _, item := range strings.Split(string(text), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// UnmarshalYAML decodes a YAML list or a comma separated string
+func (l *List) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return l.UnmarshalText([]byte(node.Value))
+	}
+
+	var items []string
+	if err := node.Decode(&items); err != nil {
+		return err
+	}
+	return l.UnmarshalText([]byte(strings.Join(items, ",")))
+}
+
+// UnmarshalJSON decodes a JSON array or a comma separated string
+func (l *List) UnmarshalJSON(data []byte) error {
+	var items []string
+	if err := json.Unmarshal(data, &items); err == nil {
+		return l.UnmarshalText([]byte(strings.Join(items, ",")))
+	}
+
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("invalid list %s, use an array of strings", data)
+	}
+	return l.UnmarshalText([]byte(text))
+}
+
+// Config is the configuration of the PubSub server.
+// Keys in files are the yaml names of the fields, sections nest.
+type Config struct {
+	// Addr is the address HTTP is served on
+	Addr string `yaml:"addr" json:"addr"`
+
+	// BroadcastConcurrency is the number of subscribers a broadcast hands a message to at a time
+	BroadcastConcurrency int `yaml:"broadcast_concurrency" json:"broadcast_concurrency"`
+
+	HTTP      HTTP      `yaml:"http" json:"http"`
+	Limits    Limits    `yaml:"limits" json:"limits"`
+	Listeners Listeners `yaml:"listeners" json:"listeners"`
+	TLS       TLS       `yaml:"tls" json:"tls"`
+	Auth      Auth      `yaml:"auth" json:"auth"`
+	CORS      CORS      `yaml:"cors" json:"cors"`
+	Queue     Queue     `yaml:"queue" json:"queue"`
+	Keepalive Keepalive `yaml:"keepalive" json:"keepalive"`
+	Ack       Ack       `yaml:"ack" json:"ack"`
+	Groups    Groups    `yaml:"groups" json:"groups"`
+	Retention Retention `yaml:"retention" json:"retention"`
+	Storage   Storage   `yaml:"storage" json:"storage"`
+	Poll      Poll      `yaml:"poll" json:"poll"`
+	Webhooks  Webhooks  `yaml:"webhooks" json:"webhooks"`
+}
+
+// HTTP holds the timeouts of the HTTP server, zero means no limit
+type HTTP struct {
+	ReadHeaderTimeout Duration `yaml:"read_header_timeout" json:"read_header_timeout"`
+	IdleTimeout       Duration `yaml:"idle_timeout" json:"idle_timeout"`
+}
+
+// Limits caps what clients may send
+type Limits struct {
+	// MaxPayload is the largest payload in bytes that may be published, zero means no limit
+	MaxPayload int `yaml:"max_payload" json:"max_payload"`
+}
+
+// Listeners holds the addresses of the protocols served alongside HTTP, each is disabled when empty
+type Listeners struct {
+	TCP  string `yaml:"tcp" json:"tcp"`
+	MQTT string `yaml:"mqtt" json:"mqtt"`
+	GRPC string `yaml:"grpc" json:"grpc"`
+}
+
+// TLS serves every listener over TLS when CertFile is set
+type TLS struct {
+	CertFile     string `yaml:"cert_file" json:"cert_file"`
+	KeyFile      string `yaml:"key_file" json:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file" json:"client_ca_file"`
+
+	// ClientAuth is none, optional or require
+	ClientAuth     string   `yaml:"client_auth" json:"client_auth"`
+	ReloadInterval Duration `yaml:"reload_interval" json:"reload_interval"`
+}
+
+// Auth requires clients to authenticate when APIKeysFile or JWT.JWKSFile is set
+type Auth struct {
+	// APIKeysFile holds one "<subject> <key>" per line
+	APIKeysFile string `yaml:"api_keys_file" json:"api_keys_file"`
+	JWT         JWT    `yaml:"jwt" json:"jwt"`
+
+	// PolicyFile holds the rules deciding which topics clients may publish and subscribe to
+	PolicyFile string `yaml:"policy_file" json:"policy_file"`
+}
+
+// JWT configures verification of HS256 and RS256 bearer tokens
+type JWT struct {
+	JWKSFile string   `yaml:"jwks_file" json:"jwks_file"`
+	Issuer   string   `yaml:"issuer" json:"issuer"`
+	Audience string   `yaml:"audience" json:"audience"`
+	Leeway   Duration `yaml:"leeway" json:"leeway"`
+}
+
+// CORS sets the origins browser apps may connect from besides the server's own
+type CORS struct {
+	// AllowedOrigins are origins such as https://dashboard.example.org, * or https://*.example.org
+	AllowedOrigins List     `yaml:"allowed_origins" json:"allowed_origins"`
+	MaxAge         Duration `yaml:"max_age" json:"max_age"`
+}
+
+// Queue configures the outbound queue of each subscriber
+type Queue struct {
+	Size int `yaml:"size" json:"size"`
+
+	// Overflow is drop-oldest, drop-newest, disconnect or block
+	Overflow     string   `yaml:"overflow" json:"overflow"`
+	BlockTimeout Duration `yaml:"block_timeout" json:"block_timeout"`
+}
+
+// Keepalive configures pings of subscribers, a ping interval of zero disables them
+type Keepalive struct {
+	PingInterval Duration `yaml:"ping_interval" json:"ping_interval"`
+	PongTimeout  Duration `yaml:"pong_timeout" json:"pong_timeout"`
+}
+
+// Ack configures at-least-once delivery to subscribers that ack messages
+type Ack struct {
+	VisibilityTimeout Duration `yaml:"visibility_timeout" json:"visibility_timeout"`
+	MaxAttempts       int      `yaml:"max_attempts" json:"max_attempts"`
+}
+
+// Groups configures consumer groups
+type Groups struct {
+	// Balancing is round-robin or least-outstanding
+	Balancing string `yaml:"balancing" json:"balancing"`
+}
+
+// Retention configures how many messages are kept in memory for replay when storage.data_dir isn't set
+type Retention struct {
+	MaxMessages int      `yaml:"max_messages" json:"max_messages"`
+	MaxAge      Duration `yaml:"max_age" json:"max_age"`
+}
+
+// Storage configures the durable log on disk, messages are kept in memory when DataDir is empty
+type Storage struct {
+	DataDir string `yaml:"data_dir" json:"data_dir"`
+
+	// Fsync is always, interval or never
+	Fsync         string   `yaml:"fsync" json:"fsync"`
+	FsyncInterval Duration `yaml:"fsync_interval" json:"fsync_interval"`
+	SegmentBytes  int64    `yaml:"segment_bytes" json:"segment_bytes"`
+	MaxSegments   int      `yaml:"max_segments" json:"max_segments"`
+	MaxAge        Duration `yaml:"max_age" json:"max_age"`
+}
+
+// Poll configures long polling
+type Poll struct {
+	DefaultWait Duration `yaml:"default_wait" json:"default_wait"`
+	MaxWait     Duration `yaml:"max_wait" json:"max_wait"`
+	IdleTimeout Duration `yaml:"idle_timeout" json:"idle_timeout"`
+	MaxPending  int      `yaml:"max_pending" json:"max_pending"`
+	MaxBatch    int      `yaml:"max_batch" json:"max_batch"`
+}
+
+// Webhooks configures delivery to webhook subscribers
+type Webhooks struct {
+	Timeout        Duration `yaml:"timeout" json:"timeout"`
+	MaxAttempts    int      `yaml:"max_attempts" json:"max_attempts"`
+	InitialBackoff Duration `yaml:"initial_backoff" json:"initial_backoff"`
+	MaxBackoff     Duration `yaml:"max_backoff" json:"max_backoff"`
+	MaxConcurrency int      `yaml:"max_concurrency" json:"max_concurrency"`
+	DisableAfter   int      `yaml:"disable_after" json:"disable_after"`
+
+	// AllowedNetworks are CIDR ranges webhooks may be delivered to despite being loopback, link-local or private
+	AllowedNetworks List `yaml:"allowed_networks" json:"allowed_networks"`
+}
+
+// Default returns the Config matching server.DefaultOptions
+func Default() *Config {
+	opts := server.DefaultOptions()
+	disk := storage.DefaultDiskConfig("")
+	tls := server.DefaultTLSConfig("", "")
+	jwt := server.DefaultJWTConfig("")
+
+	return &Config{
+		Addr:                 opts.Addr,
+		BroadcastConcurrency: opts.BroadcastConcurrency,
+		HTTP: HTTP{
+			ReadHeaderTimeout: Duration(opts.ReadHeaderTimeout),
+			IdleTimeout:       Duration(opts.IdleTimeout),
+		},
+		Limits: Limits{
+			MaxPayload: opts.MaxPayload,
+		},
+		TLS: TLS{
+			ClientAuth:     tls.ClientAuth.String(),
+			ReloadInterval: Duration(tls.ReloadInterval),
+		},
+		Auth: Auth{
+			JWT: JWT{
+				Leeway: Duration(jwt.Leeway),
+			},
+		},
+		CORS: CORS{
+			AllowedOrigins: List(opts.CORS.AllowedOrigins),
+			MaxAge:         Duration(opts.CORS.MaxAge),
+		},
+		Queue: Queue{
+			Size:         opts.Queue.Size,
+			Overflow:     opts.Queue.Policy.String(),
+			BlockTimeout: Duration(opts.Queue.BlockTimeout),
+		},
+		Keepalive: Keepalive{
+			PingInterval: Duration(opts.Keepalive.PingInterval),
+			PongTimeout:  Duration(opts.Keepalive.PongTimeout),
+		},
+		Ack: Ack{
+			VisibilityTimeout: Duration(opts.Ack.VisibilityTimeout),
+			MaxAttempts:       opts.Ack.MaxAttempts,
+		},
+		Groups: Groups{
+			Balancing: opts.Balancing.String(),
+		},
+		Retention: Retention{
+			MaxMessages: opts.Retention.MaxMessages,
+			MaxAge:      Duration(opts.Retention.MaxAge),
+		},
+		Storage: Storage{
+			Fsync:         disk.Fsync.String(),
+			FsyncInterval: Duration(disk.FsyncInterval),
+			SegmentBytes:  disk.SegmentBytes,
+			MaxSegments:   disk.MaxSegments,
+			MaxAge:        Duration(disk.MaxAge),
+		},
+		Poll: Poll{
+			DefaultWait: Duration(opts.Poll.DefaultWait),
+			MaxWait:     Duration(opts.Poll.MaxWait),
+			IdleTimeout: Duration(opts.Poll.IdleTimeout),
+			MaxPending:  opts.Poll.MaxPending,
+			MaxBatch:    opts.Poll.MaxBatch,
+		},
+		Webhooks: Webhooks{
+			Timeout:         Duration(opts.Webhook.Timeout),
+			MaxAttempts:     opts.Webhook.MaxAttempts,
+			InitialBackoff:  Duration(opts.Webhook.InitialBackoff),
+			MaxBackoff:      Duration(opts.Webhook.MaxBackoff),
+			MaxConcurrency:  opts.Webhook.MaxConcurrency,
+			DisableAfter:    opts.Webhook.DisableAfter,
+			AllowedNetworks: List(opts.Webhook.AllowedNetworks),
+		},
+	}
+}
+
+// Load returns the Default config overridden by the file at path, if path isn't empty,
+// then by the environment variables found by lookupEnv such as os.LookupEnv.
+// The file is YAML or JSON depending on its extension. Unknown keys are an error so typos don't go unnoticed.
+func Load(path string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	config := Default()
+
+	if path != "" {
+		if err := config.loadFile(path); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+
+	if err := config.loadEnv(lookupEnv); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// loadFile decodes the file at path over the config
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(c)
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(c)
+	default:
+		return fmt.Errorf("unsupported extension %q, use .yaml, .yml or .json", ext)
+	}
+
+	// An empty file leaves the config as it is
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// loadEnv sets every setting whose environment variable is set
+func (c *Config) loadEnv(lookupEnv func(string) (string, bool)) error {
+	for _, setting := range c.settings() {
+		name := EnvName(setting.key)
+		value, ok := lookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		if err := setting.set(value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// EnvName returns the environment variable that sets the setting with key
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// Set parses value into the setting with key, such as storage.data_dir, as flags do
+func (c *Config) Set(key, value string) error {
+	for _, setting := range c.settings() {
+		if setting.key == key {
+			if err := setting.set(value); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown setting %q", key)
+}
+
+// Options converts the config to server.Options and validates them.
+// Errors name the setting at fault.
+func (c *Config) Options() (server.Options, error) {
+	if c.Addr == "" {
+		return server.Options{}, errors.New("addr: must be set")
+	}
+
+	policy, err := websocket.ParseOverflowPolicy(c.Queue.Overflow)
+	if err != nil {
+		return server.Options{}, fmt.Errorf("queue.overflow: %w", err)
+	}
+
+	balancing, err := websocket.ParseGroupBalancing(c.Groups.Balancing)
+	if err != nil {
+		return server.Options{}, fmt.Errorf("groups.balancing: %w", err)
+	}
+
+	clientAuth, err := server.ParseClientAuth(c.TLS.ClientAuth)
+	if err != nil {
+		return server.Options{}, fmt.Errorf("tls.client_auth: %w", err)
+	}
+
+	opts := server.Options{
+		Addr:                 c.Addr,
+		BroadcastConcurrency: c.BroadcastConcurrency,
+		ReadHeaderTimeout:    time.Duration(c.HTTP.ReadHeaderTimeout),
+		IdleTimeout:          time.Duration(c.HTTP.IdleTimeout),
+		MaxPayload:           c.Limits.MaxPayload,
+		Queue: websocket.QueueConfig{
+			Size:         c.Queue.Size,
+			Policy:       policy,
+			BlockTimeout: time.Duration(c.Queue.BlockTimeout),
+		},
+		Keepalive: websocket.KeepaliveConfig{
+			PingInterval: time.Duration(c.Keepalive.PingInterval),
+			PongTimeout:  time.Duration(c.Keepalive.PongTimeout),
+		},
+		Ack: websocket.AckConfig{
+			VisibilityTimeout: time.Duration(c.Ack.VisibilityTimeout),
+			MaxAttempts:       c.Ack.MaxAttempts,
+		},
+		Balancing: balancing,
+		Retention: storage.MemoryConfig{
+			MaxMessages: c.Retention.MaxMessages,
+			MaxAge:      time.Duration(c.Retention.MaxAge),
+		},
+		Poll: server.PollConfig{
+			DefaultWait: time.Duration(c.Poll.DefaultWait),
+			MaxWait:     time.Duration(c.Poll.MaxWait),
+			IdleTimeout: time.Duration(c.Poll.IdleTimeout),
+			MaxPending:  c.Poll.MaxPending,
+			MaxBatch:    c.Poll.MaxBatch,
+		},
+		Webhook: websocket.WebhookConfig{
+			Timeout:         time.Duration(c.Webhooks.Timeout),
+			MaxAttempts:     c.Webhooks.MaxAttempts,
+			InitialBackoff:  time.Duration(c.Webhooks.InitialBackoff),
+			MaxBackoff:      time.Duration(c.Webhooks.MaxBackoff),
+			MaxConcurrency:  c.Webhooks.MaxConcurrency,
+			DisableAfter:    c.Webhooks.DisableAfter,
+			AllowedNetworks: c.Webhooks.AllowedNetworks,
+		},
+		CORS: server.CORSConfig{
+			AllowedOrigins: c.CORS.AllowedOrigins,
+			MaxAge:         time.Duration(c.CORS.MaxAge),
+		},
+		TCPAddr:  c.Listeners.TCP,
+		MQTTAddr: c.Listeners.MQTT,
+		GRPCAddr: c.Listeners.GRPC,
+	}
+
+	if c.Storage.DataDir != "" {
+		fsync, err := storage.ParseFsyncPolicy(c.Storage.Fsync)
+		if err != nil {
+			return server.Options{}, fmt.Errorf("storage.fsync: %w", err)
+		}
+
+		opts.Disk = &storage.DiskConfig{
+			Dir:           c.Storage.DataDir,
+			SegmentBytes:  c.Storage.SegmentBytes,
+			MaxSegments:   c.Storage.MaxSegments,
+			MaxAge:        time.Duration(c.Storage.MaxAge),
+			Fsync:         fsync,
+			FsyncInterval: time.Duration(c.Storage.FsyncInterval),
+		}
+	}
+
+	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
+		opts.TLS = &server.TLSConfig{
+			CertFile:       c.TLS.CertFile,
+			KeyFile:        c.TLS.KeyFile,
+			ClientCAFile:   c.TLS.ClientCAFile,
+			ClientAuth:     clientAuth,
+			ReloadInterval: time.Duration(c.TLS.ReloadInterval),
+		}
+	}
+
+	if c.Auth.APIKeysFile != "" || c.Auth.JWT.JWKSFile != "" {
+		opts.Auth = &server.AuthConfig{
+			APIKeysFile: c.Auth.APIKeysFile,
+		}
+
+		if c.Auth.JWT.JWKSFile != "" {
+			opts.Auth.JWT = &server.JWTConfig{
+				JWKSFile: c.Auth.JWT.JWKSFile,
+				Issuer:   c.Auth.JWT.Issuer,
+				Audience: c.Auth.JWT.Audience,
+				Leeway:   time.Duration(c.Auth.JWT.Leeway),
+			}
+		}
+	}
+
+	opts.PolicyFile = c.Auth.PolicyFile
+
+	if err := opts.Validate(); err != nil {
+		return server.Options{}, err
+	}
+
+	return opts, nil
+}
+
+// setting is a single value of the Config addressed by its dotted key
+type setting struct {
+	key   string
+	value reflect.Value
+}
+
+// settings returns every setting of the config, sections are flattened into dotted keys
+func (c *Config) settings() []setting {
+	var settings []setting
+	collectSettings("", reflect.ValueOf(c).Elem(), &settings)
+	return settings
+}
+
+// collectSettings appends the fields of the struct v to settings, prefixing their keys with prefix
+func collectSettings(prefix string, v reflect.Value, settings *[]setting) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			collectSettings(key, v.Field(i), settings)
+			continue
+		}
+
+		*settings = append(*settings, setting{key: key, value: v.Field(i)})
+	}
+}
+
+// set parses value into the setting according to its type
+func (s setting) set(value string) error {
+	if unmarshaler, ok := s.value.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return unmarshaler.UnmarshalText([]byte(value))
+	}
+
+	switch s.value.Kind() {
+	case reflect.String:
+		s.value.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		s.value.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported setting type %s", s.value.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,367 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cpheps/coder-pub-sub/server"
+	"github.com/cpheps/coder-pub-sub/storage"
+	"github.com/cpheps/coder-pub-sub/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFile writes a config file named name to a temp dir and returns its path
+func writeFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+// env returns a lookupEnv func backed by vars
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+}
+
+func Test_Default(t *testing.T) {
+	opts, err := Default().Options()
+	require.NoError(t, err)
+	assert.Equal(t, server.DefaultOptions(), opts)
+}
+
+func Test_Load_Example(t *testing.T) {
+	// The example documents every setting with its default so must stay in step with Default
+	config, err := Load(filepath.Join("..", "config.example.yaml"), env(nil))
+	require.NoError(t, err)
+	assert.Equal(t, Default(), config)
+}
+
+func Test_Load(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			desc: "YAML file",
+			testFunc: func(t *testing.T) {
+				path := writeFile(t, "pubsub.yaml", `
+addr: ":9000"
+broadcast_concurrency: 4
+limits:
+  max_payload: 2048
+listeners:
+  mqtt: ":1883"
+queue:
+  size: 16
+  overflow: block
+  block_timeout: 250ms
+groups:
+  balancing: least-outstanding
+storage:
+  data_dir: /var/lib/pubsub
+  fsync: always
+`)
+
+				config, err := Load(path, env(nil))
+				require.NoError(t, err)
+
+				opts, err := config.Options()
+				require.NoError(t, err)
+
+				assert.Equal(t, ":9000", opts.Addr)
+				assert.Equal(t, 4, opts.BroadcastConcurrency)
+				assert.Equal(t, 2048, opts.MaxPayload)
+				assert.Equal(t, ":1883", opts.MQTTAddr)
+				assert.Equal(t, websocket.QueueConfig{Size: 16, Policy: websocket.Block, BlockTimeout: 250 * time.Millisecond}, opts.Queue)
+				assert.Equal(t, websocket.LeastOutstanding, opts.Balancing)
+
+				// Settings missing from the file keep their defaults
+				assert.Equal(t, websocket.DefaultKeepaliveConfig(), opts.Keepalive)
+
+				expectedDisk := storage.DefaultDiskConfig("/var/lib/pubsub")
+				expectedDisk.Fsync = storage.FsyncAlways
+				assert.Equal(t, &expectedDisk, opts.Disk)
+			},
+		},
+		{
+			desc: "JSON file",
+			testFunc: func(t *testing.T) {
+				path := writeFile(t, "pubsub.json", `{"addr": ":9000", "keepalive": {"ping_interval": "0s"}, "poll": {"max_batch": 10}}`)
+
+				config, err := Load(path, env(nil))
+				require.NoError(t, err)
+
+				opts, err := config.Options()
+				require.NoError(t, err)
+
+				assert.Equal(t, ":9000", opts.Addr)
+				assert.Equal(t, time.Duration(0), opts.Keepalive.PingInterval)
+				assert.Equal(t, 10, opts.Poll.MaxBatch)
+				assert.Nil(t, opts.Disk)
+			},
+		},
+		{
+			desc: "Empty file",
+			testFunc: func(t *testing.T) {
+				config, err := Load(writeFile(t, "pubsub.yml", ""), env(nil))
+				require.NoError(t, err)
+				assert.Equal(t, Default(), config)
+			},
+		},
+		{
+			desc: "Environment overrides file",
+			testFunc: func(t *testing.T) {
+				path := writeFile(t, "pubsub.yaml", "addr: \":9000\"\nack:\n  max_attempts: 3\n")
+
+				config, err := Load(path, env(map[string]string{
+					"PUBSUB_ADDR":                   ":9001",
+					"PUBSUB_ACK_VISIBILITY_TIMEOUT": "1m",
+					"PUBSUB_LISTENERS_GRPC":         ":9090",
+				}))
+				require.NoError(t, err)
+
+				opts, err := config.Options()
+				require.NoError(t, err)
+
+				assert.Equal(t, ":9001", opts.Addr)
+				assert.Equal(t, websocket.AckConfig{VisibilityTimeout: time.Minute, MaxAttempts: 3}, opts.Ack)
+				assert.Equal(t, ":9090", opts.GRPCAddr)
+			},
+		},
+		{
+			desc: "CORS section",
+			testFunc: func(t *testing.T) {
+				path := writeFile(t, "pubsub.yaml", `
+cors:
+  allowed_origins:
+    - https://dashboard.example.org
+    - https://*.example.com
+  max_age: 1h
+`)
+
+				config, err := Load(path, env(nil))
+				require.NoError(t, err)
+
+				opts, err := config.Options()
+				require.NoError(t, err)
+				assert.Equal(t, server.CORSConfig{
+					AllowedOrigins: []string{"https://dashboard.example.org", "https://*.example.com"},
+					MaxAge:         time.Hour,
+				}, opts.CORS)
+
+				// The environment and JSON files may give the list as a comma separated string
+				config, err = Load(writeFile(t, "pubsub.json", `{"cors": {"allowed_origins": "http://localhost:3000"}}`), env(map[string]string{
+					"PUBSUB_CORS_ALLOWED_ORIGINS": "http://localhost:3000, http://localhost:5173",
+				}))
+				require.NoError(t, err)
+				assert.Equal(t, List{"http://localhost:3000", "http://localhost:5173"}, config.CORS.AllowedOrigins)
+
+				config, err = Load(writeFile(t, "pubsub.json", `{"cors": {"allowed_origins": ["http://localhost:3000"]}}`), env(nil))
+				require.NoError(t, err)
+				assert.Equal(t, List{"http://localhost:3000"}, config.CORS.AllowedOrigins)
+			},
+		},
+		{
+			desc: "TLS section",
+			testFunc: func(t *testing.T) {
+				path := writeFile(t, "pubsub.yaml", `
+tls:
+  cert_file: /etc/pubsub/server.crt
+  key_file: /etc/pubsub/server.key
+  client_ca_file: /etc/pubsub/ca.crt
+  client_auth: require
+`)
+
+				config, err := Load(path, env(map[string]string{"PUBSUB_TLS_RELOAD_INTERVAL": "1m"}))
+				require.NoError(t, err)
+
+				opts, err := config.Options()
+				require.NoError(t, err)
+
+				assert.Equal(t, &server.TLSConfig{
+					CertFile:       "/etc/pubsub/server.crt",
+					KeyFile:        "/etc/pubsub/server.key",
+					ClientCAFile:   "/etc/pubsub/ca.crt",
+					ClientAuth:     server.RequireClientCert,
+					ReloadInterval: time.Minute,
+				}, opts.TLS)
+			},
+		},
+		{
+			desc: "Auth section",
+			testFunc: func(t *testing.T) {
+				path := writeFile(t, "pubsub.yaml", `
+auth:
+  api_keys_file: /etc/pubsub/api-keys
+  jwt:
+    jwks_file: /etc/pubsub/jwks.json
+    audience: pubsub
+  policy_file: /etc/pubsub/policy.yaml
+`)
+
+				config, err := Load(path, env(map[string]string{"PUBSUB_AUTH_JWT_ISSUER": "https://auth.example.org"}))
+				require.NoError(t, err)
+
+				opts, err := config.Options()
+				require.NoError(t, err)
+
+				expectedJWT := server.DefaultJWTConfig("/etc/pubsub/jwks.json")
+				expectedJWT.Issuer = "https://auth.example.org"
+				expectedJWT.Audience = "pubsub"
+				assert.Equal(t, &server.AuthConfig{APIKeysFile: "/etc/pubsub/api-keys", JWT: &expectedJWT}, opts.Auth)
+				assert.Equal(t, "/etc/pubsub/policy.yaml", opts.PolicyFile)
+			},
+		},
+		{
+			desc: "Unknown key",
+			testFunc: func(t *testing.T) {
+				path := writeFile(t, "pubsub.yaml", "keepalive:\n  ping_intervall: 5s\n")
+
+				_, err := Load(path, env(nil))
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "field ping_intervall not found")
+			},
+		},
+		{
+			desc: "Unknown JSON key",
+			testFunc: func(t *testing.T) {
+				path := writeFile(t, "pubsub.json", `{"adr": ":9000"}`)
+
+				_, err := Load(path, env(nil))
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), `unknown field "adr"`)
+			},
+		},
+		{
+			desc: "Unsupported extension",
+			testFunc: func(t *testing.T) {
+				path := writeFile(t, "pubsub.toml", "")
+
+				_, err := Load(path, env(nil))
+				assert.EqualError(t, err, "config file "+path+`: unsupported extension ".toml", use .yaml, .yml or .json`)
+			},
+		},
+		{
+			desc: "Invalid duration",
+			testFunc: func(t *testing.T) {
+				path := writeFile(t, "pubsub.yaml", "poll:\n  max_wait: 60\n")
+
+				_, err := Load(path, env(nil))
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), `invalid duration "60", use a number with a unit such as 30s`)
+			},
+		},
+		{
+			desc: "Invalid environment variable",
+			testFunc: func(t *testing.T) {
+				_, err := Load("", env(map[string]string{"PUBSUB_QUEUE_SIZE": "lots"}))
+				assert.EqualError(t, err, `PUBSUB_QUEUE_SIZE: invalid integer "lots"`)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, tc.testFunc)
+	}
+}
+
+func Test_Config_Set(t *testing.T) {
+	config := Default()
+
+	require.NoError(t, config.Set("storage.data_dir", "/data"))
+	require.NoError(t, config.Set("keepalive.pong_timeout", "3s"))
+	require.NoError(t, config.Set("storage.segment_bytes", "1024"))
+
+	assert.Equal(t, "/data", config.Storage.DataDir)
+	assert.Equal(t, Duration(3*time.Second), config.Keepalive.PongTimeout)
+	assert.Equal(t, int64(1024), config.Storage.SegmentBytes)
+
+	assert.EqualError(t, config.Set("storage.dir", "/data"), `unknown setting "storage.dir"`)
+	assert.EqualError(t, config.Set("keepalive", "3s"), `unknown setting "keepalive"`)
+	assert.EqualError(t, config.Set("retention.max_age", "forever"), `retention.max_age: invalid duration "forever", use a number with a unit such as 30s`)
+}
+
+func Test_Config_Options_Invalid(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		key      string
+		value    string
+		expected string
+	}{
+		{
+			desc:     "Missing addr",
+			key:      "addr",
+			value:    "",
+			expected: "addr: must be set",
+		},
+		{
+			desc:     "Unknown overflow policy",
+			key:      "queue.overflow",
+			value:    "drop-all",
+			expected: `queue.overflow: unknown overflow policy "drop-all"`,
+		},
+		{
+			desc:     "Unknown balancing",
+			key:      "groups.balancing",
+			value:    "random",
+			expected: `groups.balancing: unknown group balancing "random"`,
+		},
+		{
+			desc:     "Unknown fsync policy",
+			key:      "storage.fsync",
+			value:    "sometimes",
+			expected: `storage.fsync: unknown fsync policy "sometimes"`,
+		},
+		{
+			desc:     "Unknown client auth",
+			key:      "tls.client_auth",
+			value:    "always",
+			expected: `tls.client_auth: unknown client auth "always"`,
+		},
+		{
+			desc:     "Missing TLS key file",
+			key:      "tls.cert_file",
+			value:    "server.crt",
+			expected: "tls: tls cert file and key file must be set",
+		},
+		{
+			desc:     "Invalid allowed origin",
+			key:      "cors.allowed_origins",
+			value:    "dashboard.example.org",
+			expected: `cors: allowed origin "dashboard.example.org" must be * or a scheme and host such as https://example.org`,
+		},
+		{
+			desc:     "Invalid webhook allowed network",
+			key:      "webhooks.allowed_networks",
+			value:    "10.0.0.1",
+			expected: `webhooks: webhook allowed network "10.0.0.1" must be a CIDR range such as 10.0.0.0/8`,
+		},
+		{
+			desc:     "Invalid section",
+			key:      "webhooks.max_concurrency",
+			value:    "0",
+			expected: "webhooks: webhook max concurrency must be greater than 0",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			config := Default()
+			config.Storage.DataDir = "/data"
+			require.NoError(t, config.Set(tc.key, tc.value))
+
+			_, err := config.Options()
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
+
+func Test_EnvName(t *testing.T) {
+	assert.Equal(t, "PUBSUB_ADDR", EnvName("addr"))
+	assert.Equal(t, "PUBSUB_STORAGE_DATA_DIR", EnvName("storage.data_dir"))
+}
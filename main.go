@@ -3,20 +3,97 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 
+	"github.com/cpheps/coder-pub-sub/config"
 	"github.com/cpheps/coder-pub-sub/server"
 )
 
+// flagSettings maps the shorthand flags to the config setting they override
+var flagSettings = map[string]string{
+	"addr":            "addr",
+	"data-dir":        "storage.data_dir",
+	"fsync":           "storage.fsync",
+	"tcp":             "listeners.tcp",
+	"mqtt":            "listeners.mqtt",
+	"grpc":            "listeners.grpc",
+	"tls-cert":        "tls.cert_file",
+	"tls-key":         "tls.key_file",
+	"api-keys":        "auth.api_keys_file",
+	"jwks":            "auth.jwt.jwks_file",
+	"policy":          "auth.policy_file",
+	"allowed-origins": "cors.allowed_origins",
+}
+
+// settingFlags collects repeated -set key=value flags
+type settingFlags []string
+
+func (sf *settingFlags) String() string {
+	return strings.Join(*sf, ",")
+}
+
+func (sf *settingFlags) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("%q is not key=value", value)
+	}
+	*sf = append(*sf, value)
+	return nil
+}
+
 func main() {
+	configPath := flag.String("config", "", "path of a YAML or JSON config file")
+	flag.String("addr", "", "address to serve HTTP on, overrides addr")
+	flag.String("data-dir", "", "directory to store published messages in, overrides storage.data_dir")
+	flag.String("fsync", "", "when the on disk log is synced: always, interval or never, overrides storage.fsync")
+	flag.String("tcp", "", "address to serve the TCP line protocol on such as :4222, overrides listeners.tcp")
+	flag.String("mqtt", "", "address to serve MQTT 3.1.1 on such as :1883, overrides listeners.mqtt")
+	flag.String("grpc", "", "address to serve the gRPC API on such as :9090, overrides listeners.grpc")
+	flag.String("tls-cert", "", "PEM certificate to serve every listener over TLS with, overrides tls.cert_file")
+	flag.String("tls-key", "", "PEM private key of the TLS certificate, overrides tls.key_file")
+	flag.String("api-keys", "", "file of API keys clients must authenticate with, overrides auth.api_keys_file")
+	flag.String("jwks", "", "JWKS file verifying JWT bearer tokens clients must authenticate with, overrides auth.jwt.jwks_file")
+	flag.String("policy", "", "file of rules deciding which topics clients may publish and subscribe to, overrides auth.policy_file")
+	flag.String("allowed-origins", "", "comma separated origins browser apps may connect from, overrides cors.allowed_origins")
+
+	var settings settingFlags
+	flag.Var(&settings, "set", "override any setting with key=value such as keepalive.ping_interval=15s, may be repeated")
+	flag.Parse()
+
+	// Settings are applied from lowest to highest precedence: defaults, the config file, the environment then flags
+	cfg, err := config.Load(*configPath, os.LookupEnv)
+	if err != nil {
+		log.Fatalln("Invalid config", err)
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		if key, ok := flagSettings[f.Name]; ok {
+			settings = append(settings, key+"="+f.Value.String())
+		}
+	})
+
+	for _, setting := range settings {
+		key, value := splitSetting(setting)
+		if err := cfg.Set(key, value); err != nil {
+			log.Fatalln("Invalid flag", err)
+		}
+	}
+
+	opts, err := cfg.Options()
+	if err != nil {
+		log.Fatalln("Invalid config", err)
+	}
+
 	// Setup signal context
 	signalCtx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
 	defer cancel()
 
-	pubsubServer, err := server.New(":8080", 10)
+	pubsubServer, err := server.New(opts)
 	if err != nil {
 		log.Fatalln("Failed to init server", err)
 	}
@@ -39,3 +116,9 @@ func main() {
 		}
 	}
 }
+
+// splitSetting splits a key=value setting
+func splitSetting(setting string) (string, string) {
+	parts := strings.SplitN(setting, "=", 2)
+	return parts[0], parts[1]
+}
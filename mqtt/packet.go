@@ -0,0 +1,623 @@
+// Package mqtt encodes and decodes MQTT 3.1.1 control packets
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// PacketType is the type of a control packet, the high nibble of its first byte
+type PacketType byte
+
+// Control packet types
+const (
+	CONNECT     PacketType = 1
+	CONNACK     PacketType = 2
+	PUBLISH     PacketType = 3
+	PUBACK      PacketType = 4
+	PUBREC      PacketType = 5
+	PUBREL      PacketType = 6
+	PUBCOMP     PacketType = 7
+	SUBSCRIBE   PacketType = 8
+	SUBACK      PacketType = 9
+	UNSUBSCRIBE PacketType = 10
+	UNSUBACK    PacketType = 11
+	PINGREQ     PacketType = 12
+	PINGRESP    PacketType = 13
+	DISCONNECT  PacketType = 14
+)
+
+// String returns the name of the packet type
+func (pt PacketType) String() string {
+	switch pt {
+	case CONNECT:
+		return "CONNECT"
+	case CONNACK:
+		return "CONNACK"
+	case PUBLISH:
+		return "PUBLISH"
+	case PUBACK:
+		return "PUBACK"
+	case PUBREC:
+		return "PUBREC"
+	case PUBREL:
+		return "PUBREL"
+	case PUBCOMP:
+		return "PUBCOMP"
+	case SUBSCRIBE:
+		return "SUBSCRIBE"
+	case SUBACK:
+		return "SUBACK"
+	case UNSUBSCRIBE:
+		return "UNSUBSCRIBE"
+	case UNSUBACK:
+		return "UNSUBACK"
+	case PINGREQ:
+		return "PINGREQ"
+	case PINGRESP:
+		return "PINGRESP"
+	case DISCONNECT:
+		return "DISCONNECT"
+	}
+	return fmt.Sprintf("PacketType(%d)", byte(pt))
+}
+
+// ProtocolLevel is the protocol level of MQTT 3.1.1
+const ProtocolLevel = 4
+
+// CONNACK return codes
+const (
+	Accepted                   byte = 0x00
+	RefusedProtocolVersion     byte = 0x01
+	RefusedIdentifierRejected  byte = 0x02
+	RefusedServerUnavailable   byte = 0x03
+	RefusedBadUsernamePassword byte = 0x04
+	RefusedNotAuthorized       byte = 0x05
+)
+
+// MaxRemainingLength is the largest remaining length the protocol can encode, about 256MiB
+const MaxRemainingLength = 268435455
+
+// SubscribeFailure is the SUBACK return code of a subscription that was refused
+const SubscribeFailure byte = 0x80
+
+// ErrMalformed is wrapped by errors for packets that break the protocol
+var ErrMalformed = errors.New("malformed packet")
+
+// ErrTooLarge is returned when a packet is larger than the limit passed to ReadPacket
+var ErrTooLarge = errors.New("packet too large")
+
+// Packet is a control packet
+type Packet interface {
+	// Type returns the type of the packet
+	Type() PacketType
+
+	// Encode returns the packet as sent on the wire
+	Encode() []byte
+}
+
+// Connect is the first packet a client sends
+type Connect struct {
+	ProtocolName  string
+	ProtocolLevel byte
+	CleanSession  bool
+	KeepAlive     uint16
+	ClientID      string
+
+	// Will is published if the client disconnects without a DISCONNECT, nil if it has none
+	Will *Publish
+
+	Username    string
+	HasUsername bool
+	Password    []byte
+	HasPassword bool
+}
+
+// Connack answers a Connect
+type Connack struct {
+	SessionPresent bool
+	ReturnCode     byte
+}
+
+// Publish carries an application message in either direction
+type Publish struct {
+	Dup      bool
+	QoS      byte
+	Retain   bool
+	Topic    string
+	PacketID uint16
+	Payload  []byte
+}
+
+// Puback acknowledges a QoS 1 Publish
+type Puback struct {
+	PacketID uint16
+}
+
+// Subscription is a single topic filter of a Subscribe
+type Subscription struct {
+	Filter string
+	QoS    byte
+}
+
+// Subscribe requests one or more subscriptions
+type Subscribe struct {
+	PacketID      uint16
+	Subscriptions []Subscription
+}
+
+// Suback answers a Subscribe with the granted QoS, or SubscribeFailure, of each subscription in order
+type Suback struct {
+	PacketID    uint16
+	ReturnCodes []byte
+}
+
+// Unsubscribe removes one or more subscriptions
+type Unsubscribe struct {
+	PacketID uint16
+	Filters  []string
+}
+
+// Unsuback answers an Unsubscribe
+type Unsuback struct {
+	PacketID uint16
+}
+
+// Pingreq is sent by a client to keep the connection alive
+type Pingreq struct{}
+
+// Pingresp answers a Pingreq
+type Pingresp struct{}
+
+// Disconnect is the last packet a client sends before closing the connection cleanly
+type Disconnect struct{}
+
+// Type returns CONNECT
+func (*Connect) Type() PacketType { return CONNECT }
+
+// Type returns CONNACK
+func (*Connack) Type() PacketType { return CONNACK }
+
+// Type returns PUBLISH
+func (*Publish) Type() PacketType { return PUBLISH }
+
+// Type returns PUBACK
+func (*Puback) Type() PacketType { return PUBACK }
+
+// Type returns SUBSCRIBE
+func (*Subscribe) Type() PacketType { return SUBSCRIBE }
+
+// Type returns SUBACK
+func (*Suback) Type() PacketType { return SUBACK }
+
+// Type returns UNSUBSCRIBE
+func (*Unsubscribe) Type() PacketType { return UNSUBSCRIBE }
+
+// Type returns UNSUBACK
+func (*Unsuback) Type() PacketType { return UNSUBACK }
+
+// Type returns PINGREQ
+func (*Pingreq) Type() PacketType { return PINGREQ }
+
+// Type returns PINGRESP
+func (*Pingresp) Type() PacketType { return PINGRESP }
+
+// Type returns DISCONNECT
+func (*Disconnect) Type() PacketType { return DISCONNECT }
+
+// Encode returns the packet as sent on the wire
+func (c *Connect) Encode() []byte {
+	var body bytes.Buffer
+	writeString(&body, c.ProtocolName)
+	body.WriteByte(c.ProtocolLevel)
+
+	var flags byte
+	if c.CleanSession {
+		flags |= 0x02
+	}
+	if c.Will != nil {
+		flags |= 0x04 | c.Will.QoS<<3
+		if c.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if c.HasPassword {
+		flags |= 0x40
+	}
+	if c.HasUsername {
+		flags |= 0x80
+	}
+	body.WriteByte(flags)
+	writeUint16(&body, c.KeepAlive)
+
+	writeString(&body, c.ClientID)
+	if c.Will != nil {
+		writeString(&body, c.Will.Topic)
+		writeBytes(&body, c.Will.Payload)
+	}
+	if c.HasUsername {
+		writeString(&body, c.Username)
+	}
+	if c.HasPassword {
+		writeBytes(&body, c.Password)
+	}
+
+	return encode(CONNECT, 0, body.Bytes())
+}
+
+// Encode returns the packet as sent on the wire
+func (c *Connack) Encode() []byte {
+	var sessionPresent byte
+	if c.SessionPresent {
+		sessionPresent = 1
+	}
+	return encode(CONNACK, 0, []byte{sessionPresent, c.ReturnCode})
+}
+
+// Encode returns the packet as sent on the wire
+func (p *Publish) Encode() []byte {
+	flags := p.QoS << 1
+	if p.Dup {
+		flags |= 0x08
+	}
+	if p.Retain {
+		flags |= 0x01
+	}
+
+	var body bytes.Buffer
+	writeString(&body, p.Topic)
+	if p.QoS > 0 {
+		writeUint16(&body, p.PacketID)
+	}
+	body.Write(p.Payload)
+
+	return encode(PUBLISH, flags, body.Bytes())
+}
+
+// Encode returns the packet as sent on the wire
+func (p *Puback) Encode() []byte {
+	return encode(PUBACK, 0, packetID(p.PacketID))
+}
+
+// Encode returns the packet as sent on the wire
+func (s *Subscribe) Encode() []byte {
+	var body bytes.Buffer
+	writeUint16(&body, s.PacketID)
+	for _, sub := range s.Subscriptions {
+		writeString(&body, sub.Filter)
+		body.WriteByte(sub.QoS)
+	}
+	return encode(SUBSCRIBE, 0x02, body.Bytes())
+}
+
+// Encode returns the packet as sent on the wire
+func (s *Suback) Encode() []byte {
+	return encode(SUBACK, 0, append(packetID(s.PacketID), s.ReturnCodes...))
+}
+
+// Encode returns the packet as sent on the wire
+func (u *Unsubscribe) Encode() []byte {
+	var body bytes.Buffer
+	writeUint16(&body, u.PacketID)
+	for _, filter := range u.Filters {
+		writeString(&body, filter)
+	}
+	return encode(UNSUBSCRIBE, 0x02, body.Bytes())
+}
+
+// Encode returns the packet as sent on the wire
+func (u *Unsuback) Encode() []byte {
+	return encode(UNSUBACK, 0, packetID(u.PacketID))
+}
+
+// Encode returns the packet as sent on the wire
+func (*Pingreq) Encode() []byte { return encode(PINGREQ, 0, nil) }
+
+// Encode returns the packet as sent on the wire
+func (*Pingresp) Encode() []byte { return encode(PINGRESP, 0, nil) }
+
+// Encode returns the packet as sent on the wire
+func (*Disconnect) Encode() []byte { return encode(DISCONNECT, 0, nil) }
+
+// encode prefixes body with the fixed header
+func encode(packetType PacketType, flags byte, body []byte) []byte {
+	packet := make([]byte, 0, len(body)+5)
+	packet = append(packet, byte(packetType)<<4|flags)
+
+	// The remaining length is a varint of 7 bits per byte, least significant first
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+
+	return append(packet, body...)
+}
+
+// ReadPacket reads a single packet from r. Packets with a remaining length above maxSize return ErrTooLarge
+// without reading their body, the stream can't be read any further in that case.
+func ReadPacket(r io.Reader, maxSize int) (Packet, error) {
+	var header [1]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	length, err := readRemainingLength(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if length > maxSize {
+		return nil, ErrTooLarge
+	}
+
+	// The body grows as it arrives so a claimed length alone doesn't allocate up to maxSize
+	body, err := io.ReadAll(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) != length {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	packetType, flags := PacketType(header[0]>>4), header[0]&0x0f
+	return decode(packetType, flags, &reader{buf: body})
+}
+
+// readRemainingLength reads the varint remaining length of the fixed header
+func readRemainingLength(r io.Reader) (int, error) {
+	var length, multiplier int = 0, 1
+	var digit [1]byte
+	for i := 0; i < 4; i++ {
+		if _, err := io.ReadFull(r, digit[:]); err != nil {
+			return 0, err
+		}
+
+		length += int(digit[0]&0x7f) * multiplier
+		if digit[0]&0x80 == 0 {
+			return length, nil
+		}
+		multiplier *= 128
+	}
+
+	return 0, fmt.Errorf("%w: remaining length is longer than 4 bytes", ErrMalformed)
+}
+
+// decode parses the body of a packet
+func decode(packetType PacketType, flags byte, r *reader) (Packet, error) {
+	// Only PUBLISH uses its flags, SUBSCRIBE, UNSUBSCRIBE and PUBREL must set them to 0010 and the others to 0
+	switch packetType {
+	case PUBLISH:
+	case SUBSCRIBE, UNSUBSCRIBE, PUBREL:
+		if flags != 0x02 {
+			return nil, fmt.Errorf("%w: invalid flags for %s", ErrMalformed, packetType)
+		}
+	default:
+		if flags != 0 {
+			return nil, fmt.Errorf("%w: invalid flags for %s", ErrMalformed, packetType)
+		}
+	}
+
+	var packet Packet
+	switch packetType {
+	case CONNECT:
+		packet = decodeConnect(r)
+	case CONNACK:
+		packet = &Connack{SessionPresent: r.byte()&0x01 == 1, ReturnCode: r.byte()}
+	case PUBLISH:
+		packet = decodePublish(flags, r)
+	case PUBACK:
+		packet = &Puback{PacketID: r.uint16()}
+	case SUBSCRIBE:
+		packet = decodeSubscribe(r)
+	case SUBACK:
+		packet = &Suback{PacketID: r.uint16(), ReturnCodes: r.rest()}
+	case UNSUBSCRIBE:
+		packet = decodeUnsubscribe(r)
+	case UNSUBACK:
+		packet = &Unsuback{PacketID: r.uint16()}
+	case PINGREQ:
+		packet = &Pingreq{}
+	case PINGRESP:
+		packet = &Pingresp{}
+	case DISCONNECT:
+		packet = &Disconnect{}
+	default:
+		return nil, fmt.Errorf("%w: unsupported packet type %s", ErrMalformed, packetType)
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("%w: %s %s", ErrMalformed, packetType, r.err)
+	}
+
+	if len(r.buf) > 0 {
+		return nil, fmt.Errorf("%w: %s has %d trailing bytes", ErrMalformed, packetType, len(r.buf))
+	}
+
+	return packet, nil
+}
+
+// decodeConnect parses the body of a CONNECT
+func decodeConnect(r *reader) *Connect {
+	connect := &Connect{
+		ProtocolName:  r.string(),
+		ProtocolLevel: r.byte(),
+	}
+
+	flags := r.byte()
+	if flags&0x01 != 0 {
+		r.fail("reserved connect flag is set")
+	}
+
+	connect.CleanSession = flags&0x02 != 0
+	connect.KeepAlive = r.uint16()
+	connect.ClientID = r.string()
+
+	if flags&0x04 != 0 {
+		connect.Will = &Publish{
+			QoS:    flags >> 3 & 0x03,
+			Retain: flags&0x20 != 0,
+			Topic:  r.string(),
+		}
+		connect.Will.Payload = r.bytes()
+
+		if connect.Will.QoS > 2 {
+			r.fail("invalid will QoS")
+		}
+	} else if flags&0x38 != 0 {
+		r.fail("will QoS or retain set without a will")
+	}
+
+	if flags&0x80 != 0 {
+		connect.HasUsername = true
+		connect.Username = r.string()
+	}
+
+	if flags&0x40 != 0 {
+		connect.HasPassword = true
+		connect.Password = r.bytes()
+	}
+
+	return connect
+}
+
+// decodePublish parses the body of a PUBLISH
+func decodePublish(flags byte, r *reader) *Publish {
+	publish := &Publish{
+		Dup:    flags&0x08 != 0,
+		QoS:    flags >> 1 & 0x03,
+		Retain: flags&0x01 != 0,
+		Topic:  r.string(),
+	}
+
+	if publish.QoS > 2 {
+		r.fail("invalid QoS")
+	}
+
+	if publish.QoS > 0 {
+		publish.PacketID = r.uint16()
+	}
+	publish.Payload = r.rest()
+
+	return publish
+}
+
+// decodeSubscribe parses the body of a SUBSCRIBE
+func decodeSubscribe(r *reader) *Subscribe {
+	subscribe := &Subscribe{PacketID: r.uint16()}
+	for len(r.buf) > 0 && r.err == nil {
+		sub := Subscription{Filter: r.string(), QoS: r.byte()}
+		if sub.QoS > 2 {
+			r.fail("invalid requested QoS")
+		}
+		subscribe.Subscriptions = append(subscribe.Subscriptions, sub)
+	}
+
+	if len(subscribe.Subscriptions) == 0 {
+		r.fail("no topic filters")
+	}
+
+	return subscribe
+}
+
+// decodeUnsubscribe parses the body of an UNSUBSCRIBE
+func decodeUnsubscribe(r *reader) *Unsubscribe {
+	unsubscribe := &Unsubscribe{PacketID: r.uint16()}
+	for len(r.buf) > 0 && r.err == nil {
+		unsubscribe.Filters = append(unsubscribe.Filters, r.string())
+	}
+
+	if len(unsubscribe.Filters) == 0 {
+		r.fail("no topic filters")
+	}
+
+	return unsubscribe
+}
+
+// reader reads the fields of a packet body, the first error is kept and later reads return zero values
+type reader struct {
+	buf []byte
+	err error
+}
+
+// fail records err unless an error was already recorded
+func (r *reader) fail(err string) {
+	if r.err == nil {
+		r.err = errors.New(err)
+	}
+}
+
+// next returns the next n bytes
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if len(r.buf) < n {
+		r.fail("body is too short")
+		return nil
+	}
+
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) uint16() uint16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+// bytes reads a length prefixed byte string
+func (r *reader) bytes() []byte {
+	return r.next(int(r.uint16()))
+}
+
+// string reads a length prefixed UTF-8 string
+func (r *reader) string() string {
+	return string(r.bytes())
+}
+
+// rest returns the unread bytes
+func (r *reader) rest() []byte {
+	return r.next(len(r.buf))
+}
+
+func writeUint16(b *bytes.Buffer, v uint16) {
+	b.WriteByte(byte(v >> 8))
+	b.WriteByte(byte(v))
+}
+
+func writeBytes(b *bytes.Buffer, v []byte) {
+	writeUint16(b, uint16(len(v)))
+	b.Write(v)
+}
+
+func writeString(b *bytes.Buffer, v string) {
+	writeBytes(b, []byte(v))
+}
+
+func packetID(id uint16) []byte {
+	return []byte{byte(id >> 8), byte(id)}
+}
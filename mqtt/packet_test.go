@@ -0,0 +1,189 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ReadPacket_RoundTrip(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		packet Packet
+	}{
+		{
+			desc: "Connect",
+			packet: &Connect{
+				ProtocolName:  "MQTT",
+				ProtocolLevel: ProtocolLevel,
+				CleanSession:  true,
+				KeepAlive:     30,
+				ClientID:      "sensor-1",
+				Will:          &Publish{QoS: 1, Retain: true, Topic: "sensors/1/status", Payload: []byte("offline")},
+				Username:      "user",
+				HasUsername:   true,
+				Password:      []byte("pass"),
+				HasPassword:   true,
+			},
+		},
+		{
+			desc:   "Connect without optional fields",
+			packet: &Connect{ProtocolName: "MQTT", ProtocolLevel: ProtocolLevel, ClientID: ""},
+		},
+		{
+			desc:   "Connack",
+			packet: &Connack{SessionPresent: true, ReturnCode: Accepted},
+		},
+		{
+			desc:   "Publish QoS 0",
+			packet: &Publish{Topic: "sensors/1/temp", Payload: []byte("21.5")},
+		},
+		{
+			desc:   "Publish QoS 1",
+			packet: &Publish{Dup: true, QoS: 1, Retain: true, Topic: "sensors/1/temp", PacketID: 7, Payload: []byte("21.5")},
+		},
+		{
+			desc:   "Large publish",
+			packet: &Publish{Topic: "blob", Payload: bytes.Repeat([]byte{0xff}, 200000)},
+		},
+		{
+			desc:   "Puback",
+			packet: &Puback{PacketID: 513},
+		},
+		{
+			desc:   "Subscribe",
+			packet: &Subscribe{PacketID: 2, Subscriptions: []Subscription{{Filter: "sensors/+/temp", QoS: 1}, {Filter: "alerts/#"}}},
+		},
+		{
+			desc:   "Suback",
+			packet: &Suback{PacketID: 2, ReturnCodes: []byte{1, SubscribeFailure}},
+		},
+		{
+			desc:   "Unsubscribe",
+			packet: &Unsubscribe{PacketID: 3, Filters: []string{"sensors/+/temp"}},
+		},
+		{
+			desc:   "Unsuback",
+			packet: &Unsuback{PacketID: 3},
+		},
+		{
+			desc:   "Pingreq",
+			packet: &Pingreq{},
+		},
+		{
+			desc:   "Pingresp",
+			packet: &Pingresp{},
+		},
+		{
+			desc:   "Disconnect",
+			packet: &Disconnect{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			actual, err := ReadPacket(bytes.NewReader(tc.packet.Encode()), 1<<20)
+			require.NoError(t, err)
+			assert.Equal(t, tc.packet, actual)
+		})
+	}
+}
+
+func Test_ReadPacket_Errors(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		data        []byte
+		maxSize     int
+		expectedErr error
+	}{
+		{
+			desc:        "Empty",
+			data:        nil,
+			maxSize:     1024,
+			expectedErr: io.EOF,
+		},
+		{
+			desc:        "Truncated body",
+			data:        []byte{0x40, 0x02, 0x00},
+			maxSize:     1024,
+			expectedErr: io.ErrUnexpectedEOF,
+		},
+		{
+			desc:        "Too large",
+			data:        (&Publish{Topic: "a", Payload: make([]byte, 100)}).Encode(),
+			maxSize:     50,
+			expectedErr: ErrTooLarge,
+		},
+		{
+			desc:        "Remaining length too long",
+			data:        []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01},
+			maxSize:     1024,
+			expectedErr: ErrMalformed,
+		},
+		{
+			desc:        "Subscribe with invalid flags",
+			data:        []byte{0x80, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x00},
+			maxSize:     1024,
+			expectedErr: ErrMalformed,
+		},
+		{
+			desc:        "Subscribe without filters",
+			data:        []byte{0x82, 0x02, 0x00, 0x01},
+			maxSize:     1024,
+			expectedErr: ErrMalformed,
+		},
+		{
+			desc:        "Publish with QoS 3",
+			data:        []byte{0x36, 0x05, 0x00, 0x01, 'a', 0x00, 0x01},
+			maxSize:     1024,
+			expectedErr: ErrMalformed,
+		},
+		{
+			desc:        "Puback with trailing bytes",
+			data:        []byte{0x40, 0x03, 0x00, 0x01, 0x00},
+			maxSize:     1024,
+			expectedErr: ErrMalformed,
+		},
+		{
+			desc:        "Connect with reserved flag",
+			data:        []byte{0x10, 0x0c, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x01, 0x00, 0x00, 0x00, 0x00},
+			maxSize:     1024,
+			expectedErr: ErrMalformed,
+		},
+		{
+			desc:        "Unsupported type",
+			data:        []byte{0xf0, 0x00},
+			maxSize:     1024,
+			expectedErr: ErrMalformed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := ReadPacket(bytes.NewReader(tc.data), tc.maxSize)
+			assert.True(t, errors.Is(err, tc.expectedErr), "expected %v got %v", tc.expectedErr, err)
+		})
+	}
+}
+
+func Test_encode_RemainingLength(t *testing.T) {
+	testCases := []struct {
+		length   int
+		expected []byte
+	}{
+		{length: 0, expected: []byte{0x00}},
+		{length: 127, expected: []byte{0x7f}},
+		{length: 128, expected: []byte{0x80, 0x01}},
+		{length: 16383, expected: []byte{0xff, 0x7f}},
+		{length: 16384, expected: []byte{0x80, 0x80, 0x01}},
+	}
+
+	for _, tc := range testCases {
+		packet := encode(PUBLISH, 0, make([]byte, tc.length))
+		assert.Equal(t, tc.expected, packet[1:1+len(tc.expected)], "length %d", tc.length)
+	}
+}
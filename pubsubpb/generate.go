@@ -0,0 +1,4 @@
+// Package pubsubpb contains the protobuf messages and gRPC service definitions of the pub/sub gRPC API.
+package pubsubpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative pubsub.proto
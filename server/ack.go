@@ -0,0 +1,38 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/cpheps/coder-pub-sub/websocket"
+)
+
+// parseAck reads the ack query parameter of a subscribe request.
+//
+//	ack=true turns on at-least-once delivery with the server's AckConfig
+//
+// Acking needs the sequence number of each message so it requires the envelope format.
+// Returns nil if acking is not turned on.
+func parseAck(query url.Values, format websocket.Format, config websocket.AckConfig) (*websocket.AckConfig, error) {
+	value := query.Get("ack")
+	if value == "" {
+		return nil, nil
+	}
+
+	ack, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("ack must be true or false: %q", value)
+	}
+
+	if !ack {
+		return nil, nil
+	}
+
+	if format != websocket.FormatEnvelope {
+		return nil, errors.New("ack requires the envelope format")
+	}
+
+	return &config, nil
+}
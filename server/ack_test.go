@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cpheps/coder-pub-sub/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseAck(t *testing.T) {
+	config := websocket.AckConfig{VisibilityTimeout: time.Second, MaxAttempts: 3}
+
+	testCases := []struct {
+		desc        string
+		query       string
+		format      websocket.Format
+		expected    *websocket.AckConfig
+		expectedErr string
+	}{
+		{
+			desc:     "No ack",
+			query:    "format=envelope",
+			format:   websocket.FormatEnvelope,
+			expected: nil,
+		},
+		{
+			desc:     "Ack turned off",
+			query:    "ack=false",
+			format:   websocket.FormatRaw,
+			expected: nil,
+		},
+		{
+			desc:     "Ack",
+			query:    "ack=true",
+			format:   websocket.FormatEnvelope,
+			expected: &config,
+		},
+		{
+			desc:        "Ack without envelope",
+			query:       "ack=true",
+			format:      websocket.FormatRaw,
+			expectedErr: "ack requires the envelope format",
+		},
+		{
+			desc:        "Invalid ack",
+			query:       "ack=maybe",
+			format:      websocket.FormatEnvelope,
+			expectedErr: `ack must be true or false: "maybe"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			query, err := url.ParseQuery(tc.query)
+			assert.NoError(t, err)
+
+			actual, err := parseAck(query, tc.format, config)
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedErr)
+			}
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	gwebsocket "github.com/gorilla/websocket"
+)
+
+const (
+	// IdentityAPIKey is the Method of an identity proven by a static API key
+	IdentityAPIKey = "api-key"
+
+	// IdentityJWT is the Method of an identity proven by a JWT bearer token
+	IdentityJWT = "jwt"
+
+	// TokenQueryParam carries the token of websocket and event stream requests from browsers, which can't set headers
+	TokenQueryParam = "access_token"
+
+	// TokenSubprotocolPrefix prefixes a websocket subprotocol carrying the token, such as bearer.<token>
+	TokenSubprotocolPrefix = "bearer."
+
+	// WebsocketSubprotocol is the subprotocol the server selects. Browsers fail the handshake if none of the
+	// subprotocols they offer is selected, so clients passing a token subprotocol must offer this one too.
+	WebsocketSubprotocol = "pubsub"
+)
+
+// ErrUnrecognizedToken is returned by an Authenticator for a token it doesn't handle, so the next one is tried
+var ErrUnrecognizedToken = errors.New("unrecognized token")
+
+// Authenticator checks the token presented by a client
+type Authenticator interface {
+	// Authenticate returns the identity proven by token.
+	// Returns ErrUnrecognizedToken if the token isn't of a kind it handles, any other error rejects the client.
+	Authenticate(ctx context.Context, token string) (*Identity, error)
+}
+
+// AuthConfig requires publishers and subscribers to authenticate with a token.
+// Clients with a verified TLS client certificate are already authenticated.
+type AuthConfig struct {
+	// APIKeysFile holds static API keys, one per line as "<subject> <key>". Blank lines and lines starting with # are skipped.
+	APIKeysFile string
+
+	// JWT verifies HS256 and RS256 bearer tokens, nil disables them
+	JWT *JWTConfig
+
+	// Authenticators are tried after the API keys and JWTs, for tokens of other kinds
+	Authenticators []Authenticator
+}
+
+// Validate checks the AuthConfig is usable, the files are only read once the server is created
+func (ac AuthConfig) Validate() error {
+	if ac.APIKeysFile == "" && ac.JWT == nil && len(ac.Authenticators) == 0 {
+		return errors.New("auth needs an api keys file, a jwks file or an authenticator")
+	}
+
+	if ac.JWT != nil {
+		return ac.JWT.Validate()
+	}
+
+	return nil
+}
+
+// newAuthenticators loads the authenticators of config in the order they are tried
+func newAuthenticators(config AuthConfig) ([]Authenticator, error) {
+	var authenticators []Authenticator
+
+	if config.APIKeysFile != "" {
+		apiKeys, err := loadAPIKeys(config.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, apiKeys)
+	}
+
+	if config.JWT != nil {
+		jwt, err := newJWTAuthenticator(*config.JWT)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, jwt)
+	}
+
+	return append(authenticators, config.Authenticators...), nil
+}
+
+var _ (Authenticator) = (apiKeys)(nil)
+
+// apiKeys authenticates static API keys, mapping the SHA-256 of each key to its subject
+// so keys aren't compared byte by byte
+type apiKeys map[[sha256.Size]byte]string
+
+// loadAPIKeys reads an API keys file
+func loadAPIKeys(path string) (apiKeys, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load api keys: %w", err)
+	}
+	defer file.Close()
+
+	keys := make(apiKeys)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("api keys file %s line %d: expected <subject> <key>", path, line)
+		}
+
+		keys[sha256.Sum256([]byte(fields[1]))] = fields[0]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load api keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+// Authenticate returns the identity of the subject the key belongs to
+func (ak apiKeys) Authenticate(_ context.Context, token string) (*Identity, error) {
+	subject, ok := ak[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, ErrUnrecognizedToken
+	}
+
+	return &Identity{
+		Subject: subject,
+		Method:  IdentityAPIKey,
+		Claims:  map[string]interface{}{},
+	}, nil
+}
+
+// authRequired reports whether clients must authenticate
+func (s *PubSubServer) authRequired() bool {
+	return len(s.authenticators) > 0
+}
+
+// authenticateToken returns the identity proven by token, trying each authenticator in turn
+func (s *PubSubServer) authenticateToken(ctx context.Context, token string) (*Identity, error) {
+	if token == "" {
+		return nil, errors.New("missing token")
+	}
+
+	for _, authenticator := range s.authenticators {
+		identity, err := authenticator.Authenticate(ctx, token)
+		if errors.Is(err, ErrUnrecognizedToken) {
+			continue
+		}
+		return identity, err
+	}
+
+	return nil, ErrUnrecognizedToken
+}
+
+// authenticate is middleware rejecting requests without a valid token with 401.
+// Requests identified by a TLS client certificate are let through.
+func (s *PubSubServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authRequired() || IdentityFromContext(r.Context()) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		identity, err := s.authenticateToken(r.Context(), requestToken(r))
+		if err != nil {
+			log.Println("Rejecting unauthenticated request to", r.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			s.writeResponse(w, http.StatusUnauthorized, &errorResponse{
+				Message: "authentication required",
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(ContextWithIdentity(r.Context(), identity)))
+	})
+}
+
+// requestToken returns the token of a request from its Authorization header.
+// Websocket and event stream requests may pass it as a query parameter or websocket subprotocol instead.
+func requestToken(r *http.Request) string {
+	if token, ok := bearerToken(r.Header.Get("Authorization")); ok {
+		return token
+	}
+
+	websocketUpgrade := gwebsocket.IsWebSocketUpgrade(r)
+	if !websocketUpgrade && !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return ""
+	}
+
+	if token := r.URL.Query().Get(TokenQueryParam); token != "" {
+		return token
+	}
+
+	if websocketUpgrade {
+		for _, protocol := range gwebsocket.Subprotocols(r) {
+			if strings.HasPrefix(protocol, TokenSubprotocolPrefix) {
+				return strings.TrimPrefix(protocol, TokenSubprotocolPrefix)
+			}
+		}
+	}
+
+	return ""
+}
+
+// bearerToken parses the token of an Authorization header using the Bearer scheme
+func bearerToken(header string) (string, bool) {
+	const scheme = "bearer "
+	if len(header) <= len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(scheme):]), true
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cpheps/coder-pub-sub/mqtt"
+	"github.com/cpheps/coder-pub-sub/pubsubpb"
+	gwebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// testAPIKey is the key of the "publisher" subject in the file written by writeAPIKeys
+const testAPIKey = "k3y-publisher"
+
+// writeAPIKeys writes an API keys file and returns its path
+func writeAPIKeys(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "api-keys")
+	require.NoError(t, os.WriteFile(path, []byte("# subject key\npublisher "+testAPIKey+"\n\nsubscriber k3y-subscriber\n"), 0o600))
+	return path
+}
+
+// authenticatorFunc adapts a func to an Authenticator
+type authenticatorFunc func(ctx context.Context, token string) (*Identity, error)
+
+func (af authenticatorFunc) Authenticate(ctx context.Context, token string) (*Identity, error) {
+	return af(ctx, token)
+}
+
+func Test_loadAPIKeys(t *testing.T) {
+	keys, err := loadAPIKeys(writeAPIKeys(t))
+	require.NoError(t, err)
+
+	identity, err := keys.Authenticate(context.Background(), testAPIKey)
+	require.NoError(t, err)
+	assert.Equal(t, "publisher", identity.Subject)
+	assert.Equal(t, IdentityAPIKey, identity.Method)
+
+	_, err = keys.Authenticate(context.Background(), "publisher")
+	assert.Equal(t, ErrUnrecognizedToken, err)
+
+	path := filepath.Join(t.TempDir(), "api-keys")
+	require.NoError(t, os.WriteFile(path, []byte("publisher\n"), 0o600))
+	_, err = loadAPIKeys(path)
+	assert.EqualError(t, err, "api keys file "+path+" line 1: expected <subject> <key>")
+}
+
+func Test_requestToken(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		target   string
+		headers  map[string]string
+		expected string
+	}{
+		{
+			desc:     "Authorization header",
+			target:   "/publish/orders",
+			headers:  map[string]string{"Authorization": "Bearer abc"},
+			expected: "abc",
+		},
+		{
+			desc:     "Case insensitive scheme",
+			target:   "/publish/orders",
+			headers:  map[string]string{"Authorization": "bearer abc"},
+			expected: "abc",
+		},
+		{
+			desc:    "Basic auth is ignored",
+			target:  "/publish/orders",
+			headers: map[string]string{"Authorization": "Basic YWJjOmRlZg=="},
+		},
+		{
+			desc:   "Query parameter ignored for plain requests",
+			target: "/publish/orders?access_token=abc",
+		},
+		{
+			desc:     "Query parameter of websocket",
+			target:   "/subscribe/orders?access_token=abc",
+			headers:  map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"},
+			expected: "abc",
+		},
+		{
+			desc:     "Query parameter of event stream",
+			target:   "/events?topic=orders&access_token=abc",
+			headers:  map[string]string{"Accept": "text/event-stream"},
+			expected: "abc",
+		},
+		{
+			desc:     "Subprotocol of websocket",
+			target:   "/subscribe/orders",
+			headers:  map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Protocol": "pubsub, bearer.abc"},
+			expected: "abc",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			for name, value := range tc.headers {
+				r.Header.Set(name, value)
+			}
+			assert.Equal(t, tc.expected, requestToken(r))
+		})
+	}
+}
+
+func Test_PubSubServer_Auth(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	jwtConfig := DefaultJWTConfig(writeJWKS(t, rsaKey))
+	jwtToken := signRS256(t, rsaKey, "rs", map[string]interface{}{"sub": "jwt-user", "exp": time.Now().Add(time.Hour).Unix()})
+
+	startAuthServer := func(t *testing.T) (*PubSubServer, string) {
+		return startServer(t, func(o *Options) {
+			o.TCPAddr = "127.0.0.1:0"
+			o.MQTTAddr = "127.0.0.1:0"
+			o.GRPCAddr = "127.0.0.1:0"
+			o.Auth = &AuthConfig{
+				APIKeysFile: writeAPIKeys(t),
+				JWT:         &jwtConfig,
+				Authenticators: []Authenticator{authenticatorFunc(func(_ context.Context, token string) (*Identity, error) {
+					if token == "rejected" {
+						return nil, errors.New("token revoked")
+					}
+					return nil, ErrUnrecognizedToken
+				})},
+			}
+		})
+	}
+
+	publish := func(t *testing.T, baseURL, token string) int {
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/publish/orders", bytes.NewBufferString("hello"))
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	testCases := []struct {
+		desc     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			desc: "HTTP publish",
+			testFunc: func(t *testing.T) {
+				_, baseURL := startAuthServer(t)
+
+				assert.Equal(t, http.StatusUnauthorized, publish(t, baseURL, ""))
+				assert.Equal(t, http.StatusUnauthorized, publish(t, baseURL, "wrong"))
+				assert.Equal(t, http.StatusUnauthorized, publish(t, baseURL, "rejected"))
+				assert.Equal(t, http.StatusOK, publish(t, baseURL, testAPIKey))
+				assert.Equal(t, http.StatusOK, publish(t, baseURL, jwtToken))
+			},
+		},
+		{
+			desc: "Websocket subscribe",
+			testFunc: func(t *testing.T) {
+				_, baseURL := startAuthServer(t)
+				wsURL := strings.Replace(baseURL, "http://", "ws://", 1) + "/subscribe/orders"
+
+				_, resp, err := gwebsocket.DefaultDialer.Dial(wsURL, nil)
+				require.Error(t, err)
+				assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+				conn, _, err := gwebsocket.DefaultDialer.Dial(wsURL+"?access_token="+jwtToken, nil)
+				require.NoError(t, err)
+				conn.Close()
+
+				// Browsers offer the token as a subprotocol alongside the one the server selects
+				dialer := &gwebsocket.Dialer{Subprotocols: []string{WebsocketSubprotocol, TokenSubprotocolPrefix + testAPIKey}}
+				conn, _, err = dialer.Dial(wsURL, nil)
+				require.NoError(t, err)
+				defer conn.Close()
+				assert.Equal(t, WebsocketSubprotocol, conn.Subprotocol())
+
+				assert.Equal(t, http.StatusOK, publish(t, baseURL, testAPIKey))
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				_, data, err := conn.ReadMessage()
+				require.NoError(t, err)
+				assert.Equal(t, "hello", string(data))
+			},
+		},
+		{
+			desc: "gRPC",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startAuthServer(t)
+				client := dialGRPC(t, pubsubServer)
+
+				_, err := client.Publish(context.Background(), &pubsubpb.PublishRequest{Topic: "orders"})
+				assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+				stream, err := client.Subscribe(context.Background(), &pubsubpb.SubscribeRequest{Pattern: "orders"})
+				require.NoError(t, err)
+				_, err = stream.Recv()
+				assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+				ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+jwtToken)
+				_, err = client.Publish(ctx, &pubsubpb.PublishRequest{Topic: "orders"})
+				assert.NoError(t, err)
+			},
+		},
+		{
+			desc: "TCP line protocol",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startAuthServer(t)
+
+				client := dialTCP(t, pubsubServer)
+				client.send("PING\r\n")
+				assert.Equal(t, "PONG", client.readLine())
+
+				client.send("AUTH wrong\r\n")
+				assert.Equal(t, "-ERR 'authentication failed'", client.readLine())
+
+				client.send("AUTH " + testAPIKey + "\r\n")
+				assert.Equal(t, "+OK", client.readLine())
+
+				client.send("SUB orders 1\r\n")
+				assert.Equal(t, "+OK", client.readLine())
+
+				unauthenticated := dialTCP(t, pubsubServer)
+				unauthenticated.send("PUB orders 5\r\nhello\r\n")
+				assert.Equal(t, "-ERR 'authentication required'", unauthenticated.readLine())
+
+				unauthenticated.conn.SetReadDeadline(time.Now().Add(time.Second))
+				_, err := unauthenticated.reader.ReadString('\n')
+				assert.Error(t, err)
+			},
+		},
+		{
+			desc: "MQTT",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startAuthServer(t)
+				connect := func(password string) *mqtt.Connect {
+					return &mqtt.Connect{
+						ProtocolName:  "MQTT",
+						ProtocolLevel: mqtt.ProtocolLevel,
+						ClientID:      "client",
+						CleanSession:  true,
+						HasPassword:   password != "",
+						Password:      []byte(password),
+					}
+				}
+
+				dialMQTT(t, pubsubServer, connect("")).expect(&mqtt.Connack{ReturnCode: mqtt.RefusedNotAuthorized})
+				dialMQTT(t, pubsubServer, connect("wrong")).expect(&mqtt.Connack{ReturnCode: mqtt.RefusedBadUsernamePassword})
+				dialMQTT(t, pubsubServer, connect(jwtToken)).expect(&mqtt.Connack{ReturnCode: mqtt.Accepted})
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, tc.testFunc)
+	}
+}
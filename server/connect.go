@@ -0,0 +1,417 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/cpheps/coder-pub-sub/websocket"
+)
+
+// Command types sent by clients of Connect
+const (
+	commandSubscribe   = "subscribe"
+	commandUnsubscribe = "unsubscribe"
+	commandPublish     = "publish"
+	commandAck         = "ack"
+	commandPing        = "ping"
+)
+
+// Frame types sent to clients of Connect
+const (
+	frameOK        = "ok"
+	framePublished = "published"
+	frameMessage   = "message"
+	framePong      = "pong"
+	frameError     = "error"
+)
+
+// errConnectNextWriter is returned by connectSubscription.NextWriter as messages are written with WriteMessage
+var errConnectNextWriter = errors.New("connect subscriptions only support WriteMessage")
+
+// command is a JSON frame sent by a client of Connect. Fields that don't apply to its type are ignored.
+type command struct {
+	Type string `json:"type"`
+
+	// Ref is chosen by the client and echoed in the reply so replies can be matched to commands
+	Ref string `json:"ref,omitempty"`
+
+	// Sid is chosen by the client to name a subscription, messages for it are tagged with it
+	Sid string `json:"sid,omitempty"`
+
+	// Topic is the pattern to subscribe to or the topic to publish to
+	Topic string `json:"topic,omitempty"`
+
+	// Subscribe settings, see parseSubscription
+	Since    *uint64 `json:"since,omitempty"`
+	Last     int     `json:"last,omitempty"`
+	Consumer string  `json:"consumer,omitempty"`
+	Group    string  `json:"group,omitempty"`
+	Ack      bool    `json:"ack,omitempty"`
+
+	// Publish payload, Encoding is base64 when Data holds a base64 encoded binary payload
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Encoding    string            `json:"encoding,omitempty"`
+	Data        string            `json:"data,omitempty"`
+
+	// Seq is the sequence number of the message to ack
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// connectFrame is a JSON frame sent to a client of Connect
+type connectFrame struct {
+	Type string `json:"type"`
+	Ref  string `json:"ref,omitempty"`
+	Sid  string `json:"sid,omitempty"`
+
+	// Error describes why a command failed
+	Error string `json:"error,omitempty"`
+
+	// Result summarizes the delivery of a published message
+	Result *publishResponse `json:"result,omitempty"`
+
+	// Message is a message for the subscription Sid encoded in the envelope format
+	Message json.RawMessage `json:"message,omitempty"`
+}
+
+// Connect opens a websocket that publishes and manages subscriptions with JSON commands rather than
+// subscribing to a single topic like RegisterSubscriber. Every command gets a reply, an error frame if it failed.
+//
+//	{"type":"subscribe","sid":"1","topic":"orders.*"}           optionally with since, last, consumer, group and ack
+//	{"type":"unsubscribe","sid":"1"}
+//	{"type":"publish","topic":"orders.created","data":"hello"}  optionally with contentType, headers and encoding
+//	{"type":"ack","sid":"1","seq":42}
+//	{"type":"ping"}
+//
+// Messages are sent as {"type":"message","sid":"1","message":{...}} with the message in the envelope format.
+func (s *PubSubServer) Connect(w http.ResponseWriter, r *http.Request) {
+	log.Println("Opening a command connection")
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Error while upgrading connection to websocket", err)
+		s.writeResponse(w, http.StatusInternalServerError, &errorResponse{
+			Message: "Internal Error",
+		})
+		return
+	}
+
+	session := &connectSession{
+		server: s,
+		conn:   conn,
+		subs:   make(map[string]*connectSubscription),
+	}
+
+	// Subscriptions are unregistered before the socket is closed so a dead socket doesn't fail later publishes
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Println("Error while closing websocket", err)
+		}
+	}()
+	defer session.unsubscribeAll()
+
+	// Block until the server closes or the client goes away, handling commands as they arrive
+	for {
+		select {
+		case <-s.doneChan:
+			return
+		case <-conn.Done():
+			log.Println("Command connection", conn.ID(), "disconnected")
+			return
+		case frame := <-conn.Incoming():
+			session.handle(r.Context(), frame)
+		}
+	}
+}
+
+// connectSession is the state of a websocket opened with Connect
+type connectSession struct {
+	server *PubSubServer
+	conn   websocket.WebsocketConnection
+
+	// subs are the subscriptions by sid, only touched by the goroutine running Connect
+	subs map[string]*connectSubscription
+}
+
+// handle runs a single command frame and replies to it
+func (cs *connectSession) handle(ctx context.Context, frame []byte) {
+	var cmd command
+	if err := json.Unmarshal(frame, &cmd); err != nil {
+		cs.write(&connectFrame{
+			Type:  frameError,
+			Error: fmt.Sprintf("malformed command: %s", err),
+		})
+		return
+	}
+
+	reply, err := cs.run(ctx, &cmd)
+	if err != nil {
+		reply = &connectFrame{
+			Type:  frameError,
+			Sid:   cmd.Sid,
+			Error: err.Error(),
+		}
+	}
+
+	reply.Ref = cmd.Ref
+	cs.write(reply)
+}
+
+// run runs cmd and returns the frame to reply with
+func (cs *connectSession) run(ctx context.Context, cmd *command) (*connectFrame, error) {
+	switch cmd.Type {
+	case commandSubscribe:
+		if err := cs.subscribe(ctx, cmd); err != nil {
+			return nil, err
+		}
+		return &connectFrame{Type: frameOK, Sid: cmd.Sid}, nil
+	case commandUnsubscribe:
+		if err := cs.unsubscribe(cmd); err != nil {
+			return nil, err
+		}
+		return &connectFrame{Type: frameOK, Sid: cmd.Sid}, nil
+	case commandPublish:
+		result, err := cs.publish(ctx, cmd)
+		if err != nil {
+			return nil, err
+		}
+		return &connectFrame{Type: framePublished, Result: result}, nil
+	case commandAck:
+		if err := cs.ack(cmd); err != nil {
+			return nil, err
+		}
+		return &connectFrame{Type: frameOK, Sid: cmd.Sid}, nil
+	case commandPing:
+		return &connectFrame{Type: framePong}, nil
+	case "":
+		return nil, errors.New("command is missing type")
+	default:
+		return nil, fmt.Errorf("unknown command type %q", cmd.Type)
+	}
+}
+
+// subscribe registers a subscription named by the command's sid
+func (cs *connectSession) subscribe(ctx context.Context, cmd *command) error {
+	if cmd.Sid == "" {
+		return errors.New("subscribe is missing sid")
+	}
+
+	if _, ok := cs.subs[cmd.Sid]; ok {
+		return fmt.Errorf("sid %q is already in use", cmd.Sid)
+	}
+
+	if err := websocket.ValidatePattern(cmd.Topic); err != nil {
+		return err
+	}
+
+	if err := cs.server.authorize(ctx, ActionSubscribe, cmd.Topic); err != nil {
+		return err
+	}
+
+	if cmd.Last < 0 {
+		return fmt.Errorf("last must be a positive number: %d", cmd.Last)
+	}
+
+	var replay *websocket.Replay
+	if cmd.Since != nil || cmd.Last > 0 {
+		replay = &websocket.Replay{
+			Last: cmd.Last,
+		}
+		if cmd.Since != nil {
+			replay.Since = *cmd.Since
+		}
+	}
+
+	var ack *websocket.AckConfig
+	if cmd.Ack {
+		config := cs.server.ack
+		ack = &config
+	}
+
+	sub := &connectSubscription{
+		id:   randomHex(8),
+		sid:  cmd.Sid,
+		conn: cs.conn,
+	}
+
+	log.Println("Registering command connection", cs.conn.ID(), "to topic", cmd.Topic)
+	err := cs.server.broadcaster.RegisterConnection(websocket.Subscription{
+		Pattern:  cmd.Topic,
+		Format:   websocket.FormatEnvelope,
+		Replay:   replay,
+		Consumer: scopeConsumer(identityOwner(IdentityFromContext(ctx)), cmd.Consumer),
+		Ack:      ack,
+		Group:    cmd.Group,
+	}, sub)
+	if err != nil {
+		log.Println("Error while registering command connection", err)
+		return errors.New("internal error")
+	}
+
+	cs.subs[cmd.Sid] = sub
+	return nil
+}
+
+// unsubscribe removes the subscription named by the command's sid
+func (cs *connectSession) unsubscribe(cmd *command) error {
+	sub, err := cs.subscription(cmd)
+	if err != nil {
+		return err
+	}
+
+	delete(cs.subs, cmd.Sid)
+	cs.server.broadcaster.UnregisterConnection(sub)
+	return nil
+}
+
+// unsubscribeAll removes every subscription of the session
+func (cs *connectSession) unsubscribeAll() {
+	for sid, sub := range cs.subs {
+		delete(cs.subs, sid)
+		cs.server.broadcaster.UnregisterConnection(sub)
+	}
+}
+
+// publish broadcasts the message carried by the command
+func (cs *connectSession) publish(ctx context.Context, cmd *command) (*publishResponse, error) {
+	if err := websocket.ValidateTopic(cmd.Topic); err != nil {
+		return nil, err
+	}
+
+	if err := cs.server.authorize(ctx, ActionPublish, cmd.Topic); err != nil {
+		return nil, err
+	}
+
+	data := []byte(cmd.Data)
+	switch cmd.Encoding {
+	case "":
+	case "base64":
+		decoded, err := base64.StdEncoding.DecodeString(cmd.Data)
+		if err != nil {
+			return nil, fmt.Errorf("data is not valid base64: %w", err)
+		}
+		data = decoded
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", cmd.Encoding)
+	}
+
+	message, err := newMessage(cmd.Topic, cmd.ContentType, cmd.Headers, data)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("Publising message to topic", cmd.Topic, "from command connection", cs.conn.ID())
+	result, err := cs.server.broadcaster.Broadcast(ctx, message)
+	if err != nil {
+		log.Println("Error while broadcasting message", err)
+		return nil, errors.New("internal error")
+	}
+
+	return newPublishResponse(message, result), nil
+}
+
+// ack acks a message written to the subscription named by the command's sid
+func (cs *connectSession) ack(cmd *command) error {
+	sub, err := cs.subscription(cmd)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Seq == 0 {
+		return errors.New("ack is missing seq")
+	}
+
+	return cs.server.broadcaster.Ack(sub, cmd.Seq)
+}
+
+// subscription returns the subscription named by the command's sid
+func (cs *connectSession) subscription(cmd *command) (*connectSubscription, error) {
+	if cmd.Sid == "" {
+		return nil, fmt.Errorf("%s is missing sid", cmd.Type)
+	}
+
+	sub, ok := cs.subs[cmd.Sid]
+	if !ok {
+		return nil, fmt.Errorf("unknown sid %q", cmd.Sid)
+	}
+	return sub, nil
+}
+
+// write sends a frame to the client, a failure is only logged as it leaves the connection done
+func (cs *connectSession) write(frame *connectFrame) {
+	if err := writeConnectFrame(cs.conn, frame); err != nil {
+		log.Println("Error while writing to command connection", cs.conn.ID(), err)
+	}
+}
+
+// writeConnectFrame sends frame as a single text frame on conn
+func writeConnectFrame(conn websocket.WebsocketConnection, frame *connectFrame) error {
+	payload, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+
+	writer, err := conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+
+	if _, err := writer.Write(payload); err != nil {
+		writer.Close()
+		return err
+	}
+
+	return writer.Close()
+}
+
+var (
+	_ (websocket.WebsocketConnection) = (*connectSubscription)(nil)
+	_ (websocket.MessageWriter)       = (*connectSubscription)(nil)
+)
+
+// connectSubscription is a subscription of a command connection.
+// Each one is registered with the broadcaster on its own so it can be unsubscribed and acked separately.
+type connectSubscription struct {
+	id   string
+	sid  string
+	conn websocket.WebsocketConnection
+}
+
+// WriteMessage writes msg as a message frame tagged with the subscription's sid, it is always in the envelope format
+func (sub *connectSubscription) WriteMessage(msg *websocket.Message, _ websocket.Format) error {
+	return writeConnectFrame(sub.conn, &connectFrame{
+		Type:    frameMessage,
+		Sid:     sub.sid,
+		Message: msg.Encode(websocket.FormatEnvelope),
+	})
+}
+
+// ID returns an identifier unique to this subscription
+func (sub *connectSubscription) ID() string {
+	return sub.id
+}
+
+// NextWriter is not supported, messages are written with WriteMessage
+func (sub *connectSubscription) NextWriter(websocket.MessageType) (io.WriteCloser, error) {
+	return nil, errConnectNextWriter
+}
+
+// Done returns a channel that is closed once the websocket is closed
+func (sub *connectSubscription) Done() <-chan struct{} {
+	return sub.conn.Done()
+}
+
+// Incoming returns nil as Connect reads commands from the websocket itself
+func (sub *connectSubscription) Incoming() <-chan []byte {
+	return nil
+}
+
+// Close closes the whole websocket, a subscription failing to write means the client is gone or too slow
+func (sub *connectSubscription) Close() error {
+	return sub.conn.Close()
+}
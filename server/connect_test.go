@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	gwebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectClient is a client of the websocket command protocol for tests
+type connectClient struct {
+	t    *testing.T
+	conn *gwebsocket.Conn
+}
+
+// receivedFrame is a frame received by a connectClient
+type receivedFrame struct {
+	Type    string           `json:"type"`
+	Ref     string           `json:"ref"`
+	Sid     string           `json:"sid"`
+	Error   string           `json:"error"`
+	Result  *publishResponse `json:"result"`
+	Message *struct {
+		Seq         uint64            `json:"seq"`
+		Topic       string            `json:"topic"`
+		ContentType string            `json:"contentType"`
+		Headers     map[string]string `json:"headers"`
+		Attempt     int               `json:"attempt"`
+		Encoding    string            `json:"encoding"`
+		Data        string            `json:"data"`
+	} `json:"message"`
+}
+
+// dialConnect opens a command connection to the server at baseURL
+func dialConnect(t *testing.T, baseURL string) *connectClient {
+	conn, _, err := gwebsocket.DefaultDialer.Dial(strings.Replace(baseURL, "http://", "ws://", 1)+"/connect", nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return &connectClient{t: t, conn: conn}
+}
+
+// send writes a raw text frame
+func (c *connectClient) send(frame string) {
+	require.NoError(c.t, c.conn.WriteMessage(gwebsocket.TextMessage, []byte(frame)))
+}
+
+// read reads the next frame
+func (c *connectClient) read() *receivedFrame {
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	messageType, data, err := c.conn.ReadMessage()
+	require.NoError(c.t, err)
+	assert.Equal(c.t, gwebsocket.TextMessage, messageType)
+
+	var frame receivedFrame
+	require.NoError(c.t, json.Unmarshal(data, &frame), string(data))
+	return &frame
+}
+
+// command sends frame and reads the reply, which must not be an error
+func (c *connectClient) command(frame string) *receivedFrame {
+	c.send(frame)
+	reply := c.read()
+	require.NotEqual(c.t, frameError, reply.Type, reply.Error)
+	return reply
+}
+
+func Test_PubSubServer_Connect(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			desc: "Ping",
+			testFunc: func(t *testing.T) {
+				_, baseURL := startServer(t)
+				client := dialConnect(t, baseURL)
+
+				reply := client.command(`{"type":"ping","ref":"a"}`)
+				assert.Equal(t, framePong, reply.Type)
+				assert.Equal(t, "a", reply.Ref)
+			},
+		},
+		{
+			desc: "Every command is answered when sent faster than handled",
+			testFunc: func(t *testing.T) {
+				_, baseURL := startServer(t)
+				client := dialConnect(t, baseURL)
+
+				// More commands than the connection buffers, none may be lost
+				const commands = 200
+				for i := 0; i < commands; i++ {
+					client.send(fmt.Sprintf(`{"type":"ping","ref":"%d"}`, i))
+				}
+
+				for i := 0; i < commands; i++ {
+					reply := client.read()
+					assert.Equal(t, framePong, reply.Type)
+					assert.Equal(t, fmt.Sprint(i), reply.Ref)
+				}
+			},
+		},
+		{
+			desc: "Publish and subscribe on one socket",
+			testFunc: func(t *testing.T) {
+				_, baseURL := startServer(t)
+				client := dialConnect(t, baseURL)
+
+				reply := client.command(`{"type":"subscribe","ref":"1","sid":"orders","topic":"orders.*"}`)
+				assert.Equal(t, frameOK, reply.Type)
+				assert.Equal(t, "1", reply.Ref)
+				assert.Equal(t, "orders", reply.Sid)
+
+				client.command(`{"type":"subscribe","sid":"created","topic":"orders.created"}`)
+
+				client.send(`{"type":"publish","ref":"2","topic":"orders.created","data":"hello","headers":{"Order-Id":"1"}}`)
+
+				// The reply and messages are written concurrently so may arrive in any order
+				var published *receivedFrame
+				messages := map[string]*receivedFrame{}
+				for i := 0; i < 3; i++ {
+					frame := client.read()
+					switch frame.Type {
+					case framePublished:
+						published = frame
+					case frameMessage:
+						messages[frame.Sid] = frame
+					default:
+						t.Fatalf("unexpected frame %+v", frame)
+					}
+				}
+
+				require.NotNil(t, published)
+				assert.Equal(t, "2", published.Ref)
+				assert.Equal(t, 2, published.Result.Delivered)
+
+				require.Len(t, messages, 2)
+				for _, sid := range []string{"orders", "created"} {
+					msg := messages[sid].Message
+					require.NotNil(t, msg)
+					assert.Equal(t, published.Result.Seq, msg.Seq)
+					assert.Equal(t, "orders.created", msg.Topic)
+					assert.Equal(t, "hello", msg.Data)
+					assert.Equal(t, map[string]string{"Order-Id": "1"}, msg.Headers)
+				}
+
+				client.command(`{"type":"unsubscribe","sid":"created"}`)
+
+				client.send(`{"type":"publish","topic":"orders.shipped","contentType":"application/octet-stream","encoding":"base64","data":"AAEC"}`)
+				var message *receivedFrame
+				for i := 0; i < 2; i++ {
+					if frame := client.read(); frame.Type == frameMessage {
+						message = frame
+					}
+				}
+
+				require.NotNil(t, message)
+				assert.Equal(t, "orders", message.Sid)
+				assert.Equal(t, "base64", message.Message.Encoding)
+				assert.Equal(t, "AAEC", message.Message.Data)
+			},
+		},
+		{
+			desc: "Shares topics with HTTP",
+			testFunc: func(t *testing.T) {
+				_, baseURL := startServer(t)
+				client := dialConnect(t, baseURL)
+
+				client.command(`{"type":"subscribe","sid":"1","topic":"orders","group":"workers"}`)
+
+				resp, err := http.Post(baseURL+"/publish/orders", "text/plain", bytes.NewBufferString("from http"))
+				require.NoError(t, err)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+				frame := client.read()
+				assert.Equal(t, frameMessage, frame.Type)
+				assert.Equal(t, "from http", frame.Message.Data)
+			},
+		},
+		{
+			desc: "Replay and ack",
+			testFunc: func(t *testing.T) {
+				_, baseURL := startServer(t, func(o *Options) { o.Ack.VisibilityTimeout = 100 * time.Millisecond })
+				client := dialConnect(t, baseURL)
+
+				resp, err := http.Post(baseURL+"/publish/orders", "text/plain", bytes.NewBufferString("hello"))
+				require.NoError(t, err)
+				resp.Body.Close()
+
+				client.send(`{"type":"subscribe","sid":"1","topic":"orders","since":0,"ack":true}`)
+
+				var message *receivedFrame
+				for i := 0; i < 2; i++ {
+					if frame := client.read(); frame.Type == frameMessage {
+						message = frame
+					}
+				}
+				require.NotNil(t, message)
+				assert.Equal(t, 1, message.Message.Attempt)
+
+				// Unacked messages are redelivered
+				frame := client.read()
+				assert.Equal(t, frameMessage, frame.Type)
+				assert.Equal(t, 2, frame.Message.Attempt)
+
+				client.command(`{"type":"ack","sid":"1","seq":1}`)
+
+				client.send(`{"type":"ack","sid":"1","seq":1}`)
+				assert.Equal(t, frameError, client.read().Type)
+			},
+		},
+		{
+			desc: "Command errors",
+			testFunc: func(t *testing.T) {
+				_, baseURL := startServer(t)
+				client := dialConnect(t, baseURL)
+
+				failures := map[string]string{
+					`not json`:                              "malformed command: invalid character 'o' in literal null (expecting 'u')",
+					`{}`:                                    "command is missing type",
+					`{"type":"hello","ref":"1"}`:            `unknown command type "hello"`,
+					`{"type":"subscribe","topic":"orders"}`: "subscribe is missing sid",
+					`{"type":"subscribe","sid":"1","topic":"orders..new"}`:                          "",
+					`{"type":"unsubscribe","sid":"2"}`:                                              `unknown sid "2"`,
+					`{"type":"ack","seq":1}`:                                                        "ack is missing sid",
+					`{"type":"publish","topic":"orders.*"}`:                                         "",
+					`{"type":"publish","topic":"orders","encoding":"hex"}`:                          `unknown encoding "hex"`,
+					`{"type":"publish","topic":"orders","contentType":"text/plain;charset=latin1"}`: "",
+				}
+
+				for command, expected := range failures {
+					client.send(command)
+					reply := client.read()
+					assert.Equal(t, frameError, reply.Type, command)
+					if expected != "" {
+						assert.Equal(t, expected, reply.Error, command)
+					} else {
+						assert.NotEmpty(t, reply.Error, command)
+					}
+				}
+
+				client.command(`{"type":"subscribe","sid":"1","topic":"orders"}`)
+				client.send(`{"type":"subscribe","sid":"1","topic":"billing"}`)
+				reply := client.read()
+				assert.Equal(t, frameError, reply.Type)
+				assert.Equal(t, `sid "1" is already in use`, reply.Error)
+
+				// The connection carries on after command errors
+				assert.Equal(t, framePong, client.command(`{"type":"ping"}`).Type)
+			},
+		},
+		{
+			desc: "Close disconnects clients",
+			testFunc: func(t *testing.T) {
+				pubsubServer, baseURL := startServer(t)
+				client := dialConnect(t, baseURL)
+
+				client.command(`{"type":"ping"}`)
+				require.NoError(t, pubsubServer.Close())
+
+				client.conn.SetReadDeadline(time.Now().Add(time.Second))
+				_, _, err := client.conn.ReadMessage()
+				assert.Error(t, err)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, tc.testFunc)
+	}
+}
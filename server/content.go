@@ -0,0 +1,93 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cpheps/coder-pub-sub/websocket"
+)
+
+// defaultContentType is assumed for a publish without a Content-Type header
+const defaultContentType = "text/plain; charset=utf-8"
+
+// textMediaTypes are non text/* media types whose payloads are text
+var textMediaTypes = map[string]struct{}{
+	"application/json":                  {},
+	"application/xml":                   {},
+	"application/javascript":            {},
+	"application/x-ndjson":              {},
+	"application/x-www-form-urlencoded": {},
+}
+
+// errUnsupportedMediaType is returned when a Content-Type can't be delivered to subscribers
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// errInvalidUTF8 is returned when a text payload is not valid UTF-8
+var errInvalidUTF8 = errors.New("text payload is not valid UTF-8")
+
+// newMessage creates a message to publish data to topic. An empty contentType is the defaultContentType.
+// Returns an error wrapping errUnsupportedMediaType or errInvalidUTF8 if the payload can't be delivered.
+func newMessage(topic, contentType string, headers map[string]string, data []byte) (*websocket.Message, error) {
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+
+	// Text payloads are sent as text frames which must be UTF-8, anything else is sent as binary frames
+	messageType, err := messageTypeFor(contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	if messageType == websocket.TextMessage && !utf8.Valid(data) {
+		return nil, errInvalidUTF8
+	}
+
+	return &websocket.Message{
+		ID:          websocket.NewMessageID(),
+		Timestamp:   time.Now().UTC(),
+		Headers:     headers,
+		Topic:       topic,
+		Type:        messageType,
+		ContentType: contentType,
+		Data:        data,
+	}, nil
+}
+
+// messageTypeFor maps a Content-Type to the websocket message type used to deliver it.
+// Text media types are sent as TextMessage and everything else as BinaryMessage.
+// Text is only accepted in UTF-8 as that is all a websocket text frame may carry.
+func messageTypeFor(contentType string) (websocket.MessageType, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", errUnsupportedMediaType, err)
+	}
+
+	if !isTextMediaType(mediaType) {
+		return websocket.BinaryMessage, nil
+	}
+
+	// ASCII is a subset of UTF-8 so it is safe to pass along as well
+	if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") && !strings.EqualFold(charset, "us-ascii") {
+		return 0, fmt.Errorf("%w: charset %q, text must be UTF-8", errUnsupportedMediaType, charset)
+	}
+
+	return websocket.TextMessage, nil
+}
+
+// isTextMediaType returns true if the media type is textual
+func isTextMediaType(mediaType string) bool {
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+
+	if strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+
+	_, ok := textMediaTypes[mediaType]
+	return ok
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/cpheps/coder-pub-sub/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_messageTypeFor(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		contentType string
+		expected    websocket.MessageType
+		expectedErr error
+	}{
+		{
+			desc:        "Default content type",
+			contentType: defaultContentType,
+			expected:    websocket.TextMessage,
+		},
+		{
+			desc:        "Form data sent by curl -d",
+			contentType: "application/x-www-form-urlencoded",
+			expected:    websocket.TextMessage,
+		},
+		{
+			desc:        "JSON",
+			contentType: "application/json",
+			expected:    websocket.TextMessage,
+		},
+		{
+			desc:        "Structured syntax suffix",
+			contentType: "application/cloudevents+json",
+			expected:    websocket.TextMessage,
+		},
+		{
+			desc:        "ASCII text",
+			contentType: "text/csv; charset=US-ASCII",
+			expected:    websocket.TextMessage,
+		},
+		{
+			desc:        "Protobuf",
+			contentType: "application/x-protobuf",
+			expected:    websocket.BinaryMessage,
+		},
+		{
+			desc:        "CBOR",
+			contentType: "application/cbor",
+			expected:    websocket.BinaryMessage,
+		},
+		{
+			desc:        "Non UTF-8 text",
+			contentType: "text/plain; charset=utf-16",
+			expectedErr: errUnsupportedMediaType,
+		},
+		{
+			desc:        "Malformed",
+			contentType: "text/",
+			expectedErr: errUnsupportedMediaType,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			actual, err := messageTypeFor(tc.contentType)
+
+			if tc.expectedErr == nil {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.expected, actual)
+			} else {
+				assert.ErrorIs(t, err, tc.expectedErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AnyOrigin in AllowedOrigins allows every origin
+const AnyOrigin = "*"
+
+// corsMethods are the methods preflight requests may ask for
+const corsMethods = "GET, POST, DELETE"
+
+// CORSConfig lets browser apps served from other origins open websockets and call the HTTP endpoints
+type CORSConfig struct {
+	// AllowedOrigins are origins such as https://dashboard.example.org. AnyOrigin allows every origin and
+	// https://*.example.org any subdomain. Browsers may only open websockets from the server's own origin when empty.
+	AllowedOrigins []string
+
+	// MaxAge is how long browsers may cache the answer to a preflight request
+	MaxAge time.Duration
+}
+
+// DefaultCORSConfig returns a CORSConfig allowing no other origins
+func DefaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		MaxAge: 10 * time.Minute,
+	}
+}
+
+// Validate checks every allowed origin is a scheme and host
+func (cc CORSConfig) Validate() error {
+	for _, origin := range cc.AllowedOrigins {
+		if origin == AnyOrigin {
+			continue
+		}
+
+		u, err := url.Parse(strings.Replace(origin, "*.", "", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+			return fmt.Errorf("allowed origin %q must be %s or a scheme and host such as https://example.org", origin, AnyOrigin)
+		}
+
+		if strings.Contains(origin, "*") && !strings.HasPrefix(origin, u.Scheme+"://*.") {
+			return fmt.Errorf("allowed origin %q may only use * for subdomains such as https://*.example.org", origin)
+		}
+	}
+
+	if cc.MaxAge < 0 {
+		return errors.New("max age must not be negative")
+	}
+
+	return nil
+}
+
+// allowsOrigin reports whether origin is one of the allowed origins
+func (cc CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range cc.AllowedOrigins {
+		if allowed == AnyOrigin || strings.EqualFold(allowed, origin) {
+			return true
+		}
+
+		// https://*.example.org matches https://a.example.org and https://a.b.example.org but not https://example.org
+		i := strings.Index(allowed, "*.")
+		if i < 0 {
+			continue
+		}
+
+		prefix, suffix := allowed[:i], allowed[i+1:]
+		if len(origin) <= len(prefix)+len(suffix) || !strings.EqualFold(origin[:len(prefix)], prefix) || !strings.EqualFold(origin[len(origin)-len(suffix):], suffix) {
+			continue
+		}
+
+		if subdomain := origin[len(prefix) : len(origin)-len(suffix)]; !strings.ContainsAny(subdomain, "/:@") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkOrigin is the websocket upgrader's origin check. Clients that aren't browsers send no Origin and are let through,
+// browsers must be on the server's own origin or an allowed one so other sites can't open websockets as their users.
+func (cc CORSConfig) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	if cc.allowsOrigin(origin) {
+		return true
+	}
+
+	log.Println("Rejecting websocket from origin", origin)
+	return false
+}
+
+// crossOrigin is middleware adding CORS headers to responses for allowed origins and answering their preflight requests,
+// which carry no token so must be answered before authentication
+func (s *PubSubServer) crossOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !s.cors.allowsOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The allowed origin is echoed rather than * so responses vary by it
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(s.cors.MaxAge.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Preflight answers OPTIONS requests crossOrigin didn't, which come from origins that aren't allowed
+func (s *PubSubServer) Preflight(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		log.Println("Rejecting request from origin", origin)
+		s.writeResponse(w, http.StatusForbidden, &errorResponse{
+			Message: fmt.Sprintf("origin %q is not allowed", origin),
+		})
+		return
+	}
+
+	w.Header().Set("Allow", corsMethods+", OPTIONS")
+	w.WriteHeader(http.StatusNoContent)
+}
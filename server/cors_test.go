@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	gwebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_CORSConfig_Validate(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		origin   string
+		expected string
+	}{
+		{desc: "Any origin", origin: "*"},
+		{desc: "Origin", origin: "https://dashboard.example.org"},
+		{desc: "Origin with port", origin: "http://localhost:3000"},
+		{desc: "Subdomains", origin: "https://*.example.org"},
+		{
+			desc:     "Missing scheme",
+			origin:   "dashboard.example.org",
+			expected: `allowed origin "dashboard.example.org" must be * or a scheme and host such as https://example.org`,
+		},
+		{
+			desc:     "Path",
+			origin:   "https://example.org/app",
+			expected: `allowed origin "https://example.org/app" must be * or a scheme and host such as https://example.org`,
+		},
+		{
+			desc:     "Partial wildcard",
+			origin:   "https://dash*.example.org",
+			expected: `allowed origin "https://dash*.example.org" may only use * for subdomains such as https://*.example.org`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			config := DefaultCORSConfig()
+			config.AllowedOrigins = []string{tc.origin}
+
+			err := config.Validate()
+			if tc.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
+
+func Test_CORSConfig_allowsOrigin(t *testing.T) {
+	config := CORSConfig{AllowedOrigins: []string{"https://dashboard.example.org", "https://*.example.com"}}
+
+	testCases := []struct {
+		origin   string
+		expected bool
+	}{
+		{origin: "https://dashboard.example.org", expected: true},
+		{origin: "https://Dashboard.Example.org", expected: true},
+		{origin: "http://dashboard.example.org", expected: false},
+		{origin: "https://dashboard.example.org:8443", expected: false},
+		{origin: "https://evil.example.org", expected: false},
+		{origin: "https://a.example.com", expected: true},
+		{origin: "https://a.b.example.com", expected: true},
+		{origin: "https://example.com", expected: false},
+		{origin: "https://.example.com", expected: false},
+		{origin: "https://evil.org/.example.com", expected: false},
+		{origin: "https://evilexample.com", expected: false},
+		{origin: "null", expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.origin, func(t *testing.T) {
+			assert.Equal(t, tc.expected, config.allowsOrigin(tc.origin))
+		})
+	}
+
+	assert.True(t, CORSConfig{AllowedOrigins: []string{AnyOrigin}}.allowsOrigin("https://anywhere.org"))
+	assert.False(t, DefaultCORSConfig().allowsOrigin("https://anywhere.org"))
+}
+
+func Test_PubSubServer_CORS(t *testing.T) {
+	const dashboard = "https://dashboard.example.org"
+
+	startCORSServer := func(t *testing.T) string {
+		_, baseURL := startServer(t, func(o *Options) {
+			o.CORS.AllowedOrigins = []string{dashboard}
+			o.CORS.MaxAge = time.Hour
+			o.Auth = &AuthConfig{APIKeysFile: writeAPIKeys(t)}
+		})
+		return baseURL
+	}
+
+	testCases := []struct {
+		desc     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			desc: "Websocket origin",
+			testFunc: func(t *testing.T) {
+				baseURL := startCORSServer(t)
+				wsURL := strings.Replace(baseURL, "http://", "ws://", 1) + "/subscribe/orders?access_token=" + testAPIKey
+
+				dial := func(origin string) (*http.Response, error) {
+					header := http.Header{}
+					if origin != "" {
+						header.Set("Origin", origin)
+					}
+
+					conn, resp, err := gwebsocket.DefaultDialer.Dial(wsURL, header)
+					if err == nil {
+						conn.Close()
+					}
+					return resp, err
+				}
+
+				// Clients that aren't browsers send no origin
+				_, err := dial("")
+				assert.NoError(t, err)
+
+				_, err = dial(baseURL)
+				assert.NoError(t, err, "same origin")
+
+				_, err = dial(dashboard)
+				assert.NoError(t, err)
+
+				resp, err := dial("https://evil.example.org")
+				require.Error(t, err)
+				assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+			},
+		},
+		{
+			desc: "Preflight",
+			testFunc: func(t *testing.T) {
+				baseURL := startCORSServer(t)
+
+				preflight := func(origin string) *http.Response {
+					req, err := http.NewRequest(http.MethodOptions, baseURL+"/publish/orders", nil)
+					require.NoError(t, err)
+					req.Header.Set("Origin", origin)
+					req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+					req.Header.Set("Access-Control-Request-Headers", "authorization, content-type")
+
+					resp, err := http.DefaultClient.Do(req)
+					require.NoError(t, err)
+					resp.Body.Close()
+					return resp
+				}
+
+				// Preflights carry no token so are answered before authentication
+				resp := preflight(dashboard)
+				assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+				assert.Equal(t, dashboard, resp.Header.Get("Access-Control-Allow-Origin"))
+				assert.Equal(t, corsMethods, resp.Header.Get("Access-Control-Allow-Methods"))
+				assert.Equal(t, "authorization, content-type", resp.Header.Get("Access-Control-Allow-Headers"))
+				assert.Equal(t, "3600", resp.Header.Get("Access-Control-Max-Age"))
+				assert.Contains(t, resp.Header.Values("Vary"), "Origin")
+
+				resp = preflight("https://evil.example.org")
+				assert.NotEqual(t, http.StatusNoContent, resp.StatusCode)
+				assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+			},
+		},
+		{
+			desc: "Publish",
+			testFunc: func(t *testing.T) {
+				baseURL := startCORSServer(t)
+
+				publish := func(origin string) *http.Response {
+					req, err := http.NewRequest(http.MethodPost, baseURL+"/publish/orders", bytes.NewBufferString("hello"))
+					require.NoError(t, err)
+					req.Header.Set("Origin", origin)
+					req.Header.Set("Authorization", "Bearer "+testAPIKey)
+
+					resp, err := http.DefaultClient.Do(req)
+					require.NoError(t, err)
+					resp.Body.Close()
+					return resp
+				}
+
+				resp := publish(dashboard)
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, dashboard, resp.Header.Get("Access-Control-Allow-Origin"))
+
+				// Without the header the browser hides the response from other origins
+				resp = publish("https://evil.example.org")
+				assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+			},
+		},
+		{
+			desc: "Preflight without allowed origins",
+			testFunc: func(t *testing.T) {
+				_, baseURL := startServer(t)
+
+				req, err := http.NewRequest(http.MethodOptions, baseURL+"/publish/orders", nil)
+				require.NoError(t, err)
+				req.Header.Set("Origin", dashboard)
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+				req, err = http.NewRequest(http.MethodOptions, baseURL+"/publish/orders", nil)
+				require.NoError(t, err)
+				resp, err = http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+				assert.Equal(t, corsMethods+", OPTIONS", resp.Header.Get("Allow"))
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, tc.testFunc)
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/cpheps/coder-pub-sub/websocket"
+)
+
+// lastEventIDHeader is sent by an EventSource reconnecting after the last event it received
+const lastEventIDHeader = "Last-Event-ID"
+
+// Events streams messages published to the topic patterns in the topic query parameters as Server-Sent Events.
+// Several topic parameters may be given to subscribe to more than one pattern with a single stream,
+// retained messages matching any of them are replayed once and in order so a resume never skips any.
+// Messages are encoded in the envelope format unless the format query parameter says otherwise.
+// A reconnecting client resumes after the message named by the Last-Event-ID header, or the lastEventId query
+// parameter for clients that can't set headers. The other optional query parameters are described by parseSubscription.
+func (s *PubSubServer) Events(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	patterns := query["topic"]
+	if len(patterns) == 0 {
+		log.Println("Rejecting event stream without a topic")
+		s.writeResponse(w, http.StatusBadRequest, &errorResponse{
+			Message: "at least one topic is required",
+		})
+		return
+	}
+
+	for _, pattern := range patterns {
+		if err := websocket.ValidatePattern(pattern); err != nil {
+			log.Println("Rejecting event stream", err)
+			s.writeResponse(w, http.StatusBadRequest, &errorResponse{
+				Message: err.Error(),
+			})
+			return
+		}
+
+		if err := s.authorize(r.Context(), ActionSubscribe, pattern); err != nil {
+			log.Println("Rejecting event stream", err)
+			s.writeResponse(w, http.StatusForbidden, &errorResponse{
+				Message: err.Error(),
+			})
+			return
+		}
+	}
+
+	sub, err := s.parseSubscription(r.Context(), query, websocket.FormatEnvelope)
+	if err != nil {
+		log.Println("Rejecting event stream", err)
+		s.writeResponse(w, http.StatusBadRequest, &errorResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+
+	// Acks travel over the websocket so an event stream can't send them
+	if sub.Ack != nil {
+		log.Println("Rejecting event stream asking for acks")
+		s.writeResponse(w, http.StatusBadRequest, &errorResponse{
+			Message: "ack is not supported by event streams",
+		})
+		return
+	}
+
+	lastEventID := r.Header.Get(lastEventIDHeader)
+	if lastEventID == "" {
+		lastEventID = query.Get("lastEventId")
+	}
+
+	if lastEventID != "" {
+		if sub.Replay == nil {
+			sub.Replay = &websocket.Replay{}
+		}
+		sub.Replay.AfterID = lastEventID
+	}
+
+	conn, err := websocket.NewSSEConn(w, r, s.keepalive)
+	if err != nil {
+		log.Println("Error while starting event stream", err)
+		s.writeResponse(w, http.StatusInternalServerError, &errorResponse{
+			Message: "Internal Error",
+		})
+		return
+	}
+
+	// The response can't be written once the handler returns
+	defer conn.Close()
+
+	log.Println("Registering an event stream to topics", patterns)
+	sub.Pattern = patterns[0]
+	sub.Patterns = patterns[1:]
+	if err := s.broadcaster.RegisterConnection(sub, conn); err != nil {
+		// The stream has started so ending it is the only way left to tell the client
+		log.Println("Error while registering event stream", err)
+		return
+	}
+
+	// Block until the server closes or the client goes away
+	select {
+	case <-s.doneChan:
+	case <-conn.Done():
+		log.Println("Event stream disconnected from topics", patterns)
+	}
+
+	s.broadcaster.UnregisterConnection(conn)
+}
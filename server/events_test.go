@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cpheps/coder-pub-sub/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_PubSubServer_Events(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			desc: "Missing topic",
+			testFunc: func(t *testing.T) {
+				mockBroadcaster := &websocket.MockBroadcaster{}
+				pubsubServer := &PubSubServer{
+					broadcaster: mockBroadcaster,
+				}
+
+				req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/events", http.NoBody).WithContext(context.Background())
+				w := httptest.NewRecorder()
+
+				pubsubServer.Events(w, req)
+
+				assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+				mockBroadcaster.AssertNotCalled(t, "RegisterConnection", mock.Anything, mock.Anything)
+			},
+		},
+		{
+			desc: "Invalid topic",
+			testFunc: func(t *testing.T) {
+				mockBroadcaster := &websocket.MockBroadcaster{}
+				pubsubServer := &PubSubServer{
+					broadcaster: mockBroadcaster,
+				}
+
+				req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/events?topic=orders&topic=orders.%3E.created", http.NoBody).WithContext(context.Background())
+				w := httptest.NewRecorder()
+
+				pubsubServer.Events(w, req)
+
+				assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+				mockBroadcaster.AssertNotCalled(t, "RegisterConnection", mock.Anything, mock.Anything)
+			},
+		},
+		{
+			desc: "Ack not supported",
+			testFunc: func(t *testing.T) {
+				mockBroadcaster := &websocket.MockBroadcaster{}
+				pubsubServer := &PubSubServer{
+					broadcaster: mockBroadcaster,
+					ack:         websocket.DefaultAckConfig(),
+				}
+
+				req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/events?topic=orders&ack=true", http.NoBody).WithContext(context.Background())
+				w := httptest.NewRecorder()
+
+				pubsubServer.Events(w, req)
+
+				assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+				mockBroadcaster.AssertNotCalled(t, "RegisterConnection", mock.Anything, mock.Anything)
+			},
+		},
+		{
+			desc: "Resume after Last-Event-ID",
+			testFunc: func(t *testing.T) {
+				expectedReplay := &websocket.Replay{AfterID: "abc"}
+
+				mockBroadcaster := &websocket.MockBroadcaster{}
+				// Both topics are registered together so they share a single replay
+				mockBroadcaster.On("RegisterConnection", websocket.Subscription{Pattern: "orders.*", Patterns: []string{"billing"}, Format: websocket.FormatEnvelope, Replay: expectedReplay}, mock.Anything).Return(nil).Once()
+				mockBroadcaster.On("UnregisterConnection", mock.Anything)
+
+				doneChan := make(chan struct{})
+				close(doneChan)
+
+				pubsubServer := &PubSubServer{
+					doneChan:    doneChan,
+					broadcaster: mockBroadcaster,
+				}
+
+				req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/events?topic=orders.*&topic=billing", http.NoBody).WithContext(context.Background())
+				req.Header.Set(lastEventIDHeader, "abc")
+				w := httptest.NewRecorder()
+
+				pubsubServer.Events(w, req)
+
+				assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+				assert.Equal(t, "text/event-stream", w.Result().Header.Get("Content-Type"))
+				mockBroadcaster.AssertExpectations(t)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, tc.testFunc)
+	}
+}
+
+func Test_PubSubServer_Events_StalledClient(t *testing.T) {
+	// Pings are rare and clients have long to answer so nothing but closing ends a blocked write
+	pubsubServer, baseURL := startServer(t, func(o *Options) {
+		o.Keepalive = websocket.KeepaliveConfig{PingInterval: time.Hour, PongTimeout: time.Hour}
+	})
+
+	// The client never reads the stream
+	client, err := net.Dial("tcp", strings.TrimPrefix(baseURL, "http://"))
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = fmt.Fprintf(client, "GET /events?topic=orders HTTP/1.1\r\nHost: %s\r\n\r\n", strings.TrimPrefix(baseURL, "http://"))
+	require.NoError(t, err)
+
+	publish := func() int {
+		resp, err := http.Post(baseURL+"/publish/orders", "text/plain", bytes.NewBufferString(strings.Repeat("a", 512<<10)))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var result publishResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return result.Delivered
+	}
+
+	// Wait for the stream to be registered then fill the socket buffers so its writes block
+	require.Eventually(t, func() bool { return publish() == 1 }, time.Second, 10*time.Millisecond)
+	for i := 0; i < 32; i++ {
+		publish()
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		pubsubServer.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server close waited on an event stream the client stopped reading")
+	}
+}
+
+func Test_PubSubServer_Events_ResumeTopics(t *testing.T) {
+	_, baseURL := startServer(t)
+
+	publish := func(topic, data string) *publishResponse {
+		resp, err := http.Post(baseURL+"/publish/"+topic, "text/plain", strings.NewReader(data))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var result publishResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return &result
+	}
+
+	first := publish("orders.created", "1")
+	publish("billing", "2")
+	publish("orders.created", "3")
+	publish("billing", "4")
+
+	// orders.* and orders.> overlap, billing is published between the orders
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/events?format=raw&topic=orders.*&topic=orders.%3E&topic=billing", nil)
+	require.NoError(t, err)
+	req.Header.Set(lastEventIDHeader, first.ID)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	events := make(chan string, 10)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() {
+				events <- data
+			}
+		}
+	}()
+
+	next := func() string {
+		select {
+		case data := <-events:
+			return data
+		case <-time.After(time.Second):
+			t.Fatal("no event received")
+			return ""
+		}
+	}
+
+	// Everything after the last event is replayed once and in the order it was published, then live messages follow
+	assert.Equal(t, "2", next())
+	assert.Equal(t, "3", next())
+	assert.Equal(t, "4", next())
+
+	require.Eventually(t, func() bool { return publish("orders.created", "5").Delivered == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "5", next())
+
+	select {
+	case data := <-events:
+		t.Fatalf("unexpected event %q", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
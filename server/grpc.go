@@ -0,0 +1,384 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/cpheps/coder-pub-sub/pubsubpb"
+	"github.com/cpheps/coder-pub-sub/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcMessageOverhead is allowed on top of the max payload for the rest of a PublishRequest such as its topic and headers
+const grpcMessageOverhead = 64 << 10
+
+// errGRPCNextWriter is returned by grpcSubscriber.NextWriter as messages are written with WriteMessage
+var errGRPCNextWriter = errors.New("grpc subscribers only support WriteMessage")
+
+// errGRPCClosed is returned when writing to a grpcSubscriber whose call has ended
+var errGRPCClosed = errors.New("grpc subscribe call has ended")
+
+// GRPCAddr returns the address the gRPC listener is bound to, nil if it isn't listening
+func (s *PubSubServer) GRPCAddr() net.Addr {
+	if s.grpc == nil {
+		return nil
+	}
+	return s.grpc.Addr()
+}
+
+var _ (pubsubpb.PubSubServer) = (*grpcService)(nil)
+
+// grpcService implements the gRPC PubSub service against the broadcaster of a PubSubServer
+type grpcService struct {
+	pubsubpb.UnimplementedPubSubServer
+
+	server *PubSubServer
+}
+
+// Publish publishes a message to all subscribers of its topic
+func (gs *grpcService) Publish(ctx context.Context, req *pubsubpb.PublishRequest) (*pubsubpb.PublishResponse, error) {
+	if err := websocket.ValidateTopic(req.Topic); err != nil {
+		log.Println("Rejecting gRPC publish", err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := gs.server.authorize(ctx, ActionPublish, req.Topic); err != nil {
+		log.Println("Rejecting gRPC publish", err)
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	if max := gs.server.maxPayload; max > 0 && len(req.Data) > max {
+		log.Println("Rejecting gRPC publish larger than", max, "bytes")
+		return nil, status.Errorf(codes.InvalidArgument, "payload is larger than the max of %d bytes", max)
+	}
+
+	message, err := newMessage(req.Topic, req.ContentType, req.Headers, req.Data)
+	if err != nil {
+		log.Println("Rejecting gRPC publish", err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	log.Println("Publising gRPC message to topic", req.Topic)
+	result, err := gs.server.broadcaster.Broadcast(ctx, message)
+	if err != nil {
+		log.Println("Error while broadcasting message", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	return &pubsubpb.PublishResponse{
+		Id:        message.ID,
+		Seq:       message.Seq,
+		Delivered: int32(result.Delivered),
+		Failed:    int32(result.Failed),
+		Skipped:   int32(result.Skipped),
+	}, nil
+}
+
+// Subscribe streams the messages published to a topic pattern until the client cancels the call,
+// the subscriber is evicted or the server closes
+func (gs *grpcService) Subscribe(req *pubsubpb.SubscribeRequest, stream pubsubpb.PubSub_SubscribeServer) error {
+	if err := websocket.ValidatePattern(req.Pattern); err != nil {
+		log.Println("Rejecting gRPC subscriber", err)
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := gs.server.authorize(stream.Context(), ActionSubscribe, req.Pattern); err != nil {
+		log.Println("Rejecting gRPC subscriber", err)
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	var replay *websocket.Replay
+	if req.Since != nil || req.Last > 0 {
+		replay = &websocket.Replay{
+			Since: req.GetSince(),
+			Last:  int(req.Last),
+		}
+	}
+
+	conn := newGRPCSubscriber(stream)
+
+	log.Println("Registering gRPC subscriber to topic", req.Pattern)
+	err := gs.server.broadcaster.RegisterConnection(websocket.Subscription{
+		Pattern:  req.Pattern,
+		Format:   websocket.FormatRaw,
+		Replay:   replay,
+		Consumer: scopeConsumer(identityOwner(IdentityFromContext(stream.Context())), req.Consumer),
+		Group:    req.Group,
+	}, conn)
+	if err != nil {
+		log.Println("Error while registering gRPC subscriber", err)
+		return status.Error(codes.Internal, "internal error")
+	}
+
+	// Unregister then stop writes before returning, the stream must not be used once the handler returns
+	defer conn.Close()
+	defer gs.server.broadcaster.UnregisterConnection(conn)
+
+	select {
+	case <-stream.Context().Done():
+		log.Println("gRPC subscriber disconnected from topic", req.Pattern)
+		return nil
+	case <-gs.server.doneChan:
+		return status.Error(codes.Unavailable, "server is closing")
+	case <-conn.Done():
+		return status.Error(codes.Unavailable, "subscriber could not keep up or failed to send")
+	}
+}
+
+var (
+	_ (websocket.WebsocketConnection) = (*grpcSubscriber)(nil)
+	_ (websocket.MessageWriter)       = (*grpcSubscriber)(nil)
+)
+
+// grpcSubscriber adapts the stream of a Subscribe call to a connection of the broadcaster
+type grpcSubscriber struct {
+	id     string
+	stream pubsubpb.PubSub_SubscribeServer
+
+	// mu serializes sends with Close so nothing is sent once the call has ended
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+// newGRPCSubscriber creates a grpcSubscriber sending to stream
+func newGRPCSubscriber(stream pubsubpb.PubSub_SubscribeServer) *grpcSubscriber {
+	return &grpcSubscriber{
+		id:     randomHex(8),
+		stream: stream,
+		done:   make(chan struct{}),
+	}
+}
+
+// WriteMessage sends msg on the stream, the format is ignored as messages are sent as protobuf
+func (sub *grpcSubscriber) WriteMessage(msg *websocket.Message, _ websocket.Format) error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.closed {
+		return errGRPCClosed
+	}
+
+	return sub.stream.Send(&pubsubpb.Message{
+		Id:          msg.ID,
+		Seq:         msg.Seq,
+		Timestamp:   timestamppb.New(msg.Timestamp),
+		Topic:       msg.Topic,
+		ContentType: msg.ContentType,
+		Headers:     msg.Headers,
+		Data:        msg.Data,
+	})
+}
+
+// ID returns an identifier unique to this subscriber
+func (sub *grpcSubscriber) ID() string {
+	return sub.id
+}
+
+// NextWriter is not supported, messages are written with WriteMessage
+func (sub *grpcSubscriber) NextWriter(websocket.MessageType) (io.WriteCloser, error) {
+	return nil, errGRPCNextWriter
+}
+
+// Done returns a channel that is closed once the subscriber is closed
+func (sub *grpcSubscriber) Done() <-chan struct{} {
+	return sub.done
+}
+
+// Incoming returns nil as gRPC subscribers send nothing after their request
+func (sub *grpcSubscriber) Incoming() <-chan []byte {
+	return nil
+}
+
+// Close stops sending to the stream and ends the Subscribe call, it may be called more than once
+func (sub *grpcSubscriber) Close() error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if !sub.closed {
+		sub.closed = true
+		close(sub.done)
+	}
+	return nil
+}
+
+// peerIdentity returns the identity proven by the TLS client certificate of a call, nil if there isn't one
+func peerIdentity(ctx context.Context) *Identity {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+	return tlsIdentity(&info.State)
+}
+
+// grpcAuthenticate returns the context of a call carrying the client's identity, proven by its TLS client certificate
+// or the bearer token in its authorization metadata. Fails with Unauthenticated if auth is required and neither is valid.
+func (s *PubSubServer) grpcAuthenticate(ctx context.Context) (context.Context, error) {
+	identity := peerIdentity(ctx)
+	if identity == nil && s.authRequired() {
+		var token string
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, value := range md.Get("authorization") {
+			if bearer, ok := bearerToken(value); ok {
+				token = bearer
+				break
+			}
+		}
+
+		var err error
+		identity, err = s.authenticateToken(ctx, token)
+		if err != nil {
+			log.Println("Rejecting unauthenticated gRPC call", err)
+			return nil, status.Error(codes.Unauthenticated, "authentication required")
+		}
+	}
+
+	if identity != nil {
+		ctx = ContextWithIdentity(ctx, identity)
+	}
+	return ctx, nil
+}
+
+// grpcUnaryInterceptor authenticates unary calls
+func (s *PubSubServer) grpcUnaryInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.grpcAuthenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// grpcStreamInterceptor authenticates streaming calls
+func (s *PubSubServer) grpcStreamInterceptor(srv interface{}, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.grpcAuthenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &identifiedStream{ServerStream: stream, ctx: ctx})
+}
+
+// identifiedStream is a grpc.ServerStream whose context carries the client's identity
+type identifiedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the context of the call
+func (is *identifiedStream) Context() context.Context {
+	return is.ctx
+}
+
+var _ (serverListener) = (*grpcListener)(nil)
+
+// grpcListener serves the gRPC service on its own address
+type grpcListener struct {
+	addr   string
+	server *grpc.Server
+
+	mu       sync.Mutex
+	listener net.Listener
+}
+
+// newGRPCListener creates a grpcListener serving s on addr, it does not listen until ListenAndServe is called.
+// Requests are limited to maxPayload plus room for the rest of the message, zero leaves gRPC's default limit.
+// Calls are served over TLS when tlsConfig isn't nil and are authenticated like HTTP requests.
+func newGRPCListener(addr string, maxPayload int, tlsConfig *tls.Config, s *PubSubServer) *grpcListener {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.grpcUnaryInterceptor),
+		grpc.StreamInterceptor(s.grpcStreamInterceptor),
+	}
+	if maxPayload > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(maxPayload+grpcMessageOverhead))
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	server := grpc.NewServer(opts...)
+	pubsubpb.RegisterPubSubServer(server, &grpcService{server: s})
+
+	return &grpcListener{
+		addr:   addr,
+		server: server,
+	}
+}
+
+// Addr returns the address the listener is bound to, nil if it isn't listening
+func (gl *grpcListener) Addr() net.Addr {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+
+	if gl.listener == nil {
+		return nil
+	}
+	return gl.listener.Addr()
+}
+
+// listen binds the listener, it fails if done is already closed
+func (gl *grpcListener) listen(done <-chan struct{}) error {
+	listener, err := net.Listen("tcp", gl.addr)
+	if err != nil {
+		return err
+	}
+
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+
+	select {
+	case <-done:
+		listener.Close()
+		return http.ErrServerClosed
+	default:
+	}
+
+	gl.listener = listener
+
+	log.Println("PubSub gRPC listening on", listener.Addr())
+	return nil
+}
+
+// unlisten releases a listener bound by listen when serve won't be called
+func (gl *grpcListener) unlisten() {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+
+	gl.listener.Close()
+	gl.listener = nil
+}
+
+// serve serves gRPC calls until done is closed.
+// Returns http.ErrServerClosed once closed, like the HTTP server, or the error that stopped it serving.
+func (gl *grpcListener) serve(done <-chan struct{}) error {
+	err := gl.server.Serve(gl.listener)
+
+	select {
+	case <-done:
+		return http.ErrServerClosed
+	default:
+	}
+
+	return err
+}
+
+// close stops accepting calls and waits for those in flight, done must be closed first so Subscribe calls return
+func (gl *grpcListener) close() error {
+	gl.server.GracefulStop()
+	return nil
+}
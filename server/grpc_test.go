@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cpheps/coder-pub-sub/pubsubpb"
+	gwebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// dialGRPC connects a PubSub client to the server's gRPC listener
+func dialGRPC(t *testing.T, pubsubServer *PubSubServer) pubsubpb.PubSubClient {
+	conn, err := grpc.Dial(pubsubServer.GRPCAddr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pubsubpb.NewPubSubClient(conn)
+}
+
+// recvGRPC receives the next message of a Subscribe stream
+func recvGRPC(t *testing.T, stream pubsubpb.PubSub_SubscribeClient) *pubsubpb.Message {
+	msg, err := stream.Recv()
+	require.NoError(t, err)
+	return msg
+}
+
+func Test_PubSubServer_GRPC(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			desc: "Publish and subscribe",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startServer(t, func(o *Options) { o.GRPCAddr = "127.0.0.1:0" })
+				client := dialGRPC(t, pubsubServer)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				first, err := client.Publish(ctx, &pubsubpb.PublishRequest{
+					Topic:   "orders.created",
+					Data:    []byte("hello"),
+					Headers: map[string]string{"Order-Id": "1"},
+				})
+				require.NoError(t, err)
+				assert.NotEmpty(t, first.Id)
+
+				// Replay the first message so it is known the subscription is registered before publishing live
+				stream, err := client.Subscribe(ctx, &pubsubpb.SubscribeRequest{
+					Pattern: "orders.*",
+					Since:   proto.Uint64(0),
+				})
+				require.NoError(t, err)
+
+				msg := recvGRPC(t, stream)
+				assert.Equal(t, first.Id, msg.Id)
+				assert.Equal(t, first.Seq, msg.Seq)
+				assert.Equal(t, "orders.created", msg.Topic)
+				assert.Equal(t, "text/plain; charset=utf-8", msg.ContentType)
+				assert.Equal(t, map[string]string{"Order-Id": "1"}, msg.Headers)
+				assert.Equal(t, []byte("hello"), msg.Data)
+				assert.False(t, msg.Timestamp.AsTime().IsZero())
+
+				second, err := client.Publish(ctx, &pubsubpb.PublishRequest{
+					Topic:       "orders.shipped",
+					Data:        []byte{0, 1, 2},
+					ContentType: "application/octet-stream",
+				})
+				require.NoError(t, err)
+				assert.Equal(t, int32(1), second.Delivered)
+
+				msg = recvGRPC(t, stream)
+				assert.Equal(t, second.Id, msg.Id)
+				assert.Equal(t, "application/octet-stream", msg.ContentType)
+				assert.Equal(t, []byte{0, 1, 2}, msg.Data)
+			},
+		},
+		{
+			desc: "Shares topics with HTTP and websockets",
+			testFunc: func(t *testing.T) {
+				pubsubServer, baseURL := startServer(t, func(o *Options) { o.GRPCAddr = "127.0.0.1:0" })
+				client := dialGRPC(t, pubsubServer)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				resp, err := http.Post(baseURL+"/publish/orders", "text/plain", bytes.NewBufferString("from http"))
+				require.NoError(t, err)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+				stream, err := client.Subscribe(ctx, &pubsubpb.SubscribeRequest{
+					Pattern: "orders",
+					Last:    1,
+				})
+				require.NoError(t, err)
+				assert.Equal(t, []byte("from http"), recvGRPC(t, stream).Data)
+
+				published, err := client.Publish(ctx, &pubsubpb.PublishRequest{
+					Topic: "orders",
+					Data:  []byte("from grpc"),
+				})
+				require.NoError(t, err)
+				assert.Equal(t, []byte("from grpc"), recvGRPC(t, stream).Data)
+
+				// A websocket subscriber replaying from before the gRPC publish receives it too
+				wsURL := strings.Replace(baseURL, "http://", "ws://", 1) + "/subscribe/orders?since=" + "1"
+				conn, _, err := gwebsocket.DefaultDialer.Dial(wsURL, nil)
+				require.NoError(t, err)
+				defer conn.Close()
+
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				_, data, err := conn.ReadMessage()
+				require.NoError(t, err)
+				assert.Equal(t, "from grpc", string(data))
+				assert.Equal(t, uint64(2), published.Seq)
+			},
+		},
+		{
+			desc: "Invalid requests",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startServer(t, func(o *Options) { o.GRPCAddr = "127.0.0.1:0" })
+				client := dialGRPC(t, pubsubServer)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				_, err := client.Publish(ctx, &pubsubpb.PublishRequest{Topic: "orders.*"})
+				assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+				_, err = client.Publish(ctx, &pubsubpb.PublishRequest{
+					Topic:       "orders",
+					Data:        []byte{0xff},
+					ContentType: "text/plain",
+				})
+				assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+				stream, err := client.Subscribe(ctx, &pubsubpb.SubscribeRequest{Pattern: "orders..created"})
+				require.NoError(t, err)
+				_, err = stream.Recv()
+				assert.Equal(t, codes.InvalidArgument, status.Code(err))
+			},
+		},
+		{
+			desc: "Close ends subscriptions",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startServer(t, func(o *Options) { o.GRPCAddr = "127.0.0.1:0" })
+				client := dialGRPC(t, pubsubServer)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				_, err := client.Publish(ctx, &pubsubpb.PublishRequest{Topic: "orders", Data: []byte("hello")})
+				require.NoError(t, err)
+
+				stream, err := client.Subscribe(ctx, &pubsubpb.SubscribeRequest{Pattern: "orders", Last: 1})
+				require.NoError(t, err)
+				recvGRPC(t, stream)
+
+				require.NoError(t, pubsubServer.Close())
+
+				_, err = stream.Recv()
+				assert.Equal(t, codes.Unavailable, status.Code(err))
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, tc.testFunc)
+	}
+}
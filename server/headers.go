@@ -0,0 +1,29 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// headerPrefix marks request headers that are passed on to subscribers as message headers.
+// Header keys are canonicalized so X-PubSub-Trace-Id is seen as X-Pubsub-Trace-Id.
+const headerPrefix = "X-Pubsub-"
+
+// messageHeaders returns the publisher supplied X-PubSub-* headers with the prefix removed.
+// Multiple values of a header are joined with a comma. Returns nil if there are none.
+func messageHeaders(header http.Header) map[string]string {
+	var headers map[string]string
+	for key, values := range header {
+		name := strings.TrimPrefix(http.CanonicalHeaderKey(key), headerPrefix)
+		if len(name) == len(key) || name == "" {
+			continue
+		}
+
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[name] = strings.Join(values, ", ")
+	}
+
+	return headers
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// IdentityClientCert is the Method of an identity proven by a verified TLS client certificate
+const IdentityClientCert = "client-cert"
+
+// tlsHandshakeTimeout is how long a client of a stream listener has to complete the TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// Identity is who a client proved to be, for authorization decisions about what it may publish and subscribe to
+type Identity struct {
+	// Subject names the client
+	Subject string
+
+	// Method is how the identity was proven, such as IdentityClientCert
+	Method string
+
+	// Claims are attributes of the identity rules can match on.
+	// Values are strings or lists of strings.
+	Claims map[string]interface{}
+}
+
+// identityKey is the context key of the Identity
+type identityKey struct{}
+
+// ContextWithIdentity returns a copy of ctx carrying identity
+func ContextWithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// identityOwner names identity as the owner of what it creates, such as webhooks and durable consumers.
+// The subject is escaped so an owner followed by a slash is never the start of another. Empty for anonymous clients.
+func identityOwner(identity *Identity) string {
+	if identity == nil {
+		return ""
+	}
+	return identity.Method + "/" + url.PathEscape(identity.Subject)
+}
+
+// scopeConsumer returns the name the durable consumer named by a client is stored under, scoped to the owner
+// of the client so it can't resume or commit the consumers of other identities. Empty if consumer is.
+func scopeConsumer(owner, consumer string) string {
+	if consumer == "" {
+		return ""
+	}
+	return owner + "/" + consumer
+}
+
+// IdentityFromContext returns the identity of the client making a request, nil for anonymous clients
+func IdentityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// certificateIdentity returns the identity proven by a verified client certificate.
+// The subject is the common name, falling back to the first URI or DNS name for certificates that only have SANs.
+func certificateIdentity(cert *x509.Certificate) *Identity {
+	uris := make([]string, 0, len(cert.URIs))
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+
+	subject := cert.Subject.CommonName
+	switch {
+	case subject != "":
+	case len(uris) > 0:
+		subject = uris[0]
+	case len(cert.DNSNames) > 0:
+		subject = cert.DNSNames[0]
+	}
+
+	return &Identity{
+		Subject: subject,
+		Method:  IdentityClientCert,
+		Claims: map[string]interface{}{
+			"cn":    cert.Subject.CommonName,
+			"o":     cert.Subject.Organization,
+			"ou":    cert.Subject.OrganizationalUnit,
+			"dns":   cert.DNSNames,
+			"uri":   uris,
+			"email": cert.EmailAddresses,
+		},
+	}
+}
+
+// tlsIdentity returns the identity of the client of a TLS connection, nil if it didn't present a certificate.
+// Certificates are verified during the handshake so any certificate of a completed handshake is trusted.
+func tlsIdentity(state *tls.ConnectionState) *Identity {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return certificateIdentity(state.PeerCertificates[0])
+}
+
+// handshake completes the TLS handshake of a conn accepted by a stream listener and returns the client's identity.
+// Plaintext connections are anonymous.
+func handshake(conn net.Conn) (*Identity, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	state := tlsConn.ConnectionState()
+	return tlsIdentity(&state), nil
+}
+
+// identify is middleware adding the identity proven by the client's TLS certificate to the request context
+func (s *PubSubServer) identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identity := tlsIdentity(r.TLS); identity != nil {
+			r = r.WithContext(ContextWithIdentity(r.Context(), identity))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
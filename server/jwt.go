@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// JWT signing algorithms that are accepted
+const (
+	jwtHS256 = "HS256"
+	jwtRS256 = "RS256"
+)
+
+// JWTConfig verifies JWT bearer tokens against the keys of a local JWKS file
+type JWTConfig struct {
+	// JWKSFile holds a JSON Web Key Set. RSA keys verify RS256 tokens and oct keys, holding a shared secret, verify HS256 tokens.
+	JWKSFile string
+
+	// Issuer, if set, must match the iss claim of tokens
+	Issuer string
+
+	// Audience, if set, must be one of the aud claim of tokens
+	Audience string
+
+	// Leeway allows for clock skew when checking the exp and nbf claims
+	Leeway time.Duration
+}
+
+// DefaultJWTConfig returns a JWTConfig using the keys in jwksFile
+func DefaultJWTConfig(jwksFile string) JWTConfig {
+	return JWTConfig{
+		JWKSFile: jwksFile,
+		Leeway:   30 * time.Second,
+	}
+}
+
+// Validate checks the JWTConfig is usable
+func (jc JWTConfig) Validate() error {
+	if jc.JWKSFile == "" {
+		return errors.New("jwt jwks file must be set")
+	}
+
+	if jc.Leeway < 0 {
+		return errors.New("jwt leeway must not be negative")
+	}
+
+	return nil
+}
+
+// jwtKey is a key tokens may be signed with
+type jwtKey struct {
+	kid string
+	alg string
+
+	// secret verifies HS256 tokens, rsaKey RS256 tokens
+	secret []byte
+	rsaKey *rsa.PublicKey
+}
+
+// jwk is a key of a JWKS file, only the members needed for HS256 and RS256 are read
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+
+	// N and E are the modulus and exponent of an RSA key
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// K is the secret of an oct key
+	K string `json:"k"`
+}
+
+// loadJWKS reads the keys of a JWKS file. Keys for other uses or algorithms are skipped.
+func loadJWKS(path string) ([]jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load jwks: %w", err)
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("jwks file %s: %w", path, err)
+	}
+
+	var keys []jwtKey
+	for i, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.parse()
+		if err != nil {
+			return nil, fmt.Errorf("jwks file %s key %d: %w", path, i, err)
+		}
+		if key != nil {
+			keys = append(keys, *key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("jwks file %s has no HS256 or RS256 keys", path)
+	}
+
+	return keys, nil
+}
+
+// parse converts the key, returning nil for keys of other types or algorithms
+func (k jwk) parse() (*jwtKey, error) {
+	switch {
+	case k.Kty == "oct" && (k.Alg == "" || k.Alg == jwtHS256):
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return nil, errors.New("invalid oct key")
+		}
+		return &jwtKey{kid: k.Kid, alg: jwtHS256, secret: secret}, nil
+
+	case k.Kty == "RSA" && (k.Alg == "" || k.Alg == jwtRS256):
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil || len(n) == 0 {
+			return nil, errors.New("invalid RSA modulus")
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+
+		return &jwtKey{
+			kid: k.Kid,
+			alg: jwtRS256,
+			rsaKey: &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			},
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// verify checks signature is the signature of signed by the key
+func (k jwtKey) verify(signed string, signature []byte) bool {
+	switch k.alg {
+	case jwtHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signed))
+		return hmac.Equal(mac.Sum(nil), signature)
+	case jwtRS256:
+		hash := sha256.Sum256([]byte(signed))
+		return rsa.VerifyPKCS1v15(k.rsaKey, crypto.SHA256, hash[:], signature) == nil
+	}
+	return false
+}
+
+var _ (Authenticator) = (*jwtAuthenticator)(nil)
+
+// jwtAuthenticator authenticates JWT bearer tokens
+type jwtAuthenticator struct {
+	config JWTConfig
+	keys   []jwtKey
+
+	// now returns the time tokens are checked against
+	now func() time.Time
+}
+
+// newJWTAuthenticator loads the keys of config
+func newJWTAuthenticator(config JWTConfig) (*jwtAuthenticator, error) {
+	keys, err := loadJWKS(config.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &jwtAuthenticator{
+		config: config,
+		keys:   keys,
+		now:    time.Now,
+	}, nil
+}
+
+// Authenticate verifies the signature and claims of a JWT and returns the identity of its sub claim.
+// Every claim is copied to the identity. Tokens that aren't JWTs are unrecognized.
+func (ja *jwtAuthenticator) Authenticate(_ context.Context, token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrUnrecognizedToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, ErrUnrecognizedToken
+	}
+
+	if header.Alg != jwtHS256 && header.Alg != jwtRS256 {
+		return nil, fmt.Errorf("unsupported jwt alg %q", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed jwt signature")
+	}
+
+	if !ja.verify(header.Alg, header.Kid, parts[0]+"."+parts[1], signature) {
+		return nil, errors.New("invalid jwt signature")
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errors.New("malformed jwt claims")
+	}
+
+	if err := ja.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	subject, _ := claims["sub"].(string)
+	return &Identity{
+		Subject: subject,
+		Method:  IdentityJWT,
+		Claims:  claims,
+	}, nil
+}
+
+// verify checks the signature against the keys of the token's alg, only the key with kid if the token names one
+func (ja *jwtAuthenticator) verify(alg, kid, signed string, signature []byte) bool {
+	for _, key := range ja.keys {
+		if key.alg != alg || (kid != "" && key.kid != kid) {
+			continue
+		}
+
+		if key.verify(signed, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkClaims checks the token is current and meant for this server
+func (ja *jwtAuthenticator) checkClaims(claims map[string]interface{}) error {
+	now := ja.now()
+
+	if exp, ok := claims["exp"]; ok {
+		expiry, ok := exp.(float64)
+		if !ok {
+			return errors.New("jwt exp claim is not a number")
+		}
+		if now.Add(-ja.config.Leeway).After(time.Unix(int64(expiry), 0)) {
+			return errors.New("jwt has expired")
+		}
+	}
+
+	if nbf, ok := claims["nbf"]; ok {
+		notBefore, ok := nbf.(float64)
+		if !ok {
+			return errors.New("jwt nbf claim is not a number")
+		}
+		if now.Add(ja.config.Leeway).Before(time.Unix(int64(notBefore), 0)) {
+			return errors.New("jwt is not valid yet")
+		}
+	}
+
+	if ja.config.Issuer != "" && claims["iss"] != ja.config.Issuer {
+		return fmt.Errorf("jwt issuer is not %q", ja.config.Issuer)
+	}
+
+	if ja.config.Audience != "" && !hasAudience(claims["aud"], ja.config.Audience) {
+		return fmt.Errorf("jwt audience does not include %q", ja.config.Audience)
+	}
+
+	return nil
+}
+
+// hasAudience reports whether the aud claim, a string or a list of strings, includes audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decodeJWTPart decodes a base64url encoded JSON part of a JWT into v
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testJWTSecret is the HS256 secret of the JWKS written by writeJWKS
+var testJWTSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// encodeJWTPart base64url encodes v as JSON
+func encodeJWTPart(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signHS256 returns an HS256 JWT of claims signed with secret
+func signHS256(t *testing.T, secret []byte, kid string, claims map[string]interface{}) string {
+	signed := encodeJWTPart(t, map[string]string{"alg": "HS256", "kid": kid}) + "." + encodeJWTPart(t, claims)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signRS256 returns an RS256 JWT of claims signed with key
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := encodeJWTPart(t, map[string]string{"alg": "RS256", "kid": kid}) + "." + encodeJWTPart(t, claims)
+
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	require.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// writeJWKS writes a JWKS holding testJWTSecret with kid "hs" and the public half of rsaKey with kid "rs"
+func writeJWKS(t *testing.T, rsaKey *rsa.PrivateKey) string {
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "oct", "kid": "hs", "alg": "HS256", "k": base64.RawURLEncoding.EncodeToString(testJWTSecret)},
+			{
+				"kty": "RSA",
+				"kid": "rs",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{"kty": "EC", "kid": "ec", "crv": "P-256"},
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	data, err := json.Marshal(jwks)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	return path
+}
+
+func Test_jwtAuthenticator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	config := DefaultJWTConfig(writeJWKS(t, rsaKey))
+	config.Issuer = "https://auth.example.org"
+	config.Audience = "pubsub"
+
+	authenticator, err := newJWTAuthenticator(config)
+	require.NoError(t, err)
+	require.Len(t, authenticator.keys, 2)
+
+	now := time.Unix(1700000000, 0)
+	authenticator.now = func() time.Time { return now }
+
+	// claims returns valid claims with overrides applied, a nil override removes the claim
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":    "billing-service",
+			"iss":    "https://auth.example.org",
+			"aud":    []string{"pubsub", "other"},
+			"exp":    now.Add(time.Minute).Unix(),
+			"groups": []string{"billing"},
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	testCases := []struct {
+		desc     string
+		token    string
+		expected string
+	}{
+		{
+			desc:  "HS256",
+			token: signHS256(t, testJWTSecret, "hs", claims(nil)),
+		},
+		{
+			desc:  "RS256",
+			token: signRS256(t, rsaKey, "rs", claims(nil)),
+		},
+		{
+			desc:  "No kid",
+			token: signRS256(t, rsaKey, "", claims(map[string]interface{}{"aud": "pubsub"})),
+		},
+		{
+			desc:  "Within leeway",
+			token: signHS256(t, testJWTSecret, "hs", claims(map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()})),
+		},
+		{
+			desc:     "Expired",
+			token:    signHS256(t, testJWTSecret, "hs", claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})),
+			expected: "jwt has expired",
+		},
+		{
+			desc:     "Not valid yet",
+			token:    signHS256(t, testJWTSecret, "hs", claims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()})),
+			expected: "jwt is not valid yet",
+		},
+		{
+			desc:     "Wrong issuer",
+			token:    signHS256(t, testJWTSecret, "hs", claims(map[string]interface{}{"iss": "https://evil.example.org"})),
+			expected: `jwt issuer is not "https://auth.example.org"`,
+		},
+		{
+			desc:     "Wrong audience",
+			token:    signHS256(t, testJWTSecret, "hs", claims(map[string]interface{}{"aud": nil})),
+			expected: `jwt audience does not include "pubsub"`,
+		},
+		{
+			desc:     "Wrong secret",
+			token:    signHS256(t, []byte("not the secret"), "hs", claims(nil)),
+			expected: "invalid jwt signature",
+		},
+		{
+			desc:     "Unknown kid",
+			token:    signHS256(t, testJWTSecret, "other", claims(nil)),
+			expected: "invalid jwt signature",
+		},
+		{
+			// An RSA public key must not be usable as an HMAC secret
+			desc:     "Algorithm confusion",
+			token:    signHS256(t, rsaKey.N.Bytes(), "rs", claims(nil)),
+			expected: "invalid jwt signature",
+		},
+		{
+			desc:     "alg none",
+			token:    encodeJWTPart(t, map[string]string{"alg": "none"}) + "." + encodeJWTPart(t, claims(nil)) + ".",
+			expected: `unsupported jwt alg "none"`,
+		},
+		{
+			desc:     "Not a JWT",
+			token:    "api-key",
+			expected: ErrUnrecognizedToken.Error(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			identity, err := authenticator.Authenticate(context.Background(), tc.token)
+			if tc.expected != "" {
+				assert.EqualError(t, err, tc.expected)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "billing-service", identity.Subject)
+			assert.Equal(t, IdentityJWT, identity.Method)
+			assert.Equal(t, []interface{}{"billing"}, identity.Claims["groups"])
+		})
+	}
+}
+
+func Test_loadJWKS(t *testing.T) {
+	dir := t.TempDir()
+
+	write := func(contents string) string {
+		path := filepath.Join(dir, "jwks.json")
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+		return path
+	}
+
+	_, err := loadJWKS(write(`{"keys": [{"kty": "EC", "crv": "P-256"}]}`))
+	assert.Contains(t, err.Error(), "has no HS256 or RS256 keys")
+
+	_, err = loadJWKS(write(`{"keys": [{"kty": "oct", "k": "!!"}]}`))
+	assert.Contains(t, err.Error(), "key 0: invalid oct key")
+
+	_, err = loadJWKS(write(`not json`))
+	assert.Error(t, err)
+
+	// Encryption keys are skipped
+	_, err = loadJWKS(write(`{"keys": [{"kty": "oct", "use": "enc", "k": "c2VjcmV0"}]}`))
+	assert.Contains(t, err.Error(), "has no HS256 or RS256 keys")
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// serverListener is a protocol served on its own address alongside HTTP
+type serverListener interface {
+	// Addr returns the address the listener is bound to, nil if it isn't listening
+	Addr() net.Addr
+
+	// listen binds the listener, it fails if done is already closed.
+	// serve must be called once it succeeds, unless unlisten is.
+	listen(done <-chan struct{}) error
+
+	// unlisten releases a listener bound by listen when serve won't be called
+	unlisten()
+
+	// serve blocks until done is closed, returning http.ErrServerClosed, or the listener fails
+	serve(done <-chan struct{}) error
+
+	// close stops the listener and waits for its clients, done must be closed first
+	close() error
+}
+
+// streamSession is a client connected to a streamListener
+type streamSession interface {
+	// serve runs the session until the client goes away or the session is closed
+	serve()
+
+	// close disconnects the client, it may be called more than once and while serve is running
+	close()
+}
+
+var _ (serverListener) = (*streamListener)(nil)
+
+// streamListener accepts clients of a protocol served over plain TCP connections rather than HTTP
+type streamListener struct {
+	// name describes the protocol in logs
+	name string
+	addr string
+
+	// tlsConfig serves clients over TLS, nil for plaintext
+	tlsConfig *tls.Config
+
+	// newSession creates the session serving a newly accepted client
+	newSession func(net.Conn) streamSession
+
+	mu       sync.Mutex
+	listener net.Listener
+	sessions map[streamSession]struct{}
+
+	// wg waits for the accept loop and every session to finish
+	wg sync.WaitGroup
+}
+
+// newStreamListener creates a streamListener for addr, it does not listen until ListenAndServe is called.
+// Clients are served over TLS when tlsConfig isn't nil, sessions complete the handshake themselves.
+func newStreamListener(name, addr string, tlsConfig *tls.Config, newSession func(net.Conn) streamSession) *streamListener {
+	return &streamListener{
+		name:       name,
+		addr:       addr,
+		tlsConfig:  tlsConfig,
+		newSession: newSession,
+		sessions:   make(map[streamSession]struct{}),
+	}
+}
+
+// Addr returns the address the listener is bound to, nil if it isn't listening
+func (sl *streamListener) Addr() net.Addr {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if sl.listener == nil {
+		return nil
+	}
+	return sl.listener.Addr()
+}
+
+// listen binds the listener, it fails if done is already closed.
+// serve must be called once it succeeds.
+func (sl *streamListener) listen(done <-chan struct{}) error {
+	listener, err := net.Listen("tcp", sl.addr)
+	if err != nil {
+		return err
+	}
+
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	select {
+	case <-done:
+		listener.Close()
+		return http.ErrServerClosed
+	default:
+	}
+
+	if sl.tlsConfig != nil {
+		listener = tls.NewListener(listener, sl.tlsConfig)
+	}
+	sl.listener = listener
+
+	// Added under the lock so close waits for the accept loop started next
+	sl.wg.Add(1)
+
+	log.Println("PubSub", sl.name, "listening on", listener.Addr())
+	return nil
+}
+
+// unlisten releases a listener bound by listen when serve won't be called, such as when another listener failed to bind
+func (sl *streamListener) unlisten() {
+	sl.mu.Lock()
+	sl.listener.Close()
+	sl.listener = nil
+	sl.mu.Unlock()
+
+	sl.wg.Done()
+}
+
+// serve accepts clients until done is closed.
+// Returns http.ErrServerClosed once closed, like the HTTP server, or the error that stopped it accepting.
+func (sl *streamListener) serve(done <-chan struct{}) error {
+	defer sl.wg.Done()
+
+	for {
+		conn, err := sl.listener.Accept()
+		if err != nil {
+			select {
+			case <-done:
+				return http.ErrServerClosed
+			default:
+			}
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				log.Println("Error while accepting", sl.name, "client", err)
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+
+			return err
+		}
+
+		session := sl.newSession(conn)
+
+		sl.mu.Lock()
+		select {
+		case <-done:
+			sl.mu.Unlock()
+			conn.Close()
+			return http.ErrServerClosed
+		default:
+		}
+		sl.sessions[session] = struct{}{}
+		sl.wg.Add(1)
+		sl.mu.Unlock()
+
+		go func() {
+			defer sl.wg.Done()
+			session.serve()
+
+			sl.mu.Lock()
+			delete(sl.sessions, session)
+			sl.mu.Unlock()
+		}()
+	}
+}
+
+// close stops accepting clients, disconnects those connected and waits for their sessions to end.
+// done must be closed first.
+func (sl *streamListener) close() error {
+	sl.mu.Lock()
+	var err error
+	if sl.listener != nil {
+		err = sl.listener.Close()
+	}
+
+	for session := range sl.sessions {
+		session.close()
+	}
+	sl.mu.Unlock()
+
+	sl.wg.Wait()
+	return err
+}
@@ -0,0 +1,723 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cpheps/coder-pub-sub/mqtt"
+	"github.com/cpheps/coder-pub-sub/websocket"
+)
+
+const (
+	// mqttPacketOverhead is allowed on top of the max payload for the rest of a PUBLISH packet such as its topic
+	mqttPacketOverhead = 64 << 10
+
+	// mqttConnectTimeout is how long a client has to send CONNECT after connecting
+	mqttConnectTimeout = 10 * time.Second
+
+	// mqttConnectLimit caps the size of CONNECT, which is read before the client is authenticated.
+	// The payload sized limit only applies once the connection is accepted.
+	mqttConnectLimit = 8 << 10
+
+	// mqttSessionExpiry is how long the state of a persistent session is kept after its client disconnects
+	mqttSessionExpiry = 24 * time.Hour
+
+	// mqttMaxSessions caps the number of persistent sessions kept, the one disconnected longest is dropped first
+	mqttMaxSessions = 10000
+
+	// mqttBinaryContentType is the content type of MQTT payloads that are not UTF-8
+	mqttBinaryContentType = "application/octet-stream"
+)
+
+// errMQTTNextWriter is returned by mqttSubscription.NextWriter as messages are written with WriteMessage
+var errMQTTNextWriter = errors.New("mqtt connections only support WriteMessage")
+
+// errMQTTClosed is returned when writing to an mqttSession that has been closed
+var errMQTTClosed = errors.New("mqtt connection is closed")
+
+// errMQTTPacketIDs is returned when a client has every packet ID in flight
+var errMQTTPacketIDs = errors.New("no free mqtt packet ID")
+
+// MQTTAddr returns the address the MQTT listener is bound to, nil if it isn't listening
+func (s *PubSubServer) MQTTAddr() net.Addr {
+	if s.mqtt == nil {
+		return nil
+	}
+	return s.mqtt.Addr()
+}
+
+// mqttState is the state of an MQTT session that outlives its connection when the client asks for a persistent session
+type mqttState struct {
+	// generation tells the consumer offsets of this session apart from those of earlier sessions of the same client
+	generation string
+
+	// subs holds the granted QoS of each topic filter
+	subs map[string]byte
+
+	// disconnected is when the client of a persistent session went away, zero while it is connected.
+	// Guarded by mqttClients.mu.
+	disconnected time.Time
+}
+
+// newMQTTState creates the state of a new session
+func newMQTTState() *mqttState {
+	return &mqttState{
+		generation: randomHex(4),
+		subs:       make(map[string]byte),
+	}
+}
+
+// mqttClientKey names a session by its client ID within the identity that connected with it,
+// so one client can't take over the session of another by reusing its client ID
+type mqttClientKey struct {
+	// owner is the identity that connected, see identityOwner
+	owner    string
+	clientID string
+}
+
+// newMQTTClientKey returns the key of clientID connected as identity
+func newMQTTClientKey(identity *Identity, clientID string) mqttClientKey {
+	return mqttClientKey{
+		owner:    identityOwner(identity),
+		clientID: clientID,
+	}
+}
+
+// mqttClients tracks the connected MQTT clients and the state of persistent sessions by client key
+type mqttClients struct {
+	mu        sync.Mutex
+	active    map[mqttClientKey]*mqttSession
+	persisted map[mqttClientKey]*mqttState
+
+	// expiry and maxSessions bound the persisted sessions, now is the clock they are checked against
+	expiry      time.Duration
+	maxSessions int
+	now         func() time.Time
+}
+
+// newMQTTClients creates an empty mqttClients
+func newMQTTClients() *mqttClients {
+	return &mqttClients{
+		active:      make(map[mqttClientKey]*mqttSession),
+		persisted:   make(map[mqttClientKey]*mqttState),
+		expiry:      mqttSessionExpiry,
+		maxSessions: mqttMaxSessions,
+		now:         time.Now,
+	}
+}
+
+// connect makes session the active session of its client key. Returns the state of the session,
+// whether it was persisted by an earlier connection and the session it takes over from, if any.
+func (mc *mqttClients) connect(session *mqttSession, clean bool) (*mqttState, bool, *mqttSession) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	previous := mc.active[session.key]
+	mc.active[session.key] = session
+
+	if clean {
+		delete(mc.persisted, session.key)
+		return newMQTTState(), false, previous
+	}
+
+	mc.evict()
+
+	if state, ok := mc.persisted[session.key]; ok {
+		state.disconnected = time.Time{}
+		return state, true, previous
+	}
+
+	state := newMQTTState()
+	mc.persisted[session.key] = state
+	return state, false, previous
+}
+
+// disconnect removes session from the active sessions unless another connection took over its client key,
+// starting the expiry of its persisted state
+func (mc *mqttClients) disconnect(session *mqttSession) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.active[session.key] != session {
+		return
+	}
+
+	delete(mc.active, session.key)
+	if state, ok := mc.persisted[session.key]; ok && state == session.state {
+		state.disconnected = mc.now()
+	}
+}
+
+// evict drops persisted sessions that expired, then the ones disconnected longest until there is room for one more.
+// Sessions with a connected client are kept. Must be called with mu held.
+func (mc *mqttClients) evict() {
+	now := mc.now()
+	for key, state := range mc.persisted {
+		if !state.disconnected.IsZero() && now.Sub(state.disconnected) >= mc.expiry {
+			delete(mc.persisted, key)
+		}
+	}
+
+	for len(mc.persisted) >= mc.maxSessions {
+		var oldest mqttClientKey
+		var oldestState *mqttState
+		for key, state := range mc.persisted {
+			if !state.disconnected.IsZero() && (oldestState == nil || state.disconnected.Before(oldestState.disconnected)) {
+				oldest, oldestState = key, state
+			}
+		}
+
+		if oldestState == nil {
+			return
+		}
+		delete(mc.persisted, oldest)
+	}
+}
+
+// mqttInflight is a QoS 1 message written to a client and awaiting its PUBACK
+type mqttInflight struct {
+	sub *mqttSubscription
+	seq uint64
+}
+
+// mqttPacketLimit returns the largest packet read from MQTT clients, enough for a PUBLISH of the max payload
+func (s *PubSubServer) mqttPacketLimit() int {
+	if s.maxPayload <= 0 || s.maxPayload > mqtt.MaxRemainingLength-mqttPacketOverhead {
+		return mqtt.MaxRemainingLength
+	}
+	return s.maxPayload + mqttPacketOverhead
+}
+
+var _ (streamSession) = (*mqttSession)(nil)
+
+// mqttSession is a client connected over MQTT 3.1.1.
+// Each topic filter it subscribes to is registered with the broadcaster as its own connection, QoS 1 filters
+// with ack mode so messages are redelivered until the client sends a PUBACK. QoS 2 subscriptions are granted QoS 1.
+// Publishes are accepted at QoS 0 and 1, QoS 2 publishes close the connection.
+type mqttSession struct {
+	server *PubSubServer
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// writeMu serializes writes from the read loop and every subscription, closed is set under it
+	writeMu sync.Mutex
+	closed  bool
+
+	// identity is who the client proved to be over TLS or with the password of CONNECT, nil for anonymous clients.
+	// Set before CONNECT is accepted.
+	identity *Identity
+
+	// clientID, key, will, state and persistent are set once CONNECT is accepted
+	clientID   string
+	key        mqttClientKey
+	will       *mqtt.Publish
+	state      *mqttState
+	persistent bool
+
+	// subs are the registered subscriptions by topic filter, only touched by the read loop
+	subs map[string]*mqttSubscription
+
+	// inflightMu guards inflight, nextID and the ids of every subscription
+	inflightMu sync.Mutex
+	inflight   map[uint16]mqttInflight
+	nextID     uint16
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// finished is closed once serve has cleaned up after the session
+	finished chan struct{}
+}
+
+// newMQTTSession creates a session for conn accepted by s
+func (s *PubSubServer) newMQTTSession(conn net.Conn) streamSession {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &mqttSession{
+		server:   s,
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		subs:     make(map[string]*mqttSubscription),
+		inflight: make(map[uint16]mqttInflight),
+		ctx:      ctx,
+		cancel:   cancel,
+		finished: make(chan struct{}),
+	}
+}
+
+// serve runs the session until the client disconnects, breaks the protocol or the session is closed
+func (ms *mqttSession) serve() {
+	defer close(ms.finished)
+	defer ms.close()
+
+	identity, err := handshake(ms.conn)
+	if err != nil {
+		log.Println("Error during TLS handshake with MQTT client", err)
+		return
+	}
+	ms.identity = identity
+
+	ms.conn.SetReadDeadline(time.Now().Add(mqttConnectTimeout))
+	packet, err := mqtt.ReadPacket(ms.reader, mqttConnectLimit)
+	if err != nil {
+		log.Println("Error while reading MQTT CONNECT", err)
+		return
+	}
+
+	connect, ok := packet.(*mqtt.Connect)
+	if !ok {
+		log.Println("Disconnecting MQTT client that sent", packet.Type(), "before CONNECT")
+		return
+	}
+
+	if !ms.accept(connect) {
+		return
+	}
+
+	defer ms.server.mqttClients.disconnect(ms)
+
+	graceful := ms.readLoop(time.Duration(connect.KeepAlive) * time.Second)
+
+	for filter, sub := range ms.subs {
+		delete(ms.subs, filter)
+		ms.server.broadcaster.UnregisterConnection(sub)
+	}
+
+	// The will is for clients that went away, not those the server disconnected while closing
+	select {
+	case <-ms.server.doneChan:
+	default:
+		if !graceful && ms.will != nil {
+			log.Println("Publishing will of MQTT client", ms.clientID)
+			if err := ms.broadcast(ms.will.Topic, ms.will.Payload); err != nil {
+				log.Println("Error while publishing will of MQTT client", ms.clientID, err)
+			}
+		}
+	}
+}
+
+// accept answers CONNECT and restores the subscriptions of a persistent session.
+// Returns false if the connection was refused.
+func (ms *mqttSession) accept(connect *mqtt.Connect) bool {
+	if connect.ProtocolName != "MQTT" || connect.ProtocolLevel != mqtt.ProtocolLevel {
+		log.Println("Refusing MQTT client with protocol", connect.ProtocolName, connect.ProtocolLevel)
+		ms.write(&mqtt.Connack{ReturnCode: mqtt.RefusedProtocolVersion})
+		return false
+	}
+
+	if !ms.authenticate(connect) {
+		return false
+	}
+
+	// Only clients without persistent sessions may leave it to the server to pick an ID
+	ms.clientID = connect.ClientID
+	if ms.clientID == "" {
+		if !connect.CleanSession {
+			ms.write(&mqtt.Connack{ReturnCode: mqtt.RefusedIdentifierRejected})
+			return false
+		}
+		ms.clientID = "auto-" + randomHex(8)
+	}
+	ms.key = newMQTTClientKey(ms.identity, ms.clientID)
+
+	if connect.Will != nil {
+		if err := websocket.ValidateTopic(connect.Will.Topic); err != nil {
+			log.Println("Refusing MQTT client with will", err)
+			return false
+		}
+
+		if err := ms.server.authorizeIdentity(ms.identity, ActionPublish, connect.Will.Topic); err != nil {
+			log.Println("Refusing MQTT client with will", err)
+			ms.write(&mqtt.Connack{ReturnCode: mqtt.RefusedNotAuthorized})
+			return false
+		}
+		ms.will = connect.Will
+	}
+
+	state, present, previous := ms.server.mqttClients.connect(ms, connect.CleanSession)
+	ms.state = state
+	ms.persistent = !connect.CleanSession
+
+	// A client ID is only connected once, the earlier connection is closed
+	if previous != nil {
+		log.Println("MQTT client", ms.clientID, "took over its earlier connection")
+		previous.close()
+		<-previous.finished
+	}
+
+	if ms.identity != nil {
+		log.Println("MQTT client", ms.clientID, "connected as", ms.identity.Subject)
+	} else {
+		log.Println("MQTT client", ms.clientID, "connected")
+	}
+	if err := ms.write(&mqtt.Connack{SessionPresent: present, ReturnCode: mqtt.Accepted}); err != nil {
+		return false
+	}
+
+	for filter, qos := range state.subs {
+		if err := ms.subscribe(filter, qos); err != nil {
+			log.Println("Error while restoring MQTT subscription", filter, err)
+			delete(state.subs, filter)
+		}
+	}
+
+	return true
+}
+
+// authenticate checks the token passed as the password of CONNECT, the username is ignored.
+// Clients identified by a TLS client certificate don't need one. Returns false if the connection was refused.
+func (ms *mqttSession) authenticate(connect *mqtt.Connect) bool {
+	if !ms.server.authRequired() || ms.identity != nil {
+		return true
+	}
+
+	if !connect.HasPassword {
+		log.Println("Refusing MQTT client without a password")
+		ms.write(&mqtt.Connack{ReturnCode: mqtt.RefusedNotAuthorized})
+		return false
+	}
+
+	identity, err := ms.server.authenticateToken(ms.ctx, string(connect.Password))
+	if err != nil {
+		log.Println("Refusing MQTT client", err)
+		ms.write(&mqtt.Connack{ReturnCode: mqtt.RefusedBadUsernamePassword})
+		return false
+	}
+
+	ms.identity = identity
+	return true
+}
+
+// readLoop handles packets until the connection ends. Returns true if the client sent DISCONNECT.
+// A client with a keepAlive is disconnected if nothing is read from it for one and a half times as long.
+func (ms *mqttSession) readLoop(keepAlive time.Duration) bool {
+	ms.conn.SetReadDeadline(time.Time{})
+
+	for {
+		if keepAlive > 0 {
+			ms.conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		}
+
+		packet, err := mqtt.ReadPacket(ms.reader, ms.server.mqttPacketLimit())
+		if err != nil {
+			if !errors.Is(err, io.EOF) && ms.ctx.Err() == nil {
+				log.Println("Error while reading from MQTT client", ms.clientID, err)
+			}
+			return false
+		}
+
+		switch packet := packet.(type) {
+		case *mqtt.Disconnect:
+			log.Println("MQTT client", ms.clientID, "disconnected")
+			return true
+		case *mqtt.Pingreq:
+			err = ms.write(&mqtt.Pingresp{})
+		case *mqtt.Publish:
+			err = ms.handlePublish(packet)
+		case *mqtt.Puback:
+			ms.handlePuback(packet)
+		case *mqtt.Subscribe:
+			err = ms.handleSubscribe(packet)
+		case *mqtt.Unsubscribe:
+			err = ms.handleUnsubscribe(packet)
+		default:
+			err = fmt.Errorf("unexpected %s", packet.Type())
+		}
+
+		if err != nil {
+			log.Println("Disconnecting MQTT client", ms.clientID, err)
+			return false
+		}
+	}
+}
+
+// handlePublish broadcasts a message from the client, acknowledging it once stored if it is QoS 1.
+// Returns an error if the connection should be closed.
+func (ms *mqttSession) handlePublish(publish *mqtt.Publish) error {
+	if publish.QoS > 1 {
+		return errors.New("QoS 2 publishes are not supported")
+	}
+
+	if err := websocket.ValidateTopic(publish.Topic); err != nil {
+		return err
+	}
+
+	if max := ms.server.maxPayload; max > 0 && len(publish.Payload) > max {
+		return fmt.Errorf("payload of %d bytes is larger than the max of %d", len(publish.Payload), max)
+	}
+
+	// MQTT 3.1.1 has no way to refuse a publish, a denied message is dropped but still acked so it isn't resent
+	if err := ms.server.authorizeIdentity(ms.identity, ActionPublish, publish.Topic); err != nil {
+		log.Println("Dropping MQTT publish from", ms.clientID, err)
+	} else if err := ms.broadcast(publish.Topic, publish.Payload); err != nil {
+		// Without a PUBACK the client sends the message again once it reconnects
+		return err
+	}
+
+	if publish.QoS == 1 {
+		return ms.write(&mqtt.Puback{PacketID: publish.PacketID})
+	}
+
+	return nil
+}
+
+// broadcast publishes payload to topic. UTF-8 payloads are published as text, anything else as binary.
+func (ms *mqttSession) broadcast(topic string, payload []byte) error {
+	contentType := defaultContentType
+	if !utf8.Valid(payload) {
+		contentType = mqttBinaryContentType
+	}
+
+	msg, err := newMessage(topic, contentType, nil, payload)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Publising message to topic", topic)
+	result, err := ms.server.broadcaster.Broadcast(ms.ctx, msg)
+	if err != nil {
+		log.Println("Error while broadcasting message", err)
+		return err
+	}
+
+	if result.Failed > 0 {
+		log.Println("Broadcast failed for", result.Failed, "subscribers")
+	}
+
+	return nil
+}
+
+// handlePuback acks the message written with the packet ID, an unknown ID is ignored
+func (ms *mqttSession) handlePuback(puback *mqtt.Puback) {
+	ms.inflightMu.Lock()
+	inflight, ok := ms.inflight[puback.PacketID]
+	if ok {
+		delete(ms.inflight, puback.PacketID)
+		delete(inflight.sub.ids, inflight.seq)
+	}
+	ms.inflightMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if err := ms.server.broadcaster.Ack(inflight.sub, inflight.seq); err != nil {
+		log.Println("Ignoring PUBACK from MQTT client", ms.clientID, err)
+	}
+}
+
+// handleSubscribe subscribes to each topic filter, granting at most QoS 1
+func (ms *mqttSession) handleSubscribe(subscribe *mqtt.Subscribe) error {
+	codes := make([]byte, 0, len(subscribe.Subscriptions))
+	for _, requested := range subscribe.Subscriptions {
+		qos := requested.QoS
+		if qos > 1 {
+			qos = 1
+		}
+
+		if err := ms.subscribe(requested.Filter, qos); err != nil {
+			log.Println("Refusing MQTT subscription", requested.Filter, err)
+			codes = append(codes, mqtt.SubscribeFailure)
+			continue
+		}
+
+		ms.state.subs[requested.Filter] = qos
+		codes = append(codes, qos)
+	}
+
+	return ms.write(&mqtt.Suback{PacketID: subscribe.PacketID, ReturnCodes: codes})
+}
+
+// handleUnsubscribe removes each topic filter, filters that aren't subscribed are ignored
+func (ms *mqttSession) handleUnsubscribe(unsubscribe *mqtt.Unsubscribe) error {
+	for _, filter := range unsubscribe.Filters {
+		ms.unsubscribe(filter)
+		delete(ms.state.subs, filter)
+	}
+
+	return ms.write(&mqtt.Unsuback{PacketID: unsubscribe.PacketID})
+}
+
+// subscribe registers a subscription to filter, replacing any earlier one to the same filter as MQTT requires.
+// Subscriptions of a persistent session are durable consumers so they resume where they left off when restored.
+func (ms *mqttSession) subscribe(filter string, qos byte) error {
+	if err := websocket.ValidatePattern(filter); err != nil {
+		return err
+	}
+
+	if err := ms.server.authorizeIdentity(ms.identity, ActionSubscribe, filter); err != nil {
+		return err
+	}
+
+	ms.unsubscribe(filter)
+
+	sub := &mqttSubscription{
+		id:      randomHex(8),
+		qos:     qos,
+		session: ms,
+		ids:     make(map[uint64]uint16),
+	}
+
+	subscription := websocket.Subscription{
+		Pattern: filter,
+		Format:  websocket.FormatRaw,
+	}
+
+	if qos == 1 {
+		ack := ms.server.ack
+		subscription.Ack = &ack
+	}
+
+	if ms.persistent {
+		subscription.Consumer = scopeConsumer(ms.key.owner, fmt.Sprintf("mqtt/%s/%s/%s", ms.clientID, ms.state.generation, filter))
+	}
+
+	log.Println("Registering MQTT subscriber to topic", filter)
+	if err := ms.server.broadcaster.RegisterConnection(subscription, sub); err != nil {
+		return err
+	}
+
+	ms.subs[filter] = sub
+	return nil
+}
+
+// unsubscribe unregisters the subscription to filter if there is one
+func (ms *mqttSession) unsubscribe(filter string) {
+	sub, ok := ms.subs[filter]
+	if !ok {
+		return
+	}
+
+	delete(ms.subs, filter)
+	ms.server.broadcaster.UnregisterConnection(sub)
+
+	// Messages still in flight to it can no longer be acked
+	ms.inflightMu.Lock()
+	for seq, id := range sub.ids {
+		delete(ms.inflight, id)
+		delete(sub.ids, seq)
+	}
+	ms.inflightMu.Unlock()
+}
+
+// packetID returns the packet ID a QoS 1 message with seq is written to sub with.
+// A redelivered message keeps its packet ID.
+func (ms *mqttSession) packetID(sub *mqttSubscription, seq uint64) (uint16, error) {
+	ms.inflightMu.Lock()
+	defer ms.inflightMu.Unlock()
+
+	if id, ok := sub.ids[seq]; ok {
+		return id, nil
+	}
+
+	// Packet IDs are non zero and must not be reused while in flight
+	for tries := 0; tries < 1<<16; tries++ {
+		ms.nextID++
+		if ms.nextID == 0 {
+			continue
+		}
+
+		if _, used := ms.inflight[ms.nextID]; !used {
+			ms.inflight[ms.nextID] = mqttInflight{sub: sub, seq: seq}
+			sub.ids[seq] = ms.nextID
+			return ms.nextID, nil
+		}
+	}
+
+	return 0, errMQTTPacketIDs
+}
+
+// write sends a single packet
+func (ms *mqttSession) write(packet mqtt.Packet) error {
+	ms.writeMu.Lock()
+	defer ms.writeMu.Unlock()
+
+	if ms.closed {
+		return errMQTTClosed
+	}
+
+	ms.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	_, err := ms.conn.Write(packet.Encode())
+	return err
+}
+
+// close disconnects the client, subscriptions see their connection as done
+func (ms *mqttSession) close() {
+	// Close the socket before taking the write lock so a write blocked on a slow client returns
+	ms.cancel()
+	ms.conn.Close()
+
+	ms.writeMu.Lock()
+	ms.closed = true
+	ms.writeMu.Unlock()
+}
+
+var (
+	_ (websocket.WebsocketConnection) = (*mqttSubscription)(nil)
+	_ (websocket.MessageWriter)       = (*mqttSubscription)(nil)
+)
+
+// mqttSubscription is a single topic filter of an mqttSession
+type mqttSubscription struct {
+	id      string
+	qos     byte
+	session *mqttSession
+
+	// ids maps the sequence number of each QoS 1 message in flight to its packet ID
+	ids map[uint64]uint16
+}
+
+// WriteMessage writes msg as a PUBLISH at the granted QoS of the subscription, the payload is always sent raw
+func (sub *mqttSubscription) WriteMessage(msg *websocket.Message, _ websocket.Format) error {
+	publish := &mqtt.Publish{
+		QoS:     sub.qos,
+		Topic:   msg.Topic,
+		Payload: msg.Data,
+	}
+
+	if sub.qos == 1 {
+		id, err := sub.session.packetID(sub, msg.Seq)
+		if err != nil {
+			return err
+		}
+
+		publish.PacketID = id
+		publish.Dup = msg.Attempt > 1
+	}
+
+	return sub.session.write(publish)
+}
+
+// ID returns an identifier unique to this subscription
+func (sub *mqttSubscription) ID() string {
+	return sub.id
+}
+
+// NextWriter is not supported, messages are written with WriteMessage
+func (sub *mqttSubscription) NextWriter(websocket.MessageType) (io.WriteCloser, error) {
+	return nil, errMQTTNextWriter
+}
+
+// Done returns a channel that is closed once the session ends
+func (sub *mqttSubscription) Done() <-chan struct{} {
+	return sub.session.ctx.Done()
+}
+
+// Incoming returns nil as the session reads packets itself
+func (sub *mqttSubscription) Incoming() <-chan []byte {
+	return nil
+}
+
+// Close ends the whole session, a subscription failing to write means the client is gone or too slow
+func (sub *mqttSubscription) Close() error {
+	sub.session.close()
+	return nil
+}
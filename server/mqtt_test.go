@@ -0,0 +1,386 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cpheps/coder-pub-sub/mqtt"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	gwebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectPaho connects an MQTT client with clientID, messages not matched by a subscription's own handler go to received
+func connectPaho(t *testing.T, pubsubServer *PubSubServer, clientID string, clean bool, received chan<- paho.Message) (paho.Client, bool) {
+	opts := paho.NewClientOptions().
+		AddBroker("tcp://" + pubsubServer.MQTTAddr().String()).
+		SetClientID(clientID).
+		SetCleanSession(clean).
+		SetAutoReconnect(false).
+		SetProtocolVersion(4).
+		SetDefaultPublishHandler(func(_ paho.Client, msg paho.Message) {
+			received <- msg
+		})
+
+	client := paho.NewClient(opts)
+	token := client.Connect()
+	require.True(t, token.WaitTimeout(time.Second))
+	require.NoError(t, token.Error())
+	t.Cleanup(func() { client.Disconnect(0) })
+
+	return client, token.(*paho.ConnectToken).SessionPresent()
+}
+
+// waitToken waits for an MQTT operation to complete successfully
+func waitToken(t *testing.T, token paho.Token) {
+	require.True(t, token.WaitTimeout(time.Second))
+	require.NoError(t, token.Error())
+}
+
+// receivePaho waits for the next message sent to an MQTT client
+func receivePaho(t *testing.T, received <-chan paho.Message) paho.Message {
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no MQTT message received")
+		return nil
+	}
+}
+
+// rawMQTTClient speaks MQTT packet by packet for tests that need control over acks
+type rawMQTTClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// dialMQTT connects to the server and sends connect
+func dialMQTT(t *testing.T, pubsubServer *PubSubServer, connect *mqtt.Connect) *rawMQTTClient {
+	conn, err := net.Dial("tcp", pubsubServer.MQTTAddr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	client := &rawMQTTClient{t: t, conn: conn}
+	client.send(connect)
+	return client
+}
+
+func (c *rawMQTTClient) send(packet mqtt.Packet) {
+	_, err := c.conn.Write(packet.Encode())
+	require.NoError(c.t, err)
+}
+
+func (c *rawMQTTClient) read() (mqtt.Packet, error) {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return mqtt.ReadPacket(c.conn, mqtt.MaxRemainingLength)
+}
+
+func (c *rawMQTTClient) expect(expected mqtt.Packet) {
+	packet, err := c.read()
+	require.NoError(c.t, err)
+	assert.Equal(c.t, expected, packet)
+}
+
+func Test_mqttClients_evict(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	clients := newMQTTClients()
+	clients.maxSessions = 2
+	clients.now = func() time.Time { return now }
+
+	// connectFor persists a session for clientID and disconnects it straight away
+	connectFor := func(clientID string) (*mqttSession, bool) {
+		session := &mqttSession{clientID: clientID, key: newMQTTClientKey(nil, clientID)}
+		state, present, _ := clients.connect(session, false)
+		session.state = state
+		return session, present
+	}
+
+	first, _ := connectFor("first")
+	clients.disconnect(first)
+	now = now.Add(time.Minute)
+
+	second, _ := connectFor("second")
+	clients.disconnect(second)
+	now = now.Add(time.Minute)
+
+	// The cap drops the session disconnected longest
+	third, _ := connectFor("third")
+	assert.NotContains(t, clients.persisted, first.key)
+	assert.Contains(t, clients.persisted, second.key)
+
+	// Connected sessions never expire, disconnected ones do
+	now = now.Add(mqttSessionExpiry)
+	_, present := connectFor("fourth")
+	assert.False(t, present)
+	assert.NotContains(t, clients.persisted, second.key)
+	assert.Contains(t, clients.persisted, third.key)
+}
+
+func Test_PubSubServer_MQTT(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			desc: "MQTT publish reaches websocket subscribers",
+			testFunc: func(t *testing.T) {
+				pubsubServer, baseURL := startServer(t, func(o *Options) { o.MQTTAddr = "127.0.0.1:0" })
+				publisher, _ := connectPaho(t, pubsubServer, "publisher", true, nil)
+
+				// A QoS 1 publish is acked once stored, so the subscriber can replay it
+				waitToken(t, publisher.Publish("sensors/kitchen/temp", 1, false, "21.5"))
+
+				wsURL := "ws" + strings.TrimPrefix(baseURL, "http") + "/subscribe/sensors/+/temp?last=1"
+				ws, _, err := gwebsocket.DefaultDialer.Dial(wsURL, nil)
+				require.NoError(t, err)
+				defer ws.Close()
+
+				ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+				messageType, data, err := ws.ReadMessage()
+				require.NoError(t, err)
+				assert.Equal(t, gwebsocket.TextMessage, messageType)
+				assert.Equal(t, "21.5", string(data))
+
+				// Payloads that are not UTF-8 are delivered as binary
+				waitToken(t, publisher.Publish("sensors/kitchen/temp", 0, false, []byte{0xff, 0x00}))
+
+				messageType, data, err = ws.ReadMessage()
+				require.NoError(t, err)
+				assert.Equal(t, gwebsocket.BinaryMessage, messageType)
+				assert.Equal(t, []byte{0xff, 0x00}, data)
+			},
+		},
+		{
+			desc: "HTTP publish reaches MQTT subscribers",
+			testFunc: func(t *testing.T) {
+				pubsubServer, baseURL := startServer(t, func(o *Options) { o.MQTTAddr = "127.0.0.1:0" })
+
+				received := make(chan paho.Message, 10)
+				subscriber, _ := connectPaho(t, pubsubServer, "subscriber", true, received)
+				waitToken(t, subscriber.Subscribe("sensors/+/temp", 1, nil))
+				waitToken(t, subscriber.Subscribe("sensors/#", 0, nil))
+
+				resp, err := http.Post(baseURL+"/publish/sensors/kitchen/temp", "text/plain", bytes.NewBufferString("21.5"))
+				require.NoError(t, err)
+				resp.Body.Close()
+
+				// Overlapping subscriptions each get a copy at their own QoS
+				qos := map[byte]string{}
+				for i := 0; i < 2; i++ {
+					msg := receivePaho(t, received)
+					assert.Equal(t, "sensors/kitchen/temp", msg.Topic())
+					qos[msg.Qos()] = string(msg.Payload())
+				}
+				assert.Equal(t, map[byte]string{0: "21.5", 1: "21.5"}, qos)
+
+				waitToken(t, subscriber.Unsubscribe("sensors/#"))
+
+				resp, err = http.Post(baseURL+"/publish/sensors/hall/temp", "text/plain", bytes.NewBufferString("19"))
+				require.NoError(t, err)
+				resp.Body.Close()
+
+				msg := receivePaho(t, received)
+				assert.Equal(t, "sensors/hall/temp", msg.Topic())
+				assert.Equal(t, byte(1), msg.Qos())
+
+				select {
+				case msg := <-received:
+					t.Fatalf("unexpected message on %s", msg.Topic())
+				case <-time.After(50 * time.Millisecond):
+				}
+			},
+		},
+		{
+			desc: "Persistent session receives messages published while away",
+			testFunc: func(t *testing.T) {
+				pubsubServer, baseURL := startServer(t, func(o *Options) { o.MQTTAddr = "127.0.0.1:0" })
+
+				received := make(chan paho.Message, 10)
+				first, present := connectPaho(t, pubsubServer, "device-1", false, received)
+				assert.False(t, present)
+				waitToken(t, first.Subscribe("alerts/#", 1, nil))
+				first.Disconnect(0)
+
+				resp, err := http.Post(baseURL+"/publish/alerts/fire", "text/plain", bytes.NewBufferString("hall"))
+				require.NoError(t, err)
+				resp.Body.Close()
+
+				// The subscription is restored without subscribing again
+				_, present = connectPaho(t, pubsubServer, "device-1", false, received)
+				assert.True(t, present)
+
+				msg := receivePaho(t, received)
+				assert.Equal(t, "alerts/fire", msg.Topic())
+				assert.Equal(t, "hall", string(msg.Payload()))
+			},
+		},
+		{
+			desc: "QoS 1 is redelivered until acked",
+			testFunc: func(t *testing.T) {
+				pubsubServer, baseURL := startServer(t, func(o *Options) {
+					o.MQTTAddr = "127.0.0.1:0"
+					o.Ack.VisibilityTimeout = 40 * time.Millisecond
+				})
+
+				client := dialMQTT(t, pubsubServer, &mqtt.Connect{ProtocolName: "MQTT", ProtocolLevel: mqtt.ProtocolLevel, ClientID: "raw", CleanSession: true})
+				client.expect(&mqtt.Connack{ReturnCode: mqtt.Accepted})
+
+				client.send(&mqtt.Subscribe{PacketID: 1, Subscriptions: []mqtt.Subscription{{Filter: "orders", QoS: 2}, {Filter: "orders.>.bad"}}})
+				client.expect(&mqtt.Suback{PacketID: 1, ReturnCodes: []byte{1, mqtt.SubscribeFailure}})
+
+				resp, err := http.Post(baseURL+"/publish/orders", "text/plain", bytes.NewBufferString("hi"))
+				require.NoError(t, err)
+				resp.Body.Close()
+
+				packet, err := client.read()
+				require.NoError(t, err)
+				first := packet.(*mqtt.Publish)
+				assert.Equal(t, byte(1), first.QoS)
+				assert.False(t, first.Dup)
+
+				// Not acked in time so it is sent again with the same packet ID
+				client.expect(&mqtt.Publish{Dup: true, QoS: 1, Topic: "orders", PacketID: first.PacketID, Payload: []byte("hi")})
+
+				client.send(&mqtt.Puback{PacketID: first.PacketID})
+				client.send(&mqtt.Pingreq{})
+				client.expect(&mqtt.Pingresp{})
+
+				// Acked so nothing more arrives
+				client.conn.SetReadDeadline(time.Now().Add(150 * time.Millisecond))
+				_, err = mqtt.ReadPacket(client.conn, mqtt.MaxRemainingLength)
+				var netErr net.Error
+				require.ErrorAs(t, err, &netErr)
+				assert.True(t, netErr.Timeout())
+			},
+		},
+		{
+			desc: "Will is published when a client goes away",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startServer(t, func(o *Options) { o.MQTTAddr = "127.0.0.1:0" })
+
+				received := make(chan paho.Message, 10)
+				subscriber, _ := connectPaho(t, pubsubServer, "watcher", true, received)
+				waitToken(t, subscriber.Subscribe("devices/+/status", 1, nil))
+
+				device := dialMQTT(t, pubsubServer, &mqtt.Connect{
+					ProtocolName:  "MQTT",
+					ProtocolLevel: mqtt.ProtocolLevel,
+					ClientID:      "device-2",
+					CleanSession:  true,
+					Will:          &mqtt.Publish{QoS: 1, Topic: "devices/2/status", Payload: []byte("offline")},
+				})
+				device.expect(&mqtt.Connack{ReturnCode: mqtt.Accepted})
+				device.conn.Close()
+
+				msg := receivePaho(t, received)
+				assert.Equal(t, "devices/2/status", msg.Topic())
+				assert.Equal(t, "offline", string(msg.Payload()))
+			},
+		},
+		{
+			desc: "Second connection takes over the client ID",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startServer(t, func(o *Options) { o.MQTTAddr = "127.0.0.1:0" })
+				connect := &mqtt.Connect{ProtocolName: "MQTT", ProtocolLevel: mqtt.ProtocolLevel, ClientID: "twin", CleanSession: true}
+
+				first := dialMQTT(t, pubsubServer, connect)
+				first.expect(&mqtt.Connack{ReturnCode: mqtt.Accepted})
+
+				second := dialMQTT(t, pubsubServer, connect)
+				second.expect(&mqtt.Connack{ReturnCode: mqtt.Accepted})
+
+				_, err := first.read()
+				assert.ErrorIs(t, err, io.EOF)
+			},
+		},
+		{
+			desc: "Refused connections",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startServer(t, func(o *Options) { o.MQTTAddr = "127.0.0.1:0" })
+
+				oldVersion := dialMQTT(t, pubsubServer, &mqtt.Connect{ProtocolName: "MQIsdp", ProtocolLevel: 3, ClientID: "old", CleanSession: true})
+				oldVersion.expect(&mqtt.Connack{ReturnCode: mqtt.RefusedProtocolVersion})
+
+				noID := dialMQTT(t, pubsubServer, &mqtt.Connect{ProtocolName: "MQTT", ProtocolLevel: mqtt.ProtocolLevel})
+				noID.expect(&mqtt.Connack{ReturnCode: mqtt.RefusedIdentifierRejected})
+
+				qos2 := dialMQTT(t, pubsubServer, &mqtt.Connect{ProtocolName: "MQTT", ProtocolLevel: mqtt.ProtocolLevel, CleanSession: true})
+				qos2.expect(&mqtt.Connack{ReturnCode: mqtt.Accepted})
+				qos2.send(&mqtt.Publish{QoS: 2, Topic: "orders", PacketID: 1, Payload: []byte("hi")})
+
+				_, err := qos2.read()
+				assert.ErrorIs(t, err, io.EOF)
+			},
+		},
+		{
+			desc: "Oversized CONNECT disconnects",
+			testFunc: func(t *testing.T) {
+				// The payload sized limit only applies once the client is accepted
+				pubsubServer, _ := startServer(t, func(o *Options) {
+					o.MQTTAddr = "127.0.0.1:0"
+					o.MaxPayload = 0
+				})
+
+				client := dialMQTT(t, pubsubServer, &mqtt.Connect{
+					ProtocolName:  "MQTT",
+					ProtocolLevel: mqtt.ProtocolLevel,
+					ClientID:      "big",
+					CleanSession:  true,
+					Will:          &mqtt.Publish{Topic: "orders", Payload: make([]byte, mqttConnectLimit)},
+				})
+
+				_, err := client.read()
+				assert.Error(t, err)
+			},
+		},
+		{
+			desc: "Sessions are scoped by identity",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startServer(t, func(o *Options) {
+					o.MQTTAddr = "127.0.0.1:0"
+					o.Auth = &AuthConfig{APIKeysFile: writeAPIKeys(t)}
+				})
+				connect := func(password string) *mqtt.Connect {
+					return &mqtt.Connect{
+						ProtocolName:  "MQTT",
+						ProtocolLevel: mqtt.ProtocolLevel,
+						ClientID:      "shared",
+						HasPassword:   true,
+						Password:      []byte(password),
+					}
+				}
+
+				owner := dialMQTT(t, pubsubServer, connect(testAPIKey))
+				owner.expect(&mqtt.Connack{ReturnCode: mqtt.Accepted})
+				owner.send(&mqtt.Subscribe{PacketID: 1, Subscriptions: []mqtt.Subscription{{Filter: "orders", QoS: 1}}})
+				owner.expect(&mqtt.Suback{PacketID: 1, ReturnCodes: []byte{1}})
+
+				// Another identity reusing the client ID gets its own session and doesn't disconnect the owner
+				other := dialMQTT(t, pubsubServer, connect("k3y-subscriber"))
+				other.expect(&mqtt.Connack{ReturnCode: mqtt.Accepted})
+
+				owner.send(&mqtt.Pingreq{})
+				owner.expect(&mqtt.Pingresp{})
+
+				owner.conn.Close()
+				require.Eventually(t, func() bool {
+					pubsubServer.mqttClients.mu.Lock()
+					defer pubsubServer.mqttClients.mu.Unlock()
+					return len(pubsubServer.mqttClients.active) == 1
+				}, time.Second, 10*time.Millisecond)
+
+				dialMQTT(t, pubsubServer, connect(testAPIKey)).expect(&mqtt.Connack{SessionPresent: true, ReturnCode: mqtt.Accepted})
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, tc.testFunc)
+	}
+}
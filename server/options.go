@@ -0,0 +1,155 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cpheps/coder-pub-sub/storage"
+	"github.com/cpheps/coder-pub-sub/websocket"
+)
+
+// Options configures a PubSubServer. Start from DefaultOptions and override the settings that differ.
+type Options struct {
+	// Addr is the address HTTP is served on
+	Addr string
+
+	// BroadcastConcurrency is the number of subscribers a broadcast hands a message to at a time
+	BroadcastConcurrency int
+
+	// ReadHeaderTimeout is how long an HTTP client has to send its request headers. Zero means no limit.
+	ReadHeaderTimeout time.Duration
+
+	// IdleTimeout is how long an idle HTTP keep-alive connection is kept open. Zero means no limit.
+	IdleTimeout time.Duration
+
+	// MaxPayload caps the size in bytes of a payload published over HTTP, TCP, MQTT or gRPC. Zero means no limit.
+	MaxPayload int
+
+	// Queue sets the size and overflow policy of every subscriber's outbound queue
+	Queue websocket.QueueConfig
+
+	// Keepalive sets how often subscribers are pinged and how long they have to answer before being disconnected
+	Keepalive websocket.KeepaliveConfig
+
+	// Ack sets how long subscribers acking messages have to ack each one before it is redelivered,
+	// and how many times it is delivered before being moved to its dead letter topic
+	Ack websocket.AckConfig
+
+	// Balancing sets how messages for a consumer group are spread across its members
+	Balancing websocket.GroupBalancing
+
+	// Retention sets how many published messages, and for how long, are kept in memory for replay.
+	// It has no effect when Disk is set.
+	Retention storage.MemoryConfig
+
+	// Disk stores published messages and consumer offsets in a durable log on local disk instead of memory
+	// so replay survives a restart. Its retention is configured by the DiskConfig rather than Retention.
+	Disk *storage.DiskConfig
+
+	// Poll sets how long polls wait for messages and how much is held for each cursor between polls
+	Poll PollConfig
+
+	// Webhook sets how messages are delivered to webhooks, retried and when a failing webhook is disabled
+	Webhook websocket.WebhookConfig
+
+	// TLS serves HTTP and every other listener over TLS, optionally requiring client certificates. Plaintext when nil.
+	TLS *TLSConfig
+
+	// Auth requires clients to authenticate with an API key, a JWT or a TLS client certificate. Open to all when nil.
+	Auth *AuthConfig
+
+	// CORS sets which other origins browsers may open websockets and make requests from
+	CORS CORSConfig
+
+	// PolicyFile holds the rules deciding which topics clients may publish and subscribe to, see Policy.
+	// Every client may use every topic when empty.
+	PolicyFile string
+
+	// TCPAddr also serves the TCP line protocol on this address, it is disabled when empty
+	TCPAddr string
+
+	// MQTTAddr also serves MQTT 3.1.1 on this address, it is disabled when empty
+	MQTTAddr string
+
+	// GRPCAddr also serves the gRPC PubSub service on this address, it is disabled when empty
+	GRPCAddr string
+}
+
+// DefaultOptions returns the Options of a server listening on :8080 with messages kept in memory
+func DefaultOptions() Options {
+	return Options{
+		Addr:                 ":8080",
+		BroadcastConcurrency: 10,
+		ReadHeaderTimeout:    10 * time.Second,
+		IdleTimeout:          2 * time.Minute,
+		MaxPayload:           1 << 20,
+		Queue:                websocket.DefaultQueueConfig(),
+		Keepalive:            websocket.DefaultKeepaliveConfig(),
+		Ack:                  websocket.DefaultAckConfig(),
+		Balancing:            websocket.RoundRobin,
+		Retention:            storage.DefaultMemoryConfig(),
+		Poll:                 DefaultPollConfig(),
+		Webhook:              websocket.DefaultWebhookConfig(),
+		CORS:                 DefaultCORSConfig(),
+	}
+}
+
+// Validate checks the Options are usable. Errors are prefixed with the setting at fault.
+func (o Options) Validate() error {
+	if o.BroadcastConcurrency <= 0 {
+		return errors.New("broadcast concurrency must be greater than 0")
+	}
+
+	if o.ReadHeaderTimeout < 0 || o.IdleTimeout < 0 {
+		return errors.New("http timeouts must not be negative")
+	}
+
+	if o.MaxPayload < 0 {
+		return errors.New("max payload must not be negative")
+	}
+
+	type section struct {
+		name     string
+		validate func() error
+	}
+
+	sections := []section{
+		{"queue", o.Queue.Validate},
+		{"keepalive", o.Keepalive.Validate},
+		{"ack", o.Ack.Validate},
+		{"retention", o.Retention.Validate},
+		{"poll", o.Poll.Validate},
+		{"webhooks", o.Webhook.Validate},
+		{"cors", o.CORS.Validate},
+	}
+
+	if o.Disk != nil {
+		sections = append(sections, section{"storage", o.Disk.Validate})
+	}
+
+	if o.TLS != nil {
+		sections = append(sections, section{"tls", o.TLS.Validate})
+	}
+
+	if o.Auth != nil {
+		sections = append(sections, section{"auth", o.Auth.Validate})
+	}
+
+	for _, section := range sections {
+		if err := section.validate(); err != nil {
+			return fmt.Errorf("%s: %w", section.name, err)
+		}
+	}
+
+	return nil
+}
+
+// newStore opens the store selected by the options
+func (o Options) newStore() (storage.Store, error) {
+	if o.Disk != nil {
+		return storage.NewDiskStore(*o.Disk)
+	}
+
+	return storage.NewMemoryStore(o.Retention)
+}
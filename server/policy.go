@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cpheps/coder-pub-sub/websocket"
+	"gopkg.in/yaml.v3"
+)
+
+// Action is what a client asks to do with a topic
+type Action string
+
+const (
+	// ActionPublish publishes to a concrete topic
+	ActionPublish Action = "publish"
+
+	// ActionSubscribe subscribes to a topic pattern, which may contain wildcards
+	ActionSubscribe Action = "subscribe"
+)
+
+// Effect is whether a rule allows or denies what it matches
+type Effect string
+
+const (
+	// Allow lets the client go ahead
+	Allow Effect = "allow"
+
+	// Deny refuses the client, it wins over any rule allowing the same thing
+	Deny Effect = "deny"
+)
+
+// AnySubject in a rule's subjects matches every authenticated client
+const AnySubject = "*"
+
+// stringList is a list of strings that may be written as a single string in a policy file
+type stringList []string
+
+// UnmarshalYAML decodes a string or a list of strings
+func (sl *stringList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*sl = stringList{node.Value}
+		return nil
+	}
+
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*sl = list
+	return nil
+}
+
+// PolicyRule allows or denies clients matching its subjects and claims the actions on its topics
+type PolicyRule struct {
+	Effect Effect `yaml:"effect"`
+
+	// Actions the rule applies to, every action when empty
+	Actions []Action `yaml:"actions"`
+
+	// Topics are topic patterns the rule applies to and may contain wildcards
+	Topics stringList `yaml:"topics"`
+
+	// Subjects the rule applies to, any client including anonymous ones when empty. AnySubject matches any authenticated client.
+	Subjects stringList `yaml:"subjects"`
+
+	// Claims the client's identity must have for the rule to apply. A claim matches if it equals,
+	// or for a list claim contains, one of the values.
+	Claims map[string]stringList `yaml:"claims"`
+}
+
+// Policy decides which topics clients may publish and subscribe to.
+//
+// A publish is allowed if an allow rule has a pattern matching the topic. A subscribe is allowed if an allow rule
+// has a pattern matching every topic the subscription could match, so orders.> allows subscribing to orders.*.
+// Deny rules win over allow rules and refuse any subscription that could match one of their topics,
+// so denying admin.> refuses subscribing to >. Anything no rule applies to gets the Default effect.
+type Policy struct {
+	// Default is the effect when no rule applies, deny when empty
+	Default Effect       `yaml:"default"`
+	Rules   []PolicyRule `yaml:"rules"`
+}
+
+// LoadPolicy reads a YAML or JSON policy file. Unknown keys are an error so typos don't open up topics.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load policy: %w", err)
+	}
+
+	var policy Policy
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&policy); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("policy file %s: %w", path, err)
+	}
+
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("policy file %s: %w", path, err)
+	}
+
+	return &policy, nil
+}
+
+// Validate checks every rule of the policy is usable
+func (p *Policy) Validate() error {
+	switch p.Default {
+	case "", Allow, Deny:
+	default:
+		return fmt.Errorf("default must be allow or deny, not %q", p.Default)
+	}
+
+	for i, rule := range p.Rules {
+		if rule.Effect != Allow && rule.Effect != Deny {
+			return fmt.Errorf("rule %d: effect must be allow or deny, not %q", i, rule.Effect)
+		}
+
+		for _, action := range rule.Actions {
+			if action != ActionPublish && action != ActionSubscribe {
+				return fmt.Errorf("rule %d: action must be publish or subscribe, not %q", i, action)
+			}
+		}
+
+		if len(rule.Topics) == 0 {
+			return fmt.Errorf("rule %d: topics must be set", i)
+		}
+
+		for _, topic := range rule.Topics {
+			if err := websocket.ValidatePattern(topic); err != nil {
+				return fmt.Errorf("rule %d: %w", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Allowed reports whether identity, nil for anonymous clients, may perform action on topic.
+// topic is a concrete topic for ActionPublish and a pattern for ActionSubscribe.
+func (p *Policy) Allowed(identity *Identity, action Action, topic string) bool {
+	allowed := p.Default == Allow
+	for _, rule := range p.Rules {
+		if !rule.appliesTo(identity, action) {
+			continue
+		}
+
+		if rule.Effect == Deny && rule.denies(action, topic) {
+			return false
+		}
+
+		if rule.Effect == Allow && rule.allows(action, topic) {
+			allowed = true
+		}
+	}
+
+	return allowed
+}
+
+// appliesTo reports whether the rule covers identity and action, regardless of topic
+func (pr PolicyRule) appliesTo(identity *Identity, action Action) bool {
+	if len(pr.Actions) > 0 && !containsAction(pr.Actions, action) {
+		return false
+	}
+
+	if len(pr.Subjects) > 0 {
+		if identity == nil {
+			return false
+		}
+
+		matched := false
+		for _, subject := range pr.Subjects {
+			if subject == AnySubject || subject == identity.Subject {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	for claim, values := range pr.Claims {
+		if identity == nil || !claimMatches(identity.Claims[claim], values) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// allows reports whether one of the rule's patterns takes in everything action on topic could touch
+func (pr PolicyRule) allows(action Action, topic string) bool {
+	for _, pattern := range pr.Topics {
+		if action == ActionPublish && websocket.MatchTopic(pattern, topic) {
+			return true
+		}
+		if action == ActionSubscribe && websocket.PatternCovers(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// denies reports whether action on topic could touch any of the rule's patterns
+func (pr PolicyRule) denies(action Action, topic string) bool {
+	for _, pattern := range pr.Topics {
+		if action == ActionPublish && websocket.MatchTopic(pattern, topic) {
+			return true
+		}
+		if action == ActionSubscribe && websocket.PatternsOverlap(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAction reports whether actions includes action
+func containsAction(actions []Action, action Action) bool {
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// claimMatches reports whether a claim, a string or a list, equals or contains one of values.
+// Claims of other types such as numbers are compared by their formatted value.
+func claimMatches(claim interface{}, values []string) bool {
+	var claims []string
+	switch claim := claim.(type) {
+	case nil:
+		return false
+	case string:
+		claims = []string{claim}
+	case []string:
+		claims = claim
+	case []interface{}:
+		for _, c := range claim {
+			claims = append(claims, fmt.Sprint(c))
+		}
+	default:
+		claims = []string{fmt.Sprint(claim)}
+	}
+
+	for _, c := range claims {
+		for _, value := range values {
+			if c == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// errForbidden is returned when the policy refuses a client
+var errForbidden = errors.New("forbidden")
+
+// authorize returns an error wrapping errForbidden if the client of ctx may not perform action on topic.
+// Everything is allowed when there is no policy.
+func (s *PubSubServer) authorize(ctx context.Context, action Action, topic string) error {
+	return s.authorizeIdentity(IdentityFromContext(ctx), action, topic)
+}
+
+// authorizeIdentity is authorize for transports that keep the identity on their session rather than a context
+func (s *PubSubServer) authorizeIdentity(identity *Identity, action Action, topic string) error {
+	if s.policy == nil || s.policy.Allowed(identity, action, topic) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: not allowed to %s %q", errForbidden, action, topic)
+}
@@ -0,0 +1,342 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cpheps/coder-pub-sub/mqtt"
+	"github.com/cpheps/coder-pub-sub/pubsubpb"
+	"github.com/cpheps/coder-pub-sub/websocket"
+	gwebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// testPolicy lets the publisher of writeAPIKeys publish and the subscriber subscribe to orders, except orders.secret
+const testPolicy = `
+default: deny
+rules:
+  - effect: allow
+    actions: [publish]
+    subjects: publisher
+    topics: ["orders.>"]
+  - effect: allow
+    actions: [subscribe]
+    subjects: [subscriber]
+    topics: ["orders.>"]
+  - effect: deny
+    topics: [orders.secret]
+`
+
+// writePolicy writes a policy file and returns its path
+func writePolicy(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+func Test_Policy_Allowed(t *testing.T) {
+	policy, err := LoadPolicy(writePolicy(t, `
+rules:
+  - effect: allow
+    actions: [subscribe]
+    topics: ["public.>"]
+  - effect: allow
+    actions: [publish]
+    subjects: "*"
+    topics: "events.*"
+  - effect: allow
+    topics: ["billing.>"]
+    claims:
+      groups: billing
+  - effect: deny
+    topics: ["admin.>"]
+  - effect: allow
+    subjects: [admin-service]
+    topics: [">"]
+`))
+	require.NoError(t, err)
+
+	anonymous := (*Identity)(nil)
+	user := &Identity{Subject: "user", Claims: map[string]interface{}{}}
+	billing := &Identity{Subject: "billing", Claims: map[string]interface{}{"groups": []interface{}{"billing", "finance"}}}
+	admin := &Identity{Subject: "admin-service", Claims: map[string]interface{}{}}
+
+	testCases := []struct {
+		desc     string
+		identity *Identity
+		action   Action
+		topic    string
+		expected bool
+	}{
+		{desc: "Anonymous subscribe to public", identity: anonymous, action: ActionSubscribe, topic: "public.news", expected: true},
+		{desc: "Anonymous subscribe to public wildcard", identity: anonymous, action: ActionSubscribe, topic: "public.*", expected: true},
+		{desc: "Anonymous publish to public", identity: anonymous, action: ActionPublish, topic: "public.news", expected: false},
+		{desc: "Anonymous publish to events", identity: anonymous, action: ActionPublish, topic: "events.click", expected: false},
+		{desc: "Authenticated publish to events", identity: user, action: ActionPublish, topic: "events.click", expected: true},
+		{desc: "Authenticated publish to nested events", identity: user, action: ActionPublish, topic: "events.click.left", expected: false},
+		{desc: "Claim in list", identity: billing, action: ActionSubscribe, topic: "billing.*", expected: true},
+		{desc: "Claim missing", identity: user, action: ActionPublish, topic: "billing.invoices", expected: false},
+		{desc: "Subscription wider than allowed", identity: billing, action: ActionSubscribe, topic: ">", expected: false},
+		{desc: "Allowed everything", identity: admin, action: ActionSubscribe, topic: "orders.>", expected: true},
+		{desc: "Deny wins for publish", identity: admin, action: ActionPublish, topic: "admin.users", expected: false},
+		{desc: "Deny wins for overlapping subscribe", identity: admin, action: ActionSubscribe, topic: ">", expected: false},
+		{desc: "Default deny", identity: user, action: ActionSubscribe, topic: "orders", expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, policy.Allowed(tc.identity, tc.action, tc.topic))
+		})
+	}
+}
+
+func Test_LoadPolicy(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		contents string
+		expected string
+	}{
+		{
+			desc:     "JSON",
+			contents: `{"default": "allow", "rules": [{"effect": "deny", "topics": ["admin.>"]}]}`,
+		},
+		{
+			desc:     "Empty",
+			contents: "",
+		},
+		{
+			desc:     "Unknown key",
+			contents: "rules:\n  - effect: allow\n    topic: orders\n",
+			expected: "field topic not found",
+		},
+		{
+			desc:     "Unknown effect",
+			contents: "rules:\n  - effect: permit\n    topics: orders\n",
+			expected: `rule 0: effect must be allow or deny, not "permit"`,
+		},
+		{
+			desc:     "Unknown action",
+			contents: "rules:\n  - effect: allow\n    actions: [read]\n    topics: orders\n",
+			expected: `rule 0: action must be publish or subscribe, not "read"`,
+		},
+		{
+			desc:     "Missing topics",
+			contents: "rules:\n  - effect: allow\n",
+			expected: "rule 0: topics must be set",
+		},
+		{
+			desc:     "Invalid pattern",
+			contents: "rules:\n  - effect: allow\n    topics: orders.>.bad\n",
+			expected: "rule 0: ",
+		},
+		{
+			desc:     "Unknown default",
+			contents: "default: maybe\n",
+			expected: `default must be allow or deny, not "maybe"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := LoadPolicy(writePolicy(t, tc.contents))
+			if tc.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.expected)
+		})
+	}
+}
+
+func Test_PubSubServer_Policy(t *testing.T) {
+	startPolicyServer := func(t *testing.T) (*PubSubServer, string) {
+		return startServer(t, func(o *Options) {
+			o.TCPAddr = "127.0.0.1:0"
+			o.MQTTAddr = "127.0.0.1:0"
+			o.GRPCAddr = "127.0.0.1:0"
+			o.Auth = &AuthConfig{APIKeysFile: writeAPIKeys(t)}
+			o.PolicyFile = writePolicy(t, testPolicy)
+		})
+	}
+
+	publish := func(t *testing.T, baseURL, topic, token string) int {
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/publish/"+topic, bytes.NewBufferString("hello"))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	testCases := []struct {
+		desc     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			desc: "HTTP publish",
+			testFunc: func(t *testing.T) {
+				_, baseURL := startPolicyServer(t)
+
+				assert.Equal(t, http.StatusOK, publish(t, baseURL, "orders.created", testAPIKey))
+				assert.Equal(t, http.StatusForbidden, publish(t, baseURL, "orders.secret", testAPIKey))
+				assert.Equal(t, http.StatusForbidden, publish(t, baseURL, "orders.created", "k3y-subscriber"))
+			},
+		},
+		{
+			desc: "Websocket subscribe",
+			testFunc: func(t *testing.T) {
+				_, baseURL := startPolicyServer(t)
+				wsURL := strings.Replace(baseURL, "http://", "ws://", 1) + "/subscribe/"
+
+				conn, _, err := gwebsocket.DefaultDialer.Dial(wsURL+"orders.created?access_token=k3y-subscriber", nil)
+				require.NoError(t, err)
+				defer conn.Close()
+
+				assert.Equal(t, http.StatusOK, publish(t, baseURL, "orders.created", testAPIKey))
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				_, data, err := conn.ReadMessage()
+				require.NoError(t, err)
+				assert.Equal(t, "hello", string(data))
+
+				// orders.* may carry orders.secret so it is refused
+				for _, pattern := range []string{"orders.*", "billing"} {
+					denied, _, err := gwebsocket.DefaultDialer.Dial(wsURL+pattern+"?access_token=k3y-subscriber", nil)
+					require.NoError(t, err)
+
+					denied.SetReadDeadline(time.Now().Add(time.Second))
+					_, _, err = denied.ReadMessage()
+					assert.True(t, gwebsocket.IsCloseError(err, websocket.ClosePolicyViolation), "%s: %v", pattern, err)
+					denied.Close()
+				}
+			},
+		},
+		{
+			desc: "Event stream",
+			testFunc: func(t *testing.T) {
+				_, baseURL := startPolicyServer(t)
+
+				req, err := http.NewRequest(http.MethodGet, baseURL+"/events?topic=orders.created&topic=billing", nil)
+				require.NoError(t, err)
+				req.Header.Set("Authorization", "Bearer k3y-subscriber")
+
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+			},
+		},
+		{
+			desc: "Websocket commands",
+			testFunc: func(t *testing.T) {
+				_, baseURL := startPolicyServer(t)
+
+				conn, _, err := gwebsocket.DefaultDialer.Dial(strings.Replace(baseURL, "http://", "ws://", 1)+"/connect?access_token=k3y-subscriber", nil)
+				require.NoError(t, err)
+				defer conn.Close()
+				client := &connectClient{t: t, conn: conn}
+
+				client.command(`{"type":"subscribe","ref":"1","sid":"orders","topic":"orders.created"}`)
+
+				client.send(`{"type":"subscribe","ref":"2","sid":"secret","topic":"orders.secret"}`)
+				reply := client.read()
+				assert.Equal(t, frameError, reply.Type)
+				assert.Contains(t, reply.Error, `not allowed to subscribe "orders.secret"`)
+
+				client.send(`{"type":"publish","ref":"3","topic":"orders.created","data":"hello"}`)
+				reply = client.read()
+				assert.Equal(t, frameError, reply.Type)
+				assert.Contains(t, reply.Error, `not allowed to publish "orders.created"`)
+			},
+		},
+		{
+			desc: "gRPC",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startPolicyServer(t)
+				client := dialGRPC(t, pubsubServer)
+
+				ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer k3y-subscriber")
+				_, err := client.Publish(ctx, &pubsubpb.PublishRequest{Topic: "orders.created"})
+				assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+				stream, err := client.Subscribe(ctx, &pubsubpb.SubscribeRequest{Pattern: "orders.secret"})
+				require.NoError(t, err)
+				_, err = stream.Recv()
+				assert.Equal(t, codes.PermissionDenied, status.Code(err))
+			},
+		},
+		{
+			desc: "TCP line protocol",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startPolicyServer(t)
+
+				client := dialTCP(t, pubsubServer)
+				client.send("AUTH k3y-subscriber\r\n")
+				assert.Equal(t, "+OK", client.readLine())
+
+				client.send("SUB orders.secret 1\r\n")
+				assert.Equal(t, `-ERR 'forbidden: not allowed to subscribe "orders.secret"'`, client.readLine())
+
+				// The payload of a denied publish is read so the connection stays usable
+				client.send("PUB orders.created 5\r\nhello\r\nPING\r\n")
+				assert.Equal(t, `-ERR 'forbidden: not allowed to publish "orders.created"'`, client.readLine())
+				assert.Equal(t, "PONG", client.readLine())
+			},
+		},
+		{
+			desc: "MQTT",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startPolicyServer(t)
+				connect := &mqtt.Connect{
+					ProtocolName:  "MQTT",
+					ProtocolLevel: mqtt.ProtocolLevel,
+					ClientID:      "client",
+					CleanSession:  true,
+					HasPassword:   true,
+					Password:      []byte("k3y-subscriber"),
+				}
+
+				client := dialMQTT(t, pubsubServer, connect)
+				client.expect(&mqtt.Connack{ReturnCode: mqtt.Accepted})
+
+				client.send(&mqtt.Subscribe{PacketID: 1, Subscriptions: []mqtt.Subscription{{Filter: "orders.created", QoS: 1}, {Filter: "orders.secret"}}})
+				client.expect(&mqtt.Suback{PacketID: 1, ReturnCodes: []byte{1, mqtt.SubscribeFailure}})
+
+				// A denied publish is acked but never delivered
+				client.send(&mqtt.Publish{QoS: 1, PacketID: 2, Topic: "orders.created", Payload: []byte("hello")})
+				client.expect(&mqtt.Puback{PacketID: 2})
+
+				connect.ClientID = "will"
+				connect.Will = &mqtt.Publish{Topic: "orders.created", Payload: []byte("gone")}
+				dialMQTT(t, pubsubServer, connect).expect(&mqtt.Connack{ReturnCode: mqtt.RefusedNotAuthorized})
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, tc.testFunc)
+	}
+}
+
+func Test_PubSubServer_authorize(t *testing.T) {
+	pubsubServer, _ := startServer(t)
+	assert.NoError(t, pubsubServer.authorize(context.Background(), ActionPublish, "orders"))
+
+	pubsubServer.policy = &Policy{}
+	err := pubsubServer.authorize(context.Background(), ActionPublish, "orders")
+	assert.True(t, errors.Is(err, errForbidden))
+}
@@ -0,0 +1,374 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cpheps/coder-pub-sub/websocket"
+	"github.com/gorilla/mux"
+)
+
+// cursorHeader carries the cursor of a poll, it is the only place to find it in a 204 response
+const cursorHeader = "X-Pubsub-Cursor"
+
+// PollConfig configures the long polling endpoint
+type PollConfig struct {
+	// DefaultWait is how long a poll waits for messages when the client doesn't say
+	DefaultWait time.Duration
+
+	// MaxWait caps how long a client may ask a poll to wait
+	MaxWait time.Duration
+
+	// IdleTimeout is how long a cursor is kept without being polled before it is dropped
+	IdleTimeout time.Duration
+
+	// MaxPending is the number of messages held for a cursor between polls, the oldest are dropped beyond it
+	MaxPending int
+
+	// MaxBatch caps the number of messages returned by a single poll
+	MaxBatch int
+}
+
+// DefaultPollConfig returns the PollConfig used when none is specified
+func DefaultPollConfig() PollConfig {
+	return PollConfig{
+		DefaultWait: 30 * time.Second,
+		MaxWait:     60 * time.Second,
+		IdleTimeout: 2 * time.Minute,
+		MaxPending:  1000,
+		MaxBatch:    100,
+	}
+}
+
+// Validate checks the PollConfig is usable
+func (pc PollConfig) Validate() error {
+	if pc.DefaultWait <= 0 || pc.MaxWait < pc.DefaultWait {
+		return errors.New("poll wait must be greater than 0 and no more than the max wait")
+	}
+
+	if pc.IdleTimeout <= pc.MaxWait {
+		return errors.New("poll idle timeout must be greater than the max wait")
+	}
+
+	if pc.MaxPending <= 0 || pc.MaxBatch <= 0 {
+		return errors.New("poll max pending and max batch must be greater than 0")
+	}
+
+	return nil
+}
+
+// pollSession is the state kept for a cursor between polls
+type pollSession struct {
+	conn    *websocket.PollConn
+	pattern string
+
+	// lastPoll and polling are guarded by pollSessions.mu
+	lastPoll time.Time
+	polling  int
+}
+
+// pollSessions tracks the cursors of long polling clients
+type pollSessions struct {
+	config PollConfig
+
+	mu       sync.Mutex
+	sessions map[string]*pollSession
+}
+
+// newPollSessions creates an empty set of sessions configured by config
+func newPollSessions(config PollConfig) *pollSessions {
+	return &pollSessions{
+		config:   config,
+		sessions: make(map[string]*pollSession),
+	}
+}
+
+// add tracks a new session
+func (ps *pollSessions) add(session *pollSession) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	session.lastPoll = time.Now()
+	ps.sessions[session.conn.ID()] = session
+}
+
+// acquire returns the session with id and marks it as being polled. Returns false if there is no such session.
+func (ps *pollSessions) acquire(id string) (*pollSession, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	session, ok := ps.sessions[id]
+	if ok {
+		session.polling++
+	}
+	return session, ok
+}
+
+// release marks a poll of session as finished
+func (ps *pollSessions) release(session *pollSession) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	session.polling--
+	session.lastPoll = time.Now()
+}
+
+// remove stops tracking the session with id
+func (ps *pollSessions) remove(id string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	delete(ps.sessions, id)
+}
+
+// expire removes and returns the sessions that haven't been polled within the idle timeout
+func (ps *pollSessions) expire(now time.Time) []*pollSession {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	expired := make([]*pollSession, 0)
+	for id, session := range ps.sessions {
+		if session.polling == 0 && now.Sub(session.lastPoll) > ps.config.IdleTimeout {
+			delete(ps.sessions, id)
+			expired = append(expired, session)
+		}
+	}
+
+	return expired
+}
+
+// reapPollSessions unregisters sessions that clients stopped polling until the server closes
+func (s *PubSubServer) reapPollSessions() {
+	ticker := time.NewTicker(s.polls.config.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.doneChan:
+			return
+		case now := <-ticker.C:
+			for _, session := range s.polls.expire(now) {
+				log.Println("Dropping idle poll cursor for topic", session.pattern)
+				s.broadcaster.UnregisterConnection(session.conn)
+				session.conn.Close()
+			}
+		}
+	}
+}
+
+// formatCursor creates the cursor acknowledging the messages of a session up to seq
+func formatCursor(id string, seq uint64) string {
+	return fmt.Sprintf("%s-%d", id, seq)
+}
+
+// parseCursor splits a cursor into its session ID and the sequence number it acknowledges
+func parseCursor(cursor string) (string, uint64, error) {
+	i := strings.LastIndexByte(cursor, '-')
+	if i <= 0 {
+		return "", 0, fmt.Errorf("malformed cursor %q", cursor)
+	}
+
+	seq, err := strconv.ParseUint(cursor[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("malformed cursor %q", cursor)
+	}
+
+	return cursor[:i], seq, nil
+}
+
+// parsePoll reads the wait and max query parameters of a poll.
+//
+//	wait=<duration> how long to wait for messages, such as 10s. Capped at the max wait.
+//	max=<n>         the most messages to return. Capped at the max batch.
+func parsePoll(query url.Values, config PollConfig) (time.Duration, int, error) {
+	wait, max := config.DefaultWait, config.MaxBatch
+
+	if value := query.Get("wait"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return 0, 0, fmt.Errorf("wait must be a duration: %q", value)
+		}
+		wait = parsed
+	}
+
+	if value := query.Get("max"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return 0, 0, fmt.Errorf("max must be a positive number: %q", value)
+		}
+		max = parsed
+	}
+
+	if wait > config.MaxWait {
+		wait = config.MaxWait
+	}
+
+	if max > config.MaxBatch {
+		max = config.MaxBatch
+	}
+
+	return wait, max, nil
+}
+
+// Poll returns the next batch of messages published to the topic pattern in the request path.
+// The first poll, without a cursor query parameter, subscribes and starts a session. Every response carries
+// a cursor which the next poll passes back to acknowledge the messages it received and wait for the ones after.
+// Messages published between polls are held for the cursor so nothing is missed.
+//
+// Responds with 200 and the messages as envelopes, or 204 if none arrived in time.
+// A cursor that has expired, or was never handed out, gets a 404.
+// The optional query parameters are described by parsePoll and parseSubscription.
+func (s *PubSubServer) Poll(w http.ResponseWriter, r *http.Request) {
+	topic := mux.Vars(r)[topicVar]
+	if err := websocket.ValidatePattern(topic); err != nil {
+		log.Println("Rejecting poll", err)
+		s.writeResponse(w, http.StatusBadRequest, &errorResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+
+	if err := s.authorize(r.Context(), ActionSubscribe, topic); err != nil {
+		log.Println("Rejecting poll", err)
+		s.writeResponse(w, http.StatusForbidden, &errorResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+
+	query := r.URL.Query()
+	wait, max, err := parsePoll(query, s.polls.config)
+	if err != nil {
+		log.Println("Rejecting poll", err)
+		s.writeResponse(w, http.StatusBadRequest, &errorResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+
+	var session *pollSession
+	var after uint64
+	if cursor := query.Get("cursor"); cursor != "" {
+		session, after, err = s.resumePoll(topic, cursor)
+	} else {
+		session, err = s.startPoll(r.Context(), topic, query)
+	}
+
+	if errors.Is(err, errUnknownCursor) {
+		log.Println("Rejecting poll", err)
+		s.writeResponse(w, http.StatusNotFound, &errorResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+
+	if err != nil {
+		log.Println("Rejecting poll", err)
+		s.writeResponse(w, http.StatusBadRequest, &errorResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+	defer s.polls.release(session)
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	// Stop waiting if the server closes
+	go func() {
+		select {
+		case <-s.doneChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	msgs := session.conn.Poll(ctx, after, max)
+	if len(msgs) > 0 {
+		after = msgs[len(msgs)-1].Seq
+	}
+
+	cursor := formatCursor(session.conn.ID(), after)
+	w.Header().Set(cursorHeader, cursor)
+
+	if len(msgs) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	s.writeResponse(w, http.StatusOK, newPollResponse(cursor, msgs))
+}
+
+// errUnknownCursor is returned when polling with a cursor that has no session
+var errUnknownCursor = errors.New("unknown or expired cursor")
+
+// startPoll subscribes a new session to pattern
+func (s *PubSubServer) startPoll(ctx context.Context, pattern string, query url.Values) (*pollSession, error) {
+	sub, err := s.parseSubscription(ctx, query, websocket.FormatEnvelope)
+	if err != nil {
+		return nil, err
+	}
+
+	if sub.Format != websocket.FormatEnvelope {
+		return nil, errors.New("polls only support the envelope format")
+	}
+
+	if sub.Ack != nil {
+		return nil, errors.New("ack is not supported by polls, the cursor acknowledges messages")
+	}
+
+	sub.Pattern = pattern
+	conn := websocket.NewPollConn(s.polls.config.MaxPending)
+
+	log.Println("Registering a poll session to topic", pattern)
+	if err := s.broadcaster.RegisterConnection(sub, conn); err != nil {
+		return nil, err
+	}
+
+	session := &pollSession{
+		conn:    conn,
+		pattern: pattern,
+	}
+	s.polls.add(session)
+
+	session, _ = s.polls.acquire(conn.ID())
+	return session, nil
+}
+
+// resumePoll finds the session of cursor and the sequence number it acknowledges
+func (s *PubSubServer) resumePoll(pattern, cursor string) (*pollSession, uint64, error) {
+	id, after, err := parseCursor(cursor)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	session, ok := s.polls.acquire(id)
+	if !ok {
+		return nil, 0, errUnknownCursor
+	}
+
+	// A session whose connection was closed, for falling too far behind for instance, can't be resumed
+	select {
+	case <-session.conn.Done():
+		s.polls.release(session)
+		s.polls.remove(id)
+		s.broadcaster.UnregisterConnection(session.conn)
+		return nil, 0, errUnknownCursor
+	default:
+	}
+
+	if session.pattern != pattern {
+		s.polls.release(session)
+		return nil, 0, errUnknownCursor
+	}
+
+	return session, after, nil
+}
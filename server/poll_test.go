@@ -0,0 +1,288 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cpheps/coder-pub-sub/websocket"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseCursor(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		cursor      string
+		expectedID  string
+		expectedSeq uint64
+		expectedErr string
+	}{
+		{
+			desc:        "Valid",
+			cursor:      "abc-42",
+			expectedID:  "abc",
+			expectedSeq: 42,
+		},
+		{
+			desc:        "Missing sequence",
+			cursor:      "abc",
+			expectedErr: `malformed cursor "abc"`,
+		},
+		{
+			desc:        "Missing ID",
+			cursor:      "-42",
+			expectedErr: `malformed cursor "-42"`,
+		},
+		{
+			desc:        "Invalid sequence",
+			cursor:      "abc-x",
+			expectedErr: `malformed cursor "abc-x"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			id, seq, err := parseCursor(tc.cursor)
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedErr)
+			}
+			assert.Equal(t, tc.expectedID, id)
+			assert.Equal(t, tc.expectedSeq, seq)
+		})
+	}
+}
+
+func Test_parsePoll(t *testing.T) {
+	config := DefaultPollConfig()
+
+	testCases := []struct {
+		desc         string
+		query        string
+		expectedWait time.Duration
+		expectedMax  int
+		expectedErr  string
+	}{
+		{
+			desc:         "Defaults",
+			query:        "",
+			expectedWait: config.DefaultWait,
+			expectedMax:  config.MaxBatch,
+		},
+		{
+			desc:         "Wait and max",
+			query:        "wait=5s&max=10",
+			expectedWait: 5 * time.Second,
+			expectedMax:  10,
+		},
+		{
+			desc:         "Capped",
+			query:        "wait=1h&max=100000",
+			expectedWait: config.MaxWait,
+			expectedMax:  config.MaxBatch,
+		},
+		{
+			desc:        "Invalid wait",
+			query:       "wait=soon",
+			expectedErr: `wait must be a duration: "soon"`,
+		},
+		{
+			desc:        "Invalid max",
+			query:       "max=0",
+			expectedErr: `max must be a positive number: "0"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			query, err := url.ParseQuery(tc.query)
+			assert.NoError(t, err)
+
+			wait, max, err := parsePoll(query, config)
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedErr)
+			}
+			assert.Equal(t, tc.expectedWait, wait)
+			assert.Equal(t, tc.expectedMax, max)
+		})
+	}
+}
+
+func Test_PollConfig_Validate(t *testing.T) {
+	config := DefaultPollConfig()
+	assert.NoError(t, config.Validate())
+
+	config.IdleTimeout = config.MaxWait
+	assert.EqualError(t, config.Validate(), "poll idle timeout must be greater than the max wait")
+
+	opts := DefaultOptions()
+	opts.Poll = config
+	_, err := New(opts)
+	assert.Error(t, err)
+}
+
+func Test_PubSubServer_Poll(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			desc: "Invalid topic",
+			testFunc: func(t *testing.T) {
+				mockBroadcaster := &websocket.MockBroadcaster{}
+				pubsubServer := &PubSubServer{
+					broadcaster: mockBroadcaster,
+					polls:       newPollSessions(DefaultPollConfig()),
+				}
+
+				req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/poll/orders.%3E.created", http.NoBody).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders.>.created"})
+				w := httptest.NewRecorder()
+
+				pubsubServer.Poll(w, req)
+
+				assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+				mockBroadcaster.AssertNotCalled(t, "RegisterConnection", mock.Anything, mock.Anything)
+			},
+		},
+		{
+			desc: "Ack not supported",
+			testFunc: func(t *testing.T) {
+				mockBroadcaster := &websocket.MockBroadcaster{}
+				pubsubServer := &PubSubServer{
+					broadcaster: mockBroadcaster,
+					ack:         websocket.DefaultAckConfig(),
+					polls:       newPollSessions(DefaultPollConfig()),
+				}
+
+				req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/poll/orders?ack=true", http.NoBody).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
+				w := httptest.NewRecorder()
+
+				pubsubServer.Poll(w, req)
+
+				assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+				mockBroadcaster.AssertNotCalled(t, "RegisterConnection", mock.Anything, mock.Anything)
+			},
+		},
+		{
+			desc: "Unknown cursor",
+			testFunc: func(t *testing.T) {
+				mockBroadcaster := &websocket.MockBroadcaster{}
+				pubsubServer := &PubSubServer{
+					broadcaster: mockBroadcaster,
+					polls:       newPollSessions(DefaultPollConfig()),
+				}
+
+				req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/poll/orders?cursor=abc-1", http.NoBody).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
+				w := httptest.NewRecorder()
+
+				pubsubServer.Poll(w, req)
+
+				assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+			},
+		},
+		{
+			desc: "Idle session is dropped",
+			testFunc: func(t *testing.T) {
+				mockBroadcaster := &websocket.MockBroadcaster{}
+				mockBroadcaster.On("RegisterConnection", websocket.Subscription{Pattern: "orders", Format: websocket.FormatEnvelope}, mock.Anything).Return(nil)
+
+				pubsubServer := &PubSubServer{
+					broadcaster: mockBroadcaster,
+					polls:       newPollSessions(DefaultPollConfig()),
+				}
+
+				req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/poll/orders?wait=0s", http.NoBody).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
+				w := httptest.NewRecorder()
+
+				pubsubServer.Poll(w, req)
+
+				assert.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+				assert.NotEmpty(t, w.Result().Header.Get(cursorHeader))
+				mockBroadcaster.AssertExpectations(t)
+
+				assert.Empty(t, pubsubServer.polls.expire(time.Now()))
+				assert.Len(t, pubsubServer.polls.expire(time.Now().Add(time.Hour)), 1)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, tc.testFunc)
+	}
+}
+
+func Test_PubSubServer_Poll_EndToEnd(t *testing.T) {
+	pubsubServer, err := New(DefaultOptions())
+	require.NoError(t, err)
+	defer pubsubServer.Close()
+
+	srv := httptest.NewServer(pubsubServer.srv.Handler)
+	defer srv.Close()
+
+	poll := func(query string) *http.Response {
+		resp, err := http.Get(srv.URL + "/poll/orders.*?wait=100ms" + query)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// The first poll subscribes and times out as nothing is published
+	resp := poll("")
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	cursor := resp.Header.Get(cursorHeader)
+	require.NotEmpty(t, cursor)
+
+	// Messages published between polls are held for the cursor
+	for _, body := range []string{"one", "two"} {
+		resp, err := http.Post(srv.URL+"/publish/orders.created", "text/plain", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	resp = poll("&cursor=" + cursor)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var batch struct {
+		Cursor   string `json:"cursor"`
+		Messages []struct {
+			Topic string `json:"topic"`
+			Data  string `json:"data"`
+		} `json:"messages"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&batch))
+	resp.Body.Close()
+
+	require.Len(t, batch.Messages, 2)
+	assert.Equal(t, "orders.created", batch.Messages[0].Topic)
+	assert.Equal(t, "one", batch.Messages[0].Data)
+	assert.Equal(t, "two", batch.Messages[1].Data)
+	assert.Equal(t, batch.Cursor, resp.Header.Get(cursorHeader))
+
+	// The new cursor acknowledges both messages
+	resp = poll("&cursor=" + batch.Cursor)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, batch.Cursor, resp.Header.Get(cursorHeader))
+
+	// The cursor only resumes the topic it was created for
+	resp, err = http.Get(srv.URL + "/poll/billing?wait=100ms&cursor=" + batch.Cursor)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/cpheps/coder-pub-sub/websocket"
+)
+
+// parseReplay reads the replay query parameters of a subscribe request.
+//
+//	since=<seq> replays retained messages published after sequence number seq
+//	last=<n>    replays at most the last n retained messages
+//
+// Both may be combined. Returns nil if neither is set.
+func parseReplay(query url.Values) (*websocket.Replay, error) {
+	since, last := query.Get("since"), query.Get("last")
+	if since == "" && last == "" {
+		return nil, nil
+	}
+
+	replay := &websocket.Replay{}
+
+	if since != "" {
+		seq, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("since must be a sequence number: %q", since)
+		}
+		replay.Since = seq
+	}
+
+	if last != "" {
+		n, err := strconv.Atoi(last)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("last must be a positive number: %q", last)
+		}
+		replay.Last = n
+	}
+
+	return replay, nil
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/cpheps/coder-pub-sub/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseReplay(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		query       string
+		expected    *websocket.Replay
+		expectedErr string
+	}{
+		{
+			desc:     "No replay",
+			query:    "format=envelope",
+			expected: nil,
+		},
+		{
+			desc:     "Since",
+			query:    "since=42",
+			expected: &websocket.Replay{Since: 42},
+		},
+		{
+			desc:     "Last",
+			query:    "last=10",
+			expected: &websocket.Replay{Last: 10},
+		},
+		{
+			desc:     "Since and last",
+			query:    "since=42&last=10",
+			expected: &websocket.Replay{Since: 42, Last: 10},
+		},
+		{
+			desc:        "Invalid since",
+			query:       "since=-1",
+			expectedErr: `since must be a sequence number: "-1"`,
+		},
+		{
+			desc:        "Invalid last",
+			query:       "last=0",
+			expectedErr: `last must be a positive number: "0"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			query, err := url.ParseQuery(tc.query)
+			assert.NoError(t, err)
+
+			actual, err := parseReplay(query)
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedErr)
+			}
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
@@ -1,6 +1,105 @@
 package server
 
+import (
+	"encoding/json"
+
+	"github.com/cpheps/coder-pub-sub/websocket"
+)
+
 // errorResponse represents an error response
 type errorResponse struct {
 	Message string `json:"message"`
 }
+
+// publishResponse summarizes the delivery of a published message
+type publishResponse struct {
+	ID        string            `json:"id"`
+	Seq       uint64            `json:"seq"`
+	Delivered int               `json:"delivered"`
+	Failed    int               `json:"failed"`
+	Skipped   int               `json:"skipped"`
+	Errors    map[string]string `json:"errors,omitempty"`
+}
+
+// newPublishResponse creates a publishResponse from the result of broadcasting msg
+func newPublishResponse(msg *websocket.Message, result *websocket.BroadcastResult) *publishResponse {
+	resp := &publishResponse{
+		ID:        msg.ID,
+		Seq:       msg.Seq,
+		Delivered: result.Delivered,
+		Failed:    result.Failed,
+		Skipped:   result.Skipped,
+	}
+
+	if len(result.Errors) > 0 {
+		resp.Errors = make(map[string]string, len(result.Errors))
+		for id, err := range result.Errors {
+			resp.Errors[id] = err.Error()
+		}
+	}
+
+	return resp
+}
+
+// pollResponse is a batch of messages returned to a long polling client
+type pollResponse struct {
+	// Cursor is passed to the next poll to acknowledge these messages and receive the ones after them
+	Cursor   string            `json:"cursor"`
+	Messages []json.RawMessage `json:"messages"`
+}
+
+// newPollResponse creates a pollResponse holding the envelope of each message
+func newPollResponse(cursor string, msgs []*websocket.Message) *pollResponse {
+	resp := &pollResponse{
+		Cursor:   cursor,
+		Messages: make([]json.RawMessage, 0, len(msgs)),
+	}
+
+	for _, msg := range msgs {
+		resp.Messages = append(resp.Messages, msg.Encode(websocket.FormatEnvelope))
+	}
+
+	return resp
+}
+
+// webhookResponse describes a registered webhook
+type webhookResponse struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	Topic    string `json:"topic"`
+	Format   string `json:"format"`
+	Consumer string `json:"consumer,omitempty"`
+	Group    string `json:"group,omitempty"`
+
+	// Secret is only returned when the webhook is created
+	Secret string `json:"secret,omitempty"`
+
+	// Status is active or disabled
+	Status    string `json:"status"`
+	Delivered uint64 `json:"delivered"`
+	Failed    uint64 `json:"failed"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// newWebhookResponse describes hook without its secret
+func newWebhookResponse(hook *webhook) *webhookResponse {
+	stats := hook.conn.Stats()
+
+	status := "active"
+	if stats.Disabled {
+		status = "disabled"
+	}
+
+	return &webhookResponse{
+		ID:        hook.id,
+		URL:       hook.url,
+		Topic:     hook.sub.Pattern,
+		Format:    hook.sub.Format.String(),
+		Consumer:  hook.consumer,
+		Group:     hook.sub.Group,
+		Status:    status,
+		Delivered: stats.Delivered,
+		Failed:    stats.Failed,
+		LastError: stats.LastError,
+	}
+}
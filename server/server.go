@@ -2,63 +2,261 @@
 package server
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 
+	"github.com/cpheps/coder-pub-sub/storage"
 	"github.com/cpheps/coder-pub-sub/websocket"
 	"github.com/gorilla/mux"
 	gwebsocket "github.com/gorilla/websocket"
 )
 
+// topicVar is the name of the mux path variable holding the topic.
+// The topic may span several path segments when using '/' as a separator.
+const topicVar = "topic"
+
 // PubSubServer a server the implements pub/sub via websockets
 type PubSubServer struct {
 	doneChan    chan struct{}
 	srv         *http.Server
 	upgrader    websocket.Upgrader
 	broadcaster websocket.Broadcaster
+	store       storage.Store
+	ack         websocket.AckConfig
+	keepalive   websocket.KeepaliveConfig
+	polls       *pollSessions
+	webhooks    *webhookRegistry
+
+	// authenticators check client tokens in order, clients don't need to authenticate if there are none
+	authenticators []Authenticator
+
+	// cors sets the origins browsers may connect from
+	cors CORSConfig
+
+	// policy decides which topics clients may publish and subscribe to, nil allows everything
+	policy *Policy
+
+	// tls holds the certificates every listener is served with, nil if TLS is disabled
+	tls *certReloader
+
+	// maxPayload caps the size of a published payload, zero means no limit
+	maxPayload int
+
+	// tcp serves the TCP line protocol, nil if it is disabled
+	tcp *streamListener
+
+	// mqtt serves MQTT 3.1.1 to mqttClients, nil if it is disabled
+	mqtt        *streamListener
+	mqttClients *mqttClients
+
+	// grpc serves the gRPC PubSub service, nil if it is disabled
+	grpc *grpcListener
 }
 
-// New creates a new instance of the PubSub Server that listens on the supplied addr.
+// New creates a new instance of the PubSub Server configured by opts.
 // Uses gorilla websocket and mux
-func New(addr string, broadcastConcurrency int) (*PubSubServer, error) {
-	broadcaster, err := websocket.NewCacheBroadcaster(broadcastConcurrency)
+func New(opts Options) (*PubSubServer, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	store, err := opts.newStore()
 	if err != nil {
 		return nil, err
 	}
 
+	broadcaster, err := websocket.NewCacheBroadcaster(opts.BroadcastConcurrency, opts.Queue, store, opts.Balancing)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	var reloader *certReloader
+	if opts.TLS != nil {
+		reloader, err = newCertReloader(*opts.TLS)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+
+	var authenticators []Authenticator
+	if opts.Auth != nil {
+		authenticators, err = newAuthenticators(*opts.Auth)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+
+	var policy *Policy
+	if opts.PolicyFile != "" {
+		policy, err = LoadPolicy(opts.PolicyFile)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+
 	// Create the server before the router so we can register it's handlers on the router
 	pubSubServer := &PubSubServer{
 		doneChan: make(chan struct{}),
 		srv: &http.Server{
-			Addr: addr,
+			Addr:              opts.Addr,
+			ReadHeaderTimeout: opts.ReadHeaderTimeout,
+			IdleTimeout:       opts.IdleTimeout,
+			// Event streams bound their writes with deadlines on the connection
+			ConnContext: websocket.ConnContext,
 		},
-		upgrader:    websocket.NewGorillaUpgrader(&gwebsocket.Upgrader{}),
-		broadcaster: broadcaster,
+		upgrader: websocket.NewGorillaUpgrader(&gwebsocket.Upgrader{
+			Subprotocols: []string{WebsocketSubprotocol},
+			CheckOrigin:  opts.CORS.checkOrigin,
+		}, opts.Keepalive),
+		broadcaster:    broadcaster,
+		store:          store,
+		ack:            opts.Ack,
+		keepalive:      opts.Keepalive,
+		authenticators: authenticators,
+		policy:         policy,
+		cors:           opts.CORS,
+		tls:            reloader,
+		maxPayload:     opts.MaxPayload,
+		polls:          newPollSessions(opts.Poll),
+		webhooks:       newWebhookRegistry(opts.Webhook),
+	}
+
+	// Every listener shares the reloader's certificates so a reload applies to all of them
+	var tlsConfig *tls.Config
+	if reloader != nil {
+		tlsConfig = reloader.tlsConfig()
+		pubSubServer.srv.TLSConfig = tlsConfig
+		go reloader.watch(pubSubServer.doneChan)
+	}
+
+	if opts.TCPAddr != "" {
+		pubSubServer.tcp = newStreamListener("TCP line protocol", opts.TCPAddr, tlsConfig, pubSubServer.newTCPSession)
+	}
+
+	if opts.MQTTAddr != "" {
+		pubSubServer.mqtt = newStreamListener("MQTT", opts.MQTTAddr, tlsConfig, pubSubServer.newMQTTSession)
+		pubSubServer.mqttClients = newMQTTClients()
+	}
+
+	if opts.GRPCAddr != "" {
+		pubSubServer.grpc = newGRPCListener(opts.GRPCAddr, opts.MaxPayload, tlsConfig, pubSubServer)
 	}
 
 	r := mux.NewRouter()
 
+	// Answer CORS preflights first as browsers don't send tokens with them
+	r.Use(pubSubServer.crossOrigin)
+
+	// Make the identity proven by a client certificate or token available to handlers
+	r.Use(pubSubServer.identify)
+	r.Use(pubSubServer.authenticate)
+
 	// Register GET only for subscribe
-	r.HandleFunc("/subscribe", pubSubServer.RegisterSubscriber).Methods(http.MethodGet)
+	r.HandleFunc("/subscribe/{topic:.+}", pubSubServer.RegisterSubscriber).Methods(http.MethodGet)
+
+	// Register GET only for the websocket command protocol
+	r.HandleFunc("/connect", pubSubServer.Connect).Methods(http.MethodGet)
+
+	// Register GET only for server-sent events
+	r.HandleFunc("/events", pubSubServer.Events).Methods(http.MethodGet)
+
+	// Register GET only for long polling
+	r.HandleFunc("/poll/{topic:.+}", pubSubServer.Poll).Methods(http.MethodGet)
+
+	// Register webhook management
+	r.HandleFunc("/webhooks", pubSubServer.CreateWebhook).Methods(http.MethodPost)
+	r.HandleFunc("/webhooks", pubSubServer.ListWebhooks).Methods(http.MethodGet)
+	r.HandleFunc("/webhooks/{id}", pubSubServer.GetWebhook).Methods(http.MethodGet)
+	r.HandleFunc("/webhooks/{id}", pubSubServer.DeleteWebhook).Methods(http.MethodDelete)
+	r.HandleFunc("/webhooks/{id}/enable", pubSubServer.EnableWebhook).Methods(http.MethodPost)
 
 	// Register Post only for publish
-	r.HandleFunc("/publish", pubSubServer.Publish).Methods(http.MethodPost)
+	r.HandleFunc("/publish/{topic:.+}", pubSubServer.Publish).Methods(http.MethodPost)
+
+	// Register OPTIONS on every path for CORS preflights
+	r.PathPrefix("/").HandlerFunc(pubSubServer.Preflight).Methods(http.MethodOptions)
 
 	// Set mux on the server
 	pubSubServer.srv.Handler = r
+
+	go pubSubServer.reapPollSessions()
+
 	return pubSubServer, nil
 }
 
 // ListenAndServe starts the server and blocks until the server returns.
+// The TCP line protocol, MQTT and gRPC listeners, if enabled, are served alongside HTTP and the first to return ends the call.
 // The server can be closed via the Close call
 func (s *PubSubServer) ListenAndServe() error {
-	log.Println("PubSub server listening on", s.srv.Addr)
+	if s.tls != nil {
+		log.Println("PubSub server listening with TLS on", s.srv.Addr)
+	} else {
+		log.Println("PubSub server listening on", s.srv.Addr)
+	}
 	log.Println("Endpoints:")
-	log.Println("GET /subscribe")
-	log.Println("POST /publish")
-	return s.srv.ListenAndServe()
+	log.Println("GET /subscribe/{topic}")
+	log.Println("GET /connect")
+	log.Println("GET /events?topic={topic}")
+	log.Println("GET /poll/{topic}?cursor={cursor}")
+	log.Println("POST /publish/{topic}")
+	log.Println("POST /webhooks")
+	log.Println("GET /webhooks")
+	log.Println("GET /webhooks/{id}")
+	log.Println("DELETE /webhooks/{id}")
+	log.Println("POST /webhooks/{id}/enable")
+
+	listeners := s.listeners()
+
+	// Bind before serving HTTP so an unusable address is reported straight away
+	for i, listener := range listeners {
+		if err := listener.listen(s.doneChan); err != nil {
+			for _, bound := range listeners[:i] {
+				bound.unlisten()
+			}
+			return err
+		}
+	}
+
+	errChan := make(chan error, len(listeners)+1)
+	for _, listener := range listeners {
+		go func(listener serverListener) {
+			errChan <- listener.serve(s.doneChan)
+		}(listener)
+	}
+	go func() {
+		if s.tls != nil {
+			// The certificate comes from the TLSConfig so no files are passed
+			errChan <- s.srv.ListenAndServeTLS("", "")
+			return
+		}
+		errChan <- s.srv.ListenAndServe()
+	}()
+
+	return <-errChan
+}
+
+// listeners returns the enabled listeners of protocols served outside of HTTP
+func (s *PubSubServer) listeners() []serverListener {
+	listeners := make([]serverListener, 0, 3)
+	if s.tcp != nil {
+		listeners = append(listeners, s.tcp)
+	}
+	if s.mqtt != nil {
+		listeners = append(listeners, s.mqtt)
+	}
+	if s.grpc != nil {
+		listeners = append(listeners, s.grpc)
+	}
+	return listeners
 }
 
 // Close causes a graceful shutdown of the server
@@ -66,13 +264,55 @@ func (s *PubSubServer) Close() error {
 	log.Println("Closing server")
 	// Close the done channel to stop all blocking handlers
 	close(s.doneChan)
+
+	// Close HTTP connections first so a write blocked on a client that stopped reading can't hold up the rest
+	err := s.srv.Close()
 	s.broadcaster.CloseConnections()
-	return s.srv.Close()
+
+	// Disconnect TCP, MQTT and gRPC clients and wait for them so none publish after the store is closed
+	for _, listener := range s.listeners() {
+		if listenerErr := listener.close(); listenerErr != nil && err == nil {
+			err = listenerErr
+		}
+	}
+
+	// Close the store last so in flight publishes are not cut off
+	if s.store != nil {
+		if storeErr := s.store.Close(); storeErr != nil {
+			log.Println("Error while closing message store", storeErr)
+			if err == nil {
+				err = storeErr
+			}
+		}
+	}
+
+	return err
 }
 
-// RegisterSubscriber registers a subscriber with the server and opens up a websocket
+// RegisterSubscriber registers a subscriber to the topic pattern in the request path and opens up a websocket.
+// The pattern may contain wildcards such as orders.*, orders.> or sensors/+/temp.
+// Optional query parameters configure the subscription, see parseSubscription.
 func (s *PubSubServer) RegisterSubscriber(w http.ResponseWriter, r *http.Request) {
-	log.Println("Registering a subscriber")
+	topic := mux.Vars(r)[topicVar]
+	if err := websocket.ValidatePattern(topic); err != nil {
+		log.Println("Rejecting subscriber", err)
+		s.writeResponse(w, http.StatusBadRequest, &errorResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+
+	sub, err := s.parseSubscription(r.Context(), r.URL.Query(), websocket.FormatRaw)
+	if err != nil {
+		log.Println("Rejecting subscriber", err)
+		s.writeResponse(w, http.StatusBadRequest, &errorResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+	sub.Pattern = topic
+
+	log.Println("Registering a subscriber to topic", topic)
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("Error while upgrading connection to websocket", err)
@@ -82,19 +322,81 @@ func (s *PubSubServer) RegisterSubscriber(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// Browsers can't read the status of a failed handshake so a denied subscriber is told with a close code instead
+	if err := s.authorize(r.Context(), ActionSubscribe, topic); err != nil {
+		log.Println("Rejecting subscriber", err)
+		if err := websocket.CloseWithReason(conn, websocket.ClosePolicyViolation, err.Error()); err != nil {
+			log.Println("Error while closing websocket", err)
+		}
+		return
+	}
+
 	// Register the connection
-	s.broadcaster.RegisterConnection(conn)
+	if err := s.broadcaster.RegisterConnection(sub, conn); err != nil {
+		// The connection is already upgraded so closing it is the only way left to tell the client
+		log.Println("Error while registering subscriber", err)
+		if err := conn.Close(); err != nil {
+			log.Println("Error while closing websocket", err)
+		}
+		return
+	}
+
+	// Only subscribers that ack send frames worth handling, the others are still read so the connection keeps reading
+	incoming := conn.Incoming()
 
-	// Block until server closes as we don't want the websocket to prematurely die
-	<-s.doneChan
+	// Block until the server closes or the client goes away as we don't want the websocket to prematurely die
+	for done := false; !done; {
+		select {
+		case <-s.doneChan:
+			done = true
+		case <-conn.Done():
+			log.Println("Subscriber disconnected from topic", topic)
+			if err := conn.Close(); err != nil {
+				log.Println("Error while closing websocket", err)
+			}
+			done = true
+		case frame := <-incoming:
+			if sub.Ack != nil {
+				s.handleAck(conn, frame)
+			}
+		}
+	}
+
+	// Stop broadcasting to the connection so a dead socket doesn't fail later publishes
+	s.broadcaster.UnregisterConnection(conn)
 }
 
-// Publish publishes a messsage to all subscribers
+// Publish publishes a messsage to all subscribers of the topic in the request path.
+// X-PubSub-* request headers are passed to subscribers as message headers.
+// Responds with a summary of the delivery to each subscriber.
 func (s *PubSubServer) Publish(w http.ResponseWriter, r *http.Request) {
-	log.Println("Publising message")
+	topic := mux.Vars(r)[topicVar]
+	if err := websocket.ValidateTopic(topic); err != nil {
+		log.Println("Rejecting publish", err)
+		s.writeResponse(w, http.StatusBadRequest, &errorResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+
+	if err := s.authorize(r.Context(), ActionPublish, topic); err != nil {
+		log.Println("Rejecting publish", err)
+		s.writeResponse(w, http.StatusForbidden, &errorResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+
+	log.Println("Publising message to topic", topic)
 	// Parse the message body
 	defer r.Body.Close()
-	msg, err := io.ReadAll(r.Body)
+	body := io.Reader(r.Body)
+	if s.maxPayload > 0 {
+		// Read one byte past the limit to tell a payload of exactly the limit from a larger one
+		body = io.LimitReader(r.Body, int64(s.maxPayload)+1)
+	}
+
+	msg, err := io.ReadAll(body)
 	if err != nil {
 		log.Println("Error while reading message body", err)
 		s.writeResponse(w, http.StatusBadRequest, &errorResponse{
@@ -103,18 +405,61 @@ func (s *PubSubServer) Publish(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.maxPayload > 0 && len(msg) > s.maxPayload {
+		log.Println("Rejecting publish larger than", s.maxPayload, "bytes")
+		s.writeResponse(w, http.StatusRequestEntityTooLarge, &errorResponse{
+			Message: fmt.Sprintf("payload is larger than the max of %d bytes", s.maxPayload),
+		})
+		return
+	}
+
+	message, err := newMessage(topic, r.Header.Get("Content-Type"), messageHeaders(r.Header), msg)
+	if err != nil {
+		log.Println("Rejecting publish", err)
+
+		code := http.StatusUnsupportedMediaType
+		if errors.Is(err, errInvalidUTF8) {
+			code = http.StatusBadRequest
+		}
+
+		s.writeResponse(w, code, &errorResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+
 	// Broadcast message
-	// Hard coding to messageType of TextMessag but ideally could parse the ContentType header and dynamically change
-	if err := s.broadcaster.Broadcast(r.Context(), websocket.TextMessage, msg); err != nil {
-		log.Println("Broadcase failure", err)
+	result, err := s.broadcaster.Broadcast(r.Context(), message)
+	if err != nil {
+		log.Println("Error while broadcasting message", err)
 		s.writeResponse(w, http.StatusInternalServerError, &errorResponse{
 			Message: "Internal Error",
 		})
 		return
 	}
 
-	// Success no content
-	w.WriteHeader(http.StatusNoContent)
+	// Report partial delivery with a multi status so the publisher can inspect which subscribers failed
+	code := http.StatusOK
+	if result.Failed > 0 {
+		log.Println("Broadcast failed for", result.Failed, "subscribers")
+		code = http.StatusMultiStatus
+	}
+
+	s.writeResponse(w, code, newPublishResponse(message, result))
+}
+
+// handleAck acks the message named by an ack frame received from conn.
+// A malformed frame or an ack for a message that isn't in flight is logged and ignored.
+func (s *PubSubServer) handleAck(conn websocket.WebsocketConnection, frame []byte) {
+	seq, err := websocket.ParseAck(frame)
+	if err != nil {
+		log.Println("Ignoring frame from subscriber", conn.ID(), err)
+		return
+	}
+
+	if err := s.broadcaster.Ack(conn, seq); err != nil {
+		log.Println("Ignoring ack of message", seq, "from subscriber", conn.ID(), err)
+	}
 }
 
 func (s *PubSubServer) writeResponse(w http.ResponseWriter, code int, v interface{}) {
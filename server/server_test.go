@@ -6,18 +6,123 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/cpheps/coder-pub-sub/storage"
 	"github.com/cpheps/coder-pub-sub/websocket"
+	"github.com/gorilla/mux"
+	gwebsocket "github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
+// matchMessage matches a published message ignoring the server generated ID and timestamp
+func matchMessage(expected *websocket.Message) interface{} {
+	return mock.MatchedBy(func(actual *websocket.Message) bool {
+		if actual.ID == "" || actual.Timestamp.IsZero() {
+			return false
+		}
+
+		withoutGenerated := *actual
+		withoutGenerated.ID = ""
+		withoutGenerated.Timestamp = time.Time{}
+		return assert.ObjectsAreEqual(expected, &withoutGenerated)
+	})
+}
+
 func Test_PubSubServer_New_Error(t *testing.T) {
-	pubsubServer, err := New("", -1)
-	assert.Error(t, err)
+	opts := DefaultOptions()
+	opts.BroadcastConcurrency = -1
+
+	pubsubServer, err := New(opts)
+	assert.EqualError(t, err, "broadcast concurrency must be greater than 0")
+	assert.Nil(t, pubsubServer)
+}
+
+func Test_PubSubServer_New_InvalidKeepalive(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Keepalive.PongTimeout = 0
+
+	pubsubServer, err := New(opts)
+	assert.EqualError(t, err, "keepalive: pong timeout must be greater than 0 when keepalive is enabled")
+	assert.Nil(t, pubsubServer)
+}
+
+func Test_PubSubServer_New_InvalidAck(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Ack.MaxAttempts = 0
+
+	pubsubServer, err := New(opts)
+	assert.EqualError(t, err, "ack: max attempts must be greater than 0")
+	assert.Nil(t, pubsubServer)
+}
+
+func Test_Options_Validate(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		modify   func(*Options)
+		expected string
+	}{
+		{
+			desc:   "Defaults",
+			modify: func(*Options) {},
+		},
+		{
+			desc:     "Negative timeout",
+			modify:   func(o *Options) { o.IdleTimeout = -time.Second },
+			expected: "http timeouts must not be negative",
+		},
+		{
+			desc:     "Negative max payload",
+			modify:   func(o *Options) { o.MaxPayload = -1 },
+			expected: "max payload must not be negative",
+		},
+		{
+			desc:     "Invalid queue",
+			modify:   func(o *Options) { o.Queue.Size = 0 },
+			expected: "queue: queue size must be greater than 0",
+		},
+		{
+			desc:     "Invalid poll",
+			modify:   func(o *Options) { o.Poll.MaxBatch = 0 },
+			expected: "poll: poll max pending and max batch must be greater than 0",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := DefaultOptions()
+			tc.modify(&opts)
+
+			err := opts.Validate()
+			if tc.expected == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expected)
+			}
+		})
+	}
+}
+
+func Test_PubSubServer_New_DiskStore(t *testing.T) {
+	config := storage.DefaultDiskConfig(t.TempDir())
+	opts := DefaultOptions()
+	opts.Disk = &config
+
+	pubsubServer, err := New(opts)
+	assert.NoError(t, err)
+	assert.IsType(t, &storage.DiskStore{}, pubsubServer.store)
+	assert.NoError(t, pubsubServer.Close())
+
+	config.SegmentBytes = 0
+	pubsubServer, err = New(opts)
+	assert.EqualError(t, err, "storage: segment bytes must be greater than 0")
 	assert.Nil(t, pubsubServer)
 }
 
@@ -27,23 +132,130 @@ func Test_PubSubServer_Publish(t *testing.T) {
 		testFunc func(*testing.T)
 	}{
 		{
-			desc: "Broadcast fails",
+			desc: "Wildcard topic",
+			testFunc: func(t *testing.T) {
+				expectedCode := http.StatusBadRequest
+
+				// No expectations are set so a broadcast fails the test
+				mockBroadcaster := &websocket.MockBroadcaster{}
+
+				pubsubServer := &PubSubServer{
+					broadcaster: mockBroadcaster,
+				}
+
+				req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/publish/orders.*", bytes.NewReader([]byte("hi"))).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders.*"})
+				w := httptest.NewRecorder()
+
+				pubsubServer.Publish(w, req)
+
+				defer w.Result().Body.Close()
+
+				assert.Equal(t, expectedCode, w.Result().StatusCode)
+				mockBroadcaster.AssertNotCalled(t, "Broadcast", mock.Anything, mock.Anything)
+			},
+		},
+		{
+			desc: "Payload too large",
+			testFunc: func(t *testing.T) {
+				expectedCode := http.StatusRequestEntityTooLarge
+				expectedResp := errorResponse{
+					Message: "payload is larger than the max of 4 bytes",
+				}
+
+				// No expectations are set so a broadcast fails the test
+				mockBroadcaster := &websocket.MockBroadcaster{}
+
+				pubsubServer := &PubSubServer{
+					broadcaster: mockBroadcaster,
+					maxPayload:  4,
+				}
+
+				req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/publish/orders", bytes.NewReader([]byte("hello"))).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
+				w := httptest.NewRecorder()
+
+				pubsubServer.Publish(w, req)
+
+				defer w.Result().Body.Close()
+
+				var actualResp errorResponse
+				err := json.NewDecoder(w.Result().Body).Decode(&actualResp)
+				assert.NoError(t, err)
+
+				assert.Equal(t, expectedCode, w.Result().StatusCode)
+				assert.Equal(t, expectedResp, actualResp)
+				mockBroadcaster.AssertNotCalled(t, "Broadcast", mock.Anything, mock.Anything)
+			},
+		},
+		{
+			desc: "Message fails to store",
 			testFunc: func(t *testing.T) {
 				expectedCode := http.StatusInternalServerError
 				expectedResp := errorResponse{
 					Message: "Internal Error",
 				}
 
+				mockBroadcaster := &websocket.MockBroadcaster{}
+				mockBroadcaster.On("Broadcast", mock.Anything, mock.Anything).Return(nil, errors.New("disk full"))
+
+				pubsubServer := &PubSubServer{
+					broadcaster: mockBroadcaster,
+				}
+
+				req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/publish/orders", bytes.NewReader([]byte("hi"))).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
+				w := httptest.NewRecorder()
+
+				pubsubServer.Publish(w, req)
+
+				defer w.Result().Body.Close()
+				data, err := io.ReadAll(w.Result().Body)
+				assert.NoError(t, err)
+
+				var resp errorResponse
+				err = json.Unmarshal(data, &resp)
+				assert.NoError(t, err)
+
+				assert.Equal(t, expectedCode, w.Result().StatusCode)
+				assert.Equal(t, expectedResp, resp)
+			},
+		},
+		{
+			desc: "Broadcast partially fails",
+			testFunc: func(t *testing.T) {
+				expectedCode := http.StatusMultiStatus
+				expectedResp := publishResponse{
+					Delivered: 1,
+					Failed:    1,
+					Skipped:   1,
+					Errors: map[string]string{
+						"conn-1": "bad thing",
+					},
+				}
+
 				message := []byte("hi")
 
+				result := websocket.NewBroadcastResult()
+				result.Delivered = 1
+				result.Failed = 1
+				result.Skipped = 1
+				result.Errors["conn-1"] = errors.New("bad thing")
+
 				mockBroadcaster := &websocket.MockBroadcaster{}
-				mockBroadcaster.On("Broadcast", mock.Anything, websocket.TextMessage, message).Return(errors.New("bad thing"))
+				mockBroadcaster.On("Broadcast", mock.Anything, matchMessage(&websocket.Message{
+					Topic:       "orders",
+					Type:        websocket.TextMessage,
+					ContentType: defaultContentType,
+					Data:        message,
+				})).Return(result, nil)
 
 				pubsubServer := &PubSubServer{
 					broadcaster: mockBroadcaster,
 				}
 
-				req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/plubish", bytes.NewReader(message)).WithContext(context.Background())
+				req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/publish/orders", bytes.NewReader(message)).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
 				w := httptest.NewRecorder()
 
 				pubsubServer.Publish(w, req)
@@ -52,10 +264,14 @@ func Test_PubSubServer_Publish(t *testing.T) {
 				data, err := io.ReadAll(w.Result().Body)
 				assert.NoError(t, err)
 
-				var resp errorResponse
+				var resp publishResponse
 				err = json.Unmarshal(data, &resp)
 				assert.NoError(t, err)
 
+				// ID is generated so only check it is set
+				assert.NotEmpty(t, resp.ID)
+				resp.ID = ""
+
 				assert.Equal(t, expectedCode, w.Result().StatusCode)
 				assert.Equal(t, expectedResp, resp)
 			},
@@ -63,18 +279,177 @@ func Test_PubSubServer_Publish(t *testing.T) {
 		{
 			desc: "Broadcast Success",
 			testFunc: func(t *testing.T) {
-				expectedCode := http.StatusNoContent
+				expectedCode := http.StatusOK
+				expectedResp := publishResponse{
+					Delivered: 2,
+				}
 
 				message := []byte("hi")
 
+				result := websocket.NewBroadcastResult()
+				result.Delivered = 2
+
 				mockBroadcaster := &websocket.MockBroadcaster{}
-				mockBroadcaster.On("Broadcast", mock.Anything, websocket.TextMessage, message).Return(nil)
+				mockBroadcaster.On("Broadcast", mock.Anything, matchMessage(&websocket.Message{
+					Topic:       "orders",
+					Type:        websocket.TextMessage,
+					ContentType: defaultContentType,
+					Data:        message,
+				})).Return(result, nil)
 
 				pubsubServer := &PubSubServer{
 					broadcaster: mockBroadcaster,
 				}
 
-				req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/plubish", bytes.NewReader(message)).WithContext(context.Background())
+				req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/publish/orders", bytes.NewReader(message)).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
+				w := httptest.NewRecorder()
+
+				pubsubServer.Publish(w, req)
+
+				defer w.Result().Body.Close()
+				data, err := io.ReadAll(w.Result().Body)
+				assert.NoError(t, err)
+
+				var resp publishResponse
+				err = json.Unmarshal(data, &resp)
+				assert.NoError(t, err)
+
+				// ID is generated so only check it is set
+				assert.NotEmpty(t, resp.ID)
+				resp.ID = ""
+
+				assert.Equal(t, expectedCode, w.Result().StatusCode)
+				assert.Equal(t, expectedResp, resp)
+			},
+		},
+		{
+			desc: "Binary content type",
+			testFunc: func(t *testing.T) {
+				expectedCode := http.StatusOK
+
+				// Not valid UTF-8 which is fine for a binary payload
+				message := []byte{0xa1, 0xff, 0x00}
+
+				result := websocket.NewBroadcastResult()
+				result.Delivered = 1
+
+				mockBroadcaster := &websocket.MockBroadcaster{}
+				mockBroadcaster.On("Broadcast", mock.Anything, matchMessage(&websocket.Message{
+					Topic:       "orders",
+					Type:        websocket.BinaryMessage,
+					ContentType: "application/cbor",
+					Data:        message,
+				})).Return(result, nil)
+
+				pubsubServer := &PubSubServer{
+					broadcaster: mockBroadcaster,
+				}
+
+				req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/publish/orders", bytes.NewReader(message)).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
+				req.Header.Set("Content-Type", "application/cbor")
+				w := httptest.NewRecorder()
+
+				pubsubServer.Publish(w, req)
+
+				defer w.Result().Body.Close()
+
+				assert.Equal(t, expectedCode, w.Result().StatusCode)
+				mockBroadcaster.AssertExpectations(t)
+			},
+		},
+		{
+			desc: "Publisher headers",
+			testFunc: func(t *testing.T) {
+				expectedCode := http.StatusOK
+
+				message := []byte(`{"id":1}`)
+
+				result := websocket.NewBroadcastResult()
+
+				mockBroadcaster := &websocket.MockBroadcaster{}
+				mockBroadcaster.On("Broadcast", mock.Anything, matchMessage(&websocket.Message{
+					Topic:       "orders",
+					Type:        websocket.TextMessage,
+					ContentType: "application/json",
+					Headers: map[string]string{
+						"Trace-Id": "abc",
+						"Tenant":   "a, b",
+					},
+					Data: message,
+				})).Return(result, nil)
+
+				pubsubServer := &PubSubServer{
+					broadcaster: mockBroadcaster,
+				}
+
+				req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/publish/orders", bytes.NewReader(message)).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("X-PubSub-Trace-Id", "abc")
+				req.Header.Add("X-PubSub-Tenant", "a")
+				req.Header.Add("X-PubSub-Tenant", "b")
+				req.Header.Set("X-Other", "ignored")
+				w := httptest.NewRecorder()
+
+				pubsubServer.Publish(w, req)
+
+				defer w.Result().Body.Close()
+
+				assert.Equal(t, expectedCode, w.Result().StatusCode)
+				mockBroadcaster.AssertExpectations(t)
+			},
+		},
+		{
+			desc: "Invalid UTF-8 text",
+			testFunc: func(t *testing.T) {
+				expectedCode := http.StatusBadRequest
+				expectedResp := errorResponse{
+					Message: "text payload is not valid UTF-8",
+				}
+
+				// No expectations are set so a broadcast fails the test
+				mockBroadcaster := &websocket.MockBroadcaster{}
+
+				pubsubServer := &PubSubServer{
+					broadcaster: mockBroadcaster,
+				}
+
+				req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/publish/orders", bytes.NewReader([]byte{0xff, 0xfe})).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
+				req.Header.Set("Content-Type", "application/json")
+				w := httptest.NewRecorder()
+
+				pubsubServer.Publish(w, req)
+
+				defer w.Result().Body.Close()
+				data, err := io.ReadAll(w.Result().Body)
+				assert.NoError(t, err)
+
+				var resp errorResponse
+				err = json.Unmarshal(data, &resp)
+				assert.NoError(t, err)
+
+				assert.Equal(t, expectedCode, w.Result().StatusCode)
+				assert.Equal(t, expectedResp, resp)
+			},
+		},
+		{
+			desc: "Unsupported charset",
+			testFunc: func(t *testing.T) {
+				expectedCode := http.StatusUnsupportedMediaType
+
+				// No expectations are set so a broadcast fails the test
+				mockBroadcaster := &websocket.MockBroadcaster{}
+
+				pubsubServer := &PubSubServer{
+					broadcaster: mockBroadcaster,
+				}
+
+				req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/publish/orders", bytes.NewReader([]byte("hi"))).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
+				req.Header.Set("Content-Type", "text/plain; charset=iso-8859-1")
 				w := httptest.NewRecorder()
 
 				pubsubServer.Publish(w, req)
@@ -97,6 +472,53 @@ func Test_PubSubServer_RegisterSubscriber(t *testing.T) {
 		desc     string
 		testFunc func(*testing.T)
 	}{
+		{
+			desc: "Invalid pattern",
+			testFunc: func(t *testing.T) {
+				expectedCode := http.StatusBadRequest
+
+				req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/subscribe/orders.>.created", http.NoBody).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders.>.created"})
+				w := httptest.NewRecorder()
+
+				// No expectations are set so an upgrade fails the test
+				mockUpgrader := &websocket.MockUpgrader{}
+
+				pubsubServer := &PubSubServer{
+					upgrader: mockUpgrader,
+				}
+
+				pubsubServer.RegisterSubscriber(w, req)
+
+				defer w.Result().Body.Close()
+
+				assert.Equal(t, expectedCode, w.Result().StatusCode)
+				mockUpgrader.AssertNotCalled(t, "Upgrade", mock.Anything, mock.Anything, mock.Anything)
+			},
+		},
+		{
+			desc: "Invalid format",
+			testFunc: func(t *testing.T) {
+				expectedCode := http.StatusBadRequest
+
+				req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/subscribe/orders?format=xml", http.NoBody).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
+				w := httptest.NewRecorder()
+
+				// No expectations are set so an upgrade fails the test
+				mockUpgrader := &websocket.MockUpgrader{}
+
+				pubsubServer := &PubSubServer{
+					upgrader: mockUpgrader,
+				}
+
+				pubsubServer.RegisterSubscriber(w, req)
+
+				defer w.Result().Body.Close()
+
+				assert.Equal(t, expectedCode, w.Result().StatusCode)
+			},
+		},
 		{
 			desc: "Upgrade Fails",
 			testFunc: func(t *testing.T) {
@@ -105,7 +527,8 @@ func Test_PubSubServer_RegisterSubscriber(t *testing.T) {
 					Message: "Internal Error",
 				}
 
-				req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/subscribe", http.NoBody).WithContext(context.Background())
+				req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/subscribe/orders", http.NoBody).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
 				w := httptest.NewRecorder()
 
 				mockUpgrader := &websocket.MockUpgrader{}
@@ -140,16 +563,20 @@ func Test_PubSubServer_RegisterSubscriber(t *testing.T) {
 			testFunc: func(t *testing.T) {
 				expectedCode := http.StatusOK
 
-				req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/subscribe", http.NoBody).WithContext(context.Background())
+				req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/subscribe/orders", http.NoBody).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
 				w := httptest.NewRecorder()
 
 				mockWebsocket := &websocket.MockWebsocketConnection{}
+				mockWebsocket.On("Done").Return(make(chan struct{}))
+				mockWebsocket.On("Incoming").Return(make(chan []byte))
 
 				mockUpgrader := &websocket.MockUpgrader{}
 				mockUpgrader.On("Upgrade", mock.Anything, mock.Anything, mock.Anything).Return(mockWebsocket, nil)
 
 				mockBroadcaster := &websocket.MockBroadcaster{}
-				mockBroadcaster.On("RegisterConnection", mockWebsocket)
+				mockBroadcaster.On("RegisterConnection", websocket.Subscription{Pattern: "orders"}, mockWebsocket).Return(nil)
+				mockBroadcaster.On("UnregisterConnection", mockWebsocket)
 
 				doneChan := make(chan struct{})
 
@@ -167,6 +594,147 @@ func Test_PubSubServer_RegisterSubscriber(t *testing.T) {
 				defer w.Result().Body.Close()
 
 				assert.Equal(t, expectedCode, w.Result().StatusCode)
+				mockBroadcaster.AssertExpectations(t)
+			},
+		},
+		{
+			desc: "Subscriber acks",
+			testFunc: func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/subscribe/orders?format=envelope&ack=true", http.NoBody).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
+				w := httptest.NewRecorder()
+
+				incoming := make(chan []byte, 2)
+				incoming <- []byte("not an ack")
+				incoming <- []byte(`{"type":"ack","seq":7}`)
+
+				mockWebsocket := &websocket.MockWebsocketConnection{}
+				mockWebsocket.On("ID").Return("conn-1")
+				mockWebsocket.On("Done").Return(make(chan struct{}))
+				mockWebsocket.On("Incoming").Return(incoming)
+
+				mockUpgrader := &websocket.MockUpgrader{}
+				mockUpgrader.On("Upgrade", mock.Anything, mock.Anything, mock.Anything).Return(mockWebsocket, nil)
+
+				ack := websocket.DefaultAckConfig()
+				doneChan := make(chan struct{})
+
+				mockBroadcaster := &websocket.MockBroadcaster{}
+				mockBroadcaster.On("RegisterConnection", websocket.Subscription{Pattern: "orders", Format: websocket.FormatEnvelope, Ack: &ack}, mockWebsocket).Return(nil)
+				mockBroadcaster.On("UnregisterConnection", mockWebsocket)
+
+				// Stop the handler once the ack is passed on
+				mockBroadcaster.On("Ack", mockWebsocket, uint64(7)).Return(nil).Run(func(mock.Arguments) {
+					close(doneChan)
+				})
+
+				pubsubServer := &PubSubServer{
+					doneChan:    doneChan,
+					upgrader:    mockUpgrader,
+					broadcaster: mockBroadcaster,
+					ack:         ack,
+				}
+
+				pubsubServer.RegisterSubscriber(w, req)
+
+				mockBroadcaster.AssertExpectations(t)
+			},
+		},
+		{
+			desc: "Consumer group",
+			testFunc: func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/subscribe/orders?group=workers", http.NoBody).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
+				w := httptest.NewRecorder()
+
+				mockWebsocket := &websocket.MockWebsocketConnection{}
+				mockWebsocket.On("Done").Return(make(chan struct{}))
+				mockWebsocket.On("Incoming").Return(make(chan []byte))
+
+				mockUpgrader := &websocket.MockUpgrader{}
+				mockUpgrader.On("Upgrade", mock.Anything, mock.Anything, mock.Anything).Return(mockWebsocket, nil)
+
+				mockBroadcaster := &websocket.MockBroadcaster{}
+				mockBroadcaster.On("RegisterConnection", websocket.Subscription{Pattern: "orders", Group: "workers"}, mockWebsocket).Return(nil)
+				mockBroadcaster.On("UnregisterConnection", mockWebsocket)
+
+				doneChan := make(chan struct{})
+				close(doneChan)
+
+				pubsubServer := &PubSubServer{
+					doneChan:    doneChan,
+					upgrader:    mockUpgrader,
+					broadcaster: mockBroadcaster,
+				}
+
+				pubsubServer.RegisterSubscriber(w, req)
+
+				mockBroadcaster.AssertExpectations(t)
+			},
+		},
+		{
+			desc: "Registration fails",
+			testFunc: func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/subscribe/orders?consumer=billing", http.NoBody).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
+				w := httptest.NewRecorder()
+
+				mockWebsocket := &websocket.MockWebsocketConnection{}
+				mockWebsocket.On("Close").Return(nil)
+
+				mockUpgrader := &websocket.MockUpgrader{}
+				mockUpgrader.On("Upgrade", mock.Anything, mock.Anything, mock.Anything).Return(mockWebsocket, nil)
+
+				mockBroadcaster := &websocket.MockBroadcaster{}
+				mockBroadcaster.On("RegisterConnection", websocket.Subscription{Pattern: "orders", Consumer: "/billing"}, mockWebsocket).Return(errors.New("bad thing"))
+
+				pubsubServer := &PubSubServer{
+					doneChan:    make(chan struct{}),
+					upgrader:    mockUpgrader,
+					broadcaster: mockBroadcaster,
+				}
+
+				pubsubServer.RegisterSubscriber(w, req)
+
+				mockBroadcaster.AssertExpectations(t)
+				mockBroadcaster.AssertNotCalled(t, "UnregisterConnection", mock.Anything)
+				mockWebsocket.AssertExpectations(t)
+			},
+		},
+		{
+			desc: "Client disconnects",
+			testFunc: func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/subscribe/orders", http.NoBody).WithContext(context.Background())
+				req = mux.SetURLVars(req, map[string]string{topicVar: "orders"})
+				w := httptest.NewRecorder()
+
+				// Simulate the read pump noticing the client went away
+				connDone := make(chan struct{})
+				close(connDone)
+
+				mockWebsocket := &websocket.MockWebsocketConnection{}
+				mockWebsocket.On("Done").Return(connDone)
+				mockWebsocket.On("Incoming").Return(make(chan []byte))
+				mockWebsocket.On("Close").Return(nil)
+
+				mockUpgrader := &websocket.MockUpgrader{}
+				mockUpgrader.On("Upgrade", mock.Anything, mock.Anything, mock.Anything).Return(mockWebsocket, nil)
+
+				mockBroadcaster := &websocket.MockBroadcaster{}
+				mockBroadcaster.On("RegisterConnection", websocket.Subscription{Pattern: "orders"}, mockWebsocket).Return(nil)
+				mockBroadcaster.On("UnregisterConnection", mockWebsocket)
+
+				// Server stays open so only the client disconnect can unblock the handler
+				pubsubServer := &PubSubServer{
+					doneChan:    make(chan struct{}),
+					upgrader:    mockUpgrader,
+					broadcaster: mockBroadcaster,
+				}
+
+				pubsubServer.RegisterSubscriber(w, req)
+
+				mockBroadcaster.AssertExpectations(t)
+				mockWebsocket.AssertExpectations(t)
 			},
 		},
 	}
@@ -176,3 +744,105 @@ func Test_PubSubServer_RegisterSubscriber(t *testing.T) {
 	}
 
 }
+
+func Test_PubSubServer_ConsumerOwner(t *testing.T) {
+	_, baseURL := startServer(t, func(o *Options) {
+		o.Auth = &AuthConfig{APIKeysFile: writeAPIKeys(t)}
+	})
+
+	const otherKey = "k3y-subscriber"
+
+	subscribe := func(key string) *gwebsocket.Conn {
+		wsURL := strings.Replace(baseURL, "http://", "ws://", 1) + "/subscribe/orders?consumer=billing&access_token=" + key
+		conn, _, err := gwebsocket.DefaultDialer.Dial(wsURL, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	publish := func(data string) int {
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/publish/orders", strings.NewReader(data))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var result publishResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return result.Delivered
+	}
+
+	read := func(conn *gwebsocket.Conn) string {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		return string(msg)
+	}
+
+	// The consumer commits the first message then goes away before the second is published
+	owner := subscribe(testAPIKey)
+	require.Eventually(t, func() bool { return publish("first") == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "first", read(owner))
+	owner.Close()
+	require.Eventually(t, func() bool { return publish("second") == 0 }, time.Second, 10*time.Millisecond)
+
+	// Another identity using the same name gets a consumer of its own that doesn't replay the owner's backlog
+	other := subscribe(otherKey)
+	require.Eventually(t, func() bool { return publish("third") == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "third", read(other))
+
+	// The owner's offset was not moved so it resumes with the message it missed
+	owner = subscribe(testAPIKey)
+	assert.Equal(t, "second", read(owner))
+}
+
+// startServer serves HTTP and any enabled stream listeners on free ports,
+// returning the server and the base URL of its HTTP endpoints
+func startServer(t *testing.T, configure ...func(*Options)) (*PubSubServer, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	httpAddr := listener.Addr().String()
+	listener.Close()
+
+	opts := DefaultOptions()
+	opts.Addr = httpAddr
+	opts.BroadcastConcurrency = 1
+	for _, c := range configure {
+		c(&opts)
+	}
+
+	pubsubServer, err := New(opts)
+	require.NoError(t, err)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- pubsubServer.ListenAndServe()
+	}()
+
+	t.Cleanup(func() {
+		// Tests may have closed the server already
+		select {
+		case <-pubsubServer.doneChan:
+		default:
+			pubsubServer.Close()
+		}
+		assert.True(t, errors.Is(<-errChan, http.ErrServerClosed))
+	})
+
+	for _, listener := range pubsubServer.listeners() {
+		require.Eventually(t, func() bool { return listener.Addr() != nil }, time.Second, time.Millisecond)
+	}
+
+	// HTTP is served last so is not necessarily accepting yet
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", httpAddr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, time.Second, time.Millisecond)
+	return pubsubServer, "http://" + httpAddr
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/cpheps/coder-pub-sub/websocket"
+)
+
+// parseSubscription reads the query parameters shared by every subscribe endpoint into a Subscription without a pattern.
+//
+//	format=<name>     how messages are encoded, see websocket.ParseFormat. defaultFormat is used if unset.
+//	since, last       replay retained messages before live delivery, see parseReplay
+//	consumer=<name>   a durable consumer that resumes after the last message it was sent, scoped to the identity in ctx
+//	ack=true          at-least-once delivery, see parseAck
+//	group=<name>      a consumer group, each message is sent to only one member of the group
+func (s *PubSubServer) parseSubscription(ctx context.Context, query url.Values, defaultFormat websocket.Format) (websocket.Subscription, error) {
+	format := defaultFormat
+	if name := query.Get("format"); name != "" {
+		parsed, err := websocket.ParseFormat(name)
+		if err != nil {
+			return websocket.Subscription{}, err
+		}
+		format = parsed
+	}
+
+	replay, err := parseReplay(query)
+	if err != nil {
+		return websocket.Subscription{}, err
+	}
+
+	ack, err := parseAck(query, format, s.ack)
+	if err != nil {
+		return websocket.Subscription{}, err
+	}
+
+	return websocket.Subscription{
+		Format:   format,
+		Replay:   replay,
+		Consumer: scopeConsumer(identityOwner(IdentityFromContext(ctx)), query.Get("consumer")),
+		Ack:      ack,
+		Group:    query.Get("group"),
+	}, nil
+}
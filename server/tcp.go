@@ -0,0 +1,466 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cpheps/coder-pub-sub/websocket"
+)
+
+const (
+	// maxTCPLine caps the length of a protocol line, not counting a PUB payload
+	maxTCPLine = 4096
+
+	// maxTCPPayload caps the size of a PUB payload when the server has no max payload,
+	// so a client can't make the server hold an unbounded payload
+	maxTCPPayload = 64 << 20
+
+	// tcpWriteTimeout is how long a write to a TCP client may block before the client is disconnected
+	tcpWriteTimeout = 10 * time.Second
+)
+
+// errTCPNextWriter is returned by tcpSubscription.NextWriter as messages are written with WriteMessage
+var errTCPNextWriter = errors.New("tcp connections only support WriteMessage")
+
+// errTCPClosed is returned when writing to a tcpSession that has been closed
+var errTCPClosed = errors.New("tcp connection is closed")
+
+// TCPAddr returns the address the TCP line protocol listener is bound to, nil if it isn't listening
+func (s *PubSubServer) TCPAddr() net.Addr {
+	if s.tcp == nil {
+		return nil
+	}
+	return s.tcp.Addr()
+}
+
+var _ (streamSession) = (*tcpSession)(nil)
+
+// tcpSession is a client connected over the TCP line protocol.
+//
+// Lines end in CRLF, a bare LF is accepted too. Client commands:
+//
+//	AUTH <token>                             authenticate, required before other commands if INFO has auth_required
+//	SUB <pattern> [group] <sid>              subscribe to pattern, messages are tagged with sid
+//	UNSUB <sid>                              remove the subscription tagged sid
+//	PUB <topic> [content-type] <#bytes>      publish the payload on the next line of exactly #bytes
+//	<payload>
+//	PING                                     the server replies with PONG
+//	PONG                                     the reply to a server PING
+//
+// Server commands:
+//
+//	INFO {...}                               sent once on connect, a JSON description of the server
+//	MSG <topic> <sid> <#bytes>               a message for the subscription tagged sid, the payload follows
+//	<payload>
+//	+OK                                      an AUTH, SUB, UNSUB or PUB succeeded
+//	-ERR '<message>'                         a command failed
+//	PING, PONG
+type tcpSession struct {
+	server *PubSubServer
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// writeMu serializes writes from the read loop and every subscription, closed is set under it
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+	closed  bool
+
+	// subs are the subscriptions by sid, only touched by the read loop
+	subs map[string]*tcpSubscription
+
+	// identity is who the client proved to be over TLS or with AUTH, nil for anonymous clients.
+	// Only touched by the read loop.
+	identity *Identity
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newTCPSession creates a session for conn accepted by s
+func (s *PubSubServer) newTCPSession(conn net.Conn) streamSession {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &tcpSession{
+		server: s,
+		conn:   conn,
+		reader: bufio.NewReaderSize(conn, maxTCPLine),
+		writer: bufio.NewWriter(conn),
+		subs:   make(map[string]*tcpSubscription),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// serve runs the session until the client disconnects, breaks the protocol or the session is closed
+func (ts *tcpSession) serve() {
+	defer ts.close()
+	defer ts.unsubscribeAll()
+
+	identity, err := handshake(ts.conn)
+	if err != nil {
+		log.Println("Error during TLS handshake with TCP client", err)
+		return
+	}
+	ts.identity = identity
+	if identity != nil {
+		log.Println("TCP client connected as", identity.Subject)
+	}
+
+	authRequired := ts.server.authRequired() && ts.identity == nil
+	ts.writeLine(fmt.Sprintf(`INFO {"server":"coder-pub-sub","max_payload":%d,"auth_required":%t}`, ts.maxPayload(), authRequired))
+
+	keepalive := ts.server.keepalive
+	if keepalive.PingInterval > 0 {
+		go ts.pingLoop(keepalive.PingInterval)
+	}
+
+	for {
+		// Any line from the client shows it is alive
+		if keepalive.PingInterval > 0 {
+			ts.conn.SetReadDeadline(time.Now().Add(keepalive.PingInterval + keepalive.PongTimeout))
+		}
+
+		line, err := ts.reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			ts.writeError("line too long")
+			return
+		}
+
+		if err != nil {
+			if !errors.Is(err, io.EOF) && ts.ctx.Err() == nil {
+				log.Println("Error while reading from TCP client", err)
+			}
+			return
+		}
+
+		if err := ts.handle(strings.Fields(string(line))); err != nil {
+			log.Println("Disconnecting TCP client", err)
+			ts.writeError(err.Error())
+			return
+		}
+	}
+}
+
+// handle runs a single command. Command errors are reported to the client,
+// an error is only returned if the stream can't be read any further.
+func (ts *tcpSession) handle(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+
+	command := strings.ToUpper(args[0])
+
+	// The payload of a PUB can't be skipped reliably so any command but AUTH ends an unauthenticated connection
+	if ts.server.authRequired() && ts.identity == nil && command != "AUTH" && command != "PING" && command != "PONG" {
+		return errors.New("authentication required")
+	}
+
+	switch command {
+	case "AUTH":
+		ts.reply(ts.auth(args[1:]))
+	case "PING":
+		ts.writeLine("PONG")
+	case "PONG":
+	case "SUB":
+		ts.reply(ts.subscribe(args[1:]))
+	case "UNSUB":
+		ts.reply(ts.unsubscribe(args[1:]))
+	case "PUB":
+		return ts.publish(args[1:])
+	default:
+		ts.writeError(fmt.Sprintf("unknown command %q", args[0]))
+	}
+
+	return nil
+}
+
+// auth handles the arguments of AUTH
+func (ts *tcpSession) auth(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: AUTH <token>")
+	}
+
+	identity, err := ts.server.authenticateToken(ts.ctx, args[0])
+	if err != nil {
+		log.Println("Rejecting TCP client token", err)
+		return errors.New("authentication failed")
+	}
+
+	ts.identity = identity
+	log.Println("TCP client authenticated as", identity.Subject)
+	return nil
+}
+
+// subscribe handles the arguments of SUB
+func (ts *tcpSession) subscribe(args []string) error {
+	var pattern, group, sid string
+	switch len(args) {
+	case 2:
+		pattern, sid = args[0], args[1]
+	case 3:
+		pattern, group, sid = args[0], args[1], args[2]
+	default:
+		return errors.New("usage: SUB <pattern> [group] <sid>")
+	}
+
+	if _, ok := ts.subs[sid]; ok {
+		return fmt.Errorf("sid %q is already in use", sid)
+	}
+
+	if err := websocket.ValidatePattern(pattern); err != nil {
+		return err
+	}
+
+	if err := ts.server.authorizeIdentity(ts.identity, ActionSubscribe, pattern); err != nil {
+		return err
+	}
+
+	sub := &tcpSubscription{
+		id:      randomHex(8),
+		sid:     sid,
+		session: ts,
+	}
+
+	log.Println("Registering TCP subscriber to topic", pattern)
+	err := ts.server.broadcaster.RegisterConnection(websocket.Subscription{
+		Pattern: pattern,
+		Format:  websocket.FormatRaw,
+		Group:   group,
+	}, sub)
+	if err != nil {
+		log.Println("Error while registering TCP subscriber", err)
+		return errors.New("internal error")
+	}
+
+	ts.subs[sid] = sub
+	return nil
+}
+
+// unsubscribe handles the arguments of UNSUB
+func (ts *tcpSession) unsubscribe(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: UNSUB <sid>")
+	}
+
+	sub, ok := ts.subs[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown sid %q", args[0])
+	}
+
+	delete(ts.subs, args[0])
+	ts.server.broadcaster.UnregisterConnection(sub)
+	return nil
+}
+
+// unsubscribeAll removes every subscription of the session
+func (ts *tcpSession) unsubscribeAll() {
+	for sid, sub := range ts.subs {
+		delete(ts.subs, sid)
+		ts.server.broadcaster.UnregisterConnection(sub)
+	}
+}
+
+// publish handles the arguments of PUB and reads its payload.
+// Returns an error if the payload can't be read as the stream can't be resynchronized.
+func (ts *tcpSession) publish(args []string) error {
+	var topic, contentType, size string
+	switch len(args) {
+	case 2:
+		topic, size = args[0], args[1]
+	case 3:
+		topic, contentType, size = args[0], args[1], args[2]
+	default:
+		return errors.New("usage: PUB <topic> [content-type] <#bytes>")
+	}
+
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid payload size %q", size)
+	}
+
+	if max := ts.maxPayload(); n > max {
+		return fmt.Errorf("payload of %d bytes is larger than the max of %d", n, max)
+	}
+
+	// The buffer grows as the payload arrives rather than trusting the size up front
+	payload, err := io.ReadAll(io.LimitReader(ts.reader, int64(n)))
+	if err != nil {
+		return fmt.Errorf("failed to read payload: %w", err)
+	}
+
+	if len(payload) != n {
+		return fmt.Errorf("failed to read payload: %w", io.ErrUnexpectedEOF)
+	}
+
+	// The payload ends in CRLF or just LF
+	end, err := ts.reader.ReadByte()
+	if err == nil && end == '\r' {
+		end, err = ts.reader.ReadByte()
+	}
+
+	if err != nil || end != '\n' {
+		return errors.New("payload does not match its size")
+	}
+
+	ts.reply(ts.broadcast(topic, contentType, payload))
+	return nil
+}
+
+// maxPayload returns the largest PUB payload accepted, maxTCPPayload if the server has no max payload
+func (ts *tcpSession) maxPayload() int {
+	if ts.server.maxPayload > 0 {
+		return ts.server.maxPayload
+	}
+	return maxTCPPayload
+}
+
+// broadcast publishes payload to topic
+func (ts *tcpSession) broadcast(topic, contentType string, payload []byte) error {
+	if err := websocket.ValidateTopic(topic); err != nil {
+		return err
+	}
+
+	if err := ts.server.authorizeIdentity(ts.identity, ActionPublish, topic); err != nil {
+		return err
+	}
+
+	msg, err := newMessage(topic, contentType, nil, payload)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Publising message to topic", topic)
+	result, err := ts.server.broadcaster.Broadcast(ts.ctx, msg)
+	if err != nil {
+		log.Println("Error while broadcasting message", err)
+		return errors.New("internal error")
+	}
+
+	if result.Failed > 0 {
+		log.Println("Broadcast failed for", result.Failed, "subscribers")
+	}
+
+	return nil
+}
+
+// pingLoop pings the client every interval until the session is closed
+func (ts *tcpSession) pingLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ts.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ts.writeLine("PING"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// reply writes +OK if err is nil, otherwise the error
+func (ts *tcpSession) reply(err error) {
+	if err != nil {
+		ts.writeError(err.Error())
+		return
+	}
+
+	ts.writeLine("+OK")
+}
+
+// writeError writes a -ERR line, quotes in the message are replaced as they end it
+func (ts *tcpSession) writeError(message string) {
+	ts.writeLine(fmt.Sprintf("-ERR '%s'", strings.ReplaceAll(message, "'", `"`)))
+}
+
+// writeLine writes a single protocol line
+func (ts *tcpSession) writeLine(line string) error {
+	return ts.write(func(w *bufio.Writer) {
+		w.WriteString(line)
+		w.WriteString("\r\n")
+	})
+}
+
+// write runs fn to write to the client then flushes
+func (ts *tcpSession) write(fn func(w *bufio.Writer)) error {
+	ts.writeMu.Lock()
+	defer ts.writeMu.Unlock()
+
+	if ts.closed {
+		return errTCPClosed
+	}
+
+	ts.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	fn(ts.writer)
+	return ts.writer.Flush()
+}
+
+// close disconnects the client, subscriptions see their connection as done
+func (ts *tcpSession) close() {
+	// Close the socket before taking the write lock so a write blocked on a slow client returns
+	ts.cancel()
+	ts.conn.Close()
+
+	ts.writeMu.Lock()
+	ts.closed = true
+	ts.writeMu.Unlock()
+}
+
+var (
+	_ (websocket.WebsocketConnection) = (*tcpSubscription)(nil)
+	_ (websocket.MessageWriter)       = (*tcpSubscription)(nil)
+)
+
+// tcpSubscription is a single SUB of a tcpSession. Each is registered with the broadcaster on its own
+// so UNSUB can remove it without touching the session's other subscriptions.
+type tcpSubscription struct {
+	id      string
+	sid     string
+	session *tcpSession
+}
+
+// WriteMessage writes msg as a MSG command, the payload is always sent raw
+func (sub *tcpSubscription) WriteMessage(msg *websocket.Message, _ websocket.Format) error {
+	return sub.session.write(func(w *bufio.Writer) {
+		fmt.Fprintf(w, "MSG %s %s %d\r\n", msg.Topic, sub.sid, len(msg.Data))
+		w.Write(msg.Data)
+		w.WriteString("\r\n")
+	})
+}
+
+// ID returns an identifier unique to this subscription
+func (sub *tcpSubscription) ID() string {
+	return sub.id
+}
+
+// NextWriter is not supported, messages are written with WriteMessage
+func (sub *tcpSubscription) NextWriter(websocket.MessageType) (io.WriteCloser, error) {
+	return nil, errTCPNextWriter
+}
+
+// Done returns a channel that is closed once the session ends
+func (sub *tcpSubscription) Done() <-chan struct{} {
+	return sub.session.ctx.Done()
+}
+
+// Incoming returns nil as the session reads commands itself
+func (sub *tcpSubscription) Incoming() <-chan []byte {
+	return nil
+}
+
+// Close ends the whole session, a subscription failing to write means the client is gone or too slow
+func (sub *tcpSubscription) Close() error {
+	sub.session.close()
+	return nil
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tcpClient is a TCP line protocol client for tests
+type tcpClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialTCP connects to the server and reads its INFO line
+func dialTCP(t *testing.T, pubsubServer *PubSubServer) *tcpClient {
+	conn, err := net.Dial("tcp", pubsubServer.TCPAddr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	client := &tcpClient{
+		t:      t,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+	assert.True(t, strings.HasPrefix(client.readLine(), "INFO {"))
+
+	return client
+}
+
+// send writes raw protocol text
+func (c *tcpClient) send(text string) {
+	_, err := io.WriteString(c.conn, text)
+	require.NoError(c.t, err)
+}
+
+// readLine reads a single line without its CRLF
+func (c *tcpClient) readLine() string {
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := c.reader.ReadString('\n')
+	require.NoError(c.t, err)
+	return strings.TrimRight(line, "\r\n")
+}
+
+// readMsg reads a MSG line and its payload
+func (c *tcpClient) readMsg() (string, string) {
+	line := c.readLine()
+	require.True(c.t, strings.HasPrefix(line, "MSG "), line)
+	return line, c.readLine()
+}
+
+func Test_PubSubServer_TCP(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			desc: "Ping",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startServer(t, func(o *Options) { o.TCPAddr = "127.0.0.1:0" })
+				client := dialTCP(t, pubsubServer)
+
+				client.send("PING\r\n")
+				assert.Equal(t, "PONG", client.readLine())
+			},
+		},
+		{
+			desc: "Publish and subscribe",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startServer(t, func(o *Options) { o.TCPAddr = "127.0.0.1:0" })
+				subscriber := dialTCP(t, pubsubServer)
+				publisher := dialTCP(t, pubsubServer)
+
+				subscriber.send("SUB orders.* 1\r\nSUB orders.created 2\r\n")
+				assert.Equal(t, "+OK", subscriber.readLine())
+				assert.Equal(t, "+OK", subscriber.readLine())
+
+				publisher.send("PUB orders.created 5\r\nhello\r\n")
+				assert.Equal(t, "+OK", publisher.readLine())
+
+				// A bare LF ends lines too
+				publisher.send("PUB orders.shipped application/octet-stream 3\n\x00\x01\x02\n")
+				assert.Equal(t, "+OK", publisher.readLine())
+
+				received := map[string]string{}
+				for i := 0; i < 3; i++ {
+					line, payload := subscriber.readMsg()
+					received[line] = payload
+				}
+
+				assert.Equal(t, map[string]string{
+					"MSG orders.created 1 5": "hello",
+					"MSG orders.created 2 5": "hello",
+					"MSG orders.shipped 1 3": "\x00\x01\x02",
+				}, received)
+
+				subscriber.send("UNSUB 1\r\n")
+				assert.Equal(t, "+OK", subscriber.readLine())
+
+				publisher.send("PUB orders.created 3\r\nbye\r\n")
+				assert.Equal(t, "+OK", publisher.readLine())
+
+				line, payload := subscriber.readMsg()
+				assert.Equal(t, "MSG orders.created 2 3", line)
+				assert.Equal(t, "bye", payload)
+			},
+		},
+		{
+			desc: "Shares topics with HTTP",
+			testFunc: func(t *testing.T) {
+				pubsubServer, baseURL := startServer(t, func(o *Options) { o.TCPAddr = "127.0.0.1:0" })
+				subscriber := dialTCP(t, pubsubServer)
+
+				subscriber.send("SUB orders workers 1\r\n")
+				assert.Equal(t, "+OK", subscriber.readLine())
+
+				resp, err := http.Post(baseURL+"/publish/orders", "text/plain", bytes.NewBufferString("from http"))
+				require.NoError(t, err)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+				line, payload := subscriber.readMsg()
+				assert.Equal(t, "MSG orders 1 9", line)
+				assert.Equal(t, "from http", payload)
+			},
+		},
+		{
+			desc: "Command errors",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startServer(t, func(o *Options) { o.TCPAddr = "127.0.0.1:0" })
+				client := dialTCP(t, pubsubServer)
+
+				client.send("HELLO\r\n")
+				assert.Equal(t, `-ERR 'unknown command "HELLO"'`, client.readLine())
+
+				client.send("SUB orders\r\n")
+				assert.Equal(t, "-ERR 'usage: SUB <pattern> [group] <sid>'", client.readLine())
+
+				client.send("SUB orders 1\r\nSUB billing 1\r\n")
+				assert.Equal(t, "+OK", client.readLine())
+				assert.Equal(t, `-ERR 'sid "1" is already in use'`, client.readLine())
+
+				client.send("UNSUB 2\r\n")
+				assert.Equal(t, `-ERR 'unknown sid "2"'`, client.readLine())
+
+				client.send("PUB orders text/plain;charset=latin1 2\r\nhi\r\n")
+				assert.True(t, strings.HasPrefix(client.readLine(), "-ERR 'unsupported media type"))
+
+				// The session carries on after command errors
+				client.send("PING\r\n")
+				assert.Equal(t, "PONG", client.readLine())
+			},
+		},
+		{
+			desc: "Payload size mismatch disconnects",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startServer(t, func(o *Options) { o.TCPAddr = "127.0.0.1:0" })
+				client := dialTCP(t, pubsubServer)
+
+				client.send("PUB orders 2\r\nhello\r\n")
+				assert.Equal(t, "-ERR 'payload does not match its size'", client.readLine())
+
+				_, err := client.reader.ReadString('\n')
+				assert.Equal(t, io.EOF, err)
+			},
+		},
+		{
+			desc: "Invalid payload size disconnects",
+			testFunc: func(t *testing.T) {
+				// Without a max payload the size is still capped
+				pubsubServer, _ := startServer(t, func(o *Options) {
+					o.TCPAddr = "127.0.0.1:0"
+					o.MaxPayload = 0
+				})
+
+				for line, expected := range map[string]string{
+					"PUB orders -1\r\n":                   `-ERR 'invalid payload size "-1"'`,
+					"PUB orders 9999999999999\r\n":        fmt.Sprintf("-ERR 'payload of 9999999999999 bytes is larger than the max of %d'", maxTCPPayload),
+					"PUB orders 99999999999999999999\r\n": `-ERR 'invalid payload size "99999999999999999999"'`,
+				} {
+					client := dialTCP(t, pubsubServer)
+					client.send(line)
+					assert.Equal(t, expected, client.readLine())
+
+					_, err := client.reader.ReadString('\n')
+					assert.Equal(t, io.EOF, err)
+				}
+			},
+		},
+		{
+			desc: "Close disconnects clients",
+			testFunc: func(t *testing.T) {
+				pubsubServer, _ := startServer(t, func(o *Options) { o.TCPAddr = "127.0.0.1:0" })
+				client := dialTCP(t, pubsubServer)
+
+				client.send("SUB orders 1\r\n")
+				assert.Equal(t, "+OK", client.readLine())
+
+				require.NoError(t, pubsubServer.Close())
+
+				client.conn.SetReadDeadline(time.Now().Add(time.Second))
+				_, err := client.reader.ReadString('\n')
+				assert.Equal(t, io.EOF, err)
+
+				_, err = net.Dial("tcp", pubsubServer.TCPAddr().String())
+				assert.Error(t, err)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, tc.testFunc)
+	}
+}
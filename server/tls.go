@@ -0,0 +1,272 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ClientAuth decides whether clients must present a certificate signed by the client CA
+type ClientAuth int
+
+const (
+	// NoClientCert doesn't ask clients for a certificate
+	NoClientCert ClientAuth = iota
+
+	// OptionalClientCert verifies a certificate if the client presents one, clients without one are let through anonymously
+	OptionalClientCert
+
+	// RequireClientCert rejects clients that don't present a certificate signed by the client CA
+	RequireClientCert
+)
+
+// String returns the name of the client auth as used by ParseClientAuth
+func (ca ClientAuth) String() string {
+	switch ca {
+	case NoClientCert:
+		return "none"
+	case OptionalClientCert:
+		return "optional"
+	case RequireClientCert:
+		return "require"
+	}
+	return fmt.Sprintf("ClientAuth(%d)", int(ca))
+}
+
+// ParseClientAuth parses the name of a ClientAuth
+func ParseClientAuth(name string) (ClientAuth, error) {
+	for _, clientAuth := range []ClientAuth{NoClientCert, OptionalClientCert, RequireClientCert} {
+		if clientAuth.String() == name {
+			return clientAuth, nil
+		}
+	}
+	return NoClientCert, fmt.Errorf("unknown client auth %q", name)
+}
+
+// TLSConfig serves every listener over TLS, optionally verifying client certificates for mutual TLS
+type TLSConfig struct {
+	// CertFile and KeyFile hold the PEM encoded server certificate chain and its private key
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile holds the PEM encoded CAs client certificates are verified against
+	ClientCAFile string
+
+	// ClientAuth decides whether clients must present a certificate, anything but NoClientCert needs a ClientCAFile
+	ClientAuth ClientAuth
+
+	// ReloadInterval is how often the files are checked for changes, a changed file is loaded without a restart.
+	// Zero disables reloading.
+	ReloadInterval time.Duration
+}
+
+// DefaultTLSConfig returns a TLSConfig serving the certificate in certFile and keyFile without client certificates
+func DefaultTLSConfig(certFile, keyFile string) TLSConfig {
+	return TLSConfig{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ClientAuth:     NoClientCert,
+		ReloadInterval: 10 * time.Second,
+	}
+}
+
+// Validate checks the TLSConfig is usable, the files are only read once the server is created
+func (tc TLSConfig) Validate() error {
+	if tc.CertFile == "" || tc.KeyFile == "" {
+		return errors.New("tls cert file and key file must be set")
+	}
+
+	switch tc.ClientAuth {
+	case NoClientCert:
+	case OptionalClientCert, RequireClientCert:
+		if tc.ClientCAFile == "" {
+			return fmt.Errorf("tls client ca file must be set for client auth %s", tc.ClientAuth)
+		}
+	default:
+		return fmt.Errorf("unknown client auth %s", tc.ClientAuth)
+	}
+
+	if tc.ReloadInterval < 0 {
+		return errors.New("tls reload interval must not be negative")
+	}
+
+	return nil
+}
+
+// fileVersion identifies the contents of a file without reading it
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// certReloader holds the certificate and client CAs loaded from a TLSConfig, reloading them when their files change.
+// The tls.Config it returns reads them on every handshake so existing listeners pick up a reload.
+type certReloader struct {
+	config TLSConfig
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+
+	// versions are the versions of the files last loaded, or that last failed to load, only touched by watch
+	versions map[string]fileVersion
+}
+
+// newCertReloader loads the files of config, failing if any of them can't be loaded
+func newCertReloader(config TLSConfig) (*certReloader, error) {
+	cr := &certReloader{
+		config: config,
+	}
+
+	if _, err := cr.reload(); err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// files returns the files the reloader loads
+func (cr *certReloader) files() []string {
+	files := []string{cr.config.CertFile, cr.config.KeyFile}
+	if cr.config.ClientCAFile != "" {
+		files = append(files, cr.config.ClientCAFile)
+	}
+	return files
+}
+
+// reload loads the files again if any of them changed since the last attempt.
+// Returns true if new files were loaded. On error the previously loaded files stay in use.
+func (cr *certReloader) reload() (bool, error) {
+	versions := make(map[string]fileVersion)
+	changed := cr.versions == nil
+	for _, file := range cr.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+
+		version := fileVersion{modTime: info.ModTime(), size: info.Size()}
+		versions[file] = version
+		if cr.versions[file] != version {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	// Don't try again until the files change, a half written file will change once it is complete
+	cr.versions = versions
+
+	cert, err := tls.LoadX509KeyPair(cr.config.CertFile, cr.config.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if cr.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(cr.config.ClientCAFile)
+		if err != nil {
+			return false, fmt.Errorf("failed to load tls client ca: %w", err)
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("no certificates found in tls client ca file %s", cr.config.ClientCAFile)
+		}
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.clientCAs = clientCAs
+	cr.mu.Unlock()
+
+	return true, nil
+}
+
+// watch reloads the files every ReloadInterval until done is closed
+func (cr *certReloader) watch(done <-chan struct{}) {
+	if cr.config.ReloadInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(cr.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			reloaded, err := cr.reload()
+			if err != nil {
+				log.Println("Error while reloading TLS files, still using the previous ones", err)
+			} else if reloaded {
+				log.Println("Reloaded TLS certificate", cr.config.CertFile)
+			}
+		}
+	}
+}
+
+// getCertificate returns the current server certificate
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// verifyConnection verifies the client certificate, if one was presented, against the current client CAs.
+// Verification is done here rather than by crypto/tls so a reloaded CA applies to every listener.
+func (cr *certReloader) verifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		if cr.config.ClientAuth == RequireClientCert {
+			return errors.New("client certificate required")
+		}
+		return nil
+	}
+
+	cr.mu.RLock()
+	clientCAs := cr.clientCAs
+	cr.mu.RUnlock()
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("invalid client certificate: %w", err)
+	}
+
+	return nil
+}
+
+// tlsConfig returns the tls.Config listeners serve with
+func (cr *certReloader) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.getCertificate,
+	}
+
+	switch cr.config.ClientAuth {
+	case OptionalClientCert:
+		config.ClientAuth = tls.RequestClientCert
+		config.VerifyConnection = cr.verifyConnection
+	case RequireClientCert:
+		config.ClientAuth = tls.RequireAnyClientCert
+		config.VerifyConnection = cr.verifyConnection
+	}
+
+	return config
+}
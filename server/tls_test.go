@@ -0,0 +1,389 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cpheps/coder-pub-sub/pubsubpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+// newTestCA creates a self signed CA
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+// issue returns a PEM encoded certificate and key for template signed by the CA
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	ca.serial++
+	template.SerialNumber = big.NewInt(ca.serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// serverCert returns a certificate and key for 127.0.0.1
+func (ca *testCA) serverCert(t *testing.T) ([]byte, []byte) {
+	return ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "pubsub"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+// clientCert returns a client certificate for commonName
+func (ca *testCA) clientCert(t *testing.T, commonName string) tls.Certificate {
+	certPEM, keyPEM := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName, Organization: []string{"billing"}},
+		URIs:        []*url.URL{{Scheme: "spiffe", Host: "example.org", Path: "/" + commonName}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	return cert
+}
+
+// pool returns a pool trusting the CA
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// pem returns the PEM encoded CA certificate
+func (ca *testCA) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// writeTLSFiles writes a server certificate, its key and the CA to dir and returns a TLSConfig using them
+func writeTLSFiles(t *testing.T, dir string, ca *testCA) TLSConfig {
+	config := DefaultTLSConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	config.ClientCAFile = filepath.Join(dir, "ca.crt")
+
+	certPEM, keyPEM := ca.serverCert(t)
+	require.NoError(t, os.WriteFile(config.CertFile, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(config.KeyFile, keyPEM, 0o600))
+	require.NoError(t, os.WriteFile(config.ClientCAFile, ca.pem(), 0o600))
+
+	return config
+}
+
+// servedSerial returns the serial of the certificate served by cr
+func servedSerial(t *testing.T, cr *certReloader) int64 {
+	cert, err := cr.getCertificate(nil)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf.SerialNumber.Int64()
+}
+
+func Test_ParseClientAuth(t *testing.T) {
+	for _, clientAuth := range []ClientAuth{NoClientCert, OptionalClientCert, RequireClientCert} {
+		parsed, err := ParseClientAuth(clientAuth.String())
+		require.NoError(t, err)
+		assert.Equal(t, clientAuth, parsed)
+	}
+
+	_, err := ParseClientAuth("always")
+	assert.EqualError(t, err, `unknown client auth "always"`)
+}
+
+func Test_TLSConfig_Validate(t *testing.T) {
+	config := DefaultTLSConfig("server.crt", "server.key")
+	assert.NoError(t, config.Validate())
+
+	config.ClientAuth = RequireClientCert
+	assert.EqualError(t, config.Validate(), "tls client ca file must be set for client auth require")
+
+	config.ClientCAFile = "ca.crt"
+	assert.NoError(t, config.Validate())
+
+	config.KeyFile = ""
+	assert.EqualError(t, config.Validate(), "tls cert file and key file must be set")
+}
+
+func Test_certReloader(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			desc: "Missing file",
+			testFunc: func(t *testing.T) {
+				_, err := newCertReloader(DefaultTLSConfig(filepath.Join(t.TempDir(), "server.crt"), "server.key"))
+				assert.Error(t, err)
+			},
+		},
+		{
+			desc: "Reloads changed certificate",
+			testFunc: func(t *testing.T) {
+				ca := newTestCA(t)
+				config := writeTLSFiles(t, t.TempDir(), ca)
+				config.ReloadInterval = 10 * time.Millisecond
+
+				cr, err := newCertReloader(config)
+				require.NoError(t, err)
+				first := servedSerial(t, cr)
+
+				done := make(chan struct{})
+				defer close(done)
+				go cr.watch(done)
+
+				certPEM, keyPEM := ca.serverCert(t)
+				require.NoError(t, os.WriteFile(config.KeyFile, keyPEM, 0o600))
+				require.NoError(t, os.WriteFile(config.CertFile, certPEM, 0o600))
+
+				assert.Eventually(t, func() bool { return servedSerial(t, cr) != first }, time.Second, 10*time.Millisecond)
+			},
+		},
+		{
+			desc: "Keeps previous certificate when reload fails",
+			testFunc: func(t *testing.T) {
+				config := writeTLSFiles(t, t.TempDir(), newTestCA(t))
+
+				cr, err := newCertReloader(config)
+				require.NoError(t, err)
+				first := servedSerial(t, cr)
+
+				require.NoError(t, os.WriteFile(config.CertFile, []byte("not a certificate"), 0o600))
+
+				reloaded, err := cr.reload()
+				assert.Error(t, err)
+				assert.False(t, reloaded)
+				assert.Equal(t, first, servedSerial(t, cr))
+
+				// The broken file isn't retried until it changes again
+				reloaded, err = cr.reload()
+				assert.NoError(t, err)
+				assert.False(t, reloaded)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, tc.testFunc)
+	}
+}
+
+func Test_PubSubServer_identify(t *testing.T) {
+	ca := newTestCA(t)
+	config := writeTLSFiles(t, t.TempDir(), ca)
+	config.ClientAuth = OptionalClientCert
+
+	cr, err := newCertReloader(config)
+	require.NoError(t, err)
+
+	// The identity is echoed back so the test can see what handlers are given
+	s := &PubSubServer{}
+	ts := httptest.NewUnstartedServer(s.identify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := IdentityFromContext(r.Context())
+		if identity == nil {
+			io.WriteString(w, "anonymous")
+			return
+		}
+		io.WriteString(w, identity.Method+" "+identity.Subject+" "+strings.Join(identity.Claims["o"].([]string), ","))
+	})))
+	// StartTLS would serve httptest's own certificate so the listener is wrapped instead
+	ts.Listener = tls.NewListener(ts.Listener, cr.tlsConfig())
+	ts.Start()
+	defer ts.Close()
+	serverURL := strings.Replace(ts.URL, "http://", "https://", 1)
+
+	get := func(certs ...tls.Certificate) (string, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      ca.pool(),
+			Certificates: certs,
+		}}}
+
+		resp, err := client.Get(serverURL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	body, err := get(ca.clientCert(t, "billing-service"))
+	require.NoError(t, err)
+	assert.Equal(t, "client-cert billing-service billing", body)
+
+	body, err = get()
+	require.NoError(t, err)
+	assert.Equal(t, "anonymous", body)
+
+	// A certificate from another CA is rejected rather than treated as anonymous
+	_, err = get(newTestCA(t).clientCert(t, "intruder"))
+	assert.Error(t, err)
+}
+
+func Test_PubSubServer_TLS(t *testing.T) {
+	ca := newTestCA(t)
+	config := writeTLSFiles(t, t.TempDir(), ca)
+	config.ClientAuth = RequireClientCert
+	config.ReloadInterval = 10 * time.Millisecond
+
+	pubsubServer, baseURL := startServer(t, func(o *Options) {
+		o.TLS = &config
+		o.TCPAddr = "127.0.0.1:0"
+		o.GRPCAddr = "127.0.0.1:0"
+
+		// Client certificates authenticate without a token
+		o.Auth = &AuthConfig{APIKeysFile: writeAPIKeys(t)}
+	})
+	baseURL = strings.Replace(baseURL, "http://", "https://", 1)
+
+	clientConfig := &tls.Config{
+		RootCAs:      ca.pool(),
+		Certificates: []tls.Certificate{ca.clientCert(t, "publisher")},
+	}
+
+	testCases := []struct {
+		desc     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			desc: "HTTPS with client certificate",
+			testFunc: func(t *testing.T) {
+				client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+
+				resp, err := client.Post(baseURL+"/publish/orders", "text/plain", bytes.NewBufferString("hello"))
+				require.NoError(t, err)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+			},
+		},
+		{
+			desc: "HTTPS without client certificate",
+			testFunc: func(t *testing.T) {
+				client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool()}}}
+
+				_, err := client.Post(baseURL+"/publish/orders", "text/plain", bytes.NewBufferString("hello"))
+				assert.Error(t, err)
+			},
+		},
+		{
+			desc: "Plaintext HTTP is refused",
+			testFunc: func(t *testing.T) {
+				resp, err := http.Post(strings.Replace(baseURL, "https://", "http://", 1)+"/publish/orders", "text/plain", bytes.NewBufferString("hello"))
+				require.NoError(t, err)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			},
+		},
+		{
+			desc: "TCP line protocol over TLS",
+			testFunc: func(t *testing.T) {
+				conn, err := tls.Dial("tcp", pubsubServer.TCPAddr().String(), clientConfig)
+				require.NoError(t, err)
+				defer conn.Close()
+
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				require.NoError(t, err)
+				assert.True(t, strings.HasPrefix(line, "INFO "), line)
+				assert.Contains(t, line, `"auth_required":false`)
+			},
+		},
+		{
+			desc: "gRPC over TLS",
+			testFunc: func(t *testing.T) {
+				conn, err := grpc.Dial(pubsubServer.GRPCAddr().String(), grpc.WithTransportCredentials(credentials.NewTLS(clientConfig)))
+				require.NoError(t, err)
+				defer conn.Close()
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+
+				resp, err := pubsubpb.NewPubSubClient(conn).Publish(ctx, &pubsubpb.PublishRequest{Topic: "orders", Data: []byte("hello")})
+				require.NoError(t, err)
+				assert.NotZero(t, resp.Seq)
+			},
+		},
+		{
+			desc: "Certificate reload without restart",
+			testFunc: func(t *testing.T) {
+				served := func() int64 {
+					conn, err := tls.Dial("tcp", pubsubServer.TCPAddr().String(), clientConfig)
+					require.NoError(t, err)
+					defer conn.Close()
+					return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+				}
+				first := served()
+
+				certPEM, keyPEM := ca.serverCert(t)
+				require.NoError(t, os.WriteFile(config.KeyFile, keyPEM, 0o600))
+				require.NoError(t, os.WriteFile(config.CertFile, certPEM, 0o600))
+
+				assert.Eventually(t, func() bool { return served() != first }, time.Second, 10*time.Millisecond)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, tc.testFunc)
+	}
+}
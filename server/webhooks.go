@@ -0,0 +1,304 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/cpheps/coder-pub-sub/websocket"
+	"github.com/gorilla/mux"
+)
+
+// webhookIDVar is the name of the mux path variable holding a webhook ID
+const webhookIDVar = "id"
+
+// maxWebhookRequestBytes caps the size of a webhook registration
+const maxWebhookRequestBytes = 64 * 1024
+
+// webhookRequest is the body of a webhook registration
+type webhookRequest struct {
+	// URL is where messages are posted
+	URL string `json:"url"`
+
+	// Topic is the topic pattern to subscribe to
+	Topic string `json:"topic"`
+
+	// Secret signs deliveries, one is generated if it is empty
+	Secret string `json:"secret"`
+
+	// Format is envelope, the default, or raw
+	Format string `json:"format"`
+
+	// Consumer and Group work as the query parameters of the same name on other subscribe endpoints
+	Consumer string `json:"consumer"`
+	Group    string `json:"group"`
+}
+
+// webhook is a registered webhook
+type webhook struct {
+	id     string
+	url    string
+	secret string
+	sub    websocket.Subscription
+
+	// owner is the identity that registered the webhook, see identityOwner. Only the owner can see and manage it.
+	owner string
+
+	// consumer is the durable consumer as named in the request, the subscription's is scoped to the owner
+	consumer string
+
+	// conn delivers the messages, a disabled webhook is given a new one when enabled. Guarded by webhookRegistry.mu.
+	conn *websocket.WebhookConn
+}
+
+// webhookRegistry holds the registered webhooks
+type webhookRegistry struct {
+	config websocket.WebhookConfig
+
+	mu    sync.Mutex
+	hooks map[string]*webhook
+}
+
+// newWebhookRegistry creates an empty registry whose webhooks deliver as configured by config
+func newWebhookRegistry(config websocket.WebhookConfig) *webhookRegistry {
+	return &webhookRegistry{
+		config: config,
+		hooks:  make(map[string]*webhook),
+	}
+}
+
+// randomHex returns n random bytes hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// parseWebhookRequest checks a registration and turns it into a webhook that is not yet connected,
+// owned by the identity in ctx. The URL's host must resolve to addresses config allows webhooks to be delivered to.
+func parseWebhookRequest(ctx context.Context, req webhookRequest, config websocket.WebhookConfig) (*webhook, error) {
+	endpoint, err := url.Parse(req.URL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("url must be an absolute http or https URL: %q", req.URL)
+	}
+
+	if err := config.CheckURL(ctx, endpoint); err != nil {
+		return nil, err
+	}
+
+	if err := websocket.ValidatePattern(req.Topic); err != nil {
+		return nil, err
+	}
+
+	format := websocket.FormatEnvelope
+	if req.Format != "" {
+		format, err = websocket.ParseFormat(req.Format)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if format == websocket.FormatMIME {
+		return nil, errors.New("webhooks support the envelope and raw formats")
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		secret = randomHex(32)
+	}
+
+	owner := ownerFromContext(ctx)
+	return &webhook{
+		id:     randomHex(8),
+		url:    req.URL,
+		secret: secret,
+		sub: websocket.Subscription{
+			Pattern:  req.Topic,
+			Format:   format,
+			Consumer: scopeConsumer(owner, req.Consumer),
+			Group:    req.Group,
+		},
+		owner:    owner,
+		consumer: req.Consumer,
+	}, nil
+}
+
+// connectWebhook registers a new connection for hook with the broadcaster. Must be called with webhooks.mu held.
+func (s *PubSubServer) connectWebhook(hook *webhook) error {
+	conn := websocket.NewWebhookConn(hook.url, hook.secret, s.webhooks.config)
+	if err := s.broadcaster.RegisterConnection(hook.sub, conn); err != nil {
+		conn.Close()
+		return err
+	}
+	hook.conn = conn
+
+	// A disabled webhook closes its connection, stop broadcasting to it
+	go func() {
+		select {
+		case <-s.doneChan:
+		case <-conn.Done():
+			s.broadcaster.UnregisterConnection(conn)
+		}
+	}()
+
+	return nil
+}
+
+// CreateWebhook registers the webhook described by the JSON body of the request as a subscriber.
+// Responds with 201 and the webhook, including its secret which is not shown again.
+func (s *PubSubServer) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req webhookRequest
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxWebhookRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		log.Println("Rejecting webhook", err)
+		s.writeResponse(w, http.StatusBadRequest, &errorResponse{
+			Message: "body must be a webhook registration",
+		})
+		return
+	}
+
+	hook, err := parseWebhookRequest(r.Context(), req, s.webhooks.config)
+	if err != nil {
+		log.Println("Rejecting webhook", err)
+		s.writeResponse(w, http.StatusBadRequest, &errorResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+
+	if err := s.authorize(r.Context(), ActionSubscribe, hook.sub.Pattern); err != nil {
+		log.Println("Rejecting webhook", err)
+		s.writeResponse(w, http.StatusForbidden, &errorResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+
+	s.webhooks.mu.Lock()
+	defer s.webhooks.mu.Unlock()
+
+	log.Println("Registering webhook", hook.id, "to topic", hook.sub.Pattern)
+	if err := s.connectWebhook(hook); err != nil {
+		log.Println("Error while registering webhook", err)
+		s.writeResponse(w, http.StatusInternalServerError, &errorResponse{
+			Message: "Internal Error",
+		})
+		return
+	}
+	s.webhooks.hooks[hook.id] = hook
+
+	resp := newWebhookResponse(hook)
+	resp.Secret = hook.secret
+	s.writeResponse(w, http.StatusCreated, resp)
+}
+
+// ownerFromContext returns the owner of what the client making a request creates, see identityOwner
+func ownerFromContext(ctx context.Context) string {
+	return identityOwner(IdentityFromContext(ctx))
+}
+
+// ownedWebhook returns the webhook in the request path if the client making the request registered it.
+// Webhooks registered by others are reported as unknown so their IDs aren't revealed. Must be called with webhooks.mu held.
+func (s *PubSubServer) ownedWebhook(w http.ResponseWriter, r *http.Request) (*webhook, bool) {
+	hook, ok := s.webhooks.hooks[mux.Vars(r)[webhookIDVar]]
+	if !ok || hook.owner != ownerFromContext(r.Context()) {
+		s.writeResponse(w, http.StatusNotFound, &errorResponse{
+			Message: "unknown webhook",
+		})
+		return nil, false
+	}
+
+	return hook, true
+}
+
+// ListWebhooks responds with every webhook registered by the client ordered by ID
+func (s *PubSubServer) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	owner := ownerFromContext(r.Context())
+
+	s.webhooks.mu.Lock()
+	resp := make([]*webhookResponse, 0, len(s.webhooks.hooks))
+	for _, hook := range s.webhooks.hooks {
+		if hook.owner == owner {
+			resp = append(resp, newWebhookResponse(hook))
+		}
+	}
+	s.webhooks.mu.Unlock()
+
+	sort.Slice(resp, func(i, j int) bool {
+		return resp[i].ID < resp[j].ID
+	})
+
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+// GetWebhook responds with the webhook in the request path and its delivery stats
+func (s *PubSubServer) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	s.webhooks.mu.Lock()
+	defer s.webhooks.mu.Unlock()
+
+	hook, ok := s.ownedWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	s.writeResponse(w, http.StatusOK, newWebhookResponse(hook))
+}
+
+// DeleteWebhook unregisters the webhook in the request path, deliveries in flight are abandoned
+func (s *PubSubServer) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	s.webhooks.mu.Lock()
+	defer s.webhooks.mu.Unlock()
+
+	hook, ok := s.ownedWebhook(w, r)
+	if !ok {
+		return
+	}
+	id := hook.id
+
+	log.Println("Deleting webhook", id)
+	delete(s.webhooks.hooks, id)
+	s.broadcaster.UnregisterConnection(hook.conn)
+	hook.conn.Close()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// EnableWebhook starts delivering to the webhook in the request path again after it was disabled.
+// A webhook with a consumer resumes after the last message it was sent, others only receive new messages.
+func (s *PubSubServer) EnableWebhook(w http.ResponseWriter, r *http.Request) {
+	s.webhooks.mu.Lock()
+	defer s.webhooks.mu.Unlock()
+
+	hook, ok := s.ownedWebhook(w, r)
+	if !ok {
+		return
+	}
+	id := hook.id
+
+	if hook.conn.Stats().Disabled {
+		log.Println("Enabling webhook", id)
+		if err := s.connectWebhook(hook); err != nil {
+			log.Println("Error while enabling webhook", err)
+			s.writeResponse(w, http.StatusInternalServerError, &errorResponse{
+				Message: "Internal Error",
+			})
+			return
+		}
+	}
+
+	s.writeResponse(w, http.StatusOK, newWebhookResponse(hook))
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cpheps/coder-pub-sub/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseWebhookRequest(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		req         webhookRequest
+		expectedSub websocket.Subscription
+		expectedErr string
+	}{
+		{
+			desc:        "Defaults to envelopes",
+			req:         webhookRequest{URL: "https://203.0.113.10/hook", Topic: "orders.*"},
+			expectedSub: websocket.Subscription{Pattern: "orders.*", Format: websocket.FormatEnvelope},
+		},
+		{
+			desc:        "Raw consumer group",
+			req:         webhookRequest{URL: "http://203.0.113.10/hook", Topic: "orders", Format: "raw", Consumer: "billing", Group: "billing"},
+			expectedSub: websocket.Subscription{Pattern: "orders", Format: websocket.FormatRaw, Consumer: "/billing", Group: "billing"},
+		},
+		{
+			desc:        "Relative URL",
+			req:         webhookRequest{URL: "/hook", Topic: "orders"},
+			expectedErr: `url must be an absolute http or https URL: "/hook"`,
+		},
+		{
+			desc:        "Unsupported scheme",
+			req:         webhookRequest{URL: "ftp://example.com/hook", Topic: "orders"},
+			expectedErr: `url must be an absolute http or https URL: "ftp://example.com/hook"`,
+		},
+		{
+			desc:        "Loopback",
+			req:         webhookRequest{URL: "http://127.0.0.1:8080/hook", Topic: "orders"},
+			expectedErr: "webhook address is not allowed: 127.0.0.1 is a loopback, link-local, private or unspecified address",
+		},
+		{
+			desc:        "Cloud metadata",
+			req:         webhookRequest{URL: "http://169.254.169.254/latest/meta-data", Topic: "orders"},
+			expectedErr: "webhook address is not allowed: 169.254.169.254 is a loopback, link-local, private or unspecified address",
+		},
+		{
+			desc:        "Allowed private network",
+			req:         webhookRequest{URL: "http://10.1.2.3/hook", Topic: "orders"},
+			expectedSub: websocket.Subscription{Pattern: "orders", Format: websocket.FormatEnvelope},
+		},
+		{
+			desc:        "Invalid topic",
+			req:         webhookRequest{URL: "https://203.0.113.10/hook", Topic: "orders.>.created"},
+			expectedErr: websocket.ValidatePattern("orders.>.created").Error(),
+		},
+		{
+			desc:        "MIME format",
+			req:         webhookRequest{URL: "https://203.0.113.10/hook", Topic: "orders", Format: "mime"},
+			expectedErr: "webhooks support the envelope and raw formats",
+		},
+	}
+
+	config := websocket.DefaultWebhookConfig()
+	config.AllowedNetworks = []string{"10.1.0.0/16"}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			hook, err := parseWebhookRequest(context.Background(), tc.req, config)
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedSub, hook.sub)
+			assert.NotEmpty(t, hook.id)
+			assert.NotEmpty(t, hook.secret)
+		})
+	}
+}
+
+func Test_PubSubServer_Webhooks(t *testing.T) {
+	var failing int32
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer endpoint.Close()
+
+	config := websocket.DefaultWebhookConfig()
+	config.InitialBackoff = time.Millisecond
+	config.MaxBackoff = time.Millisecond
+	config.DisableAfter = 1
+	config.AllowedNetworks = []string{"127.0.0.0/8"}
+
+	opts := DefaultOptions()
+	opts.Webhook = config
+	pubsubServer, err := New(opts)
+	require.NoError(t, err)
+	defer pubsubServer.Close()
+
+	srv := httptest.NewServer(pubsubServer.srv.Handler)
+	defer srv.Close()
+
+	do := func(method, path string, body interface{}, v interface{}) int {
+		var payload io.Reader = http.NoBody
+		if body != nil {
+			encoded, err := json.Marshal(body)
+			require.NoError(t, err)
+			payload = bytes.NewReader(encoded)
+		}
+
+		req, err := http.NewRequest(method, srv.URL+path, payload)
+		require.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		if v != nil {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+
+	publish := func(body string) {
+		resp, err := http.Post(srv.URL+"/publish/orders.created", "text/plain", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/webhooks", map[string]string{"url": "nope", "topic": "orders"}, nil))
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/webhooks", map[string]string{"unknown": "field"}, nil))
+
+	var created webhookResponse
+	require.Equal(t, http.StatusCreated, do(http.MethodPost, "/webhooks", webhookRequest{URL: endpoint.URL, Topic: "orders.*", Secret: "s3cret"}, &created))
+	assert.Equal(t, "s3cret", created.Secret)
+	assert.Equal(t, "active", created.Status)
+
+	// Published messages are posted to the webhook, signed with its secret
+	publish("one")
+	req, body := <-received, <-bodies
+	assert.Equal(t, websocket.SignWebhook("s3cret", req.Header.Get(websocket.WebhookTimestampHeader), body), req.Header.Get(websocket.WebhookSignatureHeader))
+
+	var envelope struct {
+		Data string `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(body, &envelope))
+	assert.Equal(t, "one", envelope.Data)
+
+	// The secret is not shown again
+	var listed []webhookResponse
+	require.Equal(t, http.StatusOK, do(http.MethodGet, "/webhooks", nil, &listed))
+	require.Len(t, listed, 1)
+	assert.Equal(t, created.ID, listed[0].ID)
+	assert.Empty(t, listed[0].Secret)
+
+	// A failing webhook is disabled
+	atomic.StoreInt32(&failing, 1)
+	publish("two")
+	assert.Eventually(t, func() bool {
+		var hook webhookResponse
+		do(http.MethodGet, "/webhooks/"+created.ID, nil, &hook)
+		return hook.Status == "disabled"
+	}, time.Second, 5*time.Millisecond)
+
+	var hook webhookResponse
+	require.Equal(t, http.StatusOK, do(http.MethodGet, "/webhooks/"+created.ID, nil, &hook))
+	assert.Equal(t, uint64(1), hook.Delivered)
+	assert.Equal(t, uint64(1), hook.Failed)
+	assert.Equal(t, "webhook responded with 410 Gone", hook.LastError)
+
+	// Enabling it delivers new messages again
+	atomic.StoreInt32(&failing, 0)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/webhooks/"+created.ID+"/enable", nil, &hook))
+	assert.Equal(t, "active", hook.Status)
+
+	publish("three")
+	<-received
+	require.NoError(t, json.Unmarshal(<-bodies, &envelope))
+	assert.Equal(t, "three", envelope.Data)
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/webhooks/"+created.ID, nil, nil))
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/webhooks/"+created.ID, nil, nil))
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/webhooks/"+created.ID+"/enable", nil, nil))
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/webhooks/"+created.ID, nil, nil))
+}
+
+func Test_PubSubServer_WebhookOwner(t *testing.T) {
+	_, baseURL := startServer(t, func(o *Options) {
+		o.Auth = &AuthConfig{APIKeysFile: writeAPIKeys(t)}
+	})
+
+	do := func(key, method, path string, body interface{}, v interface{}) int {
+		var payload io.Reader = http.NoBody
+		if body != nil {
+			encoded, err := json.Marshal(body)
+			require.NoError(t, err)
+			payload = bytes.NewReader(encoded)
+		}
+
+		req, err := http.NewRequest(method, baseURL+path, payload)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+key)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		if v != nil {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+
+	const otherKey = "k3y-subscriber"
+
+	var created webhookResponse
+	require.Equal(t, http.StatusCreated, do(testAPIKey, http.MethodPost, "/webhooks", webhookRequest{URL: "https://203.0.113.10/hook", Topic: "orders"}, &created))
+
+	// Another identity can't see or manage the webhook
+	var listed []webhookResponse
+	require.Equal(t, http.StatusOK, do(otherKey, http.MethodGet, "/webhooks", nil, &listed))
+	assert.Empty(t, listed)
+	assert.Equal(t, http.StatusNotFound, do(otherKey, http.MethodGet, "/webhooks/"+created.ID, nil, nil))
+	assert.Equal(t, http.StatusNotFound, do(otherKey, http.MethodPost, "/webhooks/"+created.ID+"/enable", nil, nil))
+	assert.Equal(t, http.StatusNotFound, do(otherKey, http.MethodDelete, "/webhooks/"+created.ID, nil, nil))
+
+	// The owner still can
+	require.Equal(t, http.StatusOK, do(testAPIKey, http.MethodGet, "/webhooks", nil, &listed))
+	require.Len(t, listed, 1)
+	assert.Equal(t, created.ID, listed[0].ID)
+	assert.Equal(t, http.StatusOK, do(testAPIKey, http.MethodGet, "/webhooks/"+created.ID, nil, nil))
+	assert.Equal(t, http.StatusOK, do(testAPIKey, http.MethodPost, "/webhooks/"+created.ID+"/enable", nil, nil))
+	assert.Equal(t, http.StatusNoContent, do(testAPIKey, http.MethodDelete, "/webhooks/"+created.ID, nil, nil))
+}
@@ -0,0 +1,762 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// segmentExt is the file extension of log segments. Segments are named after the sequence number of their first record.
+	segmentExt = ".log"
+
+	// offsetsFile holds the committed consumer offsets
+	offsetsFile = "offsets.json"
+
+	// recordHeaderSize is the length and checksum that prefix every record
+	recordHeaderSize = 8
+
+	// recordFixedSize is the sequence number, timestamp and topic length at the start of a record body
+	recordFixedSize = 8 + 8 + 2
+
+	// indexInterval is how many bytes of records a segment's index skips between entries
+	indexInterval = 4 << 10
+
+	// maintenanceInterval is how often retention is applied and offsets written when not syncing on an interval
+	maintenanceInterval = time.Second
+)
+
+// FsyncPolicy decides when appended records are flushed to stable storage
+type FsyncPolicy int
+
+const (
+	// FsyncInterval syncs on DiskConfig.FsyncInterval. A crash loses at most one interval of messages.
+	FsyncInterval FsyncPolicy = iota
+
+	// FsyncAlways syncs after every append before it returns. Nothing acknowledged is lost but appends are slow.
+	FsyncAlways
+
+	// FsyncNever leaves flushing to the operating system
+	FsyncNever
+)
+
+// String returns the name of the policy as used by ParseFsyncPolicy
+func (fp FsyncPolicy) String() string {
+	switch fp {
+	case FsyncInterval:
+		return "interval"
+	case FsyncAlways:
+		return "always"
+	case FsyncNever:
+		return "never"
+	}
+	return fmt.Sprintf("FsyncPolicy(%d)", int(fp))
+}
+
+// ParseFsyncPolicy parses the name of a FsyncPolicy
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	for _, policy := range []FsyncPolicy{FsyncInterval, FsyncAlways, FsyncNever} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return FsyncInterval, fmt.Errorf("unknown fsync policy %q", name)
+}
+
+// DiskConfig configures a DiskStore
+type DiskConfig struct {
+	// Dir is the directory segments and offsets are stored in. It is created if missing.
+	Dir string
+
+	// SegmentBytes is the size a segment grows to before a new one is started
+	SegmentBytes int64
+
+	// MaxSegments is the number of segments kept. Zero keeps every segment.
+	MaxSegments int
+
+	// MaxAge is how long a segment is kept after its newest record was appended. Zero keeps segments regardless of age.
+	MaxAge time.Duration
+
+	// Fsync is when appends are flushed to stable storage
+	Fsync FsyncPolicy
+
+	// FsyncInterval is how often to sync with the FsyncInterval policy
+	FsyncInterval time.Duration
+}
+
+// DefaultDiskConfig returns a DiskConfig storing segments in dir
+func DefaultDiskConfig(dir string) DiskConfig {
+	return DiskConfig{
+		Dir:           dir,
+		SegmentBytes:  64 << 20,
+		MaxSegments:   16,
+		MaxAge:        24 * time.Hour,
+		Fsync:         FsyncInterval,
+		FsyncInterval: time.Second,
+	}
+}
+
+// Validate checks the DiskConfig is usable
+func (dc DiskConfig) Validate() error {
+	if dc.Dir == "" {
+		return errors.New("disk store directory must be set")
+	}
+
+	if dc.SegmentBytes <= 0 {
+		return errors.New("segment bytes must be greater than 0")
+	}
+
+	if dc.MaxSegments < 0 {
+		return errors.New("max segments must not be negative")
+	}
+
+	if dc.MaxAge < 0 {
+		return errors.New("max age must not be negative")
+	}
+
+	switch dc.Fsync {
+	case FsyncAlways, FsyncNever:
+	case FsyncInterval:
+		if dc.FsyncInterval <= 0 {
+			return errors.New("fsync interval must be greater than 0 for the interval fsync policy")
+		}
+	default:
+		return fmt.Errorf("unknown fsync policy %s", dc.Fsync)
+	}
+
+	return nil
+}
+
+// segment is a single file of the log
+type segment struct {
+	// base is the sequence number of the first record in the segment
+	base uint64
+	path string
+	size int64
+
+	// lastSeq is the sequence number of the newest record, base-1 if the segment is empty
+	lastSeq       uint64
+	lastTimestamp time.Time
+
+	// index locates a record every indexInterval bytes, oldest first, so a read seeks close to where it starts.
+	// Entries are only ever appended so a copy taken under the read lock stays valid.
+	index []indexEntry
+}
+
+// indexEntry is the offset of the record with seq in its segment
+type indexEntry struct {
+	seq    uint64
+	offset int64
+}
+
+// indexRecord adds the record with seq at offset to the index if it is far enough past the last entry
+func (seg *segment) indexRecord(seq uint64, offset int64) {
+	if n := len(seg.index); n > 0 && offset-seg.index[n-1].offset < indexInterval {
+		return
+	}
+	seg.index = append(seg.index, indexEntry{seq: seq, offset: offset})
+}
+
+// seekOffset returns the offset of the last indexed record that is not after the first record following since
+func (seg *segment) seekOffset(since uint64) int64 {
+	i := sort.Search(len(seg.index), func(i int) bool {
+		return seg.index[i].seq > since
+	})
+	if i == 0 {
+		return 0
+	}
+	return seg.index[i-1].offset
+}
+
+var _ (Store) = (*DiskStore)(nil)
+
+// DiskStore is a Store backed by an append only log of segment files on local disk.
+// Records and committed offsets survive a restart.
+//
+// Each record is framed as
+//
+//	length uint32 | crc32 uint32 | seq uint64 | unix nano timestamp int64 | topic length uint16 | topic | data
+//
+// where length and the checksum cover everything after them. A torn record at the end of the log,
+// left by a crash part way through an append, is truncated when the store is opened.
+type DiskStore struct {
+	mu     sync.RWMutex
+	config DiskConfig
+
+	// segments are ordered oldest first, the last one is being appended to
+	segments []*segment
+	active   *os.File
+	lastSeq  uint64
+
+	// unsynced is true if records were appended since the last sync
+	unsynced bool
+
+	offsets        map[string]uint64
+	offsetsChanged bool
+
+	closed   bool
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewDiskStore opens the log in config.Dir, recovering any existing segments and offsets
+func NewDiskStore(config DiskConfig) (*DiskStore, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create disk store directory: %w", err)
+	}
+
+	ds := &DiskStore{
+		config:   config,
+		offsets:  make(map[string]uint64),
+		stopChan: make(chan struct{}),
+	}
+
+	if err := ds.recoverSegments(); err != nil {
+		return nil, err
+	}
+
+	if err := ds.loadOffsets(); err != nil {
+		return nil, err
+	}
+
+	if err := ds.openActive(); err != nil {
+		return nil, err
+	}
+
+	ds.applyRetention(time.Now())
+
+	ds.wg.Add(1)
+	go ds.maintain()
+
+	return ds, nil
+}
+
+// recoverSegments scans the existing segments to find where the log ends
+func (ds *DiskStore) recoverSegments() error {
+	paths, err := filepath.Glob(filepath.Join(ds.config.Dir, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		base, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), segmentExt), 10, 64)
+		if err != nil {
+			log.Println("Ignoring unexpected file in disk store", path)
+			continue
+		}
+
+		ds.segments = append(ds.segments, &segment{
+			base:    base,
+			path:    path,
+			lastSeq: base - 1,
+		})
+	}
+
+	sort.Slice(ds.segments, func(i, j int) bool {
+		return ds.segments[i].base < ds.segments[j].base
+	})
+
+	for i, seg := range ds.segments {
+		validSize, err := scanSegment(seg)
+
+		// A crash can only tear the end of the newest segment, anywhere else is corruption
+		if err != nil && i != len(ds.segments)-1 {
+			return fmt.Errorf("corrupt segment %s: %w", seg.path, err)
+		}
+
+		if err != nil {
+			log.Println("Truncating torn record at the end of", seg.path, err)
+			if err := os.Truncate(seg.path, validSize); err != nil {
+				return fmt.Errorf("failed to truncate segment %s: %w", seg.path, err)
+			}
+		}
+
+		seg.size = validSize
+		ds.lastSeq = seg.lastSeq
+	}
+
+	return nil
+}
+
+// scanSegment reads every record of seg to find its newest record.
+// Returns the size of the valid records and an error if a record is torn or corrupt.
+func scanSegment(seg *segment) (int64, error) {
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+
+	var size int64
+	for {
+		record, n, err := readRecord(reader)
+		if errors.Is(err, io.EOF) {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+
+		seg.indexRecord(record.Seq, size)
+		size += n
+		seg.lastSeq = record.Seq
+		seg.lastTimestamp = record.Timestamp
+	}
+}
+
+// openActive opens the newest segment for appending, creating one if there are none
+func (ds *DiskStore) openActive() error {
+	if len(ds.segments) == 0 {
+		return ds.createSegment(ds.lastSeq + 1)
+	}
+
+	active := ds.segments[len(ds.segments)-1]
+	file, err := os.OpenFile(active.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open segment %s: %w", active.path, err)
+	}
+
+	ds.active = file
+	return nil
+}
+
+// createSegment starts a new active segment whose first record will be base
+func (ds *DiskStore) createSegment(base uint64) error {
+	path := filepath.Join(ds.config.Dir, fmt.Sprintf("%020d%s", base, segmentExt))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create segment %s: %w", path, err)
+	}
+
+	ds.segments = append(ds.segments, &segment{
+		base:    base,
+		path:    path,
+		lastSeq: base - 1,
+	})
+	ds.active = file
+	return nil
+}
+
+// Append appends data published to topic and returns the sequence number assigned to it
+func (ds *DiskStore) Append(topic string, data []byte) (uint64, error) {
+	if len(topic) > math.MaxUint16 {
+		return 0, errors.New("topic is too long to store")
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.closed {
+		return 0, ErrClosed
+	}
+
+	active := ds.segments[len(ds.segments)-1]
+	if active.size >= ds.config.SegmentBytes {
+		if err := ds.rotate(); err != nil {
+			return 0, err
+		}
+		active = ds.segments[len(ds.segments)-1]
+	}
+
+	record := Record{
+		Seq:       ds.lastSeq + 1,
+		Timestamp: time.Now(),
+		Topic:     topic,
+		Data:      data,
+	}
+
+	buf := encodeRecord(record)
+	if _, err := ds.active.Write(buf); err != nil {
+		// Drop any partial write so the next append starts on a record boundary
+		ds.active.Truncate(active.size)
+		return 0, fmt.Errorf("failed to append to segment: %w", err)
+	}
+
+	active.indexRecord(record.Seq, active.size)
+	active.size += int64(len(buf))
+	active.lastSeq = record.Seq
+	active.lastTimestamp = record.Timestamp
+	ds.lastSeq = record.Seq
+
+	if ds.config.Fsync == FsyncAlways {
+		if err := ds.active.Sync(); err != nil {
+			return 0, fmt.Errorf("failed to sync segment: %w", err)
+		}
+	} else {
+		ds.unsynced = true
+	}
+
+	return record.Seq, nil
+}
+
+// rotate seals the active segment and starts a new one. Caller must hold the write lock.
+func (ds *DiskStore) rotate() error {
+	if err := ds.active.Sync(); err != nil {
+		return fmt.Errorf("failed to sync segment: %w", err)
+	}
+
+	if err := ds.active.Close(); err != nil {
+		return fmt.Errorf("failed to close segment: %w", err)
+	}
+
+	if err := ds.createSegment(ds.lastSeq + 1); err != nil {
+		return err
+	}
+
+	ds.unsynced = false
+	ds.applyRetention(time.Now())
+	return nil
+}
+
+// applyRetention deletes the oldest sealed segments beyond MaxSegments or older than MaxAge.
+// The active segment is never deleted. Caller must hold the write lock.
+func (ds *DiskStore) applyRetention(now time.Time) {
+	for len(ds.segments) > 1 {
+		oldest := ds.segments[0]
+
+		tooMany := ds.config.MaxSegments > 0 && len(ds.segments) > ds.config.MaxSegments
+		tooOld := ds.config.MaxAge > 0 && now.Sub(oldest.lastTimestamp) > ds.config.MaxAge
+		if !tooMany && !tooOld {
+			return
+		}
+
+		if err := os.Remove(oldest.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Println("Failed to delete expired segment", oldest.path, err)
+			return
+		}
+
+		ds.segments = ds.segments[1:]
+	}
+}
+
+// Read calls fn with each retained record with a sequence number greater than since, oldest first.
+// Reading stops early if fn returns false.
+// The segments are read as they were when Read was called, without holding the lock, so neither
+// reading the files nor fn hold up appends.
+func (ds *DiskStore) Read(since uint64, fn func(Record) bool) error {
+	ds.mu.RLock()
+	if ds.closed {
+		ds.mu.RUnlock()
+		return ErrClosed
+	}
+
+	segments := make([]segment, 0, len(ds.segments))
+	for _, seg := range ds.segments {
+		// Skip segments entirely before since
+		if seg.lastSeq > since {
+			segments = append(segments, *seg)
+		}
+	}
+	ds.mu.RUnlock()
+
+	now := time.Now()
+	for i := range segments {
+		keepGoing, err := ds.readSegment(&segments[i], since, now, fn)
+		if err != nil {
+			return err
+		}
+		if !keepGoing {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// readSegment calls fn with the records of seg after since, starting from the closest indexed record.
+// Returns false if fn asked to stop reading.
+func (ds *DiskStore) readSegment(seg *segment, since uint64, now time.Time, fn func(Record) bool) (bool, error) {
+	file, err := os.Open(seg.path)
+	if errors.Is(err, os.ErrNotExist) {
+		// Retention deleted the segment after the read started, its records are no longer retained
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open segment %s: %w", seg.path, err)
+	}
+	defer file.Close()
+
+	offset := seg.seekOffset(since)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return false, fmt.Errorf("failed to seek segment %s: %w", seg.path, err)
+	}
+
+	// Only read up to what had been appended so a concurrent append is never seen half written
+	reader := bufio.NewReader(io.LimitReader(file, seg.size-offset))
+	for {
+		record, _, err := readRecord(reader)
+		if errors.Is(err, io.EOF) {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to read segment %s: %w", seg.path, err)
+		}
+
+		if record.Seq <= since {
+			continue
+		}
+
+		// Segments are deleted as a whole so skip individual records that have aged out
+		if ds.config.MaxAge > 0 && now.Sub(record.Timestamp) > ds.config.MaxAge {
+			continue
+		}
+
+		if !fn(record) {
+			return false, nil
+		}
+	}
+}
+
+// CommitOffset records seq as the last sequence number processed by consumer.
+// Offsets are written to disk following the fsync policy.
+func (ds *DiskStore) CommitOffset(consumer string, seq uint64) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.closed {
+		return ErrClosed
+	}
+
+	ds.offsets[consumer] = seq
+	ds.offsetsChanged = true
+
+	if ds.config.Fsync == FsyncAlways {
+		return ds.writeOffsets()
+	}
+
+	return nil
+}
+
+// Offset returns the last sequence number committed by consumer
+func (ds *DiskStore) Offset(consumer string) (uint64, bool, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	if ds.closed {
+		return 0, false, ErrClosed
+	}
+
+	seq, ok := ds.offsets[consumer]
+	return seq, ok, nil
+}
+
+// LastSeq returns the sequence number of the newest record appended
+func (ds *DiskStore) LastSeq() (uint64, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	if ds.closed {
+		return 0, ErrClosed
+	}
+
+	return ds.lastSeq, nil
+}
+
+// loadOffsets reads the committed offsets written by a previous run
+func (ds *DiskStore) loadOffsets() error {
+	data, err := os.ReadFile(filepath.Join(ds.config.Dir, offsetsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read offsets: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &ds.offsets); err != nil {
+		return fmt.Errorf("failed to parse offsets: %w", err)
+	}
+
+	return nil
+}
+
+// writeOffsets atomically replaces the offsets file. Caller must hold the write lock.
+func (ds *DiskStore) writeOffsets() error {
+	if !ds.offsetsChanged {
+		return nil
+	}
+
+	data, err := json.Marshal(ds.offsets)
+	if err != nil {
+		return fmt.Errorf("failed to marshal offsets: %w", err)
+	}
+
+	path := filepath.Join(ds.config.Dir, offsetsFile)
+	tmp := path + ".tmp"
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to write offsets: %w", err)
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write offsets: %w", err)
+	}
+
+	if ds.config.Fsync != FsyncNever {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to sync offsets: %w", err)
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write offsets: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace offsets: %w", err)
+	}
+
+	ds.offsetsChanged = false
+	return nil
+}
+
+// maintain periodically syncs, writes offsets and applies retention until the store is closed
+func (ds *DiskStore) maintain() {
+	defer ds.wg.Done()
+
+	interval := maintenanceInterval
+	if ds.config.Fsync == FsyncInterval {
+		interval = ds.config.FsyncInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ds.stopChan:
+			return
+		case now := <-ticker.C:
+			ds.mu.Lock()
+			if err := ds.flush(); err != nil {
+				log.Println("Failed to flush disk store", err)
+			}
+			ds.applyRetention(now)
+			ds.mu.Unlock()
+		}
+	}
+}
+
+// flush syncs appended records if the policy calls for it and writes changed offsets. Caller must hold the write lock.
+func (ds *DiskStore) flush() error {
+	if ds.unsynced && ds.config.Fsync == FsyncInterval {
+		if err := ds.active.Sync(); err != nil {
+			return fmt.Errorf("failed to sync segment: %w", err)
+		}
+		ds.unsynced = false
+	}
+
+	return ds.writeOffsets()
+}
+
+// Close syncs the log and offsets to disk and closes the active segment
+func (ds *DiskStore) Close() error {
+	ds.mu.Lock()
+	if ds.closed {
+		ds.mu.Unlock()
+		return nil
+	}
+	ds.closed = true
+	close(ds.stopChan)
+	ds.mu.Unlock()
+
+	// Wait outside of the lock as maintenance takes it
+	ds.wg.Wait()
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if err := ds.active.Sync(); err != nil {
+		ds.active.Close()
+		return fmt.Errorf("failed to sync segment: %w", err)
+	}
+
+	if err := ds.writeOffsets(); err != nil {
+		ds.active.Close()
+		return err
+	}
+
+	return ds.active.Close()
+}
+
+// encodeRecord frames a record for writing to a segment
+func encodeRecord(record Record) []byte {
+	bodySize := recordFixedSize + len(record.Topic) + len(record.Data)
+	buf := make([]byte, recordHeaderSize+bodySize)
+
+	body := buf[recordHeaderSize:]
+	binary.BigEndian.PutUint64(body[0:8], record.Seq)
+	binary.BigEndian.PutUint64(body[8:16], uint64(record.Timestamp.UnixNano()))
+	binary.BigEndian.PutUint16(body[16:18], uint16(len(record.Topic)))
+	copy(body[recordFixedSize:], record.Topic)
+	copy(body[recordFixedSize+len(record.Topic):], record.Data)
+
+	binary.BigEndian.PutUint32(buf[0:4], uint32(bodySize))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(body))
+
+	return buf
+}
+
+// errCorruptRecord is returned when a record fails its checksum or is malformed
+var errCorruptRecord = errors.New("corrupt record")
+
+// readRecord reads the next framed record. Returns the record and the number of bytes read.
+// io.EOF is only returned at a clean record boundary, a partial record is an io.ErrUnexpectedEOF.
+func readRecord(reader io.Reader) (Record, int64, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return Record{}, 0, err
+	}
+
+	bodySize := binary.BigEndian.Uint32(header[0:4])
+	if bodySize < recordFixedSize {
+		return Record{}, 0, errCorruptRecord
+	}
+
+	body := make([]byte, bodySize)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return Record{}, 0, err
+	}
+
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:8]) {
+		return Record{}, 0, errCorruptRecord
+	}
+
+	topicLen := int(binary.BigEndian.Uint16(body[16:18]))
+	if recordFixedSize+topicLen > len(body) {
+		return Record{}, 0, errCorruptRecord
+	}
+
+	record := Record{
+		Seq:       binary.BigEndian.Uint64(body[0:8]),
+		Timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(body[8:16]))),
+		Topic:     string(body[recordFixedSize : recordFixedSize+topicLen]),
+		Data:      body[recordFixedSize+topicLen:],
+	}
+
+	return record, int64(recordHeaderSize + bodySize), nil
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDiskConfig returns a DiskConfig in a temporary directory that syncs every append
+func testDiskConfig(t *testing.T) DiskConfig {
+	config := DefaultDiskConfig(t.TempDir())
+	config.Fsync = FsyncAlways
+	return config
+}
+
+// openDiskStore opens a DiskStore and closes it when the test finishes
+func openDiskStore(t *testing.T, config DiskConfig) *DiskStore {
+	t.Helper()
+	store, err := NewDiskStore(config)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return store
+}
+
+func Test_DiskConfig_Validate(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		config      func(DiskConfig) DiskConfig
+		expectedErr error
+	}{
+		{
+			desc:        "Default",
+			config:      func(dc DiskConfig) DiskConfig { return dc },
+			expectedErr: nil,
+		},
+		{
+			desc: "Missing directory",
+			config: func(dc DiskConfig) DiskConfig {
+				dc.Dir = ""
+				return dc
+			},
+			expectedErr: errors.New("disk store directory must be set"),
+		},
+		{
+			desc: "Invalid segment size",
+			config: func(dc DiskConfig) DiskConfig {
+				dc.SegmentBytes = 0
+				return dc
+			},
+			expectedErr: errors.New("segment bytes must be greater than 0"),
+		},
+		{
+			desc: "Interval policy without interval",
+			config: func(dc DiskConfig) DiskConfig {
+				dc.FsyncInterval = 0
+				return dc
+			},
+			expectedErr: errors.New("fsync interval must be greater than 0 for the interval fsync policy"),
+		},
+		{
+			desc: "Never policy without interval",
+			config: func(dc DiskConfig) DiskConfig {
+				dc.Fsync = FsyncNever
+				dc.FsyncInterval = 0
+				return dc
+			},
+			expectedErr: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := tc.config(DefaultDiskConfig("data")).Validate()
+			if tc.expectedErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedErr.Error())
+			}
+		})
+	}
+}
+
+func Test_ParseFsyncPolicy(t *testing.T) {
+	for _, policy := range []FsyncPolicy{FsyncInterval, FsyncAlways, FsyncNever} {
+		actual, err := ParseFsyncPolicy(policy.String())
+		assert.NoError(t, err)
+		assert.Equal(t, policy, actual)
+	}
+
+	_, err := ParseFsyncPolicy("sometimes")
+	assert.EqualError(t, err, `unknown fsync policy "sometimes"`)
+}
+
+func Test_DiskStore_AppendRead(t *testing.T) {
+	store := openDiskStore(t, testDiskConfig(t))
+	appendTopics(t, store, "orders.created", "billing", "orders.deleted")
+
+	records := make([]Record, 0)
+	require.NoError(t, store.Read(1, func(record Record) bool {
+		records = append(records, record)
+		return true
+	}))
+
+	require.Len(t, records, 2)
+	assert.Equal(t, uint64(2), records[0].Seq)
+	assert.Equal(t, "billing", records[0].Topic)
+	assert.Equal(t, []byte("billing"), records[0].Data)
+	assert.Equal(t, uint64(3), records[1].Seq)
+	assert.Equal(t, "orders.deleted", records[1].Topic)
+
+	// Returning false stops the read
+	count := 0
+	require.NoError(t, store.Read(0, func(Record) bool {
+		count++
+		return false
+	}))
+	assert.Equal(t, 1, count)
+}
+
+func Test_DiskStore_ReadIndex(t *testing.T) {
+	config := testDiskConfig(t)
+	config.Fsync = FsyncNever
+	config.SegmentBytes = 64 << 10
+
+	const records = 2000
+	data := make([]byte, 100)
+
+	store := openDiskStore(t, config)
+	for i := 0; i < records; i++ {
+		_, err := store.Append("orders", data)
+		require.NoError(t, err)
+	}
+
+	// The index is sparse and rebuilt the same when the segments are recovered
+	require.Greater(t, len(store.segments), 1)
+	for _, seg := range store.segments {
+		assert.Less(t, len(seg.index), int(seg.lastSeq-seg.base+1))
+	}
+	require.NoError(t, store.Close())
+	reopened := openDiskStore(t, config)
+	for i, seg := range reopened.segments {
+		assert.Equal(t, store.segments[i].index, seg.index)
+	}
+
+	// Reads seek to the closest indexed record then skip to the first one after since
+	for _, since := range []uint64{0, 1, 39, 40, 41, 600, 601, records - 1, records} {
+		seqs := readSeqs(t, reopened, since)
+		require.Len(t, seqs, int(records-since), "since %d", since)
+		if len(seqs) > 0 {
+			assert.Equal(t, since+1, seqs[0], "since %d", since)
+		}
+	}
+}
+
+func Test_DiskStore_ReadWithoutLock(t *testing.T) {
+	store := openDiskStore(t, testDiskConfig(t))
+	appendTopics(t, store, "orders", "orders")
+
+	// Appending while reading would deadlock if the read held the lock
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		require.NoError(t, store.Read(0, func(Record) bool {
+			_, err := store.Append("orders", nil)
+			assert.NoError(t, err)
+			return true
+		}))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("appending from a read blocked")
+	}
+
+	// The read only saw the records appended before it started
+	assert.Equal(t, []uint64{1, 2, 3, 4}, readSeqs(t, store, 0))
+}
+
+func Test_DiskStore_Restart(t *testing.T) {
+	config := testDiskConfig(t)
+
+	store, err := NewDiskStore(config)
+	require.NoError(t, err)
+	appendTopics(t, store, "orders", "orders")
+	require.NoError(t, store.CommitOffset("billing", 1))
+	require.NoError(t, store.Close())
+
+	_, err = store.Append("orders", nil)
+	assert.ErrorIs(t, err, ErrClosed)
+
+	_, err = store.LastSeq()
+	assert.ErrorIs(t, err, ErrClosed)
+
+	reopened := openDiskStore(t, config)
+	assert.Equal(t, []uint64{1, 2}, readSeqs(t, reopened, 0))
+
+	last, err := reopened.LastSeq()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), last)
+
+	// Sequence numbers carry on from before the restart
+	seq, err := reopened.Append("orders", nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), seq)
+
+	offset, ok, err := reopened.Offset("billing")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), offset)
+}
+
+func Test_DiskStore_TornTail(t *testing.T) {
+	config := testDiskConfig(t)
+
+	store, err := NewDiskStore(config)
+	require.NoError(t, err)
+	appendTopics(t, store, "orders", "orders")
+	require.NoError(t, store.Close())
+
+	// Simulate a crash part way through an append
+	path := filepath.Join(config.Dir, "00000000000000000001.log")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = file.Write(encodeRecord(Record{Seq: 3, Topic: "orders", Data: []byte("orders")})[:10])
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	_, err = store.LastSeq()
+	assert.ErrorIs(t, err, ErrClosed)
+
+	reopened := openDiskStore(t, config)
+	assert.Equal(t, []uint64{1, 2}, readSeqs(t, reopened, 0))
+
+	last, err := reopened.LastSeq()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), last)
+
+	seq, err := reopened.Append("orders", nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), seq)
+	assert.Equal(t, []uint64{1, 2, 3}, readSeqs(t, reopened, 0))
+}
+
+func Test_DiskStore_Rotation(t *testing.T) {
+	config := testDiskConfig(t)
+
+	// Every record gets its own segment
+	config.SegmentBytes = 1
+	config.MaxSegments = 3
+
+	store := openDiskStore(t, config)
+	appendTopics(t, store, "orders", "orders", "orders", "orders", "orders")
+
+	segments, err := filepath.Glob(filepath.Join(config.Dir, "*"+segmentExt))
+	require.NoError(t, err)
+	assert.Len(t, segments, 3)
+
+	// The oldest segments were deleted
+	assert.Equal(t, []uint64{3, 4, 5}, readSeqs(t, store, 0))
+	assert.Equal(t, []uint64{5}, readSeqs(t, store, 4))
+}
+
+func Test_DiskStore_MaxAge(t *testing.T) {
+	config := testDiskConfig(t)
+	config.SegmentBytes = 1
+	config.MaxAge = 20 * time.Millisecond
+
+	store := openDiskStore(t, config)
+	appendTopics(t, store, "orders")
+
+	time.Sleep(40 * time.Millisecond)
+	appendTopics(t, store, "orders")
+
+	assert.Equal(t, []uint64{2}, readSeqs(t, store, 0))
+}
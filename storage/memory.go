@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// MemoryConfig bounds the records kept by a MemoryStore.
+// A record is dropped once either limit is reached.
+type MemoryConfig struct {
+	// MaxMessages is the number of records retained. Zero disables retention.
+	MaxMessages int
+
+	// MaxAge is how long a record is retained. Zero keeps records until MaxMessages pushes them out.
+	MaxAge time.Duration
+}
+
+// DefaultMemoryConfig returns the MemoryConfig used when none is specified
+func DefaultMemoryConfig() MemoryConfig {
+	return MemoryConfig{
+		MaxMessages: 1000,
+		MaxAge:      10 * time.Minute,
+	}
+}
+
+// Validate checks the MemoryConfig is usable
+func (mc MemoryConfig) Validate() error {
+	if mc.MaxMessages < 0 {
+		return errors.New("retention max messages must not be negative")
+	}
+
+	if mc.MaxAge < 0 {
+		return errors.New("retention max age must not be negative")
+	}
+
+	return nil
+}
+
+var _ (Store) = (*MemoryStore)(nil)
+
+// MemoryStore is a Store that keeps records in a bounded ring buffer.
+// Nothing survives a restart.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	config  MemoryConfig
+	records []Record
+	head    int
+	count   int
+	lastSeq uint64
+	offsets map[string]uint64
+}
+
+// NewMemoryStore creates an empty MemoryStore bounded by config
+func NewMemoryStore(config MemoryConfig) (*MemoryStore, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &MemoryStore{
+		config:  config,
+		records: make([]Record, config.MaxMessages),
+		offsets: make(map[string]uint64),
+	}, nil
+}
+
+// Append appends data published to topic and returns the sequence number assigned to it
+func (ms *MemoryStore) Append(topic string, data []byte) (uint64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.lastSeq++
+
+	if ms.config.MaxMessages == 0 {
+		return ms.lastSeq, nil
+	}
+
+	now := time.Now()
+	ms.expire(now)
+
+	// Overwrite the oldest record once full
+	if ms.count == len(ms.records) {
+		ms.head = (ms.head + 1) % len(ms.records)
+		ms.count--
+	}
+
+	ms.records[(ms.head+ms.count)%len(ms.records)] = Record{
+		Seq:       ms.lastSeq,
+		Timestamp: now,
+		Topic:     topic,
+		Data:      data,
+	}
+	ms.count++
+
+	return ms.lastSeq, nil
+}
+
+// expire drops records older than MaxAge. Caller must hold the write lock.
+func (ms *MemoryStore) expire(now time.Time) {
+	if ms.config.MaxAge == 0 {
+		return
+	}
+
+	for ms.count > 0 && now.Sub(ms.records[ms.head].Timestamp) > ms.config.MaxAge {
+		ms.records[ms.head] = Record{}
+		ms.head = (ms.head + 1) % len(ms.records)
+		ms.count--
+	}
+}
+
+// Read calls fn with each retained record with a sequence number greater than since, oldest first.
+// Reading stops early if fn returns false.
+func (ms *MemoryStore) Read(since uint64, fn func(Record) bool) error {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	now := time.Now()
+	for i := 0; i < ms.count; i++ {
+		record := ms.records[(ms.head+i)%len(ms.records)]
+
+		// Expired records are cleaned up on the next append
+		if ms.config.MaxAge != 0 && now.Sub(record.Timestamp) > ms.config.MaxAge {
+			continue
+		}
+
+		if record.Seq > since && !fn(record) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// CommitOffset records seq as the last sequence number processed by consumer
+func (ms *MemoryStore) CommitOffset(consumer string, seq uint64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.offsets[consumer] = seq
+	return nil
+}
+
+// Offset returns the last sequence number committed by consumer
+func (ms *MemoryStore) Offset(consumer string) (uint64, bool, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	seq, ok := ms.offsets[consumer]
+	return seq, ok, nil
+}
+
+// LastSeq returns the sequence number of the newest record appended
+func (ms *MemoryStore) LastSeq() (uint64, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	return ms.lastSeq, nil
+}
+
+// Close is a no-op for a MemoryStore
+func (ms *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// appendTopics appends a record for each topic and fails the test on error
+func appendTopics(t *testing.T, store Store, topics ...string) {
+	t.Helper()
+	for _, topic := range topics {
+		_, err := store.Append(topic, []byte(topic))
+		require.NoError(t, err)
+	}
+}
+
+// readSeqs returns the sequence numbers of the records after since
+func readSeqs(t *testing.T, store Store, since uint64) []uint64 {
+	t.Helper()
+	seqs := make([]uint64, 0)
+	err := store.Read(since, func(record Record) bool {
+		seqs = append(seqs, record.Seq)
+		return true
+	})
+	require.NoError(t, err)
+	return seqs
+}
+
+func Test_MemoryStore(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		config   MemoryConfig
+		appended int
+		since    uint64
+		expected []uint64
+	}{
+		{
+			desc:     "Read everything",
+			config:   MemoryConfig{MaxMessages: 10},
+			appended: 3,
+			expected: []uint64{1, 2, 3},
+		},
+		{
+			desc:     "Read since",
+			config:   MemoryConfig{MaxMessages: 10},
+			appended: 3,
+			since:    1,
+			expected: []uint64{2, 3},
+		},
+		{
+			desc:     "Bounded by count",
+			config:   MemoryConfig{MaxMessages: 2},
+			appended: 4,
+			expected: []uint64{3, 4},
+		},
+		{
+			desc:     "Retention disabled",
+			config:   MemoryConfig{},
+			appended: 2,
+			expected: []uint64{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			store, err := NewMemoryStore(tc.config)
+			require.NoError(t, err)
+
+			for i := 0; i < tc.appended; i++ {
+				appendTopics(t, store, "orders")
+			}
+
+			assert.Equal(t, tc.expected, readSeqs(t, store, tc.since))
+		})
+	}
+}
+
+func Test_MemoryStore_MaxAge(t *testing.T) {
+	store, err := NewMemoryStore(MemoryConfig{MaxMessages: 10, MaxAge: 20 * time.Millisecond})
+	require.NoError(t, err)
+	appendTopics(t, store, "orders")
+
+	time.Sleep(40 * time.Millisecond)
+	appendTopics(t, store, "orders")
+
+	assert.Equal(t, []uint64{2}, readSeqs(t, store, 0))
+}
+
+func Test_MemoryStore_LastSeq(t *testing.T) {
+	// The last sequence number is kept even when nothing is retained
+	store, err := NewMemoryStore(MemoryConfig{})
+	require.NoError(t, err)
+
+	seq, err := store.LastSeq()
+	require.NoError(t, err)
+	assert.Zero(t, seq)
+
+	appendTopics(t, store, "orders", "orders")
+
+	seq, err = store.LastSeq()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), seq)
+	assert.Empty(t, readSeqs(t, store, 0))
+}
+
+func Test_MemoryStore_Offsets(t *testing.T) {
+	store, err := NewMemoryStore(DefaultMemoryConfig())
+	require.NoError(t, err)
+
+	_, ok, err := store.Offset("billing")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, store.CommitOffset("billing", 4))
+
+	seq, ok, err := store.Offset("billing")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(4), seq)
+}
@@ -0,0 +1,49 @@
+// Package storage contains the logs published messages are retained in for replay
+package storage
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrClosed is returned when using a Store after it has been closed
+var ErrClosed = errors.New("store is closed")
+
+// Record is a single message in a Store
+type Record struct {
+	// Seq is the sequence number assigned by the Store. Sequence numbers start at 1 and only grow.
+	Seq uint64
+
+	// Timestamp is when the record was appended
+	Timestamp time.Time
+
+	// Topic is the topic the record was published to
+	Topic string
+
+	// Data is the opaque encoded message
+	Data []byte
+}
+
+// Store is an append only log of published messages along with the offsets of named consumers
+type Store interface {
+	// Append appends data published to topic and returns the sequence number assigned to it
+	Append(topic string, data []byte) (uint64, error)
+
+	// LastSeq returns the sequence number of the newest record appended, zero if nothing has been.
+	// It is returned even if retention has since removed the record.
+	LastSeq() (uint64, error)
+
+	// Read calls fn with each retained record with a sequence number greater than since, oldest first.
+	// Reading stops early if fn returns false.
+	Read(since uint64, fn func(Record) bool) error
+
+	// CommitOffset records seq as the last sequence number processed by consumer
+	CommitOffset(consumer string, seq uint64) error
+
+	// Offset returns the last sequence number committed by consumer.
+	// ok is false if the consumer has never committed.
+	Offset(consumer string) (seq uint64, ok bool, err error)
+
+	// Close releases the resources of the store
+	Close() error
+}
@@ -0,0 +1,274 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deadLetterLevel is the first level of every dead letter topic
+const deadLetterLevel = "dlq"
+
+// Headers added to a message moved to its dead letter topic
+const (
+	// DeadLetterTopicHeader holds the topic the message was originally published to
+	DeadLetterTopicHeader = "Dead-Letter-Topic"
+
+	// DeadLetterSeqHeader holds the original sequence number of the message
+	DeadLetterSeqHeader = "Dead-Letter-Seq"
+
+	// DeadLetterSubscriberHeader holds the ID of the connection that failed to ack the message
+	DeadLetterSubscriberHeader = "Dead-Letter-Subscriber"
+)
+
+// ErrNotInFlight is returned when acking a message that is not awaiting an ack.
+// It was already acked, dead lettered or was never sent to the connection.
+var ErrNotInFlight = errors.New("message is not awaiting an ack")
+
+// AckConfig configures at-least-once delivery for a subscription.
+// Every message written must be acked within VisibilityTimeout or it is sent again.
+type AckConfig struct {
+	// VisibilityTimeout is how long a subscriber has to ack a message before it is redelivered
+	VisibilityTimeout time.Duration
+
+	// MaxAttempts is how many times a message is sent before it is moved to its dead letter topic
+	MaxAttempts int
+}
+
+// DefaultAckConfig returns the AckConfig used when none is specified
+func DefaultAckConfig() AckConfig {
+	return AckConfig{
+		VisibilityTimeout: 30 * time.Second,
+		MaxAttempts:       5,
+	}
+}
+
+// Validate checks the AckConfig is usable
+func (ac AckConfig) Validate() error {
+	if ac.VisibilityTimeout <= 0 {
+		return errors.New("visibility timeout must be greater than 0")
+	}
+
+	if ac.MaxAttempts <= 0 {
+		return errors.New("max attempts must be greater than 0")
+	}
+
+	return nil
+}
+
+// checkInterval is how often unacked messages are checked against their deadline
+func (ac AckConfig) checkInterval() time.Duration {
+	return ac.VisibilityTimeout / 4
+}
+
+// DeadLetterTopic returns the topic messages published to topic are moved to once they run out of delivery attempts.
+// The topic is prefixed with a dlq level, using the topic's own separator, so it is never matched by a wildcard
+// subscription to the original topic's family.
+//
+//	orders.created       -> dlq.orders.created
+//	sensors/kitchen/temp -> dlq/sensors/kitchen/temp
+func DeadLetterTopic(topic string) string {
+	separator := "."
+	if i := strings.IndexAny(topic, "./"); i >= 0 {
+		separator = topic[i : i+1]
+	}
+
+	return deadLetterLevel + separator + topic
+}
+
+// IsDeadLetterTopic returns true if topic is a dead letter topic
+func IsDeadLetterTopic(topic string) bool {
+	levels := splitTopic(topic)
+	return len(levels) > 1 && levels[0] == deadLetterLevel
+}
+
+// ackFrame is the JSON frame a subscriber sends to ack a message
+type ackFrame struct {
+	Type string `json:"type"`
+	Seq  uint64 `json:"seq"`
+}
+
+// ParseAck parses an ack frame sent by a subscriber and returns the sequence number it acks.
+//
+//	{"type":"ack","seq":42}
+func ParseAck(frame []byte) (uint64, error) {
+	var ack ackFrame
+	if err := json.Unmarshal(frame, &ack); err != nil {
+		return 0, fmt.Errorf("malformed ack frame: %w", err)
+	}
+
+	if ack.Type != "ack" {
+		return 0, fmt.Errorf("unexpected frame type %q", ack.Type)
+	}
+
+	if ack.Seq == 0 {
+		return 0, errors.New("ack frame is missing seq")
+	}
+
+	return ack.Seq, nil
+}
+
+// inflightMessage is a message written to a subscriber that has not been acked yet
+type inflightMessage struct {
+	msg      *Message
+	attempts int
+	deadline time.Time
+}
+
+// ackTracker tracks the messages written to a single subscriber that are awaiting an ack
+type ackTracker struct {
+	config AckConfig
+
+	mu       sync.Mutex
+	inflight map[uint64]*inflightMessage
+
+	// settled holds the acked or dead lettered seqs above committed, they can't be committed
+	// while an older message is still in flight
+	settled   []uint64
+	committed uint64
+}
+
+// newAckTracker creates an ackTracker with nothing in flight
+func newAckTracker(config AckConfig) *ackTracker {
+	return &ackTracker{
+		config:   config,
+		inflight: make(map[uint64]*inflightMessage),
+	}
+}
+
+// sent records that msg was written and starts its visibility timeout.
+// Returns the delivery attempt the write was.
+func (at *ackTracker) sent(msg *Message, now time.Time) int {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	inflight, ok := at.inflight[msg.Seq]
+	if !ok {
+		inflight = &inflightMessage{msg: msg}
+		at.inflight[msg.Seq] = inflight
+	}
+
+	inflight.attempts++
+	inflight.deadline = now.Add(at.config.VisibilityTimeout)
+	return inflight.attempts
+}
+
+// attempt returns the attempt the next write of msg will be
+func (at *ackTracker) attempt(msg *Message) int {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	if inflight, ok := at.inflight[msg.Seq]; ok {
+		return inflight.attempts + 1
+	}
+	return 1
+}
+
+// ack stops tracking the message with seq
+func (at *ackTracker) ack(seq uint64) error {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	if _, ok := at.inflight[seq]; !ok {
+		return ErrNotInFlight
+	}
+
+	delete(at.inflight, seq)
+	at.settled = append(at.settled, seq)
+	return nil
+}
+
+// commit returns the highest settled seq with every message written before it settled too,
+// false if that hasn't moved since the last call
+func (at *ackTracker) commit() (uint64, bool) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	oldest := uint64(math.MaxUint64)
+	for seq := range at.inflight {
+		if seq < oldest {
+			oldest = seq
+		}
+	}
+
+	committed := at.committed
+	remaining := at.settled[:0]
+	for _, seq := range at.settled {
+		if seq >= oldest {
+			remaining = append(remaining, seq)
+			continue
+		}
+
+		if seq > committed {
+			committed = seq
+		}
+	}
+	at.settled = remaining
+
+	if committed == at.committed {
+		return 0, false
+	}
+
+	at.committed = committed
+	return committed, true
+}
+
+// drain stops tracking every message in flight and returns them
+func (at *ackTracker) drain() []*Message {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	msgs := make([]*Message, 0, len(at.inflight))
+	for seq, inflight := range at.inflight {
+		msgs = append(msgs, inflight.msg)
+		delete(at.inflight, seq)
+	}
+
+	return msgs
+}
+
+// pending returns the number of messages awaiting an ack
+func (at *ackTracker) pending() int {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	return len(at.inflight)
+}
+
+// expired returns the messages whose visibility timeout has passed, oldest first.
+// Messages that have used up their attempts are no longer tracked and returned as dead.
+func (at *ackTracker) expired(now time.Time) (redeliver []*Message, dead []*Message) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	for seq, inflight := range at.inflight {
+		if now.Before(inflight.deadline) {
+			continue
+		}
+
+		if inflight.attempts >= at.config.MaxAttempts {
+			delete(at.inflight, seq)
+			at.settled = append(at.settled, seq)
+			dead = append(dead, inflight.msg)
+			continue
+		}
+
+		redeliver = append(redeliver, inflight.msg)
+	}
+
+	sortBySeq(redeliver)
+	sortBySeq(dead)
+	return redeliver, dead
+}
+
+// sortBySeq sorts msgs into sequence order
+func sortBySeq(msgs []*Message) {
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Seq < msgs[j].Seq
+	})
+}
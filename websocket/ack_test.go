@@ -0,0 +1,346 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DeadLetterTopic(t *testing.T) {
+	testCases := []struct {
+		topic    string
+		expected string
+	}{
+		{topic: "orders", expected: "dlq.orders"},
+		{topic: "orders.created", expected: "dlq.orders.created"},
+		{topic: "sensors/kitchen/temp", expected: "dlq/sensors/kitchen/temp"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.topic, func(t *testing.T) {
+			actual := DeadLetterTopic(tc.topic)
+			assert.Equal(t, tc.expected, actual)
+			assert.True(t, IsDeadLetterTopic(actual))
+			assert.False(t, IsDeadLetterTopic(tc.topic))
+			assert.False(t, MatchTopic(tc.topic+".>", actual))
+		})
+	}
+
+	assert.False(t, IsDeadLetterTopic("dlq"))
+}
+
+func Test_ParseAck(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		frame       string
+		expected    uint64
+		expectedErr error
+	}{
+		{
+			desc:     "Valid ack",
+			frame:    `{"type":"ack","seq":42}`,
+			expected: 42,
+		},
+		{
+			desc:        "Not JSON",
+			frame:       `ack 42`,
+			expectedErr: errors.New("malformed ack frame: invalid character 'a' looking for beginning of value"),
+		},
+		{
+			desc:        "Wrong type",
+			frame:       `{"type":"nack","seq":42}`,
+			expectedErr: errors.New(`unexpected frame type "nack"`),
+		},
+		{
+			desc:        "Missing seq",
+			frame:       `{"type":"ack"}`,
+			expectedErr: errors.New("ack frame is missing seq"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			actual, err := ParseAck([]byte(tc.frame))
+			if tc.expectedErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedErr.Error())
+			}
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func Test_ackTracker(t *testing.T) {
+	tracker := newAckTracker(AckConfig{VisibilityTimeout: time.Second, MaxAttempts: 2})
+	now := time.Now()
+
+	first, second := &Message{Seq: 1}, &Message{Seq: 2}
+	assert.Equal(t, 1, tracker.attempt(first))
+	assert.Equal(t, 1, tracker.sent(first, now))
+	assert.Equal(t, 1, tracker.sent(second, now))
+	assert.Equal(t, 2, tracker.attempt(first))
+
+	// Nothing has expired yet
+	redeliver, dead := tracker.expired(now)
+	assert.Empty(t, redeliver)
+	assert.Empty(t, dead)
+
+	assert.NoError(t, tracker.ack(2))
+	assert.ErrorIs(t, tracker.ack(2), ErrNotInFlight)
+
+	redeliver, dead = tracker.expired(now.Add(time.Second))
+	assert.Equal(t, []*Message{first}, redeliver)
+	assert.Empty(t, dead)
+
+	// The second attempt is the last
+	assert.Equal(t, 2, tracker.sent(first, now.Add(time.Second)))
+	redeliver, dead = tracker.expired(now.Add(2 * time.Second))
+	assert.Empty(t, redeliver)
+	assert.Equal(t, []*Message{first}, dead)
+	assert.ErrorIs(t, tracker.ack(1), ErrNotInFlight)
+}
+
+func Test_ackTracker_commit(t *testing.T) {
+	tracker := newAckTracker(AckConfig{VisibilityTimeout: time.Second, MaxAttempts: 1})
+	now := time.Now()
+
+	for seq := uint64(1); seq <= 4; seq++ {
+		tracker.sent(&Message{Seq: seq}, now)
+	}
+
+	_, ok := tracker.commit()
+	assert.False(t, ok, "nothing acked")
+
+	// 1 is still in flight so 2 and 3 can't be committed
+	require.NoError(t, tracker.ack(2))
+	require.NoError(t, tracker.ack(3))
+	_, ok = tracker.commit()
+	assert.False(t, ok)
+
+	require.NoError(t, tracker.ack(1))
+	seq, ok := tracker.commit()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(3), seq)
+
+	// Dead lettered messages are settled too
+	_, dead := tracker.expired(now.Add(time.Second))
+	assert.Equal(t, []*Message{{Seq: 4}}, dead)
+	seq, ok = tracker.commit()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(4), seq)
+}
+
+// envelopeConn is a WebsocketConnection that records the envelopes written to it
+type envelopeConn struct {
+	*discardConn
+	mu        sync.Mutex
+	envelopes []envelope
+}
+
+func newEnvelopeConn(id string) *envelopeConn {
+	return &envelopeConn{discardConn: newDiscardConn(id)}
+}
+
+func (ec *envelopeConn) NextWriter(MessageType) (io.WriteCloser, error) {
+	return &envelopeWriter{conn: ec}, nil
+}
+
+func (ec *envelopeConn) received() []envelope {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return append([]envelope{}, ec.envelopes...)
+}
+
+type envelopeWriter struct {
+	conn *envelopeConn
+	buf  []byte
+}
+
+func (ew *envelopeWriter) Write(p []byte) (int, error) {
+	ew.buf = append(ew.buf, p...)
+	return len(p), nil
+}
+
+func (ew *envelopeWriter) Close() error {
+	var env envelope
+	if err := json.Unmarshal(ew.buf, &env); err != nil {
+		return err
+	}
+
+	ew.conn.mu.Lock()
+	ew.conn.envelopes = append(ew.conn.envelopes, env)
+	ew.conn.mu.Unlock()
+	return nil
+}
+
+func Test_CacheBroadcaster_AckRedelivery(t *testing.T) {
+	broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
+	require.NoError(t, err)
+
+	ack := &AckConfig{VisibilityTimeout: 20 * time.Millisecond, MaxAttempts: 3}
+	conn := newEnvelopeConn("acker")
+	require.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders", Format: FormatEnvelope, Ack: ack}, conn))
+
+	broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte("1")})
+
+	// The message is sent again until it is acked
+	require.Eventually(t, func() bool {
+		return len(conn.received()) >= 2
+	}, time.Second, time.Millisecond)
+	require.NoError(t, broadcaster.Ack(conn, 1))
+
+	received := conn.received()
+	assert.Equal(t, 1, received[0].Attempt)
+	assert.Equal(t, 2, received[1].Attempt)
+	assert.Equal(t, uint64(1), received[1].Seq)
+
+	// Nothing more is sent once acked
+	time.Sleep(4 * ack.VisibilityTimeout)
+	assert.LessOrEqual(t, len(conn.received()), 3)
+	assert.ErrorIs(t, broadcaster.Ack(conn, 1), ErrNotInFlight)
+}
+
+func Test_CacheBroadcaster_DeadLetter(t *testing.T) {
+	broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
+	require.NoError(t, err)
+
+	ack := &AckConfig{VisibilityTimeout: 10 * time.Millisecond, MaxAttempts: 2}
+	conn := newEnvelopeConn("acker")
+	require.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders.created", Format: FormatEnvelope, Ack: ack}, conn))
+
+	deadLetters := newEnvelopeConn("dead-letters")
+	require.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "dlq.orders.>", Format: FormatEnvelope}, deadLetters))
+
+	broadcast(t, broadcaster, &Message{Topic: "orders.created", Type: TextMessage, Headers: map[string]string{"Trace": "1"}, Data: []byte("hi")})
+
+	require.Eventually(t, func() bool {
+		return len(deadLetters.received()) == 1
+	}, time.Second, time.Millisecond)
+
+	assert.Len(t, conn.received(), 2)
+
+	deadLetter := deadLetters.received()[0]
+	assert.Equal(t, "dlq.orders.created", deadLetter.Topic)
+	assert.Equal(t, "hi", deadLetter.Data)
+	assert.Equal(t, map[string]string{
+		"Trace":                    "1",
+		DeadLetterTopicHeader:      "orders.created",
+		DeadLetterSeqHeader:        "1",
+		DeadLetterSubscriberHeader: "acker",
+	}, deadLetter.Headers)
+}
+
+// receivedSeqs returns the sequence numbers of the envelopes written to conn
+func receivedSeqs(conn *envelopeConn) []uint64 {
+	seqs := make([]uint64, 0)
+	for _, env := range conn.received() {
+		seqs = append(seqs, env.Seq)
+	}
+	return seqs
+}
+
+// Test_CacheBroadcaster_AckConsumerRedelivery checks a consumer that acks only commits acked messages
+// and is sent those it didn't ack again when it returns
+func Test_CacheBroadcaster_AckConsumerRedelivery(t *testing.T) {
+	broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
+	require.NoError(t, err)
+
+	sub := Subscription{Pattern: "orders", Format: FormatEnvelope, Consumer: "billing", Ack: &AckConfig{VisibilityTimeout: time.Minute, MaxAttempts: 3}}
+	first := newEnvelopeConn("first")
+	require.NoError(t, broadcaster.RegisterConnection(sub, first))
+
+	for i := 1; i <= 3; i++ {
+		broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte(fmt.Sprint(i))})
+	}
+
+	require.Eventually(t, func() bool {
+		return len(first.received()) == 3
+	}, time.Second, time.Millisecond)
+
+	// Written but unacked messages aren't committed
+	seq, _, err := broadcaster.store.Offset("billing")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), seq)
+
+	require.NoError(t, broadcaster.Ack(first, 1))
+	require.NoError(t, broadcaster.Ack(first, 3))
+
+	seq, _, err = broadcaster.store.Offset("billing")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), seq, "2 is unacked")
+
+	broadcaster.UnregisterConnection(first)
+
+	second := newEnvelopeConn("second")
+	require.NoError(t, broadcaster.RegisterConnection(sub, second))
+
+	require.Eventually(t, func() bool {
+		return len(second.received()) == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []uint64{2, 3}, receivedSeqs(second))
+}
+
+// Test_CacheBroadcaster_AckGroupRedelivery checks the unacked messages of a group member that goes away are sent to another member
+func Test_CacheBroadcaster_AckGroupRedelivery(t *testing.T) {
+	broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
+	require.NoError(t, err)
+
+	sub := Subscription{Pattern: "orders", Format: FormatEnvelope, Group: "workers", Ack: &AckConfig{VisibilityTimeout: time.Minute, MaxAttempts: 3}}
+	members := []*envelopeConn{newEnvelopeConn("worker-1"), newEnvelopeConn("worker-2")}
+	for _, member := range members {
+		require.NoError(t, broadcaster.RegisterConnection(sub, member))
+	}
+
+	broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte("1")})
+
+	var sent, other *envelopeConn
+	require.Eventually(t, func() bool {
+		for i, member := range members {
+			if len(member.received()) == 1 {
+				sent, other = member, members[1-i]
+				return true
+			}
+		}
+		return false
+	}, time.Second, time.Millisecond)
+
+	broadcaster.UnregisterConnection(sent)
+
+	require.Eventually(t, func() bool {
+		return len(other.received()) == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []uint64{1}, receivedSeqs(other))
+	assert.NoError(t, broadcaster.Ack(other, 1))
+}
+
+// Test_CacheBroadcaster_AckDisconnectDeadLetter checks the unacked messages of a subscriber with nowhere to redeliver them are dead lettered
+func Test_CacheBroadcaster_AckDisconnectDeadLetter(t *testing.T) {
+	broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
+	require.NoError(t, err)
+
+	conn := newEnvelopeConn("acker")
+	require.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders", Format: FormatEnvelope, Ack: &AckConfig{VisibilityTimeout: time.Minute, MaxAttempts: 3}}, conn))
+
+	deadLetters := newEnvelopeConn("dead-letters")
+	require.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "dlq.orders", Format: FormatEnvelope}, deadLetters))
+
+	broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte("1")})
+	require.Eventually(t, func() bool {
+		return len(conn.received()) == 1
+	}, time.Second, time.Millisecond)
+
+	broadcaster.UnregisterConnection(conn)
+
+	require.Eventually(t, func() bool {
+		return len(deadLetters.received()) == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, "1", deadLetters.received()[0].Headers[DeadLetterSeqHeader])
+}
@@ -5,18 +5,63 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"sync"
+	"time"
 
-	"golang.org/x/sync/errgroup"
+	"github.com/cpheps/coder-pub-sub/storage"
 )
 
-// Broadcaster broadcasts a message to several websockets
+// Subscription describes what a connection subscribes to and how it wants messages delivered
+type Subscription struct {
+	// Pattern is the topic pattern to subscribe to, it may contain wildcards
+	Pattern string
+
+	// Patterns are more topic patterns to subscribe to alongside Pattern. Messages matching any of them are replayed
+	// once and in order, where registering the connection once per pattern replays each pattern on its own.
+	Patterns []string
+
+	// Format is how messages are encoded for the connection.
+	// A connection registered several times keeps the format of its first subscription.
+	Format Format
+
+	// Replay selects retained messages to deliver before live messages. Nil only delivers live messages.
+	Replay *Replay
+
+	// Consumer names a durable consumer whose offset is committed as messages are written, or acked with Ack set.
+	// Without an explicit Replay a returning consumer resumes after its committed offset,
+	// a new consumer starts with live messages and resumes from there.
+	// A connection registered several times keeps the consumer of its first subscription.
+	Consumer string
+
+	// Ack turns on at-least-once delivery, messages written to the connection are redelivered until acked.
+	// Messages left unacked when the connection goes away are sent to another member of its Group, resent to
+	// its Consumer when it returns or otherwise moved to their dead letter topic.
+	// Nil delivers each message at most once. A connection registered several times keeps the setting of its first subscription.
+	Ack *AckConfig
+
+	// Group names a consumer group. Each message is sent to one member of a group rather than all of them.
+	// A connection registered several times keeps the group of its first subscription.
+	Group string
+}
+
+// Broadcaster broadcasts a message to the websockets subscribed to a topic
 type Broadcaster interface {
-	// RegisterConnection registers a connection with the Broadcaster
-	RegisterConnection(WebsocketConnection)
+	// RegisterConnection registers a connection with the Broadcaster as a subscriber
+	RegisterConnection(sub Subscription, conn WebsocketConnection) error
+
+	// Ack acknowledges the message with seq written to a connection subscribed with an AckConfig
+	Ack(conn WebsocketConnection, seq uint64) error
+
+	// UnregisterConnection removes a connection from every topic it is subscribed to.
+	// The connection is not closed.
+	UnregisterConnection(conn WebsocketConnection)
 
-	// Broadcast sends the bytes of messageType to all websockets.
-	// Returns and error if a single send fails
-	Broadcast(ctx context.Context, messageType MessageType, msg []byte) error
+	// Broadcast stores the message then sends it to all websockets subscribed to its topic,
+	// or to a single member of each consumer group subscribed to it.
+	// A failure to send to one subscriber does not affect the others.
+	// Returns the outcome of the send for each subscriber or an error if the message could not be stored
+	Broadcast(ctx context.Context, msg *Message) (*BroadcastResult, error)
 
 	// CloseConnections closes all registered connections
 	CloseConnections()
@@ -24,103 +69,512 @@ type Broadcaster interface {
 
 var _ (Broadcaster) = (*CacheBroadcaster)(nil)
 
-// CacheBroadcaster implements the Broadcaster interface as well as locally caches websocket connections
+// CacheBroadcaster implements the Broadcaster interface as well as locally caches websocket connections per topic.
+// Each connection gets its own bounded send queue and writer goroutine so a slow subscriber never delays
+// a broadcast or the other subscribers.
 type CacheBroadcaster struct {
-	conns []WebsocketConnection
+	topics *TopicRegistry
+
+	// publishMu orders sequence assignment against subscribing.
+	// A broadcast assigns its sequence number and resolves its subscribers under the lock and a
+	// subscriber notes the newest sequence number and registers under it. Its replay is then read
+	// up to that sequence number without the lock, so it hands over to live delivery without a gap or duplicate.
+	publishMu sync.Mutex
+	store     storage.Store
+
+	// commitMu makes reading and committing a consumer's offset atomic so it only moves forward
+	commitMu sync.Mutex
+
+	// queuesMu guards queues and keeps them consistent with topics
+	queuesMu sync.RWMutex
+	queues   map[WebsocketConnection]*subscriberQueue
+
+	queueConfig QueueConfig
+	balancer    *groupBalancer
 
 	// concurrency is the number of goroutines to have active at a time while sending
 	concurrency int
 }
 
-// NewCacheBroadcaster creates a new CacheBroadcaster with the passed in concurrency
-func NewCacheBroadcaster(concurrency int) (*CacheBroadcaster, error) {
+// NewCacheBroadcaster creates a new CacheBroadcaster with the passed in concurrency.
+// Every registered connection gets an outbound queue configured by queueConfig.
+// Published messages are appended to store for replay, the caller remains responsible for closing it.
+// Messages for a consumer group are spread across its members using balancing.
+func NewCacheBroadcaster(concurrency int, queueConfig QueueConfig, store storage.Store, balancing GroupBalancing) (*CacheBroadcaster, error) {
 	if concurrency <= 0 {
 		return nil, errors.New("concurrency must be greater than 0")
 	}
 
+	if err := queueConfig.Validate(); err != nil {
+		return nil, err
+	}
+
+	if store == nil {
+		return nil, errors.New("store must be set")
+	}
+
+	switch balancing {
+	case RoundRobin, LeastOutstanding:
+	default:
+		return nil, fmt.Errorf("unknown group balancing %s", balancing)
+	}
+
 	return &CacheBroadcaster{
-		conns:       make([]WebsocketConnection, 0),
+		topics:      NewTopicRegistry(),
+		store:       store,
+		queues:      make(map[WebsocketConnection]*subscriberQueue),
+		queueConfig: queueConfig,
+		balancer:    newGroupBalancer(balancing),
 		concurrency: concurrency,
 	}, nil
 }
 
-// RegisterConnection registers a connection with the Broadcaster
-func (cb *CacheBroadcaster) RegisterConnection(conn WebsocketConnection) {
-	cb.conns = append(cb.conns, conn)
+// RegisterConnection registers a connection with the Broadcaster as a subscriber.
+// Any replayed messages are delivered before the live messages that follow them. The replay is read from the store
+// a page at a time as the connection's queue makes room, live messages wait in the queue under its overflow policy meanwhile.
+// Returns an error if the replay could not be read, the connection is not registered to the pattern in that case.
+func (cb *CacheBroadcaster) RegisterConnection(sub Subscription, conn WebsocketConnection) error {
+	if sub.Ack != nil {
+		if err := sub.Ack.Validate(); err != nil {
+			return err
+		}
+	}
+
+	cb.publishMu.Lock()
+
+	replay := sub.Replay
+
+	// A returning consumer picks up after the last message it settled
+	if replay == nil && sub.Consumer != "" {
+		seq, ok, err := cb.store.Offset(sub.Consumer)
+		if err != nil {
+			cb.publishMu.Unlock()
+			return fmt.Errorf("failed to read offset of consumer %s: %w", sub.Consumer, err)
+		}
+
+		if ok {
+			replay = &Replay{Since: seq}
+		} else if err := cb.startConsumer(sub.Consumer); err != nil {
+			cb.publishMu.Unlock()
+			return err
+		}
+	}
+
+	// Messages up to until are replayed, later ones are delivered live
+	var until uint64
+	if replay != nil {
+		seq, err := cb.store.LastSeq()
+		if err != nil {
+			cb.publishMu.Unlock()
+			return fmt.Errorf("failed to read last sequence number: %w", err)
+		}
+		until = seq
+	}
+
+	cb.queuesMu.Lock()
+
+	// A connection subscribed to several topics shares a single queue
+	queue, registered := cb.queues[conn]
+	if !registered {
+		var acks *ackTracker
+		if sub.Ack != nil {
+			acks = newAckTracker(*sub.Ack)
+		}
+
+		queue = newSubscriberQueue(conn, sub.Format, sub.Group, cb.queueConfig, acks, queueCallbacks{
+			onWriteError: cb.onWriteError,
+			onCommit:     cb.committer(sub.Consumer),
+			onDeadLetter: cb.onDeadLetter,
+			onRelease:    cb.releaser(sub),
+		})
+		cb.queues[conn] = queue
+	}
+
+	if replay != nil {
+		queue.startReplay()
+	}
+	patterns := append([]string{sub.Pattern}, sub.Patterns...)
+	subscribed := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if cb.topics.Subscribe(pattern, conn) {
+			subscribed = append(subscribed, pattern)
+		}
+	}
+
+	cb.queuesMu.Unlock()
+	cb.publishMu.Unlock()
+
+	if replay == nil {
+		return nil
+	}
+
+	err := replayMessages(cb.store, patterns, *replay, until, cb.queueConfig.Size, queue.replay)
+	queue.endReplay()
+	if err == nil {
+		return nil
+	}
+
+	if !registered {
+		cb.UnregisterConnection(conn)
+		return err
+	}
+
+	for _, pattern := range subscribed {
+		cb.topics.UnsubscribePattern(pattern, conn)
+	}
+
+	return err
+}
+
+// startConsumer commits the offset of a new consumer at the newest message so if it goes away
+// before being sent anything it still resumes with the messages published since it first registered
+func (cb *CacheBroadcaster) startConsumer(consumer string) error {
+	seq, err := cb.store.LastSeq()
+	if err != nil {
+		return fmt.Errorf("failed to read last sequence number: %w", err)
+	}
+
+	if err := cb.store.CommitOffset(consumer, seq); err != nil {
+		return fmt.Errorf("failed to commit offset of consumer %s: %w", consumer, err)
+	}
+
+	return nil
+}
+
+// committer returns the callback committing the offset of consumer as messages are settled, nil without a consumer
+func (cb *CacheBroadcaster) committer(consumer string) func(uint64) {
+	if consumer == "" {
+		return nil
+	}
+
+	return func(seq uint64) {
+		cb.commitMu.Lock()
+		defer cb.commitMu.Unlock()
+
+		// Replays and redeliveries can settle a message older than the committed offset
+		current, ok, err := cb.store.Offset(consumer)
+		if err != nil {
+			log.Println("Failed to read offset of consumer", consumer, err)
+			return
+		}
+
+		if ok && seq <= current {
+			return
+		}
+
+		if err := cb.store.CommitOffset(consumer, seq); err != nil {
+			log.Println("Failed to commit offset of consumer", consumer, err)
+		}
+	}
+}
+
+// releaser returns the callback handling the messages a subscriber that acks left unacked, nil if it doesn't ack.
+// Each message goes to another member of the subscriber's group. Failing that a consumer's offset doesn't cover
+// the message so it is sent again when the consumer returns, anything else is moved to its dead letter topic.
+func (cb *CacheBroadcaster) releaser(sub Subscription) func(WebsocketConnection, []*Message) {
+	if sub.Ack == nil {
+		return nil
+	}
+
+	return func(conn WebsocketConnection, msgs []*Message) {
+		for _, msg := range msgs {
+			if sub.Group != "" && cb.redeliverToGroup(sub.Group, conn, msg) {
+				continue
+			}
+
+			if sub.Consumer != "" {
+				continue
+			}
+
+			cb.onDeadLetter(conn, msg)
+		}
+	}
+}
+
+// redeliverToGroup queues msg for a member of group subscribed to its topic other than conn.
+// Returns false if there is no such member or the message didn't fit in its queue.
+func (cb *CacheBroadcaster) redeliverToGroup(group string, conn WebsocketConnection, msg *Message) bool {
+	cb.queuesMu.RLock()
+	members := make([]*subscriberQueue, 0)
+	for _, subscriber := range cb.topics.Subscribers(msg.Topic) {
+		if queue, ok := cb.queues[subscriber]; ok && queue.group == group && subscriber != conn {
+			members = append(members, queue)
+		}
+	}
+	member := cb.balancer.pick(group, members)
+	cb.queuesMu.RUnlock()
+
+	if member == nil {
+		return false
+	}
+
+	switch member.enqueue(msg, nil) {
+	case enqueued:
+		return true
+	case overflowed:
+		cb.evict(member.conn)
+	}
+
+	return false
+}
+
+// Ack acknowledges the message with seq written to conn so it is not redelivered.
+// Returns ErrNotInFlight if the message is not awaiting an ack from conn.
+func (cb *CacheBroadcaster) Ack(conn WebsocketConnection, seq uint64) error {
+	cb.queuesMu.RLock()
+	queue, ok := cb.queues[conn]
+	cb.queuesMu.RUnlock()
+
+	if !ok {
+		return errors.New("connection is not registered")
+	}
+
+	return queue.ack(seq)
+}
+
+// UnregisterConnection removes a connection from every topic it is subscribed to.
+// Any messages still queued for the connection are discarded, or released if it acks. The connection is not closed.
+func (cb *CacheBroadcaster) UnregisterConnection(conn WebsocketConnection) {
+	cb.queuesMu.Lock()
+	defer cb.queuesMu.Unlock()
+
+	cb.topics.Unsubscribe(conn)
+
+	queue, ok := cb.queues[conn]
+	if !ok {
+		return
+	}
+
+	queue.stop()
+	delete(cb.queues, conn)
+
+	if queue.group != "" && !cb.hasGroupMember(queue.group) {
+		cb.balancer.forget(queue.group)
+	}
+}
+
+// hasGroupMember returns true if any registered connection is a member of group. Caller must hold queuesMu.
+func (cb *CacheBroadcaster) hasGroupMember(group string) bool {
+	for _, queue := range cb.queues {
+		if queue.group == group {
+			return true
+		}
+	}
+	return false
 }
 
 // CloseConnections closes all registered connections
 // Will log any errors
 func (cb *CacheBroadcaster) CloseConnections() {
-	for _, conn := range cb.conns {
+	// Clear tracking first so no broadcast picks up a connection while it is being closed
+	cb.queuesMu.Lock()
+	conns := cb.topics.Clear()
+	for _, queue := range cb.queues {
+		queue.stop()
+	}
+	cb.queues = make(map[WebsocketConnection]*subscriberQueue)
+	cb.queuesMu.Unlock()
+
+	for _, conn := range conns {
 		if err := conn.Close(); err != nil {
 			log.Println("Error while closing websocket", err)
 		}
 	}
-
-	// After all connections are closed clean our connection tracking
-	cb.conns = make([]WebsocketConnection, 0)
 }
 
-// Broadcast sends the bytes of messageType to all websockets.
-// Returns and error if a single send fails
-func (cb *CacheBroadcaster) Broadcast(ctx context.Context, messageType MessageType, msg []byte) error {
-	group, errCtx := errgroup.WithContext(ctx)
+// Broadcast appends the message to the store, which assigns its sequence number, and queues it for all websockets subscribed to its topic.
+// Each subscriber's queue is written by its own goroutine so this does not wait for the writes.
+// When a subscriber's queue is full the configured OverflowPolicy decides the outcome for it.
+// Subscribers that fail to be written to are closed and unregistered so they don't affect later broadcasts.
+// Returns the outcome of the send for each subscriber or an error, without sending, if the message could not be stored
+func (cb *CacheBroadcaster) Broadcast(ctx context.Context, msg *Message) (*BroadcastResult, error) {
+	data, err := encodeStored(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	cb.publishMu.Lock()
+	seq, err := cb.store.Append(msg.Topic, data)
+	if err != nil {
+		cb.publishMu.Unlock()
+		return nil, fmt.Errorf("failed to store message: %w", err)
+	}
+	msg.Seq = seq
+	subscribers := cb.selectSubscribers(cb.topics.Subscribers(msg.Topic))
+	cb.publishMu.Unlock()
+
+	result := NewBroadcastResult()
 
 	// Create a buffered channel large enough so each worker is busy
-	socketChan := make(chan WebsocketConnection, cb.concurrency)
+	socketChan := make(chan subscriberTurn, cb.concurrency)
 
-	// Spin up workers to handle broadcasting
+	// Spin up workers to handle broadcasting.
+	// Queueing is normally instant but the Block policy can wait on a full queue so spread the subscribers out.
+	var wg sync.WaitGroup
 	for i := 0; i < cb.concurrency; i++ {
-		group.Go(func() error {
-			return broadcastWorker(errCtx, socketChan, messageType, msg)
-		})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cb.broadcastWorker(ctx, socketChan, msg, result)
+		}()
 	}
 
-	// Feed connections to workers
-	for _, conn := range cb.conns {
-		socketChan <- conn
+	// Feed subscribers to workers
+	for _, subscriber := range subscribers {
+		socketChan <- subscriber
 	}
 
 	close(socketChan)
+	wg.Wait()
 
-	return group.Wait()
+	return result, nil
 }
 
-// broadcastWorker sends the message to each WebsocketConnection supplied to it
-func broadcastWorker(ctx context.Context, socketChan <-chan WebsocketConnection, messageType MessageType, msg []byte) error {
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case conn, ok := <-socketChan:
-			if !ok {
-				return nil
-			}
+// subscriberTurn is a subscriber a broadcast sends to along with its turn to queue the message
+type subscriberTurn struct {
+	queue  *subscriberQueue
+	ticket uint64
+}
 
-			// Create a new writer for the websocket
-			writer, err := conn.NextWriter(messageType)
-			if err != nil {
-				return fmt.Errorf("failed to create writer for websocket: %w", err)
-			}
+// selectSubscribers narrows the subscribers of a topic down to those a message is sent to.
+// Ungrouped subscribers all get the message while each consumer group gets it once, sent to the member its balancing picks.
+// Each selected subscriber's turn is taken so the caller must hold publishMu and go on to queue the message for all of them.
+func (cb *CacheBroadcaster) selectSubscribers(subscribers []WebsocketConnection) []subscriberTurn {
+	cb.queuesMu.RLock()
+	defer cb.queuesMu.RUnlock()
+
+	selected := make([]subscriberTurn, 0, len(subscribers))
+	groups := make(map[string][]*subscriberQueue)
+	for _, conn := range subscribers {
+		queue, ok := cb.queues[conn]
+		if !ok {
+			continue
+		}
+
+		if queue.group == "" {
+			selected = append(selected, subscriberTurn{queue: queue, ticket: queue.ticket()})
+			continue
+		}
+
+		groups[queue.group] = append(groups[queue.group], queue)
+	}
 
-			// Write all data to the writer created by the connection
-			for written := 0; written < len(msg); {
-				numBytes, err := writer.Write(msg[written:])
-				if err != nil {
-					// Ignore error on purpose here. We don't really care if we fail to close just make an attempt.
-					// It's likely the pipe is broken if we've hit an error so closing a broken pipe will likely result in another error
-					writer.Close()
-					return fmt.Errorf("failed while writing to websocket: %w", err)
-				}
-
-				written += numBytes
+	for group, members := range groups {
+		if member := cb.balancer.pick(group, members); member != nil {
+			selected = append(selected, subscriberTurn{queue: member, ticket: member.ticket()})
+		}
+	}
+
+	return selected
+}
+
+// broadcastWorker queues the message for each subscriber supplied to it, in its turn, and records the outcome in result.
+// Turns are taken in sequence order so every subscriber's messages are queued in sequence order.
+func (cb *CacheBroadcaster) broadcastWorker(ctx context.Context, socketChan <-chan subscriberTurn, msg *Message, result *BroadcastResult) {
+	for subscriber := range socketChan {
+		queue := subscriber.queue
+		queue.inTurn(subscriber.ticket, func() {
+			// Skip the send if the broadcast was cancelled or the connection is already gone
+			select {
+			case <-ctx.Done():
+				result.recordSkipped()
+				return
+			case <-queue.conn.Done():
+				result.recordSkipped()
+				return
+			case <-queue.stopChan:
+				// The connection was unregistered after this broadcast resolved its subscribers
+				result.recordSkipped()
+				return
+			default:
 			}
 
-			// Close the writer
-			if err := writer.Close(); err != nil {
-				return fmt.Errorf("failed to close writer for websocket: %w", err)
+			switch queue.enqueue(msg, ctx.Done()) {
+			case enqueued:
+				result.recordDelivered()
+			case dropped:
+				result.recordSkipped()
+			case overflowed:
+				result.recordFailed(queue.conn.ID(), ErrSlowConsumer)
+				cb.evict(queue.conn)
 			}
+		})
+	}
+}
+
+// onWriteError is called by a subscriber queue when writing to its connection fails
+func (cb *CacheBroadcaster) onWriteError(conn WebsocketConnection, _ error) {
+	cb.evict(conn)
+}
+
+// onDeadLetter is called by a subscriber queue when a message ran out of delivery attempts.
+// The message is published to its dead letter topic, messages already on a dead letter topic are dropped.
+func (cb *CacheBroadcaster) onDeadLetter(conn WebsocketConnection, msg *Message) {
+	if IsDeadLetterTopic(msg.Topic) {
+		log.Println("Dropping unacked message", msg.Seq, "from dead letter topic", msg.Topic)
+		return
+	}
+
+	headers := make(map[string]string, len(msg.Headers)+3)
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	headers[DeadLetterTopicHeader] = msg.Topic
+	headers[DeadLetterSeqHeader] = strconv.FormatUint(msg.Seq, 10)
+	headers[DeadLetterSubscriberHeader] = conn.ID()
+
+	deadLetter := &Message{
+		ID:          NewMessageID(),
+		Timestamp:   time.Now().UTC(),
+		Topic:       DeadLetterTopic(msg.Topic),
+		Type:        msg.Type,
+		ContentType: msg.ContentType,
+		Headers:     headers,
+		Data:        msg.Data,
+	}
+
+	// Publish from another goroutine as the dead letter topic may be queued to this same subscriber
+	go func() {
+		if _, err := cb.Broadcast(context.Background(), deadLetter); err != nil {
+			log.Println("Failed to publish message", msg.Seq, "to dead letter topic", deadLetter.Topic, err)
 		}
+	}()
+}
+
+// evict unregisters and closes a connection that can no longer be written to
+func (cb *CacheBroadcaster) evict(conn WebsocketConnection) {
+	cb.UnregisterConnection(conn)
+
+	if err := conn.Close(); err != nil {
+		log.Println("Error while closing websocket", err)
 	}
 }
+
+// writeMessage sends a single message to the connection
+func writeMessage(conn WebsocketConnection, messageType MessageType, msg []byte) error {
+	// Create a new writer for the websocket
+	writer, err := conn.NextWriter(messageType)
+	if err != nil {
+		return fmt.Errorf("failed to create writer for websocket: %w", err)
+	}
+
+	// Write all data to the writer created by the connection
+	for written := 0; written < len(msg); {
+		numBytes, err := writer.Write(msg[written:])
+		if err != nil {
+			// Ignore error on purpose here. We don't really care if we fail to close just make an attempt.
+			// It's likely the pipe is broken if we've hit an error so closing a broken pipe will likely result in another error
+			writer.Close()
+			return fmt.Errorf("failed while writing to websocket: %w", err)
+		}
+
+		written += numBytes
+	}
+
+	// Close the writer
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to close writer for websocket: %w", err)
+	}
+
+	return nil
+}
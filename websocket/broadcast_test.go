@@ -3,29 +3,97 @@ package websocket
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/cpheps/coder-pub-sub/storage"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
+// newMemoryStore creates a storage.MemoryStore with the default retention
+func newMemoryStore(t *testing.T) *storage.MemoryStore {
+	t.Helper()
+	store, err := storage.NewMemoryStore(storage.DefaultMemoryConfig())
+	require.NoError(t, err)
+	return store
+}
+
+// broadcast broadcasts msg and checks it was stored
+func broadcast(t *testing.T, broadcaster *CacheBroadcaster, msg *Message) *BroadcastResult {
+	t.Helper()
+	result, err := broadcaster.Broadcast(context.Background(), msg)
+	assert.NoError(t, err)
+	return result
+}
+
 func Test_NewCacheBroadcaster(t *testing.T) {
+	store := newMemoryStore(t)
+
 	testCases := []struct {
 		desc        string
-		input       int
+		concurrency int
+		queueConfig QueueConfig
+		store       storage.Store
+		balancing   GroupBalancing
 		expected    *CacheBroadcaster
 		expectedErr error
 	}{
 		{
 			desc:        "Invalid concurrency value",
-			input:       -1,
+			concurrency: -1,
+			queueConfig: DefaultQueueConfig(),
+			store:       store,
 			expected:    nil,
 			expectedErr: errors.New("concurrency must be greater than 0"),
 		},
 		{
-			desc:  "Valid create",
-			input: 2,
+			desc:        "Invalid queue size",
+			concurrency: 2,
+			queueConfig: QueueConfig{Size: 0, Policy: DropOldest},
+			store:       store,
+			expected:    nil,
+			expectedErr: errors.New("queue size must be greater than 0"),
+		},
+		{
+			desc:        "Block policy without timeout",
+			concurrency: 2,
+			queueConfig: QueueConfig{Size: 1, Policy: Block},
+			store:       store,
+			expected:    nil,
+			expectedErr: errors.New("block timeout must be greater than 0 for the block overflow policy"),
+		},
+		{
+			desc:        "Missing store",
+			concurrency: 2,
+			queueConfig: DefaultQueueConfig(),
+			expected:    nil,
+			expectedErr: errors.New("store must be set"),
+		},
+		{
+			desc:        "Unknown group balancing",
+			concurrency: 2,
+			queueConfig: DefaultQueueConfig(),
+			store:       store,
+			balancing:   GroupBalancing(9),
+			expected:    nil,
+			expectedErr: errors.New("unknown group balancing GroupBalancing(9)"),
+		},
+		{
+			desc:        "Valid create",
+			concurrency: 2,
+			queueConfig: DefaultQueueConfig(),
+			store:       store,
 			expected: &CacheBroadcaster{
-				conns:       make([]WebsocketConnection, 0),
+				topics:      NewTopicRegistry(),
+				store:       store,
+				queues:      make(map[WebsocketConnection]*subscriberQueue),
+				queueConfig: DefaultQueueConfig(),
+				balancer:    newGroupBalancer(RoundRobin),
 				concurrency: 2,
 			},
 			expectedErr: nil,
@@ -34,7 +102,7 @@ func Test_NewCacheBroadcaster(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
-			actual, err := NewCacheBroadcaster(tc.input)
+			actual, err := NewCacheBroadcaster(tc.concurrency, tc.queueConfig, tc.store, tc.balancing)
 
 			if tc.expectedErr == nil {
 				assert.NoError(t, err)
@@ -47,30 +115,64 @@ func Test_NewCacheBroadcaster(t *testing.T) {
 }
 
 func Test_CacheBroadCaster_RegisterConnection(t *testing.T) {
-	broadcaster, err := NewCacheBroadcaster(1)
+	broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
 	assert.NoError(t, err)
 
 	// Create an empty connection since we don't care if it works
 	connection := &GorillaConn{}
 
-	broadcaster.RegisterConnection(connection)
+	assert.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders"}, connection))
+	assert.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "billing"}, connection))
+
+	subscribers := broadcaster.topics.Subscribers("orders")
+	assert.Len(t, subscribers, 1)
+	assert.Equal(t, connection, subscribers[0])
+
+	// Both subscriptions share a single queue
+	assert.Len(t, broadcaster.queues, 1)
 
-	assert.Len(t, broadcaster.conns, 1)
-	assert.Equal(t, connection, broadcaster.conns[0])
+	broadcaster.UnregisterConnection(connection)
+	assert.Empty(t, broadcaster.queues)
 }
 
 func Test_CacheBroadCaster_CloseConnections(t *testing.T) {
-	broadcaster, err := NewCacheBroadcaster(1)
+	broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
 	assert.NoError(t, err)
 
 	// Create an empty connection since we don't care if it works
 	mockConn := &MockWebsocketConnection{}
+	mockConn.On("Done").Return(make(chan struct{}))
 	mockConn.On("Close").Return(nil)
 
-	broadcaster.RegisterConnection(mockConn)
+	assert.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders"}, mockConn))
 	broadcaster.CloseConnections()
 
-	assert.Len(t, broadcaster.conns, 0)
+	assert.Len(t, broadcaster.topics.Connections(), 0)
+	assert.Empty(t, broadcaster.queues)
+	mockConn.AssertCalled(t, "Close")
+}
+
+// notifyOnCall returns a channel that receives when the expected call is made
+func notifyOnCall(call *mock.Call) <-chan struct{} {
+	called := make(chan struct{}, 1)
+	call.Run(func(mock.Arguments) {
+		select {
+		case called <- struct{}{}:
+		default:
+		}
+	})
+
+	return called
+}
+
+// waitForCall waits for a call notified by notifyOnCall
+func waitForCall(t *testing.T, called <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for call")
+	}
 }
 
 func Test_CacheBroadCaster_Broadcast(t *testing.T) {
@@ -83,19 +185,24 @@ func Test_CacheBroadCaster_Broadcast(t *testing.T) {
 			testFunc: func(t *testing.T) {
 				messageType := TextMessage
 				msg := []byte("hi")
-				expectedErr := errors.New("bad stuff")
 
 				mockConn := &MockWebsocketConnection{}
-				mockConn.On("NextWriter", messageType).Return(nil, expectedErr)
+				mockConn.On("ID").Return("conn-1")
+				mockConn.On("Done").Return(make(chan struct{}))
+				mockConn.On("NextWriter", messageType).Return(nil, errors.New("bad stuff"))
+				closed := notifyOnCall(mockConn.On("Close").Return(nil))
 
-				broadcaster, err := NewCacheBroadcaster(1)
+				broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
 				assert.NoError(t, err)
 
-				broadcaster.RegisterConnection(mockConn)
+				assert.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders"}, mockConn))
 
-				err = broadcaster.Broadcast(context.Background(), messageType, msg)
+				result := broadcast(t, broadcaster, &Message{Topic: "orders", Type: messageType, Data: msg})
+				assert.Equal(t, 1, result.Delivered)
 
-				assert.ErrorIs(t, err, expectedErr)
+				// Failed connection should be closed and evicted by its writer
+				waitForCall(t, closed)
+				assert.Empty(t, broadcaster.topics.Subscribers("orders"))
 			},
 		},
 		{
@@ -103,70 +210,108 @@ func Test_CacheBroadCaster_Broadcast(t *testing.T) {
 			testFunc: func(t *testing.T) {
 				messageType := TextMessage
 				msg := []byte("hi")
-				expectedErr := errors.New("bad stuff")
 
 				mockWriter := &MockWriteCloser{}
-				mockWriter.On("Write", msg).Return(0, expectedErr)
+				mockWriter.On("Write", msg).Return(0, errors.New("bad stuff"))
+				mockWriter.On("Close").Return(nil)
 
 				mockConn := &MockWebsocketConnection{}
+				mockConn.On("ID").Return("conn-1")
+				mockConn.On("Done").Return(make(chan struct{}))
 				mockConn.On("NextWriter", messageType).Return(mockWriter, nil)
-				mockWriter.On("Close").Return(nil)
+				closed := notifyOnCall(mockConn.On("Close").Return(nil))
 
-				broadcaster, err := NewCacheBroadcaster(1)
+				broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
 				assert.NoError(t, err)
 
-				broadcaster.RegisterConnection(mockConn)
+				assert.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders"}, mockConn))
 
-				err = broadcaster.Broadcast(context.Background(), messageType, msg)
+				result := broadcast(t, broadcaster, &Message{Topic: "orders", Type: messageType, Data: msg})
+				assert.Equal(t, 1, result.Delivered)
 
-				assert.ErrorIs(t, err, expectedErr)
+				waitForCall(t, closed)
+				assert.Empty(t, broadcaster.topics.Subscribers("orders"))
 			},
 		},
 		{
-			desc: "Write Success, close failure",
+			desc: "Write Success",
 			testFunc: func(t *testing.T) {
 				messageType := TextMessage
 				msg := []byte("hi")
-				expectedErr := errors.New("bad stuff")
 
 				mockWriter := &MockWriteCloser{}
 				mockWriter.On("Write", msg).Return(len(msg), nil)
-				mockWriter.On("Close").Return(expectedErr)
+				written := notifyOnCall(mockWriter.On("Close").Return(nil))
 
 				mockConn := &MockWebsocketConnection{}
+				mockConn.On("Done").Return(make(chan struct{}))
 				mockConn.On("NextWriter", messageType).Return(mockWriter, nil)
 
-				broadcaster, err := NewCacheBroadcaster(1)
+				broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
 				assert.NoError(t, err)
 
-				broadcaster.RegisterConnection(mockConn)
+				assert.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders"}, mockConn))
 
-				err = broadcaster.Broadcast(context.Background(), messageType, msg)
+				result := broadcast(t, broadcaster, &Message{Topic: "orders", Type: messageType, Data: msg})
 
-				assert.ErrorIs(t, err, expectedErr)
+				assert.Equal(t, 1, result.Delivered)
+				assert.Empty(t, result.Errors)
+				waitForCall(t, written)
 			},
 		},
 		{
-			desc: "Write Success",
+			desc: "Only topic subscribers receive",
 			testFunc: func(t *testing.T) {
 				messageType := TextMessage
 				msg := []byte("hi")
 
 				mockWriter := &MockWriteCloser{}
 				mockWriter.On("Write", msg).Return(len(msg), nil)
-				mockWriter.On("Close").Return(nil)
+				written := notifyOnCall(mockWriter.On("Close").Return(nil))
 
-				mockConn := &MockWebsocketConnection{}
-				mockConn.On("NextWriter", messageType).Return(mockWriter, nil)
+				ordersConn := &MockWebsocketConnection{}
+				ordersConn.On("Done").Return(make(chan struct{}))
+				ordersConn.On("NextWriter", messageType).Return(mockWriter, nil)
 
-				broadcaster, err := NewCacheBroadcaster(1)
+				// NextWriter has no expectation so any write to this connection fails the test
+				billingConn := &MockWebsocketConnection{}
+				billingConn.On("Done").Return(make(chan struct{}))
+
+				broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
 				assert.NoError(t, err)
 
-				broadcaster.RegisterConnection(mockConn)
+				assert.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders"}, ordersConn))
+				assert.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "billing"}, billingConn))
+
+				result := broadcast(t, broadcaster, &Message{Topic: "orders", Type: messageType, Data: msg})
+
+				assert.Equal(t, 1, result.Delivered)
+				waitForCall(t, written)
+				billingConn.AssertNotCalled(t, "NextWriter", messageType)
+			},
+		},
+		{
+			desc: "Closed connection is skipped",
+			testFunc: func(t *testing.T) {
+				messageType := TextMessage
+				msg := []byte("hi")
+
+				connDone := make(chan struct{})
+				close(connDone)
 
-				err = broadcaster.Broadcast(context.Background(), messageType, msg)
+				// NextWriter has no expectation so writing to the closed connection fails the test
+				mockConn := &MockWebsocketConnection{}
+				mockConn.On("Done").Return(connDone)
 
+				broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
 				assert.NoError(t, err)
+
+				assert.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders"}, mockConn))
+
+				result := broadcast(t, broadcaster, &Message{Topic: "orders", Type: messageType, Data: msg})
+
+				assert.Equal(t, 1, result.Skipped)
+				assert.Equal(t, 0, result.Delivered)
 			},
 		},
 	}
@@ -175,3 +320,326 @@ func Test_CacheBroadCaster_Broadcast(t *testing.T) {
 		t.Run(tc.desc, tc.testFunc)
 	}
 }
+
+// blockingConn is a WebsocketConnection whose writes block until release is closed.
+// Every message written is sent on written once unblocked.
+type blockingConn struct {
+	*discardConn
+	release chan struct{}
+	written chan []byte
+}
+
+func newBlockingConn(id string) *blockingConn {
+	return &blockingConn{
+		discardConn: newDiscardConn(id),
+		release:     make(chan struct{}),
+		written:     make(chan []byte, 16),
+	}
+}
+
+func (bc *blockingConn) NextWriter(MessageType) (io.WriteCloser, error) {
+	<-bc.release
+	return &recordingWriter{written: bc.written}, nil
+}
+
+// recordingWriter sends the bytes of each message to written on close
+type recordingWriter struct {
+	buf     []byte
+	written chan []byte
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	rw.buf = append(rw.buf, p...)
+	return len(p), nil
+}
+
+func (rw *recordingWriter) Close() error {
+	rw.written <- rw.buf
+	return nil
+}
+
+func Test_ParseOverflowPolicy(t *testing.T) {
+	for _, policy := range []OverflowPolicy{DropOldest, DropNewest, Disconnect, Block} {
+		actual, err := ParseOverflowPolicy(policy.String())
+		assert.NoError(t, err)
+		assert.Equal(t, policy, actual)
+	}
+
+	_, err := ParseOverflowPolicy("drop-all")
+	assert.EqualError(t, err, `unknown overflow policy "drop-all"`)
+}
+
+func Test_CacheBroadcaster_OverflowPolicies(t *testing.T) {
+	// Every case uses a queue of 1 on a connection that is stuck writing the first message,
+	// so the second message fills the queue and the third overflows it.
+	testCases := []struct {
+		desc             string
+		config           QueueConfig
+		expectedThird    func(t *testing.T, result *BroadcastResult)
+		expectedReceived []string
+	}{
+		{
+			desc:   "Drop oldest",
+			config: QueueConfig{Size: 1, Policy: DropOldest},
+			expectedThird: func(t *testing.T, result *BroadcastResult) {
+				assert.Equal(t, 1, result.Delivered)
+			},
+			expectedReceived: []string{"1", "3"},
+		},
+		{
+			desc:   "Drop newest",
+			config: QueueConfig{Size: 1, Policy: DropNewest},
+			expectedThird: func(t *testing.T, result *BroadcastResult) {
+				assert.Equal(t, 1, result.Skipped)
+			},
+			expectedReceived: []string{"1", "2"},
+		},
+		{
+			desc:   "Block with timeout",
+			config: QueueConfig{Size: 1, Policy: Block, BlockTimeout: 10 * time.Millisecond},
+			expectedThird: func(t *testing.T, result *BroadcastResult) {
+				assert.Equal(t, 1, result.Skipped)
+			},
+			expectedReceived: []string{"1", "2"},
+		},
+		{
+			desc:   "Disconnect",
+			config: QueueConfig{Size: 1, Policy: Disconnect},
+			expectedThird: func(t *testing.T, result *BroadcastResult) {
+				assert.Equal(t, 1, result.Failed)
+				assert.ErrorIs(t, result.Errors["slow"], ErrSlowConsumer)
+			},
+			expectedReceived: []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			broadcaster, err := NewCacheBroadcaster(1, tc.config, newMemoryStore(t), RoundRobin)
+			require.NoError(t, err)
+
+			conn := newBlockingConn("slow")
+			assert.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders"}, conn))
+
+			// The writer picks up the first message and blocks on it
+			assert.Equal(t, 1, broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte("1")}).Delivered)
+			broadcaster.queuesMu.RLock()
+			queue := broadcaster.queues[conn]
+			broadcaster.queuesMu.RUnlock()
+			require.Eventually(t, func() bool {
+				return len(queue.messages) == 0
+			}, time.Second, time.Millisecond)
+
+			assert.Equal(t, 1, broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte("2")}).Delivered)
+			tc.expectedThird(t, broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte("3")}))
+
+			close(conn.release)
+
+			for _, expected := range tc.expectedReceived {
+				select {
+				case msg := <-conn.written:
+					assert.Equal(t, expected, string(msg))
+				case <-time.After(time.Second):
+					t.Fatal("timed out waiting for", expected)
+				}
+			}
+		})
+	}
+}
+
+func Test_CacheBroadcaster_SlowSubscriberDoesNotBlock(t *testing.T) {
+	broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
+	require.NoError(t, err)
+
+	slow := newBlockingConn("slow")
+	defer close(slow.release)
+
+	fast := newDiscardConn("fast")
+
+	assert.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders"}, slow))
+	assert.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders"}, fast))
+
+	// Publishing more than fits in the slow queue should never wait on the slow subscriber
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*DefaultQueueConfig().Size; i++ {
+			broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte("hi")})
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("broadcast blocked on a slow subscriber")
+	}
+}
+
+// discardConn is a thread safe WebsocketConnection that discards everything written to it
+type discardConn struct {
+	id       string
+	doneChan chan struct{}
+}
+
+func newDiscardConn(id string) *discardConn {
+	return &discardConn{
+		id:       id,
+		doneChan: make(chan struct{}),
+	}
+}
+
+func (dc *discardConn) ID() string { return dc.id }
+
+func (dc *discardConn) NextWriter(MessageType) (io.WriteCloser, error) {
+	return nopWriteCloser{io.Discard}, nil
+}
+
+func (dc *discardConn) Done() <-chan struct{} { return dc.doneChan }
+
+func (dc *discardConn) Incoming() <-chan []byte { return nil }
+
+func (dc *discardConn) Close() error { return nil }
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Test_CacheBroadcaster_ConcurrentAccess subscribes, publishes and unsubscribes at the same time.
+// Run with -race to detect unsynchronized access to the connection registry.
+func Test_CacheBroadcaster_ConcurrentAccess(t *testing.T) {
+	const (
+		workers    = 8
+		iterations = 200
+	)
+
+	broadcaster, err := NewCacheBroadcaster(4, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
+	require.NoError(t, err)
+
+	// Keep a stable subscriber that should receive every publish regardless of churn
+	stable := newDiscardConn("stable")
+	assert.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders.created"}, stable))
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(3)
+
+		// Subscribers churning on and off
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				conn := newDiscardConn(fmt.Sprintf("churn-%d-%d", w, i))
+				assert.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders.*"}, conn))
+				assert.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders.>"}, conn))
+				broadcaster.UnregisterConnection(conn)
+			}
+		}(w)
+
+		// Publishers
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				result := broadcast(t, broadcaster, &Message{Topic: "orders.created", Type: TextMessage, Data: []byte("hi")})
+				assert.Zero(t, result.Failed)
+				assert.GreaterOrEqual(t, result.Delivered, 1)
+			}
+		}()
+
+		// Readers of the whole registry
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				broadcaster.topics.Connections()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// Only the stable subscriber should remain after all the churn
+	assert.Equal(t, []WebsocketConnection{stable}, broadcaster.topics.Subscribers("orders.created"))
+	assert.Equal(t, []WebsocketConnection{stable}, broadcaster.topics.Connections())
+}
+
+// Test_CacheBroadcaster_ConcurrentOrder publishes from several goroutines and checks every subscriber
+// is sent the messages in sequence order and its consumer's offset ends on the newest one
+func Test_CacheBroadcaster_ConcurrentOrder(t *testing.T) {
+	const (
+		publishers = 8
+		iterations = 100
+	)
+
+	broadcaster, err := NewCacheBroadcaster(4, QueueConfig{Size: publishers * iterations, Policy: DropNewest}, newMemoryStore(t), RoundRobin)
+	require.NoError(t, err)
+
+	subscribers := make([]*envelopeConn, 4)
+	for i := range subscribers {
+		subscribers[i] = newEnvelopeConn(fmt.Sprintf("subscriber-%d", i))
+		sub := Subscription{Pattern: "orders.>", Format: FormatEnvelope, Consumer: fmt.Sprintf("consumer-%d", i)}
+		require.NoError(t, broadcaster.RegisterConnection(sub, subscribers[i]))
+	}
+
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				broadcast(t, broadcaster, &Message{Topic: "orders.created", Type: TextMessage, Data: []byte("hi")})
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, subscriber := range subscribers {
+		require.Eventually(t, func() bool {
+			return len(subscriber.received()) == publishers*iterations
+		}, time.Second, time.Millisecond)
+
+		seqs := receivedSeqs(subscriber)
+		for j := 1; j < len(seqs); j++ {
+			require.Less(t, seqs[j-1], seqs[j], "subscriber %d", i)
+		}
+
+		require.Eventually(t, func() bool {
+			seq, _, err := broadcaster.store.Offset(fmt.Sprintf("consumer-%d", i))
+			return err == nil && seq == publishers*iterations
+		}, time.Second, time.Millisecond)
+	}
+}
+
+// Test_CacheBroadcaster_ConcurrentClose closes all connections while publishes and subscribes are in flight
+func Test_CacheBroadcaster_ConcurrentClose(t *testing.T) {
+	broadcaster, err := NewCacheBroadcaster(4, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			assert.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders"}, newDiscardConn(fmt.Sprintf("conn-%d", i))))
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			broadcast(t, broadcaster, &Message{Topic: "orders", Type: BinaryMessage, Data: []byte{0x1}})
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			broadcaster.CloseConnections()
+		}
+	}()
+
+	wg.Wait()
+
+	broadcaster.CloseConnections()
+	assert.Empty(t, broadcaster.topics.Connections())
+}
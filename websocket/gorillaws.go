@@ -2,7 +2,10 @@ package websocket
 
 import (
 	"io"
+	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	gwebsocket "github.com/gorilla/websocket"
 )
@@ -11,41 +14,214 @@ var _ (Upgrader) = (*GorillaUpgrader)(nil)
 
 // GorillaUpgrader is a wrapper around the gorilla/websocket Upgrader to satisfy the Upgrader interface
 type GorillaUpgrader struct {
-	upgrader *gwebsocket.Upgrader
+	upgrader  *gwebsocket.Upgrader
+	keepalive KeepaliveConfig
 }
 
-// NewGorillaUpgrader creates a new GorillaUpgrader that wraps the passed in upgrader
-func NewGorillaUpgrader(upgrader *gwebsocket.Upgrader) *GorillaUpgrader {
+// NewGorillaUpgrader creates a new GorillaUpgrader that wraps the passed in upgrader.
+// Upgraded connections are kept alive with pings configured by keepalive.
+func NewGorillaUpgrader(upgrader *gwebsocket.Upgrader, keepalive KeepaliveConfig) *GorillaUpgrader {
 	return &GorillaUpgrader{
-		upgrader: upgrader,
+		upgrader:  upgrader,
+		keepalive: keepalive,
 	}
 }
 
 // Upgrade upgrades the HTTP server connection to the WebSocket protocol.
+// The returned connection starts reading from the socket so a closed or broken connection is detected.
 func (gu *GorillaUpgrader) Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (WebsocketConnection, error) {
 	conn, err := gu.upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		return nil, err
 	}
 
-	return &GorillaConn{
-		conn: conn,
-	}, nil
+	return NewGorillaConn(conn, gu.keepalive), nil
 }
 
+const (
+	// maxIncomingFrameSize is the largest frame a client may send, clients only send small control frames such as acks
+	maxIncomingFrameSize = 64 << 10
+
+	// incomingBufferSize is the number of received frames buffered before the read pump waits for them to be read
+	incomingBufferSize = 64
+
+	// closeTimeout is how long writing a close frame may block
+	closeTimeout = time.Second
+)
+
 var _ (WebsocketConnection) = (*GorillaConn)(nil)
+var _ (ReasonCloser) = (*GorillaConn)(nil)
 
 // GorillaConn is a wrapper around the gorilla/websocket Conn to satisfy the WebsocketConnection interface
 type GorillaConn struct {
+	id   string
 	conn *gwebsocket.Conn
+
+	keepalive KeepaliveConfig
+
+	// writeMu is held from NextWriter until the writer is closed as gorilla supports only one concurrent writer
+	writeMu sync.Mutex
+
+	incoming chan []byte
+
+	doneChan  chan struct{}
+	closeOnce sync.Once
+
+	// closedChan is closed by Close so a read pump waiting on Incoming gives up
+	closedChan chan struct{}
+	closedOnce sync.Once
+}
+
+// NewGorillaConn wraps conn and starts its read pump.
+// If keepalive is enabled the connection is pinged and closed once the client stops answering.
+func NewGorillaConn(conn *gwebsocket.Conn, keepalive KeepaliveConfig) *GorillaConn {
+	gc := &GorillaConn{
+		id:         newConnectionID(),
+		conn:       conn,
+		keepalive:  keepalive,
+		incoming:   make(chan []byte, incomingBufferSize),
+		doneChan:   make(chan struct{}),
+		closedChan: make(chan struct{}),
+	}
+
+	conn.SetReadLimit(maxIncomingFrameSize)
+
+	if keepalive.Enabled() {
+		// Any pong pushes the deadline back. Once it passes the read pump errors and the connection is marked done.
+		conn.SetReadDeadline(keepalive.readDeadline())
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(keepalive.readDeadline())
+		})
+
+		go gc.pingLoop()
+	}
+
+	go gc.readPump()
+
+	return gc
+}
+
+// pingLoop sends a ping every PingInterval until the connection is done
+func (gc *GorillaConn) pingLoop() {
+	ticker := time.NewTicker(gc.keepalive.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-gc.doneChan:
+			return
+		case <-ticker.C:
+			// WriteControl is safe to call concurrently with NextWriter
+			deadline := time.Now().Add(gc.keepalive.PongTimeout)
+			if err := gc.conn.WriteControl(int(PingMessage), nil, deadline); err != nil {
+				log.Println("Failed to ping subscriber", gc.id, err)
+				gc.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// readPump reads from the websocket until it errors.
+// Reading is required for gorilla to process control frames such as close frames.
+// Data frames are passed on to Incoming, once it is full the pump stops reading until there is room
+// so a client sending frames faster than they are handled is pushed back on rather than losing any.
+// Any error, including a close frame from the client, marks the connection as done.
+func (gc *GorillaConn) readPump() {
+	defer gc.markDone()
+
+	for {
+		_, reader, err := gc.conn.NextReader()
+		if err != nil {
+			return
+		}
+
+		frame, err := io.ReadAll(reader)
+		if err != nil {
+			return
+		}
+
+		select {
+		case gc.incoming <- frame:
+		case <-gc.closedChan:
+			return
+		}
+	}
+}
+
+// markDone closes the done channel exactly once
+func (gc *GorillaConn) markDone() {
+	gc.closeOnce.Do(func() {
+		close(gc.doneChan)
+	})
+}
+
+// ID returns an identifier unique to this connection
+func (gc *GorillaConn) ID() string {
+	return gc.id
 }
 
-// NextWriter returns a writer for the next message to send
+// NextWriter returns a writer for the next message to send.
+// Blocks until the writer of any message already in progress is closed.
+// The message must be written and closed before the write deadline or the write fails,
+// so a client that stops reading can't block the writer forever.
 func (gc *GorillaConn) NextWriter(messageType MessageType) (io.WriteCloser, error) {
-	return gc.conn.NextWriter(int(messageType))
+	gc.writeMu.Lock()
+
+	if err := gc.conn.SetWriteDeadline(gc.keepalive.writeDeadline()); err != nil {
+		gc.writeMu.Unlock()
+		return nil, err
+	}
+
+	writer, err := gc.conn.NextWriter(int(messageType))
+	if err != nil {
+		gc.writeMu.Unlock()
+		return nil, err
+	}
+
+	return &lockedWriter{
+		WriteCloser: writer,
+		unlock:      gc.writeMu.Unlock,
+	}, nil
+}
+
+// lockedWriter releases the connection's write lock once the message is closed
+type lockedWriter struct {
+	io.WriteCloser
+	unlock func()
+	once   sync.Once
+}
+
+// Close closes the message writer and releases the write lock
+func (lw *lockedWriter) Close() error {
+	defer lw.once.Do(lw.unlock)
+	return lw.WriteCloser.Close()
+}
+
+// Incoming returns the data frames received from the client.
+// It must be read for as long as the connection is open or the connection stops reading from the client.
+func (gc *GorillaConn) Incoming() <-chan []byte {
+	return gc.incoming
+}
+
+// Done returns a channel that is closed once the connection is closed or broken
+func (gc *GorillaConn) Done() <-chan struct{} {
+	return gc.doneChan
 }
 
 // Close closes the websocket connection
 func (gc *GorillaConn) Close() error {
+	// Closing the underlying connection causes the read pump to exit and mark the connection done
+	gc.closedOnce.Do(func() {
+		close(gc.closedChan)
+	})
 	return gc.conn.Close()
 }
+
+// CloseWithReason sends a close frame with code and reason then closes the websocket connection.
+// The connection is closed even if the close frame can't be written.
+func (gc *GorillaConn) CloseWithReason(code int, reason string) error {
+	// WriteControl is safe to call concurrently with NextWriter
+	gc.conn.WriteControl(int(CloseMessage), gwebsocket.FormatCloseMessage(code, reason), time.Now().Add(closeTimeout))
+	return gc.Close()
+}
@@ -0,0 +1,238 @@
+package websocket
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gwebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestGorillaConn starts a test server that upgrades a single connection.
+// Returns the server side connection and the client side gorilla connection.
+func newTestGorillaConn(t *testing.T, keepalive KeepaliveConfig) (WebsocketConnection, *gwebsocket.Conn) {
+	connChan := make(chan WebsocketConnection, 1)
+	upgrader := NewGorillaUpgrader(&gwebsocket.Upgrader{}, keepalive)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		connChan <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := gwebsocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	return <-connChan, client
+}
+
+func Test_GorillaConn_Done(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		disconnect func(client *gwebsocket.Conn)
+	}{
+		{
+			desc: "Client sends close frame",
+			disconnect: func(client *gwebsocket.Conn) {
+				msg := gwebsocket.FormatCloseMessage(gwebsocket.CloseNormalClosure, "bye")
+				client.WriteControl(gwebsocket.CloseMessage, msg, time.Now().Add(time.Second))
+			},
+		},
+		{
+			desc: "Client connection drops",
+			disconnect: func(client *gwebsocket.Conn) {
+				client.UnderlyingConn().Close()
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			conn, client := newTestGorillaConn(t, KeepaliveConfig{})
+
+			select {
+			case <-conn.Done():
+				t.Fatal("connection marked done before the client disconnected")
+			default:
+			}
+
+			tc.disconnect(client)
+
+			select {
+			case <-conn.Done():
+			case <-time.After(time.Second):
+				t.Fatal("connection was not marked done after the client disconnected")
+			}
+
+			assert.NoError(t, conn.Close())
+		})
+	}
+}
+
+func Test_GorillaConn_Incoming(t *testing.T) {
+	conn, client := newTestGorillaConn(t, KeepaliveConfig{})
+
+	require.NoError(t, client.WriteMessage(gwebsocket.TextMessage, []byte(`{"type":"ack","seq":1}`)))
+
+	select {
+	case frame := <-conn.Incoming():
+		assert.Equal(t, []byte(`{"type":"ack","seq":1}`), frame)
+	case <-time.After(time.Second):
+		t.Fatal("frame from the client was not received")
+	}
+
+	assert.NoError(t, conn.Close())
+}
+
+// Test_GorillaConn_IncomingBackpressure sends more frames than are buffered before any are read and checks none are lost
+func Test_GorillaConn_IncomingBackpressure(t *testing.T) {
+	const frames = incomingBufferSize * 3
+
+	conn, client := newTestGorillaConn(t, KeepaliveConfig{})
+
+	// The client's writes are pushed back on over TCP until the server reads
+	written := make(chan error, 1)
+	go func() {
+		for i := 0; i < frames; i++ {
+			if err := client.WriteMessage(gwebsocket.TextMessage, []byte(fmt.Sprint(i))); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < frames; i++ {
+		select {
+		case frame := <-conn.Incoming():
+			assert.Equal(t, fmt.Sprint(i), string(frame))
+		case <-time.After(time.Second):
+			t.Fatalf("frame %d from the client was not received", i)
+		}
+	}
+	require.NoError(t, <-written)
+
+	// A read pump waiting on Incoming stops once the connection is closed
+	require.NoError(t, client.WriteMessage(gwebsocket.TextMessage, []byte("unread")))
+	assert.NoError(t, conn.Close())
+
+	select {
+	case <-conn.Done():
+	case <-time.After(time.Second):
+		t.Fatal("connection was not marked done")
+	}
+}
+
+func Test_GorillaConn_CloseWithReason(t *testing.T) {
+	conn, client := newTestGorillaConn(t, KeepaliveConfig{})
+
+	require.NoError(t, CloseWithReason(conn, ClosePolicyViolation, "not allowed"))
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := client.ReadMessage()
+
+	var closeErr *gwebsocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, ClosePolicyViolation, closeErr.Code)
+	assert.Equal(t, "not allowed", closeErr.Text)
+}
+
+func Test_GorillaConn_ConcurrentWrites(t *testing.T) {
+	conn, client := newTestGorillaConn(t, KeepaliveConfig{})
+
+	const writers = 8
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, writeMessage(conn, TextMessage, []byte("hi")))
+		}()
+	}
+
+	// Every message should arrive whole despite being written concurrently
+	for i := 0; i < writers; i++ {
+		_, msg, err := client.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "hi", string(msg))
+	}
+
+	wg.Wait()
+}
+
+func Test_GorillaConn_WriteDeadline(t *testing.T) {
+	// Pings are rare so only the write deadline can fail the write
+	conn, _ := newTestGorillaConn(t, KeepaliveConfig{
+		PingInterval: time.Hour,
+		PongTimeout:  50 * time.Millisecond,
+	})
+
+	// The client never reads so writes fail once the socket buffers fill
+	payload := make([]byte, 1<<20)
+	errChan := make(chan error, 1)
+	go func() {
+		for {
+			if err := writeMessage(conn, BinaryMessage, payload); err != nil {
+				errChan <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-errChan:
+		var netErr net.Error
+		require.ErrorAs(t, err, &netErr)
+		assert.True(t, netErr.Timeout(), "expected a timeout, got %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write to a client that stopped reading never timed out")
+	}
+}
+
+func Test_GorillaConn_Keepalive(t *testing.T) {
+	keepalive := KeepaliveConfig{
+		PingInterval: 20 * time.Millisecond,
+		PongTimeout:  20 * time.Millisecond,
+	}
+
+	t.Run("Client answers pings", func(t *testing.T) {
+		conn, client := newTestGorillaConn(t, keepalive)
+
+		// Gorilla clients answer pings while reading
+		go func() {
+			for {
+				if _, _, err := client.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
+		select {
+		case <-conn.Done():
+			t.Fatal("connection closed while client was answering pings")
+		case <-time.After(10 * keepalive.PingInterval):
+		}
+	})
+
+	t.Run("Client stops answering", func(t *testing.T) {
+		conn, _ := newTestGorillaConn(t, keepalive)
+
+		// The client never reads so it never answers a ping
+		select {
+		case <-conn.Done():
+		case <-time.After(time.Second):
+			t.Fatal("connection was not closed after missing pongs")
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package websocket
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// GroupBalancing decides which member of a consumer group a message is sent to
+type GroupBalancing int
+
+const (
+	// RoundRobin sends messages to each member of a group in turn
+	RoundRobin GroupBalancing = iota
+
+	// LeastOutstanding sends each message to the member with the fewest queued and unacked messages.
+	// Ties are broken round robin.
+	LeastOutstanding
+)
+
+// String returns the name of the balancing as used by ParseGroupBalancing
+func (gb GroupBalancing) String() string {
+	switch gb {
+	case RoundRobin:
+		return "round-robin"
+	case LeastOutstanding:
+		return "least-outstanding"
+	}
+	return fmt.Sprintf("GroupBalancing(%d)", int(gb))
+}
+
+// ParseGroupBalancing parses the name of a GroupBalancing
+func ParseGroupBalancing(name string) (GroupBalancing, error) {
+	for _, balancing := range []GroupBalancing{RoundRobin, LeastOutstanding} {
+		if balancing.String() == name {
+			return balancing, nil
+		}
+	}
+	return RoundRobin, fmt.Errorf("unknown group balancing %q", name)
+}
+
+// groupBalancer picks the member of a consumer group each message is sent to
+type groupBalancer struct {
+	balancing GroupBalancing
+
+	// next is the round robin position of each group
+	mu   sync.Mutex
+	next map[string]int
+}
+
+// newGroupBalancer creates a groupBalancer using balancing
+func newGroupBalancer(balancing GroupBalancing) *groupBalancer {
+	return &groupBalancer{
+		balancing: balancing,
+		next:      make(map[string]int),
+	}
+}
+
+// pick returns the member of group to send the next message to.
+// Members whose connection is done are passed over. Returns nil if no member is left.
+func (gb *groupBalancer) pick(group string, members []*subscriberQueue) *subscriberQueue {
+	live := make([]*subscriberQueue, 0, len(members))
+	for _, member := range members {
+		select {
+		case <-member.conn.Done():
+		default:
+			live = append(live, member)
+		}
+	}
+
+	if len(live) == 0 {
+		return nil
+	}
+
+	// Members come from the topic trie in no particular order
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].conn.ID() < live[j].conn.ID()
+	})
+
+	gb.mu.Lock()
+	start := gb.next[group] % len(live)
+	gb.next[group] = start + 1
+	gb.mu.Unlock()
+
+	if gb.balancing == RoundRobin {
+		return live[start]
+	}
+
+	// Scan from the round robin position so idle members share the load
+	picked := live[start]
+	fewest := picked.outstanding()
+	for i := 1; i < len(live) && fewest > 0; i++ {
+		member := live[(start+i)%len(live)]
+		if outstanding := member.outstanding(); outstanding < fewest {
+			picked, fewest = member, outstanding
+		}
+	}
+
+	return picked
+}
+
+// forget drops the round robin position of a group that has no members left
+func (gb *groupBalancer) forget(group string) {
+	gb.mu.Lock()
+	defer gb.mu.Unlock()
+
+	delete(gb.next, group)
+}
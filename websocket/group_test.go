@@ -0,0 +1,133 @@
+package websocket
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseGroupBalancing(t *testing.T) {
+	for _, balancing := range []GroupBalancing{RoundRobin, LeastOutstanding} {
+		actual, err := ParseGroupBalancing(balancing.String())
+		assert.NoError(t, err)
+		assert.Equal(t, balancing, actual)
+	}
+
+	_, err := ParseGroupBalancing("random")
+	assert.EqualError(t, err, `unknown group balancing "random"`)
+}
+
+func Test_CacheBroadcaster_Groups(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			desc: "Round robin",
+			testFunc: func(t *testing.T) {
+				broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
+				require.NoError(t, err)
+
+				members := make([]*seqConn, 0, 3)
+				for i := 0; i < 3; i++ {
+					member := &seqConn{discardConn: newDiscardConn(fmt.Sprintf("worker-%d", i))}
+					require.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders", Group: "workers"}, member))
+					members = append(members, member)
+				}
+
+				// An ungrouped subscriber still gets every message
+				audit := &seqConn{discardConn: newDiscardConn("audit")}
+				require.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders"}, audit))
+
+				for i := 1; i <= 6; i++ {
+					result := broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte(fmt.Sprint(i))})
+					assert.Equal(t, 2, result.Delivered)
+				}
+
+				require.Eventually(t, func() bool {
+					return len(audit.received()) == 6
+				}, time.Second, time.Millisecond)
+
+				// Members take turns in order of their IDs
+				require.Eventually(t, func() bool {
+					return len(members[0].received())+len(members[1].received())+len(members[2].received()) == 6
+				}, time.Second, time.Millisecond)
+				assert.Equal(t, []uint64{1, 4}, members[0].received())
+				assert.Equal(t, []uint64{2, 5}, members[1].received())
+				assert.Equal(t, []uint64{3, 6}, members[2].received())
+			},
+		},
+		{
+			desc: "Least outstanding",
+			testFunc: func(t *testing.T) {
+				broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), LeastOutstanding)
+				require.NoError(t, err)
+
+				// The stuck member holds the first message it is sent and queues the rest
+				stuck := newBlockingConn("a-stuck")
+				defer close(stuck.release)
+				require.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders", Group: "workers"}, stuck))
+
+				free := &seqConn{discardConn: newDiscardConn("b-free")}
+				require.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders", Group: "workers"}, free))
+
+				// The first message goes to the stuck member as both are idle
+				broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte("1")})
+				broadcaster.queuesMu.RLock()
+				stuckQueue := broadcaster.queues[stuck]
+				broadcaster.queuesMu.RUnlock()
+				require.Eventually(t, func() bool {
+					return len(stuckQueue.messages) == 0 && stuckQueue.outstanding() == 1
+				}, time.Second, time.Millisecond)
+
+				for i := 2; i <= 5; i++ {
+					broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte(fmt.Sprint(i))})
+
+					// Wait for the free member to drain so its outstanding count is settled
+					require.Eventually(t, func() bool {
+						broadcaster.queuesMu.RLock()
+						defer broadcaster.queuesMu.RUnlock()
+						return broadcaster.queues[free].outstanding() == 0
+					}, time.Second, time.Millisecond)
+				}
+
+				// Only the first message is stuck with the slow member, everything else goes to the free one
+				assert.Equal(t, []uint64{2, 3, 4, 5}, free.received())
+			},
+		},
+		{
+			desc: "Members that leave are skipped",
+			testFunc: func(t *testing.T) {
+				broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
+				require.NoError(t, err)
+
+				gone := &seqConn{discardConn: newDiscardConn("a-gone")}
+				require.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders", Group: "workers"}, gone))
+				close(gone.doneChan)
+
+				stays := &seqConn{discardConn: newDiscardConn("b-stays")}
+				require.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders", Group: "workers"}, stays))
+
+				for i := 1; i <= 2; i++ {
+					broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte(fmt.Sprint(i))})
+				}
+
+				require.Eventually(t, func() bool {
+					return len(stays.received()) == 2
+				}, time.Second, time.Millisecond)
+				assert.Empty(t, gone.received())
+
+				broadcaster.UnregisterConnection(gone)
+				broadcaster.UnregisterConnection(stays)
+				assert.Empty(t, broadcaster.balancer.next)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, tc.testFunc)
+	}
+}
@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"errors"
+	"time"
+)
+
+// writeTimeout is how long writing a message may block when keepalive is disabled
+const writeTimeout = 10 * time.Second
+
+// KeepaliveConfig configures the pings sent to idle websocket connections.
+// Load balancers and proxies often drop connections that go quiet, pings keep them active
+// and let the server notice clients that silently went away.
+type KeepaliveConfig struct {
+	// PingInterval is how often a ping is sent to the client. Zero disables keepalive.
+	PingInterval time.Duration
+
+	// PongTimeout is how long after a ping is due the client has to answer before the connection is closed
+	PongTimeout time.Duration
+}
+
+// DefaultKeepaliveConfig returns the KeepaliveConfig used when none is specified
+func DefaultKeepaliveConfig() KeepaliveConfig {
+	return KeepaliveConfig{
+		PingInterval: 30 * time.Second,
+		PongTimeout:  10 * time.Second,
+	}
+}
+
+// Enabled returns true if pings should be sent
+func (kc KeepaliveConfig) Enabled() bool {
+	return kc.PingInterval > 0
+}
+
+// Validate checks the KeepaliveConfig is usable
+func (kc KeepaliveConfig) Validate() error {
+	if kc.PingInterval < 0 {
+		return errors.New("ping interval must not be negative")
+	}
+
+	if kc.Enabled() && kc.PongTimeout <= 0 {
+		return errors.New("pong timeout must be greater than 0 when keepalive is enabled")
+	}
+
+	return nil
+}
+
+// readDeadline returns the time by which the next pong must arrive
+func (kc KeepaliveConfig) readDeadline() time.Time {
+	return time.Now().Add(kc.PingInterval + kc.PongTimeout)
+}
+
+// writeDeadline returns the time by which the next message must be written.
+// With keepalive enabled a client gets as long to take a message as it does to answer a ping.
+func (kc KeepaliveConfig) writeDeadline() time.Time {
+	if kc.Enabled() {
+		return time.Now().Add(kc.PongTimeout)
+	}
+	return time.Now().Add(writeTimeout)
+}
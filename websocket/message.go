@@ -0,0 +1,157 @@
+package websocket
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Message is a single published message
+type Message struct {
+	// ID uniquely identifies the message, it is generated by the server
+	ID string
+
+	// Seq is the server wide sequence number of the message, it is assigned when the message is broadcast
+	Seq uint64
+
+	// Timestamp is when the server received the message
+	Timestamp time.Time
+
+	// Topic is the concrete topic the message was published to
+	Topic string
+
+	// Type is the websocket frame type used to deliver the message
+	Type MessageType
+
+	// ContentType is the media type supplied by the publisher
+	ContentType string
+
+	// Headers are optional publisher supplied metadata
+	Headers map[string]string
+
+	// Data is the message payload
+	Data []byte
+
+	// Attempt is the delivery attempt of the message to a subscriber acking messages, zero otherwise
+	Attempt int
+}
+
+// NewMessageID generates a random identifier for a message
+func NewMessageID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(err)
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// Format is how a Message is encoded into a websocket frame for a subscriber
+type Format int
+
+const (
+	// FormatRaw sends only the payload. The frame type tells text and binary payloads apart.
+	FormatRaw Format = iota
+
+	// FormatMIME prefixes the payload with MIME style headers, a blank line separates them from the payload.
+	//
+	//	Content-Type: application/cbor
+	//
+	//	<payload>
+	FormatMIME
+
+	// FormatEnvelope wraps the payload in a JSON envelope carrying the message metadata.
+	// Envelopes are always sent as text frames, binary payloads are base64 encoded.
+	FormatEnvelope
+)
+
+// String returns the name of the format as used by ParseFormat
+func (f Format) String() string {
+	switch f {
+	case FormatRaw:
+		return "raw"
+	case FormatMIME:
+		return "mime"
+	case FormatEnvelope:
+		return "envelope"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ParseFormat parses the name of a format. An empty name is FormatRaw.
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "", "raw":
+		return FormatRaw, nil
+	case "mime":
+		return FormatMIME, nil
+	case "envelope":
+		return FormatEnvelope, nil
+	}
+	return FormatRaw, fmt.Errorf("unknown format %q", name)
+}
+
+// envelope is the JSON structure sent to subscribers using FormatEnvelope
+type envelope struct {
+	ID          string            `json:"id"`
+	Seq         uint64            `json:"seq"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Topic       string            `json:"topic"`
+	ContentType string            `json:"contentType"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Attempt     int               `json:"attempt,omitempty"`
+
+	// Encoding is set to base64 when Data holds a base64 encoded binary payload
+	Encoding string `json:"encoding,omitempty"`
+	Data     string `json:"data"`
+}
+
+// FrameType returns the websocket frame type used to send the message in the given format
+func (m *Message) FrameType(format Format) MessageType {
+	if format == FormatEnvelope {
+		return TextMessage
+	}
+	return m.Type
+}
+
+// Encode returns the frame payload of the message in the given format
+func (m *Message) Encode(format Format) []byte {
+	switch format {
+	case FormatMIME:
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "Content-Type: %s\r\n\r\n", m.ContentType)
+		buf.Write(m.Data)
+		return buf.Bytes()
+	case FormatEnvelope:
+		env := envelope{
+			ID:          m.ID,
+			Seq:         m.Seq,
+			Timestamp:   m.Timestamp,
+			Topic:       m.Topic,
+			ContentType: m.ContentType,
+			Headers:     m.Headers,
+			Attempt:     m.Attempt,
+			Data:        string(m.Data),
+		}
+
+		if m.Type == BinaryMessage {
+			env.Encoding = "base64"
+			env.Data = base64.StdEncoding.EncodeToString(m.Data)
+		}
+
+		data, err := json.Marshal(env)
+		if err != nil {
+			// The envelope only holds strings and a time so this can't happen in practice
+			log.Println("failed to marshal message envelope:", err)
+		}
+		return data
+	default:
+		return m.Data
+	}
+}
@@ -0,0 +1,80 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Message_Encode(t *testing.T) {
+	msg := &Message{
+		Topic:       "orders",
+		Type:        BinaryMessage,
+		ContentType: "application/cbor",
+		Data:        []byte{0xa1, 0x01},
+	}
+
+	assert.Equal(t, msg.Data, msg.Encode(FormatRaw))
+	assert.Equal(t, append([]byte("Content-Type: application/cbor\r\n\r\n"), msg.Data...), msg.Encode(FormatMIME))
+}
+
+func Test_Message_Encode_Envelope(t *testing.T) {
+	timestamp := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		desc     string
+		msg      *Message
+		expected string
+	}{
+		{
+			desc: "Text payload",
+			msg: &Message{
+				ID:          "abc",
+				Seq:         7,
+				Timestamp:   timestamp,
+				Topic:       "orders",
+				Type:        TextMessage,
+				ContentType: "application/json",
+				Headers:     map[string]string{"Trace-Id": "123"},
+				Data:        []byte(`{"id":1}`),
+			},
+			expected: `{"id":"abc","seq":7,"timestamp":"2021-09-01T12:00:00Z","topic":"orders","contentType":"application/json","headers":{"Trace-Id":"123"},"data":"{\"id\":1}"}`,
+		},
+		{
+			desc: "Binary payload",
+			msg: &Message{
+				ID:          "abc",
+				Seq:         7,
+				Timestamp:   timestamp,
+				Topic:       "orders",
+				Type:        BinaryMessage,
+				ContentType: "application/cbor",
+				Data:        []byte{0xa1, 0x01},
+			},
+			expected: `{"id":"abc","seq":7,"timestamp":"2021-09-01T12:00:00Z","topic":"orders","contentType":"application/cbor","encoding":"base64","data":"oQE="}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.JSONEq(t, tc.expected, string(tc.msg.Encode(FormatEnvelope)))
+			assert.Equal(t, TextMessage, tc.msg.FrameType(FormatEnvelope))
+		})
+	}
+}
+
+func Test_ParseFormat(t *testing.T) {
+	for _, format := range []Format{FormatRaw, FormatMIME, FormatEnvelope} {
+		parsed, err := ParseFormat(format.String())
+		assert.NoError(t, err)
+		assert.Equal(t, format, parsed)
+	}
+
+	parsed, err := ParseFormat("")
+	assert.NoError(t, err)
+	assert.Equal(t, FormatRaw, parsed)
+
+	_, err = ParseFormat("xml")
+	assert.EqualError(t, err, `unknown format "xml"`)
+}
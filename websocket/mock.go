@@ -15,6 +15,11 @@ type MockWebsocketConnection struct {
 	mock.Mock
 }
 
+func (m *MockWebsocketConnection) ID() string {
+	args := m.Called()
+	return args.String(0)
+}
+
 func (m *MockWebsocketConnection) NextWriter(messageType MessageType) (io.WriteCloser, error) {
 	args := m.Called(messageType)
 	if args.Get(0) == nil {
@@ -29,6 +34,16 @@ func (m *MockWebsocketConnection) Close() error {
 	return args.Error(0)
 }
 
+func (m *MockWebsocketConnection) Done() <-chan struct{} {
+	args := m.Called()
+	return args.Get(0).(chan struct{})
+}
+
+func (m *MockWebsocketConnection) Incoming() <-chan []byte {
+	args := m.Called()
+	return args.Get(0).(chan []byte)
+}
+
 var _ (io.WriteCloser) = (*MockWriteCloser)(nil)
 
 // MockWriteCloser represents a mock io.WriteCloser
@@ -53,18 +68,34 @@ type MockBroadcaster struct {
 	mock.Mock
 }
 
-// RegisterConnection registers a connection with the Broadcaster
-func (m *MockBroadcaster) RegisterConnection(conn WebsocketConnection) {
-	m.Called(conn)
+// RegisterConnection registers a connection with the Broadcaster as a subscriber
+func (m *MockBroadcaster) RegisterConnection(sub Subscription, conn WebsocketConnection) error {
+	args := m.Called(sub, conn)
+	return args.Error(0)
 }
 
-// Broadcast sends the bytes of messageType to all websockets.
-// Returns and error if a single send fails
-func (m *MockBroadcaster) Broadcast(ctx context.Context, messageType MessageType, msg []byte) error {
-	args := m.Called(ctx, messageType, msg)
+// Ack acknowledges the message with seq written to a connection
+func (m *MockBroadcaster) Ack(conn WebsocketConnection, seq uint64) error {
+	args := m.Called(conn, seq)
 	return args.Error(0)
 }
 
+// UnregisterConnection removes a connection from every topic it is subscribed to
+func (m *MockBroadcaster) UnregisterConnection(conn WebsocketConnection) {
+	m.Called(conn)
+}
+
+// Broadcast sends the message to all websockets subscribed to its topic.
+// Returns the outcome of the send for each subscriber or an error if the message could not be stored
+func (m *MockBroadcaster) Broadcast(ctx context.Context, msg *Message) (*BroadcastResult, error) {
+	args := m.Called(ctx, msg)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	return args.Get(0).(*BroadcastResult), args.Error(1)
+}
+
 // CloseConnections closes all registered connections
 func (m *MockBroadcaster) CloseConnections() {
 	m.Called()
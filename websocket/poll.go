@@ -0,0 +1,128 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// errPollNextWriter is returned by PollConn.NextWriter as messages are written with WriteMessage
+var errPollNextWriter = errors.New("long poll connections only support WriteMessage")
+
+var (
+	_ (WebsocketConnection) = (*PollConn)(nil)
+	_ (MessageWriter)       = (*PollConn)(nil)
+)
+
+// PollConn holds the messages for a long polling client between its polls.
+// Messages stay pending until a later poll acknowledges them by passing a sequence number at or beyond theirs,
+// so a poll response lost on the way to the client is sent again by the next poll.
+// Once more than maxPending messages are waiting the oldest is dropped.
+type PollConn struct {
+	id         string
+	maxPending int
+
+	mu      sync.Mutex
+	pending []*Message
+
+	// notify is signalled when a message is written
+	notify chan struct{}
+
+	doneChan  chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPollConn creates a PollConn that keeps up to maxPending messages between polls
+func NewPollConn(maxPending int) *PollConn {
+	return &PollConn{
+		id:         newConnectionID(),
+		maxPending: maxPending,
+		notify:     make(chan struct{}, 1),
+		doneChan:   make(chan struct{}),
+	}
+}
+
+// WriteMessage adds msg to the pending messages. The format is decided when the messages are polled.
+func (pc *PollConn) WriteMessage(msg *Message, _ Format) error {
+	pc.mu.Lock()
+	pc.pending = append(pc.pending, msg)
+	if len(pc.pending) > pc.maxPending {
+		pc.pending[0] = nil
+		pc.pending = pc.pending[1:]
+	}
+	pc.mu.Unlock()
+
+	select {
+	case pc.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Poll drops the pending messages with a sequence number up to after then waits for messages to be pending.
+// Returns at most max messages, oldest first, without removing them. Returns no messages if ctx ends or
+// the connection is closed before any arrive.
+func (pc *PollConn) Poll(ctx context.Context, after uint64, max int) []*Message {
+	for {
+		if msgs := pc.take(after, max); len(msgs) > 0 {
+			return msgs
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-pc.doneChan:
+			return nil
+		case <-pc.notify:
+		}
+	}
+}
+
+// take drops the acknowledged messages and returns up to max of those left
+func (pc *PollConn) take(after uint64, max int) []*Message {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	acked := 0
+	for acked < len(pc.pending) && pc.pending[acked].Seq <= after {
+		pc.pending[acked] = nil
+		acked++
+	}
+	pc.pending = pc.pending[acked:]
+
+	if len(pc.pending) < max {
+		max = len(pc.pending)
+	}
+
+	return append([]*Message{}, pc.pending[:max]...)
+}
+
+// ID returns an identifier unique to this connection
+func (pc *PollConn) ID() string {
+	return pc.id
+}
+
+// NextWriter is not supported, messages are written with WriteMessage
+func (pc *PollConn) NextWriter(MessageType) (io.WriteCloser, error) {
+	return nil, errPollNextWriter
+}
+
+// Done returns a channel that is closed once the connection is closed
+func (pc *PollConn) Done() <-chan struct{} {
+	return pc.doneChan
+}
+
+// Incoming returns nil as polls only carry messages from the server to the client
+func (pc *PollConn) Incoming() <-chan []byte {
+	return nil
+}
+
+// Close ends any poll in progress, pending messages are discarded
+func (pc *PollConn) Close() error {
+	pc.closeOnce.Do(func() {
+		close(pc.doneChan)
+	})
+	return nil
+}
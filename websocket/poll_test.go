@@ -0,0 +1,97 @@
+package websocket
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func pollSeqs(msgs []*Message) []uint64 {
+	seqs := make([]uint64, 0, len(msgs))
+	for _, msg := range msgs {
+		seqs = append(seqs, msg.Seq)
+	}
+	return seqs
+}
+
+func Test_PollConn(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			desc: "Pending messages are kept until acknowledged",
+			testFunc: func(t *testing.T) {
+				conn := NewPollConn(10)
+				for seq := uint64(1); seq <= 3; seq++ {
+					assert.NoError(t, conn.WriteMessage(&Message{Seq: seq}, FormatEnvelope))
+				}
+
+				assert.Equal(t, []uint64{1, 2}, pollSeqs(conn.Poll(context.Background(), 0, 2)))
+
+				// A lost response is sent again by polling the same cursor
+				assert.Equal(t, []uint64{1, 2}, pollSeqs(conn.Poll(context.Background(), 0, 2)))
+
+				assert.Equal(t, []uint64{3}, pollSeqs(conn.Poll(context.Background(), 2, 2)))
+			},
+		},
+		{
+			desc: "Oldest message is dropped beyond max pending",
+			testFunc: func(t *testing.T) {
+				conn := NewPollConn(2)
+				for seq := uint64(1); seq <= 3; seq++ {
+					assert.NoError(t, conn.WriteMessage(&Message{Seq: seq}, FormatEnvelope))
+				}
+
+				assert.Equal(t, []uint64{2, 3}, pollSeqs(conn.Poll(context.Background(), 0, 10)))
+			},
+		},
+		{
+			desc: "Waits for a message",
+			testFunc: func(t *testing.T) {
+				conn := NewPollConn(10)
+
+				go func() {
+					time.Sleep(20 * time.Millisecond)
+					conn.WriteMessage(&Message{Seq: 7}, FormatEnvelope)
+				}()
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+
+				assert.Equal(t, []uint64{7}, pollSeqs(conn.Poll(ctx, 0, 10)))
+			},
+		},
+		{
+			desc: "Times out",
+			testFunc: func(t *testing.T) {
+				conn := NewPollConn(10)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+				defer cancel()
+
+				assert.Empty(t, conn.Poll(ctx, 0, 10))
+			},
+		},
+		{
+			desc: "Close ends a poll",
+			testFunc: func(t *testing.T) {
+				conn := NewPollConn(10)
+
+				go func() {
+					time.Sleep(20 * time.Millisecond)
+					conn.Close()
+				}()
+
+				assert.Empty(t, conn.Poll(context.Background(), 0, 10))
+				assert.NoError(t, conn.Close())
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, tc.testFunc)
+	}
+}
@@ -0,0 +1,524 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy decides what happens when a message is broadcast to a subscriber whose send queue is full
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest queued message to make room for the new one
+	DropOldest OverflowPolicy = iota
+
+	// DropNewest discards the new message, leaving the queue untouched
+	DropNewest
+
+	// Disconnect closes and unregisters the slow subscriber
+	Disconnect
+
+	// Block waits for room in the queue up to QueueConfig.BlockTimeout before discarding the new message
+	Block
+)
+
+// String returns the name of the policy
+func (op OverflowPolicy) String() string {
+	switch op {
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case Disconnect:
+		return "disconnect"
+	case Block:
+		return "block"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(op))
+}
+
+// ParseOverflowPolicy parses the name of an OverflowPolicy
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	for _, policy := range []OverflowPolicy{DropOldest, DropNewest, Disconnect, Block} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return DropOldest, fmt.Errorf("unknown overflow policy %q", name)
+}
+
+// ErrSlowConsumer is recorded for subscribers disconnected by the Disconnect overflow policy
+var ErrSlowConsumer = errors.New("subscriber send queue is full")
+
+// QueueConfig configures the outbound queue of each subscriber
+type QueueConfig struct {
+	// Size is the number of messages that can be queued for a subscriber
+	Size int
+
+	// Policy is applied when a subscriber's queue is full
+	Policy OverflowPolicy
+
+	// BlockTimeout is how long the Block policy waits for room in the queue
+	BlockTimeout time.Duration
+}
+
+// DefaultQueueConfig returns the QueueConfig used when none is specified
+func DefaultQueueConfig() QueueConfig {
+	return QueueConfig{
+		Size:   64,
+		Policy: DropOldest,
+	}
+}
+
+// Validate checks the QueueConfig is usable
+func (qc QueueConfig) Validate() error {
+	if qc.Size <= 0 {
+		return errors.New("queue size must be greater than 0")
+	}
+
+	switch qc.Policy {
+	case DropOldest, DropNewest, Disconnect:
+	case Block:
+		if qc.BlockTimeout <= 0 {
+			return errors.New("block timeout must be greater than 0 for the block overflow policy")
+		}
+	default:
+		return fmt.Errorf("unknown overflow policy %s", qc.Policy)
+	}
+
+	return nil
+}
+
+// enqueueOutcome is the result of offering a message to a subscriberQueue
+type enqueueOutcome int
+
+const (
+	// enqueued means the message is queued for delivery
+	enqueued enqueueOutcome = iota
+
+	// dropped means the message was discarded by the overflow policy
+	dropped
+
+	// overflowed means the queue is full and the subscriber should be disconnected
+	overflowed
+)
+
+// queueCallbacks are called from the writer goroutine of a subscriberQueue
+type queueCallbacks struct {
+	// onWriteError is called if a write to the connection fails
+	onWriteError func(WebsocketConnection, error)
+
+	// onCommit is called with the seq every message written up to is settled, it may be nil.
+	// A message is settled once written, or for a subscriber that acks once acked or dead lettered.
+	onCommit func(uint64)
+
+	// onDeadLetter is called with a message that was not acked within its delivery attempts, it may be nil
+	onDeadLetter func(WebsocketConnection, *Message)
+
+	// onRelease is called when the writer of a subscriber that acks stops, with the messages it was sent
+	// or had queued but never acked. It may be nil.
+	onRelease func(WebsocketConnection, []*Message)
+}
+
+// subscriberQueue buffers messages for a single connection and writes them from its own goroutine
+// so a slow connection only ever delays its own messages.
+type subscriberQueue struct {
+	conn     WebsocketConnection
+	format   Format
+	group    string
+	config   QueueConfig
+	messages chan *Message
+
+	// backlog holds replayed messages which are written before any live message.
+	// Replays page messages into it, waiting on backlogRoom while it holds the queue size.
+	// Live messages are held in messages under the overflow policy while replays is above zero.
+	backlogMu    sync.Mutex
+	backlog      []*Message
+	replays      int
+	backlogReady chan struct{}
+	backlogRoom  chan struct{}
+
+	// writing is 1 while a message is being written to the connection
+	writing int32
+
+	// acks tracks written messages awaiting an ack, nil if the subscriber doesn't ack
+	acks *ackTracker
+
+	callbacks queueCallbacks
+
+	// Broadcasts take a ticket while holding the publish lock and queue their message when serving reaches it,
+	// so messages are queued in sequence order even though broadcasts queue them concurrently
+	turnMu  sync.Mutex
+	turn    *sync.Cond
+	tickets uint64
+	serving uint64
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// newSubscriberQueue creates a queue for conn that encodes messages in format and starts its writer.
+// A queue that is a member of a consumer group has the group's name, otherwise group is empty.
+// If acks is not nil written messages are redelivered until they are acked.
+func newSubscriberQueue(conn WebsocketConnection, format Format, group string, config QueueConfig, acks *ackTracker, callbacks queueCallbacks) *subscriberQueue {
+	sq := &subscriberQueue{
+		conn:         conn,
+		format:       format,
+		group:        group,
+		config:       config,
+		messages:     make(chan *Message, config.Size),
+		backlogReady: make(chan struct{}, 1),
+		backlogRoom:  make(chan struct{}, 1),
+		acks:         acks,
+		callbacks:    callbacks,
+		stopChan:     make(chan struct{}),
+	}
+	sq.turn = sync.NewCond(&sq.turnMu)
+
+	go sq.writeLoop()
+
+	return sq
+}
+
+// writeLoop writes queued messages to the connection until the queue is stopped or the connection is done.
+// Replayed messages in the backlog always go out before live messages.
+func (sq *subscriberQueue) writeLoop() {
+	// Only subscribers that ack have messages to redeliver
+	var redeliverChan <-chan time.Time
+	if sq.acks != nil {
+		ticker := time.NewTicker(sq.acks.config.checkInterval())
+		defer ticker.Stop()
+		redeliverChan = ticker.C
+	}
+
+	// A message that failed to be written is released along with the unacked ones
+	var failed *Message
+	defer func() {
+		sq.release(failed)
+	}()
+
+	for {
+		msg, ok, replaying := sq.nextBacklog()
+		if !ok {
+			// Live messages wait for replays to finish
+			live := sq.messages
+			if replaying {
+				live = nil
+			}
+
+			select {
+			case <-sq.stopChan:
+				return
+			case <-sq.conn.Done():
+				return
+			case <-sq.backlogReady:
+				continue
+			case now := <-redeliverChan:
+				if err := sq.redeliver(now); err != nil {
+					return
+				}
+				continue
+			case msg = <-live:
+			}
+		}
+
+		if err := sq.write(msg); err != nil {
+			failed = msg
+			return
+		}
+	}
+}
+
+// write writes a single message to the connection, tracking it for an ack if the subscriber acks.
+// The queue's onWriteError callback has been called if an error is returned.
+func (sq *subscriberQueue) write(msg *Message) error {
+	atomic.StoreInt32(&sq.writing, 1)
+	defer atomic.StoreInt32(&sq.writing, 0)
+
+	delivery := msg
+	if sq.acks != nil {
+		// The message is shared with other subscribers so the attempt goes on a copy
+		attempt := *msg
+		attempt.Attempt = sq.acks.attempt(msg)
+		delivery = &attempt
+	}
+
+	var err error
+	if writer, ok := sq.conn.(MessageWriter); ok {
+		err = writer.WriteMessage(delivery, sq.format)
+	} else {
+		err = writeMessage(sq.conn, delivery.FrameType(sq.format), delivery.Encode(sq.format))
+	}
+
+	if err != nil {
+		log.Println("Error while writing to subscriber", sq.conn.ID(), err)
+		sq.callbacks.onWriteError(sq.conn, err)
+		return err
+	}
+
+	// Messages that are acked are committed as they are acked
+	if sq.acks != nil {
+		sq.acks.sent(msg, time.Now())
+	} else if sq.callbacks.onCommit != nil {
+		sq.callbacks.onCommit(msg.Seq)
+	}
+
+	return nil
+}
+
+// redeliver writes the messages whose visibility timeout has passed again
+// and hands those out of attempts to the dead letter callback.
+func (sq *subscriberQueue) redeliver(now time.Time) error {
+	redeliver, dead := sq.acks.expired(now)
+
+	for _, msg := range dead {
+		log.Println("Message", msg.Seq, "was not acked by subscriber", sq.conn.ID(), "after", sq.acks.config.MaxAttempts, "attempts")
+		if sq.callbacks.onDeadLetter != nil {
+			sq.callbacks.onDeadLetter(sq.conn, msg)
+		}
+	}
+
+	if len(dead) > 0 {
+		sq.commit()
+	}
+
+	for _, msg := range redeliver {
+		if err := sq.write(msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ack acknowledges the message with seq, returns ErrNotInFlight if it isn't awaiting an ack
+func (sq *subscriberQueue) ack(seq uint64) error {
+	if sq.acks == nil {
+		return errors.New("subscriber does not ack messages")
+	}
+
+	if err := sq.acks.ack(seq); err != nil {
+		return err
+	}
+
+	sq.commit()
+	return nil
+}
+
+// commit passes the seq every written message up to is acked or dead lettered to the commit callback when it moves
+func (sq *subscriberQueue) commit() {
+	if sq.callbacks.onCommit == nil {
+		return
+	}
+
+	if seq, ok := sq.acks.commit(); ok {
+		sq.callbacks.onCommit(seq)
+	}
+}
+
+// release hands the messages of a subscriber that acks which were never acked to the release callback, oldest first.
+// That's those in flight, failed, waiting to be replayed and still queued.
+func (sq *subscriberQueue) release(failed *Message) {
+	if sq.acks == nil || sq.callbacks.onRelease == nil {
+		return
+	}
+
+	msgs := sq.acks.drain()
+	if failed != nil {
+		msgs = append(msgs, failed)
+	}
+
+	sq.backlogMu.Lock()
+	msgs = append(msgs, sq.backlog...)
+	sq.backlog = nil
+	sq.backlogMu.Unlock()
+
+	for queued := true; queued; {
+		select {
+		case msg := <-sq.messages:
+			msgs = append(msgs, msg)
+		default:
+			queued = false
+		}
+	}
+
+	if len(msgs) == 0 {
+		return
+	}
+
+	sortBySeq(msgs)
+	sq.callbacks.onRelease(sq.conn, msgs)
+}
+
+// startReplay holds back live messages until the matching endReplay so replayed messages are written first
+func (sq *subscriberQueue) startReplay() {
+	sq.backlogMu.Lock()
+	sq.replays++
+	sq.backlogMu.Unlock()
+}
+
+// endReplay lets live messages through once no replay is left
+func (sq *subscriberQueue) endReplay() {
+	sq.backlogMu.Lock()
+	sq.replays--
+	sq.backlogMu.Unlock()
+
+	sq.wake()
+}
+
+// replay adds msg to the backlog to be written ahead of live messages, waiting while the backlog is full.
+// Returns false if the queue stopped first.
+func (sq *subscriberQueue) replay(msg *Message) bool {
+	for {
+		select {
+		case <-sq.stopChan:
+			return false
+		case <-sq.conn.Done():
+			return false
+		default:
+		}
+
+		sq.backlogMu.Lock()
+		if len(sq.backlog) < sq.config.Size {
+			sq.backlog = append(sq.backlog, msg)
+			sq.backlogMu.Unlock()
+			sq.wake()
+			return true
+		}
+		sq.backlogMu.Unlock()
+
+		select {
+		case <-sq.backlogRoom:
+		case <-sq.stopChan:
+			return false
+		case <-sq.conn.Done():
+			return false
+		}
+	}
+}
+
+// wake wakes the writer if it is waiting on live messages
+func (sq *subscriberQueue) wake() {
+	select {
+	case sq.backlogReady <- struct{}{}:
+	default:
+	}
+}
+
+// nextBacklog pops the oldest replayed message if there is one.
+// Also returns whether a replay is still running.
+func (sq *subscriberQueue) nextBacklog() (*Message, bool, bool) {
+	sq.backlogMu.Lock()
+	defer sq.backlogMu.Unlock()
+
+	if len(sq.backlog) == 0 {
+		return nil, false, sq.replays > 0
+	}
+
+	msg := sq.backlog[0]
+	sq.backlog[0] = nil
+	sq.backlog = sq.backlog[1:]
+
+	// Let a replay waiting on a full backlog carry on
+	select {
+	case sq.backlogRoom <- struct{}{}:
+	default:
+	}
+
+	return msg, true, sq.replays > 0
+}
+
+// enqueue offers a message to the queue applying the overflow policy if it is full
+func (sq *subscriberQueue) enqueue(msg *Message, done <-chan struct{}) enqueueOutcome {
+	// Fast path when there is room in the queue
+	select {
+	case sq.messages <- msg:
+		return enqueued
+	default:
+	}
+
+	switch sq.config.Policy {
+	case DropNewest:
+		return dropped
+	case Disconnect:
+		return overflowed
+	case Block:
+		timer := time.NewTimer(sq.config.BlockTimeout)
+		defer timer.Stop()
+
+		select {
+		case sq.messages <- msg:
+			return enqueued
+		case <-timer.C:
+			return dropped
+		case <-done:
+			return dropped
+		case <-sq.stopChan:
+			return dropped
+		}
+	default:
+		// DropOldest, keep making room until the message fits as other broadcasts may be filling the queue too
+		for {
+			select {
+			case sq.messages <- msg:
+				return enqueued
+			default:
+			}
+
+			select {
+			case <-sq.messages:
+			default:
+			}
+		}
+	}
+}
+
+// ticket takes the next turn to queue a message. The caller must pass it to inTurn exactly once.
+func (sq *subscriberQueue) ticket() uint64 {
+	sq.turnMu.Lock()
+	defer sq.turnMu.Unlock()
+
+	ticket := sq.tickets
+	sq.tickets++
+	return ticket
+}
+
+// inTurn waits until every earlier ticket has had its turn then calls fn
+func (sq *subscriberQueue) inTurn(ticket uint64, fn func()) {
+	sq.turnMu.Lock()
+	for sq.serving != ticket {
+		sq.turn.Wait()
+	}
+	sq.turnMu.Unlock()
+
+	fn()
+
+	sq.turnMu.Lock()
+	sq.serving++
+	sq.turn.Broadcast()
+	sq.turnMu.Unlock()
+}
+
+// outstanding returns the number of messages queued, being written, waiting to be replayed or awaiting an ack
+func (sq *subscriberQueue) outstanding() int {
+	sq.backlogMu.Lock()
+	outstanding := len(sq.messages) + len(sq.backlog) + int(atomic.LoadInt32(&sq.writing))
+	sq.backlogMu.Unlock()
+
+	if sq.acks != nil {
+		outstanding += sq.acks.pending()
+	}
+
+	return outstanding
+}
+
+// stop stops the writer goroutine. Queued messages are discarded, unless the subscriber acks when they are released.
+func (sq *subscriberQueue) stop() {
+	sq.stopOnce.Do(func() {
+		close(sq.stopChan)
+	})
+}
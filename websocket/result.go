@@ -0,0 +1,57 @@
+package websocket
+
+import (
+	"sync"
+)
+
+// BroadcastResult reports the outcome of a broadcast for each subscriber
+type BroadcastResult struct {
+	mu sync.Mutex
+
+	// Delivered is the number of subscribers the message was queued for.
+	// Writes happen asynchronously and a subscriber whose write fails is disconnected.
+	Delivered int
+
+	// Failed is the number of subscribers the message could not be delivered to
+	Failed int
+
+	// Skipped is the number of subscribers that did not get the message without failing.
+	// This happens when the connection was already closed, the broadcast was cancelled or
+	// the overflow policy dropped the message.
+	Skipped int
+
+	// Errors maps the ID of each failed connection to the reason it failed
+	Errors map[string]error
+}
+
+// NewBroadcastResult creates an empty BroadcastResult
+func NewBroadcastResult() *BroadcastResult {
+	return &BroadcastResult{
+		Errors: make(map[string]error),
+	}
+}
+
+// recordDelivered records a successful delivery
+func (br *BroadcastResult) recordDelivered() {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	br.Delivered++
+}
+
+// recordFailed records a failed delivery to the connection with id
+func (br *BroadcastResult) recordFailed(id string, err error) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	br.Failed++
+	br.Errors[id] = err
+}
+
+// recordSkipped records a subscriber that was not attempted
+func (br *BroadcastResult) recordSkipped() {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	br.Skipped++
+}
@@ -0,0 +1,182 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cpheps/coder-pub-sub/storage"
+)
+
+// Replay selects retained messages to deliver to a new subscriber before live delivery starts
+type Replay struct {
+	// Since replays messages with a sequence number greater than Since
+	Since uint64
+
+	// Last limits the replay to the most recent Last matching messages. Zero means no limit.
+	Last int
+
+	// AfterID replays messages published after the message with this ID, such as an SSE Last-Event-ID.
+	// If the message is no longer retained every retained message after Since is replayed.
+	AfterID string
+}
+
+// storedMessage is how a Message is encoded in a storage.Store.
+// The sequence number and topic are kept by the store itself.
+type storedMessage struct {
+	ID          string            `json:"id"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Type        MessageType       `json:"type"`
+	ContentType string            `json:"contentType"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Data        []byte            `json:"data"`
+}
+
+// encodeStored encodes msg for appending to a storage.Store
+func encodeStored(msg *Message) ([]byte, error) {
+	data, err := json.Marshal(storedMessage{
+		ID:          msg.ID,
+		Timestamp:   msg.Timestamp,
+		Type:        msg.Type,
+		ContentType: msg.ContentType,
+		Headers:     msg.Headers,
+		Data:        msg.Data,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode message for storage: %w", err)
+	}
+
+	return data, nil
+}
+
+// decodeStored rebuilds the Message held in record
+func decodeStored(record storage.Record) (*Message, error) {
+	var stored storedMessage
+	if err := json.Unmarshal(record.Data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to decode stored message %d: %w", record.Seq, err)
+	}
+
+	return &Message{
+		ID:          stored.ID,
+		Seq:         record.Seq,
+		Timestamp:   stored.Timestamp,
+		Topic:       record.Topic,
+		Type:        stored.Type,
+		ContentType: stored.ContentType,
+		Headers:     stored.Headers,
+		Data:        stored.Data,
+	}, nil
+}
+
+// seqOfID returns the sequence number of the retained message with id
+func seqOfID(store storage.Store, since uint64, id string) (uint64, bool, error) {
+	var seq uint64
+	var found bool
+	err := store.Read(since, func(record storage.Record) bool {
+		msg, err := decodeStored(record)
+		if err == nil && msg.ID == id {
+			seq, found = msg.Seq, true
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read retained messages: %w", err)
+	}
+
+	return seq, found, nil
+}
+
+// matchAny returns true if topic matches any of patterns
+func matchAny(patterns []string, topic string) bool {
+	for _, pattern := range patterns {
+		if MatchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// replayMessages calls fn with the messages selected by replay whose topic matches any of patterns and whose sequence number
+// is at most until, oldest first. Messages are read from store a page of at most pageSize at a time and fn is only called
+// between reads so it may block without holding up appends to the store. The replay stops early if fn returns false.
+// Messages that fail to decode are logged and skipped so one bad record doesn't block a replay.
+func replayMessages(store storage.Store, patterns []string, replay Replay, until uint64, pageSize int, fn func(*Message) bool) error {
+	if replay.AfterID != "" {
+		seq, found, err := seqOfID(store, replay.Since, replay.AfterID)
+		if err != nil {
+			return err
+		}
+
+		if found {
+			replay.Since = seq
+		} else {
+			log.Println("Message", replay.AfterID, "is no longer retained, replaying every retained message")
+		}
+	}
+
+	// Only the most recent Last messages are replayed so count the matches to know how many to skip
+	skip := 0
+	if replay.Last > 0 {
+		matched := 0
+		err := store.Read(replay.Since, func(record storage.Record) bool {
+			if record.Seq > until {
+				return false
+			}
+
+			if matchAny(patterns, record.Topic) {
+				matched++
+			}
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read retained messages: %w", err)
+		}
+
+		skip = matched - replay.Last
+	}
+
+	since := replay.Since
+	for {
+		page := make([]*Message, 0, pageSize)
+		err := store.Read(since, func(record storage.Record) bool {
+			if record.Seq > until {
+				return false
+			}
+			since = record.Seq
+
+			if !matchAny(patterns, record.Topic) {
+				return true
+			}
+
+			if skip > 0 {
+				skip--
+				return true
+			}
+
+			msg, err := decodeStored(record)
+			if err != nil {
+				log.Println("Skipping message during replay", err)
+				return true
+			}
+
+			page = append(page, msg)
+			return len(page) < pageSize
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read retained messages: %w", err)
+		}
+
+		for _, msg := range page {
+			if !fn(msg) {
+				return nil
+			}
+		}
+
+		// A page that isn't full means there was nothing left to read
+		if len(page) < pageSize {
+			return nil
+		}
+	}
+}
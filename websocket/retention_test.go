@@ -0,0 +1,375 @@
+package websocket
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cpheps/coder-pub-sub/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// storeTopics appends a message for each topic to store
+func storeTopics(t *testing.T, store storage.Store, topics ...string) {
+	t.Helper()
+	for _, topic := range topics {
+		data, err := encodeStored(&Message{Topic: topic, Type: TextMessage, Data: []byte(topic)})
+		require.NoError(t, err)
+
+		_, err = store.Append(topic, data)
+		require.NoError(t, err)
+	}
+}
+
+func Test_replayMessages(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		config   storage.MemoryConfig
+		topics   []string
+		pattern  string
+		replay   Replay
+		expected []uint64
+	}{
+		{
+			desc:     "Replay everything",
+			config:   storage.MemoryConfig{MaxMessages: 10},
+			topics:   []string{"orders", "orders", "orders"},
+			pattern:  "orders",
+			expected: []uint64{1, 2, 3},
+		},
+		{
+			desc:     "Replay since",
+			config:   storage.MemoryConfig{MaxMessages: 10},
+			topics:   []string{"orders", "orders", "orders"},
+			pattern:  "orders",
+			replay:   Replay{Since: 1},
+			expected: []uint64{2, 3},
+		},
+		{
+			desc:     "Replay last",
+			config:   storage.MemoryConfig{MaxMessages: 10},
+			topics:   []string{"orders", "orders", "orders"},
+			pattern:  "orders",
+			replay:   Replay{Last: 2},
+			expected: []uint64{2, 3},
+		},
+		{
+			desc:     "Only matching topics",
+			config:   storage.MemoryConfig{MaxMessages: 10},
+			topics:   []string{"orders.created", "billing.created", "orders.deleted"},
+			pattern:  "orders.*",
+			expected: []uint64{1, 3},
+		},
+		{
+			desc:     "Last counts matching topics only",
+			config:   storage.MemoryConfig{MaxMessages: 10},
+			topics:   []string{"orders", "orders", "billing", "billing"},
+			pattern:  "orders",
+			replay:   Replay{Last: 1},
+			expected: []uint64{2},
+		},
+		{
+			desc:     "Across pages",
+			config:   storage.MemoryConfig{MaxMessages: 10},
+			topics:   []string{"orders", "billing", "orders", "orders", "orders", "billing", "orders"},
+			pattern:  "orders",
+			expected: []uint64{1, 3, 4, 5, 7},
+		},
+		{
+			desc:     "Last across pages",
+			config:   storage.MemoryConfig{MaxMessages: 10},
+			topics:   []string{"orders", "billing", "orders", "orders", "orders", "billing", "orders"},
+			pattern:  "orders",
+			replay:   Replay{Last: 3},
+			expected: []uint64{4, 5, 7},
+		},
+		{
+			desc:     "Retention disabled",
+			config:   storage.MemoryConfig{},
+			topics:   []string{"orders", "orders"},
+			pattern:  "orders",
+			expected: []uint64{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			store, err := storage.NewMemoryStore(tc.config)
+			require.NoError(t, err)
+			storeTopics(t, store, tc.topics...)
+
+			// A small page checks the replay carries on across pages
+			actual := make([]uint64, 0)
+			err = replayMessages(store, []string{tc.pattern}, tc.replay, math.MaxUint64, 2, func(msg *Message) bool {
+				actual = append(actual, msg.Seq)
+				return true
+			})
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func Test_replayMessages_AfterID(t *testing.T) {
+	store := newMemoryStore(t)
+	for _, id := range []string{"a", "b", "c"} {
+		data, err := encodeStored(&Message{ID: id, Topic: "orders", Type: TextMessage})
+		require.NoError(t, err)
+
+		_, err = store.Append("orders", data)
+		require.NoError(t, err)
+	}
+
+	testCases := []struct {
+		desc     string
+		replay   Replay
+		expected []string
+	}{
+		{
+			desc:     "After a retained message",
+			replay:   Replay{AfterID: "a"},
+			expected: []string{"b", "c"},
+		},
+		{
+			desc:     "After the newest message",
+			replay:   Replay{AfterID: "c"},
+			expected: []string{},
+		},
+		{
+			desc:     "Message no longer retained",
+			replay:   Replay{AfterID: "gone"},
+			expected: []string{"a", "b", "c"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			actual := make([]string, 0)
+			err := replayMessages(store, []string{"orders"}, tc.replay, math.MaxUint64, 2, func(msg *Message) bool {
+				actual = append(actual, msg.ID)
+				return true
+			})
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func Test_decodeStored(t *testing.T) {
+	msg := &Message{
+		ID:          "abc",
+		Timestamp:   time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC),
+		Topic:       "orders",
+		Type:        BinaryMessage,
+		ContentType: "application/octet-stream",
+		Headers:     map[string]string{"Trace": "1"},
+		Data:        []byte{0x0, 0xff},
+	}
+
+	data, err := encodeStored(msg)
+	require.NoError(t, err)
+
+	actual, err := decodeStored(storage.Record{Seq: 9, Topic: "orders", Data: data})
+	require.NoError(t, err)
+
+	expected := *msg
+	expected.Seq = 9
+	assert.Equal(t, &expected, actual)
+}
+
+// seqConn is a WebsocketConnection that records the sequence numbers of the envelopes written to it
+type seqConn struct {
+	*discardConn
+	mu   sync.Mutex
+	seqs []uint64
+}
+
+func (sc *seqConn) NextWriter(MessageType) (io.WriteCloser, error) {
+	return &seqWriter{conn: sc}, nil
+}
+
+func (sc *seqConn) received() []uint64 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return append([]uint64{}, sc.seqs...)
+}
+
+type seqWriter struct {
+	conn *seqConn
+	buf  []byte
+}
+
+func (sw *seqWriter) Write(p []byte) (int, error) {
+	sw.buf = append(sw.buf, p...)
+	return len(p), nil
+}
+
+func (sw *seqWriter) Close() error {
+	var seq uint64
+	if _, err := fmt.Sscanf(string(sw.buf), "%d", &seq); err != nil {
+		return err
+	}
+
+	sw.conn.mu.Lock()
+	sw.conn.seqs = append(sw.conn.seqs, seq)
+	sw.conn.mu.Unlock()
+	return nil
+}
+
+// Test_CacheBroadcaster_ReplayHandover subscribes with a replay while messages are being published
+// and checks the subscriber sees every message exactly once in order.
+func Test_CacheBroadcaster_ReplayHandover(t *testing.T) {
+	const published = 500
+
+	store, err := storage.NewMemoryStore(storage.MemoryConfig{MaxMessages: published})
+	require.NoError(t, err)
+
+	broadcaster, err := NewCacheBroadcaster(1, QueueConfig{Size: published, Policy: DropNewest}, store, RoundRobin)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	// A single publisher so sequence order is delivery order. Each payload is its own sequence number.
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= published; i++ {
+			broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte(fmt.Sprint(i))})
+		}
+	}()
+
+	// Subscribe part way through publishing
+	time.Sleep(time.Millisecond)
+	conn := &seqConn{discardConn: newDiscardConn("replay")}
+	assert.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders", Replay: &Replay{}}, conn))
+
+	wg.Wait()
+
+	require.Eventually(t, func() bool {
+		return len(conn.received()) >= published
+	}, time.Second, time.Millisecond)
+
+	received := conn.received()
+	require.Len(t, received, published)
+	for i, seq := range received {
+		assert.Equal(t, uint64(i+1), seq)
+	}
+}
+
+// gatedConn is an envelopeConn whose writes wait until gate is closed
+type gatedConn struct {
+	*envelopeConn
+	gate chan struct{}
+}
+
+func (gc *gatedConn) NextWriter(messageType MessageType) (io.WriteCloser, error) {
+	<-gc.gate
+	return gc.envelopeConn.NextWriter(messageType)
+}
+
+// Test_CacheBroadcaster_PagedReplay replays more messages than fit in the subscriber's queue to a subscriber that
+// isn't being written to and checks publishing carries on meanwhile and the replay is delivered in full ahead of live messages
+func Test_CacheBroadcaster_PagedReplay(t *testing.T) {
+	const retained = 100
+
+	broadcaster, err := NewCacheBroadcaster(1, QueueConfig{Size: 4, Policy: DropNewest}, newMemoryStore(t), RoundRobin)
+	require.NoError(t, err)
+
+	for i := 0; i < retained; i++ {
+		broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte("retained")})
+	}
+
+	conn := &gatedConn{envelopeConn: newEnvelopeConn("replay"), gate: make(chan struct{})}
+	registered := make(chan error, 1)
+	go func() {
+		registered <- broadcaster.RegisterConnection(Subscription{Pattern: "orders", Format: FormatEnvelope, Replay: &Replay{}}, conn)
+	}()
+
+	// The replay waits for the queue to make room without holding up publishers
+	require.Eventually(t, func() bool {
+		return len(broadcaster.topics.Subscribers("orders")) == 1
+	}, time.Second, time.Millisecond)
+	for i := 0; i < 2; i++ {
+		result := broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte("live")})
+		assert.Equal(t, 1, result.Delivered)
+	}
+
+	select {
+	case err := <-registered:
+		t.Fatalf("replay finished before the subscriber was written to: %v", err)
+	default:
+	}
+
+	close(conn.gate)
+	require.NoError(t, <-registered)
+
+	require.Eventually(t, func() bool {
+		return len(conn.received()) == retained+2
+	}, time.Second, time.Millisecond)
+
+	for i, seq := range receivedSeqs(conn.envelopeConn) {
+		assert.Equal(t, uint64(i+1), seq)
+	}
+}
+
+// Test_CacheBroadcaster_ConsumerResume checks a named consumer resumes after the last message written to it
+func Test_CacheBroadcaster_ConsumerResume(t *testing.T) {
+	broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
+	require.NoError(t, err)
+
+	first := &seqConn{discardConn: newDiscardConn("first")}
+	require.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders", Consumer: "billing"}, first))
+
+	for i := 1; i <= 2; i++ {
+		broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte(fmt.Sprint(i))})
+	}
+
+	require.Eventually(t, func() bool {
+		seq, ok, err := broadcaster.store.Offset("billing")
+		return err == nil && ok && seq == 2
+	}, time.Second, time.Millisecond)
+	broadcaster.UnregisterConnection(first)
+
+	// Published while the consumer was away
+	for i := 3; i <= 4; i++ {
+		broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte(fmt.Sprint(i))})
+	}
+
+	second := &seqConn{discardConn: newDiscardConn("second")}
+	require.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders", Consumer: "billing"}, second))
+
+	require.Eventually(t, func() bool {
+		return len(second.received()) == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []uint64{3, 4}, second.received())
+}
+
+func Test_CacheBroadcaster_NewConsumerResume(t *testing.T) {
+	broadcaster, err := NewCacheBroadcaster(1, DefaultQueueConfig(), newMemoryStore(t), RoundRobin)
+	require.NoError(t, err)
+
+	// Published before the consumer first registered
+	broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte("1")})
+
+	first := &seqConn{discardConn: newDiscardConn("first")}
+	require.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders", Consumer: "billing"}, first))
+	broadcaster.UnregisterConnection(first)
+
+	// Published while the consumer was away before it was sent anything
+	broadcast(t, broadcaster, &Message{Topic: "orders", Type: TextMessage, Data: []byte("2")})
+
+	second := &seqConn{discardConn: newDiscardConn("second")}
+	require.NoError(t, broadcaster.RegisterConnection(Subscription{Pattern: "orders", Consumer: "billing"}, second))
+
+	require.Eventually(t, func() bool {
+		return len(second.received()) == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []uint64{2}, second.received())
+	assert.Empty(t, first.received())
+}
@@ -0,0 +1,252 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errSSENextWriter is returned by SSEConn.NextWriter as events are written with WriteMessage
+var errSSENextWriter = errors.New("server-sent events connections only support WriteMessage")
+
+// errSSEClosed is returned when writing to an SSEConn that has been closed
+var errSSEClosed = errors.New("server-sent events connection is closed")
+
+// netConnKey is the context key of the connection a request was received on
+type netConnKey struct{}
+
+// ConnContext adds conn to the context of the requests received on it so an SSEConn can bound its writes.
+// It is meant to be used as the ConnContext of an http.Server.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, netConnKey{}, conn)
+}
+
+var (
+	_ (WebsocketConnection) = (*SSEConn)(nil)
+	_ (MessageWriter)       = (*SSEConn)(nil)
+)
+
+// SSEConn delivers messages to a client as Server-Sent Events over a streamed HTTP response.
+// Each message is sent as a single event whose id is the message ID so an EventSource resumes with Last-Event-ID.
+// Binary payloads are base64 encoded unless the envelope format is used, which does so itself.
+//
+// The connection is tied to the request it was created for. The handler must Close it before returning
+// as the response can't be written to afterwards.
+//
+// Writes to an HTTP/1 request received on a connection added by ConnContext must finish by a write deadline
+// so a client that stops reading can't block the stream, or closing it, forever.
+type SSEConn struct {
+	id      string
+	writer  http.ResponseWriter
+	flusher http.Flusher
+
+	// ctx is the context of the request, canceled once the client goes away
+	ctx context.Context
+
+	// conn is the connection the response is written to, nil if writes can't be bounded
+	conn      net.Conn
+	keepalive KeepaliveConfig
+
+	// writeMu serializes events and comments, closed is set under it so nothing is written after Close
+	writeMu sync.Mutex
+	closed  bool
+
+	doneChan  chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSSEConn starts an event stream on w in response to r.
+// If keepalive is enabled a comment is sent every PingInterval so proxies don't time out an idle stream.
+// Returns an error if w can't be flushed, streaming isn't possible in that case.
+func NewSSEConn(w http.ResponseWriter, r *http.Request, keepalive KeepaliveConfig) (*SSEConn, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("response writer does not support flushing")
+	}
+
+	sc := &SSEConn{
+		id:        newConnectionID(),
+		writer:    w,
+		flusher:   flusher,
+		ctx:       r.Context(),
+		keepalive: keepalive,
+		doneChan:  make(chan struct{}),
+	}
+
+	// An HTTP/2 connection is shared by many requests so a deadline on it would cut off the others
+	if conn, ok := r.Context().Value(netConnKey{}).(net.Conn); ok && r.ProtoMajor == 1 {
+		sc.conn = conn
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// The request context ends once the client goes away
+	go func() {
+		select {
+		case <-r.Context().Done():
+			sc.markDone()
+		case <-sc.doneChan:
+		}
+	}()
+
+	if keepalive.Enabled() {
+		go sc.commentLoop(keepalive.PingInterval)
+	}
+
+	return sc, nil
+}
+
+// commentLoop sends a comment every interval until the connection is done
+func (sc *SSEConn) commentLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sc.doneChan:
+			return
+		case <-ticker.C:
+			if err := sc.write([]byte(": ping\n\n")); err != nil {
+				log.Println("Failed to ping subscriber", sc.id, err)
+				sc.markDone()
+				return
+			}
+		}
+	}
+}
+
+// WriteMessage writes msg as a single event
+func (sc *SSEConn) WriteMessage(msg *Message, format Format) error {
+	data := msg.Encode(format)
+
+	// Event data must be text
+	if msg.FrameType(format) == BinaryMessage {
+		data = []byte(base64.StdEncoding.EncodeToString(data))
+	}
+
+	if err := sc.write(encodeEvent(msg.ID, data)); err != nil {
+		sc.markDone()
+		return err
+	}
+
+	return nil
+}
+
+// write writes and flushes p by the write deadline unless the connection is closed
+func (sc *SSEConn) write(p []byte) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+
+	if sc.conn != nil {
+		if err := sc.conn.SetWriteDeadline(sc.keepalive.writeDeadline()); err != nil {
+			return fmt.Errorf("failed to set write deadline: %w", err)
+		}
+		// The connection may serve another request once this one is done
+		defer sc.conn.SetWriteDeadline(time.Time{})
+	}
+
+	// Checked after the deadline is set so a Close racing this write can always cut it short
+	if sc.closed || sc.isDone() {
+		return errSSEClosed
+	}
+
+	if _, err := sc.writer.Write(p); err != nil {
+		return fmt.Errorf("failed to write event: %w", err)
+	}
+
+	// Flush hides write errors, the server cancels the request context when writing to the connection fails
+	sc.flusher.Flush()
+	if err := sc.ctx.Err(); err != nil {
+		return fmt.Errorf("failed to flush event: %w", err)
+	}
+
+	return nil
+}
+
+// encodeEvent frames data as an event with id. Every line of data gets its own data field.
+func encodeEvent(id string, data []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "id: %s\n", id)
+
+	// Any of CRLF, CR or LF ends a line in an event stream
+	lines := strings.Split(strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(string(data)), "\n")
+	for _, line := range lines {
+		buf.WriteString("data: ")
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// markDone closes the done channel exactly once
+func (sc *SSEConn) markDone() {
+	sc.closeOnce.Do(func() {
+		close(sc.doneChan)
+	})
+}
+
+// isDone returns true once the done channel is closed
+func (sc *SSEConn) isDone() bool {
+	select {
+	case <-sc.doneChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// ID returns an identifier unique to this connection
+func (sc *SSEConn) ID() string {
+	return sc.id
+}
+
+// NextWriter is not supported, events are written with WriteMessage
+func (sc *SSEConn) NextWriter(MessageType) (io.WriteCloser, error) {
+	return nil, errSSENextWriter
+}
+
+// Done returns a channel that is closed once the client goes away or the connection is closed
+func (sc *SSEConn) Done() <-chan struct{} {
+	return sc.doneChan
+}
+
+// Incoming returns nil as an event stream only flows from the server to the client
+func (sc *SSEConn) Incoming() <-chan []byte {
+	return nil
+}
+
+// Close stops any further writes to the response.
+// A write in progress is cut short by moving the write deadline to now rather than waited on to finish.
+func (sc *SSEConn) Close() error {
+	// Mark the connection done before the deadline moves so a write starting after it gives up
+	sc.markDone()
+	if sc.conn != nil {
+		sc.conn.SetWriteDeadline(time.Now())
+	}
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	sc.closed = true
+
+	// Nothing is written from here on, clearing the deadline lets the server end the response cleanly
+	if sc.conn != nil {
+		sc.conn.SetWriteDeadline(time.Time{})
+	}
+
+	return nil
+}
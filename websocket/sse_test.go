@@ -0,0 +1,177 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_encodeEvent(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		data     string
+		expected string
+	}{
+		{
+			desc:     "Single line",
+			data:     "hi",
+			expected: "id: abc\ndata: hi\n\n",
+		},
+		{
+			desc:     "Multiple lines",
+			data:     "one\ntwo\r\nthree\rfour",
+			expected: "id: abc\ndata: one\ndata: two\ndata: three\ndata: four\n\n",
+		},
+		{
+			desc:     "Empty",
+			data:     "",
+			expected: "id: abc\ndata: \n\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, string(encodeEvent("abc", []byte(tc.data))))
+		})
+	}
+}
+
+func Test_SSEConn(t *testing.T) {
+	connChan := make(chan *SSEConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := NewSSEConn(w, r, KeepaliveConfig{})
+		require.NoError(t, err)
+		connChan <- conn
+
+		// Keep the response open until the client goes away
+		<-conn.Done()
+		conn.Close()
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	conn := <-connChan
+
+	require.NoError(t, conn.WriteMessage(&Message{ID: "abc", Type: BinaryMessage, Data: []byte{0xa1, 0x01}}, FormatRaw))
+
+	reader := bufio.NewReader(resp.Body)
+	event := make([]string, 0, 2)
+	for len(event) < 2 {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		event = append(event, strings.TrimSuffix(line, "\n"))
+	}
+	assert.Equal(t, []string{"id: abc", "data: oQE="}, event)
+
+	// The connection is done once the client goes away
+	cancel()
+	select {
+	case <-conn.Done():
+	case <-time.After(time.Second):
+		t.Fatal("connection was not marked done after the client went away")
+	}
+
+	assert.NoError(t, conn.Close())
+	assert.ErrorIs(t, conn.WriteMessage(&Message{ID: "def"}, FormatRaw), errSSEClosed)
+}
+
+func Test_SSEConn_StalledClient(t *testing.T) {
+	// startStalledStream starts an event stream for a client that never reads it
+	startStalledStream := func(t *testing.T, keepalive KeepaliveConfig) *SSEConn {
+		connChan := make(chan *SSEConn, 1)
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := NewSSEConn(w, r, keepalive)
+			require.NoError(t, err)
+			connChan <- conn
+
+			<-conn.Done()
+			conn.Close()
+		}))
+		srv.Config.ConnContext = ConnContext
+		srv.Start()
+		t.Cleanup(srv.Close)
+
+		client, err := net.Dial("tcp", srv.Listener.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { client.Close() })
+
+		_, err = fmt.Fprintf(client, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", srv.Listener.Addr())
+		require.NoError(t, err)
+
+		return <-connChan
+	}
+
+	// writeUntilError writes large events until one fails
+	writeUntilError := func(conn *SSEConn) <-chan error {
+		msg := &Message{ID: "abc", Type: TextMessage, Data: []byte(strings.Repeat("a", 1<<20))}
+		errChan := make(chan error, 1)
+		go func() {
+			for {
+				if err := conn.WriteMessage(msg, FormatRaw); err != nil {
+					errChan <- err
+					return
+				}
+			}
+		}()
+		return errChan
+	}
+
+	t.Run("Write deadline", func(t *testing.T) {
+		// Pings are rare so only the write deadline can fail the write
+		conn := startStalledStream(t, KeepaliveConfig{
+			PingInterval: time.Hour,
+			PongTimeout:  50 * time.Millisecond,
+		})
+
+		select {
+		case err := <-writeUntilError(conn):
+			assert.Error(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("write to a client that stopped reading never timed out")
+		}
+	})
+
+	t.Run("Close cuts a write short", func(t *testing.T) {
+		conn := startStalledStream(t, KeepaliveConfig{
+			PingInterval: time.Hour,
+			PongTimeout:  time.Hour,
+		})
+
+		errChan := writeUntilError(conn)
+
+		// Give the writes time to fill the socket buffers and block
+		time.Sleep(100 * time.Millisecond)
+
+		closed := make(chan struct{})
+		go func() {
+			conn.Close()
+			close(closed)
+		}()
+
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("close waited on a blocked write")
+		}
+		assert.Error(t, <-errChan)
+	})
+}
@@ -0,0 +1,413 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Topic wildcards. Both NATS and MQTT styles are supported and may be used with either separator.
+const (
+	// singleLevelWildcard matches exactly one level in the NATS style, e.g. orders.*
+	singleLevelWildcard = "*"
+
+	// mqttSingleLevelWildcard matches exactly one level in the MQTT style, e.g. sensors/+/temp
+	mqttSingleLevelWildcard = "+"
+
+	// multiLevelWildcard matches one or more trailing levels in the NATS style, e.g. orders.>
+	multiLevelWildcard = ">"
+
+	// mqttMultiLevelWildcard matches zero or more trailing levels in the MQTT style, e.g. sensors/#
+	mqttMultiLevelWildcard = "#"
+)
+
+// ErrInvalidTopic is returned when a topic or topic pattern is malformed
+var ErrInvalidTopic = errors.New("invalid topic")
+
+// splitTopic splits a topic into its levels. Both '.' and '/' act as level separators.
+func splitTopic(topic string) []string {
+	return strings.FieldsFunc(topic, func(r rune) bool {
+		return r == '.' || r == '/'
+	})
+}
+
+// isWildcard returns true if the level is any of the supported wildcards
+func isWildcard(level string) bool {
+	switch level {
+	case singleLevelWildcard, mqttSingleLevelWildcard, multiLevelWildcard, mqttMultiLevelWildcard:
+		return true
+	}
+	return false
+}
+
+// validateLevels checks that no level is empty. FieldsFunc drops empty levels so compare against a plain split.
+func validateLevels(topic string, levels []string) error {
+	if len(levels) == 0 {
+		return fmt.Errorf("%w: topic must not be empty", ErrInvalidTopic)
+	}
+
+	if len(levels) != strings.Count(topic, ".")+strings.Count(topic, "/")+1 {
+		return fmt.Errorf("%w: %q contains an empty level", ErrInvalidTopic, topic)
+	}
+
+	return nil
+}
+
+// ValidateTopic checks that topic is a valid concrete topic that can be published to.
+// Concrete topics may not contain wildcards.
+func ValidateTopic(topic string) error {
+	levels := splitTopic(topic)
+	if err := validateLevels(topic, levels); err != nil {
+		return err
+	}
+
+	for _, level := range levels {
+		if isWildcard(level) {
+			return fmt.Errorf("%w: %q can not publish to a wildcard", ErrInvalidTopic, topic)
+		}
+	}
+
+	return nil
+}
+
+// ValidatePattern checks that pattern is a valid subscription pattern.
+// Multi level wildcards are only allowed as the last level.
+func ValidatePattern(pattern string) error {
+	levels := splitTopic(pattern)
+	if err := validateLevels(pattern, levels); err != nil {
+		return err
+	}
+
+	for i, level := range levels {
+		if (level == multiLevelWildcard || level == mqttMultiLevelWildcard) && i != len(levels)-1 {
+			return fmt.Errorf("%w: %q multi level wildcard must be the last level", ErrInvalidTopic, pattern)
+		}
+	}
+
+	return nil
+}
+
+// MatchTopic returns true if the concrete topic matches pattern.
+// This is the same matching TopicRegistry does and is meant for checking a single pattern.
+func MatchTopic(pattern, topic string) bool {
+	return matchLevels(splitTopic(pattern), splitTopic(topic))
+}
+
+// matchLevels matches the levels of a topic against the levels of a pattern
+func matchLevels(pattern, topic []string) bool {
+	for i, level := range pattern {
+		switch level {
+		case mqttMultiLevelWildcard:
+			return true
+		case multiLevelWildcard:
+			return len(topic) > i
+		}
+
+		if i >= len(topic) {
+			return false
+		}
+
+		if level != singleLevelWildcard && level != mqttSingleLevelWildcard && level != topic[i] {
+			return false
+		}
+	}
+
+	return len(pattern) == len(topic)
+}
+
+// PatternCovers returns true if every topic matching sub also matches pattern, such as orders.> covering orders.*.
+// Both are expected to have been checked with ValidatePattern.
+func PatternCovers(pattern, sub string) bool {
+	patternLevels, subLevels := splitTopic(pattern), splitTopic(sub)
+
+	for i, level := range patternLevels {
+		switch level {
+		case mqttMultiLevelWildcard:
+			return true
+		case multiLevelWildcard:
+			// sub must have at least one more level, # may match none
+			return len(subLevels) > i && subLevels[i] != mqttMultiLevelWildcard
+		}
+
+		if i >= len(subLevels) {
+			return false
+		}
+
+		switch subLevels[i] {
+		case multiLevelWildcard, mqttMultiLevelWildcard:
+			return false
+		case singleLevelWildcard, mqttSingleLevelWildcard:
+			if level != singleLevelWildcard && level != mqttSingleLevelWildcard {
+				return false
+			}
+		default:
+			if level != singleLevelWildcard && level != mqttSingleLevelWildcard && level != subLevels[i] {
+				return false
+			}
+		}
+	}
+
+	return len(patternLevels) == len(subLevels)
+}
+
+// PatternsOverlap returns true if some topic matches both a and b, such as orders.* and *.created.
+// Both are expected to have been checked with ValidatePattern.
+func PatternsOverlap(a, b string) bool {
+	aLevels, bLevels := splitTopic(a), splitTopic(b)
+
+	for i := 0; i < len(aLevels) || i < len(bLevels); i++ {
+		// Once one pattern ends the other only matches the same topics if it can match no more levels
+		if i >= len(aLevels) {
+			return bLevels[i] == mqttMultiLevelWildcard
+		}
+		if i >= len(bLevels) {
+			return aLevels[i] == mqttMultiLevelWildcard
+		}
+
+		aLevel, bLevel := aLevels[i], bLevels[i]
+		if aLevel == mqttMultiLevelWildcard || bLevel == mqttMultiLevelWildcard ||
+			aLevel == multiLevelWildcard || bLevel == multiLevelWildcard {
+			return true
+		}
+
+		if aLevel != bLevel && !isWildcard(aLevel) && !isWildcard(bLevel) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// topicNode is a single level in the topic trie.
+// Once a node is part of a published snapshot it is never mutated, updates copy the nodes they touch instead.
+type topicNode struct {
+	children    map[string]*topicNode
+	subscribers map[WebsocketConnection]struct{}
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children:    make(map[string]*topicNode),
+		subscribers: make(map[WebsocketConnection]struct{}),
+	}
+}
+
+// TopicRegistry keeps track of the set of connections subscribed to each topic pattern.
+// Patterns are stored in a trie keyed by level so a published topic can be resolved
+// to every matching subscriber set without scanning all patterns.
+//
+// The trie is copy-on-write. Writers are serialized and publish a new snapshot that shares every
+// untouched node with the previous one. Readers load the current snapshot without locking so
+// a broadcast never blocks, or is blocked by, subscribers coming and going.
+type TopicRegistry struct {
+	// root holds the current *topicNode snapshot
+	root atomic.Value
+
+	// mu serializes writers and guards patterns
+	mu sync.Mutex
+
+	// patterns indexes the patterns each connection is subscribed to so it can be removed without walking the trie
+	patterns map[WebsocketConnection]map[string]struct{}
+}
+
+// NewTopicRegistry creates a new empty TopicRegistry
+func NewTopicRegistry() *TopicRegistry {
+	tr := &TopicRegistry{
+		patterns: make(map[WebsocketConnection]map[string]struct{}),
+	}
+	tr.root.Store(newTopicNode())
+
+	return tr
+}
+
+// snapshot returns the current root of the trie. The returned trie must not be modified.
+func (tr *TopicRegistry) snapshot() *topicNode {
+	return tr.root.Load().(*topicNode)
+}
+
+// Subscribe adds the connection to the subscriber set of pattern.
+// The pattern is expected to have been checked with ValidatePattern.
+// Returns false if the connection was already subscribed to pattern.
+func (tr *TopicRegistry) Subscribe(pattern string, conn WebsocketConnection) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if _, ok := tr.patterns[conn][pattern]; ok {
+		return false
+	}
+
+	root := tr.snapshot().update(splitTopic(pattern), func(n *topicNode) {
+		n.subscribers[conn] = struct{}{}
+	})
+	tr.root.Store(root)
+
+	connPatterns, ok := tr.patterns[conn]
+	if !ok {
+		connPatterns = make(map[string]struct{})
+		tr.patterns[conn] = connPatterns
+	}
+	connPatterns[pattern] = struct{}{}
+	return true
+}
+
+// UnsubscribePattern removes the connection from the subscriber set of pattern, leaving its other patterns
+func (tr *TopicRegistry) UnsubscribePattern(pattern string, conn WebsocketConnection) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	connPatterns, ok := tr.patterns[conn]
+	if _, subscribed := connPatterns[pattern]; !ok || !subscribed {
+		return
+	}
+
+	root := tr.snapshot().update(splitTopic(pattern), func(n *topicNode) {
+		delete(n.subscribers, conn)
+	})
+	tr.root.Store(root)
+
+	delete(connPatterns, pattern)
+	if len(connPatterns) == 0 {
+		delete(tr.patterns, conn)
+	}
+}
+
+// Unsubscribe removes the connection from every pattern it is subscribed to
+func (tr *TopicRegistry) Unsubscribe(conn WebsocketConnection) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	connPatterns, ok := tr.patterns[conn]
+	if !ok {
+		return
+	}
+
+	root := tr.snapshot()
+	for pattern := range connPatterns {
+		root = root.update(splitTopic(pattern), func(n *topicNode) {
+			delete(n.subscribers, conn)
+		})
+	}
+	tr.root.Store(root)
+
+	delete(tr.patterns, conn)
+}
+
+// update returns a copy of the trie with fn applied to a copy of the node at levels.
+// Only the nodes along the path are copied, the rest of the trie is shared with n.
+// Nodes left without subscribers or children are pruned.
+func (n *topicNode) update(levels []string, fn func(*topicNode)) *topicNode {
+	clone := &topicNode{
+		children:    make(map[string]*topicNode, len(n.children)),
+		subscribers: n.subscribers,
+	}
+	for level, child := range n.children {
+		clone.children[level] = child
+	}
+
+	if len(levels) == 0 {
+		// This is the node being modified so it needs its own subscriber set
+		clone.subscribers = make(map[WebsocketConnection]struct{}, len(n.subscribers))
+		for conn := range n.subscribers {
+			clone.subscribers[conn] = struct{}{}
+		}
+
+		fn(clone)
+		return clone
+	}
+
+	child, ok := n.children[levels[0]]
+	if !ok {
+		child = newTopicNode()
+	}
+
+	updated := child.update(levels[1:], fn)
+	if updated.empty() {
+		delete(clone.children, levels[0])
+	} else {
+		clone.children[levels[0]] = updated
+	}
+
+	return clone
+}
+
+// empty returns true if the node holds no subscribers or children
+func (n *topicNode) empty() bool {
+	return len(n.subscribers) == 0 && len(n.children) == 0
+}
+
+// Subscribers returns the connections subscribed to any pattern that matches topic
+func (tr *TopicRegistry) Subscribers(topic string) []WebsocketConnection {
+	matched := make(map[WebsocketConnection]struct{})
+	tr.snapshot().match(splitTopic(topic), matched)
+
+	conns := make([]WebsocketConnection, 0, len(matched))
+	for conn := range matched {
+		conns = append(conns, conn)
+	}
+
+	return conns
+}
+
+// match walks the trie collecting the subscribers of every pattern matching levels
+func (n *topicNode) match(levels []string, matched map[WebsocketConnection]struct{}) {
+	// MQTT multi level wildcard also matches the parent level so check it before the end of the topic
+	if child, ok := n.children[mqttMultiLevelWildcard]; ok {
+		child.collect(matched)
+	}
+
+	if len(levels) == 0 {
+		n.collect(matched)
+		return
+	}
+
+	if child, ok := n.children[multiLevelWildcard]; ok {
+		child.collect(matched)
+	}
+
+	for _, key := range []string{levels[0], singleLevelWildcard, mqttSingleLevelWildcard} {
+		if child, ok := n.children[key]; ok {
+			child.match(levels[1:], matched)
+		}
+	}
+}
+
+// collect adds the node's own subscribers to matched
+func (n *topicNode) collect(matched map[WebsocketConnection]struct{}) {
+	for conn := range n.subscribers {
+		matched[conn] = struct{}{}
+	}
+}
+
+// Connections returns every connection subscribed to at least one pattern
+func (tr *TopicRegistry) Connections() []WebsocketConnection {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	return tr.connections()
+}
+
+// connections returns every connection in the patterns index. Caller must hold mu.
+func (tr *TopicRegistry) connections() []WebsocketConnection {
+	conns := make([]WebsocketConnection, 0, len(tr.patterns))
+	for conn := range tr.patterns {
+		conns = append(conns, conn)
+	}
+
+	return conns
+}
+
+// Clear removes all patterns and their subscribers.
+// Returns the connections that were removed so the caller can clean them up.
+func (tr *TopicRegistry) Clear() []WebsocketConnection {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	conns := tr.connections()
+
+	tr.root.Store(newTopicNode())
+	tr.patterns = make(map[WebsocketConnection]map[string]struct{})
+
+	return conns
+}
@@ -0,0 +1,207 @@
+package websocket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TopicRegistry(t *testing.T) {
+	registry := NewTopicRegistry()
+
+	ordersConn := &MockWebsocketConnection{}
+	sharedConn := &MockWebsocketConnection{}
+
+	registry.Subscribe("orders", ordersConn)
+	registry.Subscribe("orders", sharedConn)
+	registry.Subscribe("billing", sharedConn)
+
+	// Subscribing twice should not duplicate the subscriber
+	assert.False(t, registry.Subscribe("orders", ordersConn))
+
+	assert.ElementsMatch(t, []WebsocketConnection{ordersConn, sharedConn}, registry.Subscribers("orders"))
+	assert.ElementsMatch(t, []WebsocketConnection{sharedConn}, registry.Subscribers("billing"))
+	assert.Empty(t, registry.Subscribers("unknown"))
+	assert.ElementsMatch(t, []WebsocketConnection{ordersConn, sharedConn}, registry.Connections())
+
+	// Only the one pattern is removed
+	registry.UnsubscribePattern("billing", sharedConn)
+	assert.Empty(t, registry.Subscribers("billing"))
+	assert.ElementsMatch(t, []WebsocketConnection{ordersConn, sharedConn}, registry.Subscribers("orders"))
+	assert.True(t, registry.Subscribe("billing", sharedConn))
+
+	registry.Clear()
+
+	assert.Empty(t, registry.Connections())
+	assert.Empty(t, registry.Subscribers("orders"))
+}
+
+func Test_TopicRegistry_Wildcards(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		pattern  string
+		matching []string
+		missing  []string
+	}{
+		{
+			desc:     "NATS single level",
+			pattern:  "orders.*",
+			matching: []string{"orders.created", "orders.deleted"},
+			missing:  []string{"orders", "orders.created.eu", "billing.created"},
+		},
+		{
+			desc:     "NATS multi level",
+			pattern:  "orders.>",
+			matching: []string{"orders.created", "orders.created.eu"},
+			missing:  []string{"orders", "billing.created"},
+		},
+		{
+			desc:     "MQTT single level",
+			pattern:  "sensors/+/temp",
+			matching: []string{"sensors/1/temp", "sensors/kitchen/temp"},
+			missing:  []string{"sensors/temp", "sensors/1/humidity", "sensors/1/2/temp"},
+		},
+		{
+			desc:     "MQTT multi level",
+			pattern:  "sensors/#",
+			matching: []string{"sensors", "sensors/1", "sensors/1/temp"},
+			missing:  []string{"devices/1"},
+		},
+		{
+			desc:     "Exact",
+			pattern:  "orders.created",
+			matching: []string{"orders.created", "orders/created"},
+			missing:  []string{"orders", "orders.created.eu"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			registry := NewTopicRegistry()
+			conn := &MockWebsocketConnection{}
+
+			assert.NoError(t, ValidatePattern(tc.pattern))
+			registry.Subscribe(tc.pattern, conn)
+
+			for _, topic := range tc.matching {
+				assert.Equal(t, []WebsocketConnection{conn}, registry.Subscribers(topic), topic)
+				assert.True(t, MatchTopic(tc.pattern, topic), topic)
+			}
+
+			for _, topic := range tc.missing {
+				assert.Empty(t, registry.Subscribers(topic), topic)
+				assert.False(t, MatchTopic(tc.pattern, topic), topic)
+			}
+		})
+	}
+}
+
+func Test_TopicRegistry_OverlappingPatterns(t *testing.T) {
+	registry := NewTopicRegistry()
+	conn := &MockWebsocketConnection{}
+
+	// A connection matched by several patterns should only be returned once
+	registry.Subscribe("orders.*", conn)
+	registry.Subscribe("orders.>", conn)
+
+	assert.Len(t, registry.Subscribers("orders.created"), 1)
+}
+
+func Test_ValidateTopic(t *testing.T) {
+	assert.NoError(t, ValidateTopic("orders.created"))
+	assert.NoError(t, ValidateTopic("sensors/1/temp"))
+	assert.ErrorIs(t, ValidateTopic(""), ErrInvalidTopic)
+	assert.ErrorIs(t, ValidateTopic("orders..created"), ErrInvalidTopic)
+	assert.ErrorIs(t, ValidateTopic("orders.*"), ErrInvalidTopic)
+	assert.ErrorIs(t, ValidateTopic("sensors/#"), ErrInvalidTopic)
+}
+
+func Test_ValidatePattern(t *testing.T) {
+	assert.NoError(t, ValidatePattern("orders.*"))
+	assert.NoError(t, ValidatePattern("orders.>"))
+	assert.NoError(t, ValidatePattern("sensors/+/temp"))
+	assert.ErrorIs(t, ValidatePattern(""), ErrInvalidTopic)
+	assert.ErrorIs(t, ValidatePattern("orders/"), ErrInvalidTopic)
+	assert.ErrorIs(t, ValidatePattern("orders.>.created"), ErrInvalidTopic)
+	assert.ErrorIs(t, ValidatePattern("sensors/#/temp"), ErrInvalidTopic)
+}
+
+func Test_PatternCovers(t *testing.T) {
+	testCases := []struct {
+		pattern  string
+		sub      string
+		expected bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders.*", true},
+		{"orders.+", "orders.*", true},
+		{"orders.created", "orders.*", false},
+		{"orders.*", "orders.>", false},
+		{"orders.>", "orders.*", true},
+		{"orders.>", "orders.*.items", true},
+		{"orders.>", "orders.>", true},
+		{"orders.>", "orders.#", false},
+		{"orders.>", "orders", false},
+		{"orders.#", "orders", true},
+		{"orders.#", "orders.#", true},
+		{"orders.#", "orders.>", true},
+		{"orders/#", "orders.created", true},
+		{"orders.*", "orders", false},
+		{"orders", "orders.created", false},
+		{"billing.>", ">", false},
+		{">", "billing.>", true},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, PatternCovers(tc.pattern, tc.sub), "%s covers %s", tc.pattern, tc.sub)
+	}
+}
+
+func Test_PatternsOverlap(t *testing.T) {
+	testCases := []struct {
+		a        string
+		b        string
+		expected bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders.shipped", false},
+		{"orders.*", "*.created", true},
+		{"orders.*", "billing.*", false},
+		{"admin.>", ">", true},
+		{"admin.>", "admin", false},
+		{"admin.#", "admin", true},
+		{"admin", "admin.#", true},
+		{"admin.>", "*.secrets", true},
+		{"orders.*", "orders.created.items", false},
+		{"orders.*.items", "orders.>", true},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, PatternsOverlap(tc.a, tc.b), "%s overlaps %s", tc.a, tc.b)
+		assert.Equal(t, tc.expected, PatternsOverlap(tc.b, tc.a), "%s overlaps %s", tc.b, tc.a)
+	}
+}
+
+func Test_TopicRegistry_Unsubscribe(t *testing.T) {
+	registry := NewTopicRegistry()
+
+	deadConn := &MockWebsocketConnection{}
+	liveConn := &MockWebsocketConnection{}
+
+	registry.Subscribe("orders.created", deadConn)
+	registry.Subscribe("orders.*", deadConn)
+	registry.Subscribe("orders.created", liveConn)
+
+	registry.Unsubscribe(deadConn)
+
+	assert.Equal(t, []WebsocketConnection{liveConn}, registry.Subscribers("orders.created"))
+	assert.Equal(t, []WebsocketConnection{liveConn}, registry.Connections())
+
+	// Empty branches of the trie should be pruned
+	_, ok := registry.snapshot().children["orders"].children["*"]
+	assert.False(t, ok)
+
+	registry.Unsubscribe(liveConn)
+	assert.Empty(t, registry.snapshot().children)
+}
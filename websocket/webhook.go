@@ -0,0 +1,422 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// WebhookSignatureHeader carries the HMAC-SHA256 signature of a webhook delivery, see SignWebhook
+	WebhookSignatureHeader = "X-Pubsub-Signature"
+
+	// WebhookTimestampHeader carries the unix time a webhook delivery was signed at
+	WebhookTimestampHeader = "X-Pubsub-Timestamp"
+
+	// WebhookMessageIDHeader carries the ID of the delivered message so receivers can drop retried duplicates
+	WebhookMessageIDHeader = "X-Pubsub-Message-Id"
+)
+
+// errWebhookNextWriter is returned by WebhookConn.NextWriter as messages are written with WriteMessage
+var errWebhookNextWriter = errors.New("webhook connections only support WriteMessage")
+
+// ErrWebhookDisabled is returned when writing to a WebhookConn that has been closed or disabled
+var ErrWebhookDisabled = errors.New("webhook is disabled")
+
+// ErrWebhookAddress is returned when a webhook resolves to an address that isn't allowed, see WebhookConfig.AllowedNetworks
+var ErrWebhookAddress = errors.New("webhook address is not allowed")
+
+var (
+	_ (WebsocketConnection) = (*WebhookConn)(nil)
+	_ (MessageWriter)       = (*WebhookConn)(nil)
+)
+
+// WebhookConfig configures how messages are delivered to webhooks
+type WebhookConfig struct {
+	// Timeout is how long a single delivery attempt may take
+	Timeout time.Duration
+
+	// MaxAttempts is the number of times a message is posted before the delivery fails
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the first retry, it doubles for each retry after
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the wait between retries
+	MaxBackoff time.Duration
+
+	// MaxConcurrency is the number of deliveries in flight to a webhook at a time.
+	// Messages are only delivered in order with a MaxConcurrency of 1.
+	MaxConcurrency int
+
+	// DisableAfter is the number of deliveries in a row that may fail before the webhook is disabled
+	DisableAfter int
+
+	// AllowedNetworks are CIDR ranges such as 10.0.0.0/8 webhooks may be delivered to.
+	// Loopback, link-local, private and unspecified addresses are refused unless they are in one,
+	// so webhooks can't be used to reach the server's internal network.
+	AllowedNetworks []string
+}
+
+// DefaultWebhookConfig returns the WebhookConfig used when none is specified
+func DefaultWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		Timeout:        10 * time.Second,
+		MaxAttempts:    5,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+		MaxConcurrency: 4,
+		DisableAfter:   10,
+	}
+}
+
+// Validate checks the WebhookConfig is usable
+func (wc WebhookConfig) Validate() error {
+	if wc.Timeout <= 0 {
+		return errors.New("webhook timeout must be greater than 0")
+	}
+
+	if wc.MaxAttempts <= 0 {
+		return errors.New("webhook max attempts must be greater than 0")
+	}
+
+	if wc.InitialBackoff <= 0 || wc.MaxBackoff < wc.InitialBackoff {
+		return errors.New("webhook initial backoff must be greater than 0 and no more than the max backoff")
+	}
+
+	if wc.MaxConcurrency <= 0 {
+		return errors.New("webhook max concurrency must be greater than 0")
+	}
+
+	if wc.DisableAfter <= 0 {
+		return errors.New("webhook disable after must be greater than 0")
+	}
+
+	for _, network := range wc.AllowedNetworks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return fmt.Errorf("webhook allowed network %q must be a CIDR range such as 10.0.0.0/8", network)
+		}
+	}
+
+	return nil
+}
+
+// CheckURL resolves the host of a webhook URL and returns an error wrapping ErrWebhookAddress if any of its addresses
+// isn't allowed. Deliveries check the address they connect to again as what the host resolves to can change.
+func (wc WebhookConfig) CheckURL(ctx context.Context, endpoint *url.URL) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, endpoint.Hostname())
+	if err != nil {
+		return fmt.Errorf("failed to resolve webhook host %s: %w", endpoint.Hostname(), err)
+	}
+
+	for _, addr := range addrs {
+		if err := wc.checkIP(addr.IP); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkIP returns an error wrapping ErrWebhookAddress if webhooks may not be delivered to ip
+func (wc WebhookConfig) checkIP(ip net.IP) error {
+	for _, network := range wc.AllowedNetworks {
+		if _, allowed, err := net.ParseCIDR(network); err == nil && allowed.Contains(ip) {
+			return nil
+		}
+	}
+
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified() {
+		return fmt.Errorf("%w: %s is a loopback, link-local, private or unspecified address", ErrWebhookAddress, ip)
+	}
+
+	return nil
+}
+
+// dialControl checks the address a delivery is about to connect to, after DNS resolution, so a host
+// can't pass CheckURL then resolve to an internal address
+func (wc WebhookConfig) dialControl(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: %s is not an IP address", ErrWebhookAddress, host)
+	}
+
+	return wc.checkIP(ip)
+}
+
+// backoff returns the wait before the retry following attempt
+func (wc WebhookConfig) backoff(attempt int) time.Duration {
+	wait := wc.InitialBackoff
+	for i := 1; i < attempt && wait < wc.MaxBackoff; i++ {
+		wait *= 2
+	}
+
+	if wait > wc.MaxBackoff {
+		wait = wc.MaxBackoff
+	}
+
+	return wait
+}
+
+// SignWebhook returns the value of the WebhookSignatureHeader for a delivery of body signed at timestamp.
+// It is the hex encoded HMAC-SHA256, keyed by secret, of the timestamp, a '.' and the body, prefixed by "sha256=".
+// Receivers should recompute it and compare with hmac.Equal, and reject stale timestamps to prevent replays.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookStats summarizes the deliveries to a webhook
+type WebhookStats struct {
+	// Delivered is the number of messages the webhook accepted
+	Delivered uint64
+
+	// Failed is the number of messages that could not be delivered within the attempts
+	Failed uint64
+
+	// ConsecutiveFailures is the number of deliveries that failed since the last success
+	ConsecutiveFailures int
+
+	// LastError describes the last failed attempt, empty if there was none
+	LastError string
+
+	// Disabled is true once the webhook was disabled after too many failures
+	Disabled bool
+}
+
+// WebhookConn delivers messages to an HTTP endpoint as POST requests.
+// Each delivery is retried with exponential backoff on network errors, 5xx, 408 and 429 responses,
+// other responses outside of 2xx fail it straight away. Up to MaxConcurrency deliveries are in flight at once,
+// writes wait for a free slot so a slow endpoint pushes back on its queue. The connection disables itself,
+// closing as if disconnected, after DisableAfter deliveries in a row fail.
+type WebhookConn struct {
+	id     string
+	url    string
+	secret string
+	config WebhookConfig
+	client *http.Client
+
+	// slots limits the deliveries in flight
+	slots chan struct{}
+
+	statsMu sync.Mutex
+	stats   WebhookStats
+
+	// ctx is cancelled on Close to abandon deliveries in flight
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+// NewWebhookConn creates a WebhookConn posting messages to url. Deliveries are signed with secret when it is not empty.
+func NewWebhookConn(url, secret string, config WebhookConfig) *WebhookConn {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Connect directly rather than through any proxy from the environment so the address checked is the webhook's own
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout:   config.Timeout,
+		KeepAlive: 30 * time.Second,
+		Control:   config.dialControl,
+	}).DialContext
+
+	return &WebhookConn{
+		id:     newConnectionID(),
+		url:    url,
+		secret: secret,
+		config: config,
+		client: &http.Client{
+			Timeout:   config.Timeout,
+			Transport: transport,
+		},
+		slots:  make(chan struct{}, config.MaxConcurrency),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// WriteMessage starts delivering msg encoded in format once a delivery slot is free.
+// Returns ErrWebhookDisabled if the connection is closed, delivery errors are only reflected in Stats.
+func (wc *WebhookConn) WriteMessage(msg *Message, format Format) error {
+	// Checked first as select picks at random when a slot is also free
+	if wc.ctx.Err() != nil {
+		return ErrWebhookDisabled
+	}
+
+	select {
+	case wc.slots <- struct{}{}:
+	case <-wc.ctx.Done():
+		return ErrWebhookDisabled
+	}
+
+	go func() {
+		defer func() { <-wc.slots }()
+		wc.deliver(msg, format)
+	}()
+
+	return nil
+}
+
+// deliver posts msg until it is accepted, fails permanently or runs out of attempts
+func (wc *WebhookConn) deliver(msg *Message, format Format) {
+	body := msg.Encode(format)
+
+	contentType := msg.ContentType
+	if format == FormatEnvelope {
+		contentType = "application/json"
+	}
+
+	var err error
+	for attempt := 1; attempt <= wc.config.MaxAttempts; attempt++ {
+		var retry bool
+		retry, err = wc.post(msg.ID, contentType, body)
+		if err == nil {
+			wc.succeeded()
+			return
+		}
+
+		if !retry || attempt == wc.config.MaxAttempts {
+			break
+		}
+
+		timer := time.NewTimer(wc.config.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-wc.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+
+	// Failures after Close are just the deliveries being abandoned
+	if wc.ctx.Err() != nil {
+		return
+	}
+
+	log.Println("Failed to deliver message", msg.Seq, "to webhook", wc.id, err)
+	wc.failed(err)
+}
+
+// post makes a single delivery attempt. Returns whether a failed attempt is worth retrying.
+func (wc *WebhookConn) post(messageID, contentType string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(wc.ctx, http.MethodPost, wc.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set(WebhookMessageIDHeader, messageID)
+
+	if wc.secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(WebhookTimestampHeader, timestamp)
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(wc.secret, timestamp, body))
+	}
+
+	resp, err := wc.client.Do(req)
+	if err != nil {
+		return !errors.Is(err, ErrWebhookAddress), err
+	}
+
+	// Drain the body so the connection is reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("webhook responded with %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+}
+
+// succeeded records a delivered message
+func (wc *WebhookConn) succeeded() {
+	wc.statsMu.Lock()
+	defer wc.statsMu.Unlock()
+
+	wc.stats.Delivered++
+	wc.stats.ConsecutiveFailures = 0
+}
+
+// failed records a message that could not be delivered and disables the webhook after too many in a row
+func (wc *WebhookConn) failed(err error) {
+	wc.statsMu.Lock()
+	wc.stats.Failed++
+	wc.stats.ConsecutiveFailures++
+	wc.stats.LastError = err.Error()
+
+	disable := !wc.stats.Disabled && wc.stats.ConsecutiveFailures >= wc.config.DisableAfter
+	if disable {
+		wc.stats.Disabled = true
+	}
+	wc.statsMu.Unlock()
+
+	if disable {
+		log.Println("Disabling webhook", wc.id, "after", wc.config.DisableAfter, "failed deliveries in a row")
+		wc.Close()
+	}
+}
+
+// Stats returns a summary of the deliveries so far
+func (wc *WebhookConn) Stats() WebhookStats {
+	wc.statsMu.Lock()
+	defer wc.statsMu.Unlock()
+
+	return wc.stats
+}
+
+// ID returns an identifier unique to this connection
+func (wc *WebhookConn) ID() string {
+	return wc.id
+}
+
+// NextWriter is not supported, messages are written with WriteMessage
+func (wc *WebhookConn) NextWriter(MessageType) (io.WriteCloser, error) {
+	return nil, errWebhookNextWriter
+}
+
+// Done returns a channel that is closed once the connection is closed or disabled
+func (wc *WebhookConn) Done() <-chan struct{} {
+	return wc.ctx.Done()
+}
+
+// Incoming returns nil as webhooks only carry messages from the server to the endpoint
+func (wc *WebhookConn) Incoming() <-chan []byte {
+	return nil
+}
+
+// Close stops delivering messages, deliveries in flight are abandoned
+func (wc *WebhookConn) Close() error {
+	wc.closeOnce.Do(func() {
+		wc.cancel()
+		wc.client.CloseIdleConnections()
+	})
+	return nil
+}
@@ -0,0 +1,298 @@
+package websocket
+
+import (
+	"context"
+	"crypto/hmac"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testWebhookConfig retries quickly so tests don't wait on the backoff and allows the loopback test servers
+func testWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		Timeout:         time.Second,
+		MaxAttempts:     3,
+		InitialBackoff:  time.Millisecond,
+		MaxBackoff:      5 * time.Millisecond,
+		MaxConcurrency:  1,
+		DisableAfter:    2,
+		AllowedNetworks: []string{"127.0.0.0/8", "::1/128"},
+	}
+}
+
+func Test_WebhookConfig_Validate(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		modify      func(*WebhookConfig)
+		expectedErr string
+	}{
+		{
+			desc:   "Default",
+			modify: func(*WebhookConfig) {},
+		},
+		{
+			desc:        "No timeout",
+			modify:      func(wc *WebhookConfig) { wc.Timeout = 0 },
+			expectedErr: "webhook timeout must be greater than 0",
+		},
+		{
+			desc:        "No attempts",
+			modify:      func(wc *WebhookConfig) { wc.MaxAttempts = 0 },
+			expectedErr: "webhook max attempts must be greater than 0",
+		},
+		{
+			desc:        "Backoff beyond max",
+			modify:      func(wc *WebhookConfig) { wc.InitialBackoff = time.Hour },
+			expectedErr: "webhook initial backoff must be greater than 0 and no more than the max backoff",
+		},
+		{
+			desc:        "No concurrency",
+			modify:      func(wc *WebhookConfig) { wc.MaxConcurrency = 0 },
+			expectedErr: "webhook max concurrency must be greater than 0",
+		},
+		{
+			desc:        "Never disabled",
+			modify:      func(wc *WebhookConfig) { wc.DisableAfter = 0 },
+			expectedErr: "webhook disable after must be greater than 0",
+		},
+		{
+			desc:   "Allowed networks",
+			modify: func(wc *WebhookConfig) { wc.AllowedNetworks = []string{"10.0.0.0/8", "fd00::/8"} },
+		},
+		{
+			desc:        "Allowed network without prefix length",
+			modify:      func(wc *WebhookConfig) { wc.AllowedNetworks = []string{"10.0.0.1"} },
+			expectedErr: `webhook allowed network "10.0.0.1" must be a CIDR range such as 10.0.0.0/8`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			config := DefaultWebhookConfig()
+			tc.modify(&config)
+
+			err := config.Validate()
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedErr)
+			}
+		})
+	}
+}
+
+func Test_WebhookConfig_backoff(t *testing.T) {
+	config := WebhookConfig{
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Second,
+	}
+
+	assert.Equal(t, time.Second, config.backoff(1))
+	assert.Equal(t, 2*time.Second, config.backoff(2))
+	assert.Equal(t, 4*time.Second, config.backoff(3))
+	assert.Equal(t, 5*time.Second, config.backoff(4))
+	assert.Equal(t, 5*time.Second, config.backoff(100))
+}
+
+func Test_WebhookConfig_CheckURL(t *testing.T) {
+	config := WebhookConfig{AllowedNetworks: []string{"10.1.0.0/16"}}
+
+	testCases := []struct {
+		url     string
+		allowed bool
+	}{
+		{url: "https://203.0.113.10/hook", allowed: true},
+		{url: "https://[2001:db8::1]/hook", allowed: true},
+		{url: "http://127.0.0.1:8080/hook"},
+		{url: "http://localhost/hook"},
+		{url: "http://[::1]/hook"},
+		{url: "http://[::ffff:127.0.0.1]/hook"},
+		{url: "http://0.0.0.0/hook"},
+		{url: "http://169.254.169.254/latest/meta-data"},
+		{url: "http://[fe80::1]/hook"},
+		{url: "http://10.0.0.1/hook"},
+		{url: "http://172.16.0.1/hook"},
+		{url: "http://192.168.1.1/hook"},
+		{url: "http://[fd00::1]/hook"},
+		{url: "http://10.1.2.3/hook", allowed: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.url, func(t *testing.T) {
+			endpoint, err := url.Parse(tc.url)
+			require.NoError(t, err)
+
+			err = config.CheckURL(context.Background(), endpoint)
+			if tc.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrWebhookAddress)
+			}
+		})
+	}
+}
+
+func Test_WebhookConn(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			desc: "Delivers a signed message",
+			testFunc: func(t *testing.T) {
+				received := make(chan *http.Request, 1)
+				bodies := make(chan []byte, 1)
+				endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					body, _ := io.ReadAll(r.Body)
+					received <- r
+					bodies <- body
+				}))
+				defer endpoint.Close()
+
+				conn := NewWebhookConn(endpoint.URL, "s3cret", testWebhookConfig())
+				defer conn.Close()
+
+				msg := &Message{ID: "abc", Seq: 1, Topic: "orders", Type: TextMessage, ContentType: "text/plain", Data: []byte("hi")}
+				require.NoError(t, conn.WriteMessage(msg, FormatEnvelope))
+
+				req := <-received
+				body := <-bodies
+				assert.Equal(t, msg.Encode(FormatEnvelope), body)
+				assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+				assert.Equal(t, "abc", req.Header.Get(WebhookMessageIDHeader))
+
+				expected := SignWebhook("s3cret", req.Header.Get(WebhookTimestampHeader), body)
+				assert.True(t, hmac.Equal([]byte(expected), []byte(req.Header.Get(WebhookSignatureHeader))))
+
+				assert.Eventually(t, func() bool { return conn.Stats().Delivered == 1 }, time.Second, time.Millisecond)
+			},
+		},
+		{
+			desc: "Retries server errors",
+			testFunc: func(t *testing.T) {
+				var calls int32
+				endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if atomic.AddInt32(&calls, 1) < 3 {
+						w.WriteHeader(http.StatusServiceUnavailable)
+					}
+				}))
+				defer endpoint.Close()
+
+				conn := NewWebhookConn(endpoint.URL, "", testWebhookConfig())
+				defer conn.Close()
+
+				require.NoError(t, conn.WriteMessage(&Message{ID: "abc", Data: []byte("hi")}, FormatRaw))
+
+				assert.Eventually(t, func() bool { return conn.Stats().Delivered == 1 }, time.Second, time.Millisecond)
+				assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+				assert.Zero(t, conn.Stats().Failed)
+			},
+		},
+		{
+			desc: "Client errors are not retried and disable the webhook",
+			testFunc: func(t *testing.T) {
+				var calls int32
+				endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					atomic.AddInt32(&calls, 1)
+					w.WriteHeader(http.StatusBadRequest)
+				}))
+				defer endpoint.Close()
+
+				conn := NewWebhookConn(endpoint.URL, "", testWebhookConfig())
+				defer conn.Close()
+
+				require.NoError(t, conn.WriteMessage(&Message{ID: "one"}, FormatRaw))
+				assert.Eventually(t, func() bool { return conn.Stats().Failed == 1 }, time.Second, time.Millisecond)
+				assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+				require.NoError(t, conn.WriteMessage(&Message{ID: "two"}, FormatRaw))
+				select {
+				case <-conn.Done():
+				case <-time.After(time.Second):
+					t.Fatal("webhook was not disabled")
+				}
+
+				stats := conn.Stats()
+				assert.True(t, stats.Disabled)
+				assert.Equal(t, 2, stats.ConsecutiveFailures)
+				assert.Equal(t, "webhook responded with 400 Bad Request", stats.LastError)
+				assert.Equal(t, ErrWebhookDisabled, conn.WriteMessage(&Message{ID: "three"}, FormatRaw))
+			},
+		},
+		{
+			desc: "Refuses addresses that aren't allowed when connecting",
+			testFunc: func(t *testing.T) {
+				var requests int32
+				endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					atomic.AddInt32(&requests, 1)
+				}))
+				defer endpoint.Close()
+
+				config := testWebhookConfig()
+				config.AllowedNetworks = nil
+				conn := NewWebhookConn(endpoint.URL, "", config)
+				defer conn.Close()
+
+				require.NoError(t, conn.WriteMessage(&Message{ID: "abc"}, FormatRaw))
+
+				require.Eventually(t, func() bool { return conn.Stats().Failed == 1 }, time.Second, time.Millisecond)
+				assert.Contains(t, conn.Stats().LastError, ErrWebhookAddress.Error())
+				assert.Zero(t, atomic.LoadInt32(&requests))
+			},
+		},
+		{
+			desc: "Limits deliveries in flight",
+			testFunc: func(t *testing.T) {
+				var inFlight, maxInFlight int32
+				release := make(chan struct{})
+				endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					current := atomic.AddInt32(&inFlight, 1)
+					defer atomic.AddInt32(&inFlight, -1)
+
+					for {
+						seen := atomic.LoadInt32(&maxInFlight)
+						if current <= seen || atomic.CompareAndSwapInt32(&maxInFlight, seen, current) {
+							break
+						}
+					}
+					<-release
+				}))
+				defer endpoint.Close()
+
+				config := testWebhookConfig()
+				config.MaxConcurrency = 2
+				conn := NewWebhookConn(endpoint.URL, "", config)
+				defer conn.Close()
+
+				var wg sync.WaitGroup
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < 4; i++ {
+						conn.WriteMessage(&Message{ID: "abc"}, FormatRaw)
+					}
+				}()
+
+				assert.Eventually(t, func() bool { return atomic.LoadInt32(&inFlight) == 2 }, time.Second, time.Millisecond)
+				close(release)
+				wg.Wait()
+
+				assert.Eventually(t, func() bool { return conn.Stats().Delivered == 4 }, time.Second, time.Millisecond)
+				assert.Equal(t, int32(2), atomic.LoadInt32(&maxInFlight))
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, tc.testFunc)
+	}
+}
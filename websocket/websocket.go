@@ -2,6 +2,8 @@
 package websocket
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"io"
 	"net/http"
 )
@@ -31,6 +33,9 @@ const (
 	PongMessage MessageType = 10
 )
 
+// ClosePolicyViolation is the close code of a connection closed because it broke a policy, see RFC 6455 section 7.4.1
+const ClosePolicyViolation = 1008
+
 // Upgrader is used to upgrade an existing connection to a websocket connection
 type Upgrader interface {
 	// Upgrade upgrades the HTTP server connection to the WebSocket protocol.
@@ -39,9 +44,51 @@ type Upgrader interface {
 
 // WebsocketConnection represents a single websocket connection
 type WebsocketConnection interface {
+	// ID returns an identifier unique to this connection
+	ID() string
+
 	// Close closes the websocket connection
 	Close() error
 
 	// NextWriter returns a writer for the next message to send
 	NextWriter(messageType MessageType) (io.WriteCloser, error)
+
+	// Done returns a channel that is closed once the connection is closed by either side or breaks
+	Done() <-chan struct{}
+
+	// Incoming returns the data frames received from the client such as acks.
+	// Frames may be dropped if the channel isn't read.
+	Incoming() <-chan []byte
+}
+
+// MessageWriter is implemented by connections that are not websockets and frame each message themselves.
+// Messages are written to connections implementing it with WriteMessage rather than NextWriter.
+type MessageWriter interface {
+	// WriteMessage writes a single message encoded in format
+	WriteMessage(msg *Message, format Format) error
+}
+
+// ReasonCloser is implemented by connections that can tell the client why they are being closed
+type ReasonCloser interface {
+	// CloseWithReason sends a close frame with code and reason then closes the connection
+	CloseWithReason(code int, reason string) error
+}
+
+// CloseWithReason closes conn with code and reason if it is a ReasonCloser, otherwise it is just closed
+func CloseWithReason(conn WebsocketConnection, code int, reason string) error {
+	if closer, ok := conn.(ReasonCloser); ok {
+		return closer.CloseWithReason(code, reason)
+	}
+	return conn.Close()
+}
+
+// newConnectionID generates a random identifier for a connection
+func newConnectionID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(err)
+	}
+
+	return hex.EncodeToString(id)
 }